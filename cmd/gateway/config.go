@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// gatewayConfig is the configuration of the gateway, from its flags,
+// GATEWAY_ environment variables and -config file.
+type gatewayConfig struct {
+	HTTPAddr        string
+	DebugAddr       string
+	StaticDir       string
+	RetryMax        int
+	RetryTimeout    time.Duration
+	AttemptTimeout  time.Duration
+	MaxInFlight     int
+	BreakerFailures uint
+	BreakerOpen     time.Duration
+	RoutesConfig    string
+	RateLimit       bool
+	TrustForwarded  bool
+	CORSOrigins     string
+	CORSCredentials bool
+	Cache           bool
+	CacheEntries    int
+	CacheBody       int
+	Validate        bool
+	ValidateBody    int64
+	DetailsTimeout  time.Duration
+	HealthTimeout   time.Duration
+	ShutdownTimeout time.Duration
+}
+
+// reloadable are the flags changed on SIGHUP, besides the route policies and
+// rate limits of -routes.config.
+var reloadable = []string{"log.level", "retry.max", "retry.timeout", "retry.attempt-timeout"}
+
+func (c *gatewayConfig) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.HTTPAddr, "http.addr", ":8000", "Address for HTTP (JSON) server")
+	fs.IntVar(&c.RetryMax, "retry.max", 3, "per-request retries to different instances")
+	fs.DurationVar(&c.RetryTimeout, "retry.timeout", 500*time.Millisecond, "per-request timeout, including retries")
+	fs.StringVar(&c.DebugAddr, "debug.addr", ":8001", "Debug and metrics listen address")
+	fs.DurationVar(&c.AttemptTimeout, "retry.attempt-timeout", 200*time.Millisecond, "timeout of each try at an instance, 0 for none")
+	fs.IntVar(&c.MaxInFlight, "upstream.max-inflight", 100, "concurrent calls per upstream service, 0 for no limit")
+	fs.UintVar(&c.BreakerFailures, "upstream.breaker-failures", 5, "consecutive upstream failures opening its circuit breaker, 0 to never open")
+	fs.DurationVar(&c.BreakerOpen, "upstream.breaker-open", 30*time.Second, "how long an open circuit breaker rejects calls")
+	fs.StringVar(&c.StaticDir, "static_dir", "./public/", "static directory in addition to default static directory")
+	fs.StringVar(&c.RoutesConfig, "routes.config", "", "YAML file overriding route policies, rate limits and upstream guards")
+	fs.BoolVar(&c.RateLimit, "ratelimit", true, "Rate limit clients per address and per user")
+	fs.BoolVar(&c.TrustForwarded, "ratelimit.trust-forwarded", false, "Take client addresses from X-Forwarded-For, behind a trusted proxy")
+	fs.StringVar(&c.CORSOrigins, "cors.origins", "*", "Comma separated origins allowed to call the api from browsers, * for any")
+	fs.BoolVar(&c.Cache, "cache", true, "Cache the responses of catalog routes")
+	fs.IntVar(&c.CacheEntries, "cache.max-entries", 10000, "Responses kept in the cache")
+	fs.IntVar(&c.CacheBody, "cache.max-body", 1<<20, "Largest response body cached, in bytes")
+	fs.BoolVar(&c.CORSCredentials, "cors.credentials", false, "Let browsers send cookies and Authorization cross origin, from the origins listed by -cors.origins")
+	fs.BoolVar(&c.Validate, "validate", true, "Reject requests not matching the OpenAPI spec of their route")
+	fs.Int64Var(&c.ValidateBody, "validate.max-body", 1<<20, "Largest JSON request body accepted, in bytes")
+	fs.DurationVar(&c.DetailsTimeout, "details.timeout", time.Second, "deadline of an order details request, across all the services it calls")
+	fs.DurationVar(&c.HealthTimeout, "health.timeout", 3*time.Second, "Time allowed to each readiness check")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown.timeout", 15*time.Second, "Time allowed on SIGTERM to the requests in flight")
+}
+
+// validate reports the first invalid setting of c.
+func (c gatewayConfig) validate() error {
+	for _, a := range []struct{ flag, addr string }{
+		{"http.addr", c.HTTPAddr},
+		{"debug.addr", c.DebugAddr},
+	} {
+		if _, _, err := net.SplitHostPort(a.addr); err != nil {
+			return fmt.Errorf("-%s: %v", a.flag, err)
+		}
+	}
+	if c.HTTPAddr == c.DebugAddr {
+		return fmt.Errorf("-http.addr and -debug.addr are both %s", c.HTTPAddr)
+	}
+	if c.CORSCredentials {
+		for _, origin := range strings.Split(c.CORSOrigins, ",") {
+			if origin == "" || origin == "*" {
+				return fmt.Errorf("-cors.credentials needs -cors.origins to list the allowed origins, not %q", c.CORSOrigins)
+			}
+		}
+	}
+	if c.RetryMax < 1 {
+		return fmt.Errorf("-retry.max %d is not positive", c.RetryMax)
+	}
+	for _, n := range []struct {
+		flag string
+		n    int64
+	}{
+		{"upstream.max-inflight", int64(c.MaxInFlight)},
+		{"cache.max-entries", int64(c.CacheEntries)},
+		{"cache.max-body", int64(c.CacheBody)},
+		{"validate.max-body", c.ValidateBody},
+	} {
+		if n.n < 0 {
+			return fmt.Errorf("-%s %v is negative", n.flag, n.n)
+		}
+	}
+	if c.AttemptTimeout < 0 {
+		return fmt.Errorf("-retry.attempt-timeout %v is negative", c.AttemptTimeout)
+	}
+	for _, d := range []struct {
+		flag string
+		d    time.Duration
+	}{
+		{"retry.timeout", c.RetryTimeout},
+		{"upstream.breaker-open", c.BreakerOpen},
+		{"details.timeout", c.DetailsTimeout},
+		{"health.timeout", c.HealthTimeout},
+		{"shutdown.timeout", c.ShutdownTimeout},
+	} {
+		if d.d <= 0 {
+			return fmt.Errorf("-%s %v is not positive", d.flag, d.d)
+		}
+	}
+	return nil
+}
@@ -1,244 +1,381 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
-	"time"
 
 	"github.com/go-kit/kit/endpoint"
-	consulsd "github.com/go-kit/kit/sd/consul"
-	"github.com/hashicorp/consul/api"
+	"github.com/go-kit/kit/metrics/prometheus"
+	"github.com/laidingqing/dabanshan-go/svcs/authorize"
+	"github.com/laidingqing/dabanshan-go/svcs/config"
+	"github.com/laidingqing/dabanshan-go/svcs/discovery"
+	"github.com/laidingqing/dabanshan-go/svcs/gateway"
+	"github.com/laidingqing/dabanshan-go/svcs/health"
+	"github.com/laidingqing/dabanshan-go/svcs/instrumenting"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
 	p_endpoint "github.com/laidingqing/dabanshan-go/svcs/product/endpoint"
 	p_service "github.com/laidingqing/dabanshan-go/svcs/product/service"
 	p_transport "github.com/laidingqing/dabanshan-go/svcs/product/transport"
-	"github.com/laidingqing/dabanshan-go/utils"
-	"google.golang.org/grpc"
+	"github.com/laidingqing/dabanshan-go/svcs/tracing"
 
 	u_endpoint "github.com/laidingqing/dabanshan-go/svcs/user/endpoint"
+	u_model "github.com/laidingqing/dabanshan-go/svcs/user/model"
 	u_service "github.com/laidingqing/dabanshan-go/svcs/user/service"
 	u_transport "github.com/laidingqing/dabanshan-go/svcs/user/transport"
 
 	o_endpoint "github.com/laidingqing/dabanshan-go/svcs/order/endpoint"
+	o_model "github.com/laidingqing/dabanshan-go/svcs/order/model"
 	o_service "github.com/laidingqing/dabanshan-go/svcs/order/service"
 	o_transport "github.com/laidingqing/dabanshan-go/svcs/order/transport"
 
-	stdopentracing "github.com/opentracing/opentracing-go"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/go-kit/kit/sd"
 	"github.com/go-kit/kit/sd/lb"
 )
 
 func main() {
-	var (
-		httpAddr     = flag.String("http.addr", ":8000", "Address for HTTP (JSON) server")
-		consulAddr   = flag.String("consul.addr", "localhost:8500", "Consul agent address")
-		retryMax     = flag.Int("retry.max", 3, "per-request retries to different instances")
-		retryTimeout = flag.Duration("retry.timeout", 500*time.Millisecond, "per-request timeout, including retries")
-		staticDir    = flag.String("static_dir", "./public/", "static directory in addition to default static directory")
-	)
-	flag.Parse()
+	var cfg gatewayConfig
+	cfg.register(flag.CommandLine)
+	discoveryFlags := discovery.RegisterFlags(flag.CommandLine, "productsvc", "usersvc", "ordersvc")
+	tracingFlags := tracing.RegisterFlags(flag.CommandLine)
+	loggingFlags := logging.RegisterFlags(flag.CommandLine)
+	loader := config.New(flag.CommandLine, "GATEWAY_")
+	if err := loader.Parse(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	// Logging domain.
-	logger := utils.NewLogger()
+	logger, err := loggingFlags.New("gateway")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-	// Service discovery domain. In this example we use Consul.
-	var client consulsd.Client
+	// Service discovery domain, selected by -discovery.
+	instancers := map[string]sd.Instancer{}
 	{
-		consulConfig := api.DefaultConfig()
-		if len(*consulAddr) > 0 {
-			consulConfig.Address = *consulAddr
-		}
-		consulClient, err := api.NewClient(consulConfig)
+		disc, err := discoveryFlags.New(logger)
 		if err != nil {
 			logger.Log("err", err)
 			os.Exit(1)
 		}
-		client = consulsd.NewClient(consulClient)
+		for _, service := range []string{"productsvc", "usersvc", "ordersvc"} {
+			if instancers[service], err = disc.Instancer(service); err != nil {
+				logger.Log("err", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// Health domain: the gateway is ready while it reaches an instance of
+	// every service.
+	checks := health.New(cfg.HealthTimeout)
+	for service, instancer := range instancers {
+		checks.Add(service, health.Instances(instancer))
+	}
+
+	// API spec, served and used to validate requests.
+	spec, err := gateway.NewAPISpec()
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+
+	// Tracing domain, selected by -tracer. The spans of a request start
+	// here and go on in the services.
+	tracer, closer, err := tracingFlags.New("gateway", cfg.HTTPAddr, logger)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
 	}
+	defer closer.Close()
 
 	// Transport domain.
-	tracer := stdopentracing.GlobalTracer() // no-op
 	mux := http.NewServeMux()
-	//r := mux.NewRouter()
+	rateGroups := gateway.NewRateGroups(gateway.DefaultRateGroups)
+	cacheRules := gateway.DefaultCacheRules
+	corsPolicies := []gateway.CORS{gateway.DefaultCORS(strings.Split(cfg.CORSOrigins, ","), cfg.CORSCredentials)}
+	endpointMetrics := instrumenting.NewEndpointMetrics("gateway")
+	var (
+		table            []gateway.Route
+		policies         *gateway.Policies
+		upstreams        *gateway.Upstreams
+		upstreamPolicies map[string]gateway.UpstreamPolicy
+		upstreamMetrics  = gateway.UpstreamMetrics{
+			BreakerState: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+				Namespace: "dabanshan",
+				Subsystem: "gateway",
+				Name:      "breaker_state",
+				Help:      "Circuit breaker state of upstream services: 0 closed, 1 half open, 2 open.",
+			}, []string{"service"}),
+			InFlight: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+				Namespace: "dabanshan",
+				Subsystem: "gateway",
+				Name:      "upstream_in_flight",
+				Help:      "Calls in flight to upstream services.",
+			}, []string{"service"}),
+			Rejected: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "dabanshan",
+				Subsystem: "gateway",
+				Name:      "upstream_rejected_total",
+				Help:      "Calls to upstream services refused by their breaker or bulkhead.",
+			}, []string{"service", "reason"}),
+		}
+	)
 	{
 		var (
-			tags             = []string{}
-			passingOnly      = true
-			pEndpoints       = p_endpoint.Set{}
-			uEndpoints       = u_endpoint.Set{}
-			oEndpoints       = o_endpoint.Set{}
-			productInstancer = consulsd.NewInstancer(client, logger, "productsvc", tags, passingOnly)
-			userInstancer    = consulsd.NewInstancer(client, logger, "usersvc", tags, passingOnly)
-			orderInstancer   = consulsd.NewInstancer(client, logger, "ordersvc", tags, passingOnly)
+			pEndpoints = p_endpoint.Set{}
+			uEndpoints = u_endpoint.Set{}
+			oEndpoints = o_endpoint.Set{}
+			oExporter  o_service.Exporter
+			policy     = gateway.Policy{RetryMax: cfg.RetryMax, Timeout: cfg.RetryTimeout, AttemptTimeout: cfg.AttemptTimeout}
 		)
-		{
-			productfactory := addProductFactory(p_endpoint.MakeGetProductsEndpoint, tracer, logger)
-			endpointer := sd.NewEndpointer(productInstancer, productfactory, logger)
-			balancer := lb.NewRoundRobin(endpointer)
-			retry := lb.Retry(*retryMax, *retryTimeout, balancer)
-			pEndpoints.GetProductsEndpoint = retry
-		}
-		{
-			productfactory := addProductFactory(p_endpoint.MakeCreateProductEndpoint, tracer, logger)
-			endpointer := sd.NewEndpointer(productInstancer, productfactory, logger)
-			balancer := lb.NewRoundRobin(endpointer)
-			retry := lb.Retry(*retryMax, *retryTimeout, balancer)
-			pEndpoints.CreateProductEndpoint = retry
+		product := func(m func(p_service.Service) endpoint.Endpoint) sd.Factory {
+			return gateway.ProductFactory(m, tracer, logger)
 		}
-		{
-			productfactory := addProductFactory(p_endpoint.MakeUploadEndpoint, tracer, logger)
-			endpointer := sd.NewEndpointer(productInstancer, productfactory, logger)
-			balancer := lb.NewRoundRobin(endpointer)
-			retry := lb.Retry(*retryMax, *retryTimeout, balancer)
-			pEndpoints.UploadEndpoint = retry
+		user := func(m func(u_service.Service) endpoint.Endpoint) sd.Factory {
+			return gateway.UserFactory(m, tracer, logger)
 		}
-		{
-			userfactory := addUserFactory(u_endpoint.MakeGetUserEndpoint, tracer, logger)
-			endpointer := sd.NewEndpointer(userInstancer, userfactory, logger)
-			balancer := lb.NewRoundRobin(endpointer)
-			retry := lb.Retry(*retryMax, *retryTimeout, balancer)
-			uEndpoints.GetUserEndpoint = retry
+		order := func(m func(o_service.Service) endpoint.Endpoint) sd.Factory {
+			return gateway.OrderFactory(m, tracer, logger)
 		}
-		{
-			userfactory := addUserFactory(u_endpoint.MakeRegisterEndpoint, tracer, logger)
-			endpointer := sd.NewEndpointer(userInstancer, userfactory, logger)
-			balancer := lb.NewRoundRobin(endpointer)
-			retry := lb.Retry(*retryMax, *retryTimeout, balancer)
-			uEndpoints.RegisterEndpoint = retry
+
+		// The route table: every endpoint the gateway proxies, the set field
+		// it fills and how it is called. -routes.config overrides policies.
+		table = []gateway.Route{
+			{Service: "productsvc", Method: "GetProducts", Factory: product(p_endpoint.MakeGetProductsEndpoint), Bind: &pEndpoints.GetProductsEndpoint, Policy: policy},
+			{Service: "productsvc", Method: "GetProductsByIDs", Factory: product(p_endpoint.MakeGetProductsByIDsEndpoint), Bind: &pEndpoints.GetProductsByIDsEndpoint, Policy: policy},
+			{Service: "productsvc", Method: "CreateProduct", Factory: product(p_endpoint.MakeCreateProductEndpoint), Bind: &pEndpoints.CreateProductEndpoint, Policy: policy.WithOnce()},
+			{Service: "productsvc", Method: "Upload", Factory: product(p_endpoint.MakeUploadEndpoint), Bind: &pEndpoints.UploadEndpoint, Policy: policy.WithOnce()},
+			{Service: "usersvc", Method: "GetUser", Factory: user(u_endpoint.MakeGetUserEndpoint), Bind: &uEndpoints.GetUserEndpoint, Policy: policy},
+			{Service: "usersvc", Method: "Register", Factory: user(u_endpoint.MakeRegisterEndpoint), Bind: &uEndpoints.RegisterEndpoint, Policy: policy.WithOnce()},
+			{Service: "usersvc", Method: "Login", Factory: user(u_endpoint.MakeLoginEndpoint), Bind: &uEndpoints.LoginEndpoint, Policy: policy, Middleware: mergeCartOnLogin(&oEndpoints.MergeCartEndpoint, logger)},
+			{Service: "ordersvc", Method: "AddCart", Factory: order(o_endpoint.MakeAddCartEndpoint), Bind: &oEndpoints.CreateCartEndpoint, Policy: policy.WithOnce()},
+			{Service: "ordersvc", Method: "CreateOrder", Factory: order(o_endpoint.MakeCreateOrderEndpoint), Bind: &oEndpoints.CreateOrderEndpoint, Policy: policy.WithOnce()},
+			{Service: "ordersvc", Method: "GetCartItems", Factory: order(o_endpoint.MakeGetCartItemsEndpoint), Bind: &oEndpoints.GetCartItemsEndpoint, Policy: policy},
+			{Service: "ordersvc", Method: "RemoveCartItem", Factory: order(o_endpoint.MakeRemoveCartItemEndpoint), Bind: &oEndpoints.RemoveCartItemEndpoint, Policy: policy},
+			{Service: "ordersvc", Method: "UpdateQuantity", Factory: order(o_endpoint.MakeUpdateQuantityEndpoint), Bind: &oEndpoints.UpdateQuantityEndpoint, Policy: policy},
+			{Service: "ordersvc", Method: "MergeCart", Factory: order(o_endpoint.MakeMergeCartEndpoint), Bind: &oEndpoints.MergeCartEndpoint, Policy: policy.WithAuth()},
+			{Service: "ordersvc", Method: "GetOrders", Factory: order(o_endpoint.MakeGetOrdersEndpoint), Bind: &oEndpoints.GetOrdersEndpoint, Policy: policy.WithAuth()},
+			{Service: "ordersvc", Method: "GetOrder", Factory: order(o_endpoint.MakeGetOrderEndpoint), Bind: &oEndpoints.GetOrderEndpoint, Policy: policy.WithAuth()},
 		}
-		{
-			userfactory := addUserFactory(u_endpoint.MakeLoginEndpoint, tracer, logger)
-			endpointer := sd.NewEndpointer(userInstancer, userfactory, logger)
-			balancer := lb.NewRoundRobin(endpointer)
-			retry := lb.Retry(*retryMax, *retryTimeout, balancer)
-			uEndpoints.LoginEndpoint = retry
+		routes := table
+		if cfg.RoutesConfig != "" {
+			routesConfig, err := gateway.LoadConfig(cfg.RoutesConfig)
+			if err != nil {
+				logger.Log("err", err)
+				os.Exit(1)
+			}
+			if routes, err = routesConfig.Apply(routes); err != nil {
+				logger.Log("err", err)
+				os.Exit(1)
+			}
+			if routesConfig.RateLimits != nil {
+				rateGroups.Set(routesConfig.RateLimits)
+			}
+			upstreamPolicies = routesConfig.Upstreams
+			if routesConfig.CORS != nil {
+				corsPolicies = routesConfig.CORS
+			}
+			if routesConfig.Cache != nil {
+				cacheRules = routesConfig.Cache
+			}
 		}
-		{
-			orderfactory := addOrderFactory(o_endpoint.MakeAddCartEndpoint, tracer, logger)
-			endpointer := sd.NewEndpointer(orderInstancer, orderfactory, logger)
-			balancer := lb.NewRoundRobin(endpointer)
-			retry := lb.Retry(*retryMax, *retryTimeout, balancer)
-			oEndpoints.CreateCartEndpoint = retry
+		upstreams = gateway.NewUpstreams(gateway.UpstreamPolicy{
+			MaxInFlight:     cfg.MaxInFlight,
+			BreakerFailures: uint32(cfg.BreakerFailures),
+			BreakerOpen:     cfg.BreakerOpen,
+		}, upstreamPolicies, upstreamMetrics)
+		if policies, err = gateway.Build(routes, instancers, upstreams, tracer, endpointMetrics, logger); err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
 		}
+
 		{
-			orderfactory := addOrderFactory(o_endpoint.MakeCreateOrderEndpoint, tracer, logger)
-			endpointer := sd.NewEndpointer(orderInstancer, orderfactory, logger)
-			balancer := lb.NewRoundRobin(endpointer)
-			retry := lb.Retry(*retryMax, *retryTimeout, balancer)
-			oEndpoints.CreateOrderEndpoint = retry
+			// Exports stream for as long as the client reads, so the
+			// instance is picked without lb.Retry and its timeout.
+			endpointer := sd.NewEndpointer(instancers["ordersvc"], gateway.OrderExporterFactory(tracer, logger), logger)
+			oExporter = gateway.NewBalancedExporter(lb.NewRoundRobin(endpointer))
 		}
-		{
-			orderfactory := addOrderFactory(o_endpoint.MakeGetCartItemsEndpoint, tracer, logger)
-			endpointer := sd.NewEndpointer(orderInstancer, orderfactory, logger)
-			balancer := lb.NewRoundRobin(endpointer)
-			retry := lb.Retry(*retryMax, *retryTimeout, balancer)
-			oEndpoints.GetCartItemsEndpoint = retry
+
+		mux.Handle("/api/v1/products/", p_transport.NewHTTPHandler(pEndpoints, tracer, logger))
+		mux.Handle("/api/v1/users/", u_transport.NewHTTPHandler(uEndpoints, tracer, logger))
+		// Order details are assembled here from the order, product and user
+		// services; the other order routes go to the order service.
+		orderDetails := gateway.MakeOrderDetailsEndpoint(gateway.OrderDetailsEndpoints{
+			GetOrder:         oEndpoints.GetOrderEndpoint,
+			GetProductsByIDs: pEndpoints.GetProductsByIDsEndpoint,
+			GetUser:          uEndpoints.GetUserEndpoint,
+		}, cfg.DetailsTimeout, log.With(logger, "handler", "OrderDetails"))
+		orderDetails = endpointMetrics.Middleware("OrderDetails")(orderDetails)
+		orders := o_transport.NewHTTPHandler(oEndpoints, oExporter, tracer, logger)
+		mux.Handle("/api/v1/orders/", gateway.NewOrderDetailsHandler(orderDetails, orders, tracer, logger))
+		mux.Handle("/api/v1/carts/", o_transport.NewHTTPHandler(oEndpoints, oExporter, tracer, logger))
+		mux.Handle("/api/"+gateway.APIVersion+"/openapi.json", spec)
+		mux.Handle("/", http.FileServer(http.Dir(cfg.StaticDir)))
+	}
+	cache := gateway.NewResponseCache(cacheRules, cfg.CacheEntries, cfg.CacheBody, gateway.CacheMetrics{
+		Hits: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "dabanshan",
+			Subsystem: "gateway",
+			Name:      "cache_hits_total",
+			Help:      "Responses served from the gateway cache.",
+		}, []string{"rule"}),
+		Misses: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "dabanshan",
+			Subsystem: "gateway",
+			Name:      "cache_misses_total",
+			Help:      "Cacheable requests passed on to the services.",
+		}, []string{"rule"}),
+		Invalidations: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "dabanshan",
+			Subsystem: "gateway",
+			Name:      "cache_invalidations_total",
+			Help:      "Times the entries of a cache rule were dropped.",
+		}, []string{"rule"}),
+	})
+	var handler http.Handler = mux
+	if cfg.Validate {
+		handler = spec.Validate(cfg.ValidateBody)(handler)
+	}
+	if cfg.Cache {
+		handler = cache.Middleware(handler)
+	}
+	if cfg.RateLimit {
+		handler = gateway.RateLimit(rateGroups, gateway.NewMemoryRateStore(), cfg.TrustForwarded, logger)(handler)
+	}
+	handler = gateway.CORSMiddleware(corsPolicies)(authorize.HTTPToContext(handler))
+	http.Handle("/", logging.RequestMiddleware(logger)(handler))
+	checks.Register(http.DefaultServeMux)
+	// Reload the log level, the retry flags, and the route policies and rate
+	// limits of -routes.config on SIGHUP. Its other settings take a restart.
+	go config.Notify(nil, func() {
+		changed, err := loader.Reload(reloadable...)
+		if err == nil {
+			err = cfg.validate()
 		}
-		{
-			orderfactory := addOrderFactory(o_endpoint.MakeRemoveCartItemEndpoint, tracer, logger)
-			endpointer := sd.NewEndpointer(orderInstancer, orderfactory, logger)
-			balancer := lb.NewRoundRobin(endpointer)
-			retry := lb.Retry(*retryMax, *retryTimeout, balancer)
-			oEndpoints.RemoveCartItemEndpoint = retry
+		var routesConfig gateway.Config
+		if err == nil && cfg.RoutesConfig != "" {
+			routesConfig, err = gateway.LoadConfig(cfg.RoutesConfig)
 		}
-		{
-			orderfactory := addOrderFactory(o_endpoint.MakeUpdateQuantityEndpoint, tracer, logger)
-			endpointer := sd.NewEndpointer(orderInstancer, orderfactory, logger)
-			balancer := lb.NewRoundRobin(endpointer)
-			retry := lb.Retry(*retryMax, *retryTimeout, balancer)
-			oEndpoints.UpdateQuantityEndpoint = retry
+		var routes []gateway.Route
+		if err == nil {
+			routes, err = routesConfig.Apply(retryPolicies(table, cfg))
 		}
-		{
-			orderfactory := addOrderFactory(o_endpoint.MakeGetOrdersEndpoint, tracer, logger)
-			endpointer := sd.NewEndpointer(orderInstancer, orderfactory, logger)
-			balancer := lb.NewRoundRobin(endpointer)
-			retry := lb.Retry(*retryMax, *retryTimeout, balancer)
-			oEndpoints.GetOrdersEndpoint = retry
+		if err != nil {
+			level.Error(logger).Log("during", "reload", "err", err)
+			return
 		}
-		{
-			orderfactory := addOrderFactory(o_endpoint.MakeGetOrderEndpoint, tracer, logger)
-			endpointer := sd.NewEndpointer(orderInstancer, orderfactory, logger)
-			balancer := lb.NewRoundRobin(endpointer)
-			retry := lb.Retry(*retryMax, *retryTimeout, balancer)
-			oEndpoints.GetOrderEndpoint = retry
+		policies.Set(routes)
+		if routesConfig.RateLimits != nil {
+			rateGroups.Set(routesConfig.RateLimits)
+		} else {
+			rateGroups.Set(gateway.DefaultRateGroups)
 		}
+		level.Info(logger).Log("reloaded", strings.Join(changed, ","), "routes.config", cfg.RoutesConfig)
+	})
 
-		mux.Handle("/api/v1/products/", p_transport.NewHTTPHandler(pEndpoints, tracer, logger))
-		mux.Handle("/api/v1/users/", u_transport.NewHTTPHandler(uEndpoints, tracer, logger))
-		mux.Handle("/api/v1/orders/", o_transport.NewHTTPHandler(oEndpoints, tracer, logger))
-		mux.Handle("/api/v1/carts/", o_transport.NewHTTPHandler(oEndpoints, tracer, logger))
-		mux.Handle("/", http.FileServer(http.Dir(*staticDir)))
-	}
-	http.Handle("/", accessControl(mux))
 	// Interrupt handler.
-	errc := make(chan error, 2)
+	errc := make(chan error, 3)
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errc <- fmt.Errorf("%s", <-c)
 	}()
 
 	// HTTP transport.
+	httpServer := &http.Server{Addr: cfg.HTTPAddr}
+	go func() {
+		logger.Log("transport", "HTTP", "addr", cfg.HTTPAddr)
+		errc <- httpServer.ListenAndServe()
+	}()
+
+	// Debug listener, with the metrics, the health checks and the state of
+	// upstreams.
+	debugMux := http.NewServeMux()
+	debugMux.Handle("/metrics", promhttp.Handler())
+	debugMux.Handle("/debug/upstreams", upstreams)
+	debugMux.Handle("/debug/cache/invalidate", cache)
+	checks.Register(debugMux)
+	debugServer := &http.Server{Addr: cfg.DebugAddr, Handler: debugMux}
 	go func() {
-		logger.Log("transport", "HTTP", "addr", *httpAddr)
-		errc <- http.ListenAndServe(*httpAddr, nil)
+		logger.Log("transport", "debug/HTTP", "addr", cfg.DebugAddr)
+		errc <- debugServer.ListenAndServe()
 	}()
 
 	// Run!
 	logger.Log("exit", <-errc)
 
-}
-
-func accessControl(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type")
-		if r.Method == "OPTIONS" {
-			return
+	// Stop accepting connections and drain the requests in flight, closing
+	// those left after -shutdown.timeout. The spans are flushed by the
+	// deferred closer of the tracer.
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	for _, srv := range []*http.Server{httpServer, debugServer} {
+		if err := srv.Shutdown(ctx); err != nil {
+			level.Warn(logger).Log("during", "Shutdown", "addr", srv.Addr, "err", err)
+			srv.Close()
 		}
-		h.ServeHTTP(w, r)
-	})
-}
-
-func addProductFactory(makeEndpoint func(p_service.Service) endpoint.Endpoint, tracer stdopentracing.Tracer, logger log.Logger) sd.Factory {
-	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
-		conn, err := grpc.Dial(instance, grpc.WithInsecure())
-		if err != nil {
-			return nil, nil, err
-		}
-		service := p_transport.NewGRPCClient(conn, tracer, logger)
-		endpoint := makeEndpoint(service)
-		return endpoint, conn, nil
 	}
 }
 
-func addOrderFactory(makeEndpoint func(o_service.Service) endpoint.Endpoint, tracer stdopentracing.Tracer, logger log.Logger) sd.Factory {
-	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
-		conn, err := grpc.Dial(instance, grpc.WithInsecure())
-		if err != nil {
-			return nil, nil, err
-		}
-		service := o_transport.NewGRPCClient(conn, tracer, logger)
-		endpoint := makeEndpoint(service)
-		return endpoint, conn, nil
+// retryPolicies returns table with the retry flags of cfg, the auth of each
+// route kept.
+func retryPolicies(table []gateway.Route, cfg gatewayConfig) []gateway.Route {
+	routes := make([]gateway.Route, len(table))
+	for i, r := range table {
+		r.Policy.RetryMax = cfg.RetryMax
+		r.Policy.Timeout = cfg.RetryTimeout
+		r.Policy.AttemptTimeout = cfg.AttemptTimeout
+		routes[i] = r
 	}
+	return routes
 }
 
-func addUserFactory(makeEndpoint func(u_service.Service) endpoint.Endpoint, tracer stdopentracing.Tracer, logger log.Logger) sd.Factory {
-	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
-		conn, err := grpc.Dial(instance, grpc.WithInsecure())
-		if err != nil {
-			return nil, nil, err
+// mergeCartOnLogin merges the guest cart of a successful login into the
+// user's cart, within the metrics and the span of the usersvc.Login route.
+// merge is read on each login, once Build has bound it. A failed merge is
+// logged and does not fail the login.
+func mergeCartOnLogin(merge *endpoint.Endpoint, logger log.Logger) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			response, err := next(ctx, request)
+			if err != nil {
+				return response, err
+			}
+			req, ok := request.(u_model.LoginRequest)
+			if !ok || req.CartToken == "" {
+				return response, nil
+			}
+			resp, ok := response.(u_model.LoginResponse)
+			if !ok || resp.User == nil || resp.User.UserID == "" {
+				return response, nil
+			}
+			// The merge route requires a token; the one just issued will do.
+			ctx = authorize.NewContext(ctx, resp.Token)
+			_, mergeErr := (*merge)(ctx, o_model.MergeCartRequest{
+				CartToken: req.CartToken,
+				UserID:    resp.User.UserID,
+			})
+			if mergeErr != nil {
+				logging.With(ctx, logger).Log("method", "MergeCart", "userID", resp.User.UserID, "err", mergeErr)
+			}
+			return response, nil
 		}
-		service := u_transport.NewGRPCClient(conn, tracer, logger)
-		endpoint := makeEndpoint(service)
-		return endpoint, conn, nil
 	}
 }
@@ -3,287 +3,139 @@ package main
 import (
 	"flag"
 	"fmt"
-	corelog "log"
-	"net"
-	"net/http"
-	"os"
-	"os/signal"
-	"strconv"
-	"syscall"
-	"text/tabwriter"
+	"time"
 
 	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/metrics"
 	"github.com/go-kit/kit/metrics/prometheus"
-	consulsd "github.com/go-kit/kit/sd/consul"
-	"github.com/hashicorp/consul/api"
 	"github.com/laidingqing/dabanshan-go/svcs/order/db"
 	"github.com/laidingqing/dabanshan-go/svcs/order/db/mongodb"
-	lightstep "github.com/lightstep/lightstep-tracer-go"
-	"github.com/oklog/oklog/pkg/group"
-	stdopentracing "github.com/opentracing/opentracing-go"
-	zipkin "github.com/openzipkin/zipkin-go-opentracing"
+	"github.com/laidingqing/dabanshan-go/svcs/order/db/mongodriver"
+	"github.com/laidingqing/dabanshan-go/svcs/order/db/sqldb"
+	"github.com/laidingqing/dabanshan-go/svcs/order/jobs"
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
-	"sourcegraph.com/sourcegraph/appdash"
-	appdashot "sourcegraph.com/sourcegraph/appdash/opentracing"
 
 	addpb "github.com/laidingqing/dabanshan-go/pb"
+	"github.com/laidingqing/dabanshan-go/svcs/bootstrap"
+	"github.com/laidingqing/dabanshan-go/svcs/discovery"
+	"github.com/laidingqing/dabanshan-go/svcs/mongo"
 	o_endpoint "github.com/laidingqing/dabanshan-go/svcs/order/endpoint"
 	o_service "github.com/laidingqing/dabanshan-go/svcs/order/service"
 	o_transport "github.com/laidingqing/dabanshan-go/svcs/order/transport"
+	s_sqldb "github.com/laidingqing/dabanshan-go/svcs/sqldb"
 )
 
 func init() {
 	db.Register("mongodb", &mongodb.Mongo{})
+	db.Register("mongodriver", &mongodriver.Mongo{})
+	db.Register("postgres", &sqldb.SQL{Dialect: s_sqldb.Postgres})
+	db.Register("sqlite", &sqldb.SQL{Dialect: s_sqldb.SQLite})
 }
 
 func main() {
 	fs := flag.NewFlagSet("orderSvc", flag.ExitOnError)
-	var (
-		debugAddr      = fs.String("debug.addr", ":8070", "Debug and metrics listen address")
-		httpAddr       = fs.String("http-addr", ":8071", "HTTP listen address")
-		grpcAddr       = fs.String("grpc-addr", ":8072", "gRPC listen address")
-		consulAddr     = flag.String("consul.addr", "localhost:8500", "Consul agent address")
-		zipkinURL      = fs.String("zipkin-url", "http://localhost:9411/api/v1/spans", "Enable Zipkin tracing via a collector URL e.g. http://localhost:9411/api/v1/spans")
-		lightstepToken = flag.String("lightstep-token", "", "Enable LightStep tracing via a LightStep access token")
-		appdashAddr    = flag.String("appdash-addr", "", "Enable Appdash tracing via an Appdash server host:port")
-		serviceName    = flag.String("service.name", "ordersvc", "Name of the service")
-		instance       = flag.Int("instance", 1, "The instance count of the status service")
-	)
-	fs.Usage = usageFor(fs, os.Args[0]+" [flags]")
-	fs.Parse(os.Args[1:])
-
-	// Create a single logger, which we'll use and give to other components.
-	var logger log.Logger
-	{
-		logger = log.NewLogfmtLogger(os.Stderr)
-		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
-		logger = log.With(logger, "caller", log.DefaultCaller)
-	}
-
-	controlSvc := &service{
-		HTTPAddress: httpAddr,
-		GRPCAddress: grpcAddr,
-		Name:        serviceName,
-		Instance:    *instance}
-
-	var (
-		kitconsul consulsd.Client
-	)
-	{
-		var err error
-		kitconsul, err = createConsulClient(consulAddr, logger)
-		if err != nil {
-			logger.Log("err", err)
-		}
-		err = registerService(kitconsul, controlSvc)
-		if err != nil {
-			logger.Log("err", err)
-		}
-	}
-	// Determine which tracer to use. We'll pass the tracer to all the
-	// components that use it, as a dependency.
-	var tracer stdopentracing.Tracer
-	{
-		if *zipkinURL != "" {
-			logger.Log("tracer", "Zipkin", "URL", *zipkinURL)
-			collector, err := zipkin.NewHTTPCollector(*zipkinURL)
-			if err != nil {
-				logger.Log("err", err)
-				os.Exit(1)
+	var jobsConfig jobsConfig
+	jobsConfig.register(fs)
+	db.RegisterFlags(fs)
+	mongo.RegisterFlags(fs)
+	mongodb.RegisterFlags(fs)
+	mongodriver.RegisterFlags(fs)
+	sqldb.RegisterFlags(fs)
+	bootstrap.Run(fs, bootstrap.Service{
+		Name:      "ordersvc",
+		Subsystem: "orders",
+		DebugAddr: ":8070",
+		HTTPAddr:  ":8071",
+		GRPCAddr:  ":8072",
+		DB:        bootstrap.DB{Validate: bootstrap.Validators(mongo.Validate, s_sqldb.Validate), Set: db.Set, Init: db.Init, Ping: db.Ping, Close: db.Close, Duration: &db.Duration},
+		Validate: func() error {
+			return jobsConfig.validate(fs.Lookup("discovery").Value.String())
+		},
+		New: func(deps bootstrap.Deps) bootstrap.Server {
+			// Business-level metrics.
+			serviceMetrics := o_service.Metrics{
+				OrdersCreated: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+					Namespace: "dabanshan",
+					Subsystem: "orders",
+					Name:      "orders_created_total",
+					Help:      "Orders created.",
+				}, []string{}),
+				OrderValue: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+					Namespace: "dabanshan",
+					Subsystem: "orders",
+					Name:      "order_value",
+					Help:      "Amount of the orders created.",
+					Buckets:   []float64{10, 50, 100, 500, 1000, 5000, 10000, 50000},
+				}, []string{}),
+				CartsAdded: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+					Namespace: "dabanshan",
+					Subsystem: "orders",
+					Name:      "cart_items_added_total",
+					Help:      "Items added to carts, by cart: user or guest.",
+				}, []string{"cart"}),
 			}
-			defer collector.Close()
 			var (
-				debug       = false
-				hostPort    = "localhost:80"
-				serviceName = "ordersvc"
+				service    = o_service.New(deps.Logger, serviceMetrics)
+				endpoints  = o_endpoint.New(service, deps.Logger, deps.Metrics, deps.Tracer)
+				exporter   = o_service.NewExporter(deps.Logger)
+				grpcServer = o_transport.NewGRPCServer(endpoints, exporter, deps.Tracer, deps.Logger)
 			)
-			recorder := zipkin.NewRecorder(collector, debug, hostPort, serviceName)
-			tracer, err = zipkin.NewTracer(recorder)
-			if err != nil {
-				logger.Log("err", err)
-				os.Exit(1)
-			}
-		} else if *lightstepToken != "" {
-			logger.Log("tracer", "LightStep") // probably don't want to print out the token :)
-			tracer = lightstep.NewTracer(lightstep.Options{
-				AccessToken: *lightstepToken,
-			})
-			defer lightstep.FlushLightStepTracer(tracer)
-		} else if *appdashAddr != "" {
-			logger.Log("tracer", "Appdash", "addr", *appdashAddr)
-			tracer = appdashot.NewTracer(appdash.NewRemoteCollector(*appdashAddr))
-		} else {
-			logger.Log("tracer", "none")
-			tracer = stdopentracing.GlobalTracer() // no-op
-		}
-	}
 
-	dbconn := false
-	for !dbconn {
-		err := db.Init()
-		if err != nil {
-			if err == db.ErrNoDatabaseSelected {
-				corelog.Fatal(err)
+			// Background jobs, run by a single elected instance, or by
+			// every instance with -jobs.lock=local.
+			var locker jobs.Locker = jobs.LocalLocker{}
+			if jobsConfig.Lock == lockConsul {
+				locker = jobs.NewConsulLocker(deps.Discovery.(*discovery.Consul).Client, deps.Name)
 			}
-			corelog.Print(err)
-		} else {
-			dbconn = true
-		}
-	}
-
-	// Create the (sparse) metrics we'll use in the service. They, too, are
-	// dependencies that we pass to components that use them.
-	var ints, chars metrics.Counter
-	{
-		// Business-level metrics.
-		ints = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
-			Namespace: "dabanshan",
-			Subsystem: "orders",
-			Name:      "integers_summed",
-			Help:      "Total count of integers summed via the Sum method.",
-		}, []string{})
-		chars = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
-			Namespace: "dabanshan",
-			Subsystem: "orders",
-			Name:      "characters_concatenated",
-			Help:      "Total count of characters concatenated via the Concat method.",
-		}, []string{})
-	}
-	var duration metrics.Histogram
-	{
-		// Endpoint-level metrics.
-		duration = prometheus.NewSummaryFrom(stdprometheus.SummaryOpts{
-			Namespace: "dabanshan",
-			Subsystem: "orders",
-			Name:      "request_duration_seconds",
-			Help:      "Request duration in seconds.",
-		}, []string{"method", "success"})
-	}
-	http.DefaultServeMux.Handle("/metrics", promhttp.Handler())
-	http.DefaultServeMux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
-
-	var (
-		service     = o_service.New(logger, ints, chars)
-		endpoints   = o_endpoint.New(service, logger, duration, tracer)
-		httpHandler = o_transport.NewHTTPHandler(endpoints, tracer, logger)
-		grpcServer  = o_transport.NewGRPCServer(endpoints, tracer, logger)
-	)
+			runner := jobs.NewRunner(locker, log.With(deps.Logger, "component", "jobs"),
+				jobs.CancelExpiredOrders(jobsConfig.OrderExpiry, jobsConfig.Interval),
+				jobs.PurgeStaleCarts(time.Duration(jobsConfig.CartMaxAgeDays)*24*time.Hour, jobsConfig.Interval),
+			)
 
-	var g group.Group
-	{
-		debugListener, err := net.Listen("tcp", *debugAddr)
-		if err != nil {
-			logger.Log("transport", "debug/HTTP", "during", "Listen", "err", err)
-			os.Exit(1)
-		}
-		g.Add(func() error {
-			logger.Log("transport", "debug/HTTP", "addr", *debugAddr)
-			return http.Serve(debugListener, http.DefaultServeMux)
-		}, func(error) {
-			debugListener.Close()
-		})
-	}
-	{
-		// The HTTP listener mounts the Go kit HTTP handler we created.
-		httpListener, err := net.Listen("tcp", *httpAddr)
-		if err != nil {
-			logger.Log("transport", "HTTP", "during", "Listen", "err", err)
-			os.Exit(1)
-		}
-		g.Add(func() error {
-			logger.Log("transport", "HTTP", "addr", *httpAddr)
-			return http.Serve(httpListener, httpHandler)
-		}, func(error) {
-			httpListener.Close()
-		})
-	}
-	{
-		// The gRPC listener mounts the Go kit gRPC server we created.
-		grpcListener, err := net.Listen("tcp", *grpcAddr)
-		if err != nil {
-			logger.Log("transport", "gRPC", "during", "Listen", "err", err)
-			os.Exit(1)
-		}
-		g.Add(func() error {
-			logger.Log("transport", "gRPC", "addr", *grpcAddr)
-			baseServer := grpc.NewServer()
-			addpb.RegisterOrderRpcServiceServer(baseServer, grpcServer)
-			return baseServer.Serve(grpcListener)
-		}, func(error) {
-			grpcListener.Close()
-		})
-	}
-	{
-		// This function just sits and waits for ctrl-C.
-		cancelInterrupt := make(chan struct{})
-		g.Add(func() error {
-			c := make(chan os.Signal, 1)
-			signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-			select {
-			case sig := <-c:
-				return fmt.Errorf("received signal %s", sig)
-			case <-cancelInterrupt:
-				return nil
+			return bootstrap.Server{
+				HTTP:   o_transport.NewHTTPHandler(endpoints, exporter, deps.Tracer, deps.Logger),
+				GRPC:   func(s *grpc.Server) { addpb.RegisterOrderRpcServiceServer(s, grpcServer) },
+				Actors: []bootstrap.Actor{{Execute: runner.Run, Interrupt: runner.Interrupt}},
 			}
-		}, func(error) {
-			close(cancelInterrupt)
-		})
-	}
-	logger.Log("exit", g.Run())
+		},
+	})
 }
 
-func usageFor(fs *flag.FlagSet, short string) func() {
-	return func() {
-		fmt.Fprintf(os.Stderr, "USAGE\n")
-		fmt.Fprintf(os.Stderr, "  %s\n", short)
-		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "FLAGS\n")
-		w := tabwriter.NewWriter(os.Stderr, 0, 2, 2, ' ', 0)
-		fs.VisitAll(func(f *flag.Flag) {
-			fmt.Fprintf(w, "\t-%s %s\t%s\n", f.Name, f.DefValue, f.Usage)
-		})
-		w.Flush()
-		fmt.Fprintf(os.Stderr, "\n")
-	}
-}
+// The -jobs.lock modes.
+const (
+	lockConsul = "consul"
+	lockLocal  = "local"
+)
 
-type service struct {
-	GRPCAddress *string
-	HTTPAddress *string
-	Instance    int
-	Name        *string
+// jobsConfig is the configuration of the background jobs.
+type jobsConfig struct {
+	Interval       time.Duration
+	Lock           string
+	OrderExpiry    time.Duration
+	CartMaxAgeDays int
 }
 
-func createConsulClient(consulAddr *string, logger log.Logger) (consulsd.Client, error) {
-	consulConfig := api.DefaultConfig()
-	if len(*consulAddr) > 0 {
-		consulConfig.Address = *consulAddr
-	}
-	consulClient, err := api.NewClient(consulConfig)
-	return consulsd.NewClient(consulClient), err
+func (c *jobsConfig) register(fs *flag.FlagSet) {
+	fs.DurationVar(&c.Interval, "jobs.interval", time.Minute, "How often background jobs run")
+	fs.StringVar(&c.Lock, "jobs.lock", lockConsul, "How the instance running background jobs is elected: consul, with -discovery=consul, or local for a single instance")
+	fs.DurationVar(&c.OrderExpiry, "order.expiry", 30*time.Minute, "Cancel orders left unpaid for longer than this")
+	fs.IntVar(&c.CartMaxAgeDays, "cart.max-age-days", 30, "Purge cart items not touched for this many days")
 }
 
-func registerService(client consulsd.Client, svc *service) error {
-	check := &api.AgentServiceCheck{
-		HTTP:     fmt.Sprintf("http://127.0.0.1%v/health", *svc.HTTPAddress),
-		Interval: "10s",
-		Timeout:  "3s",
-	}
-	host, strPort, _ := net.SplitHostPort(*svc.GRPCAddress)
-	port, _ := strconv.Atoi(strPort)
-	reg := &api.AgentServiceRegistration{
-		Name:    *svc.Name,
-		Address: host,
-		Port:    port,
-		ID:      *svc.Name + "-" + strconv.Itoa(svc.Instance),
-		Tags:    []string{"grpc"},
-		Check:   check,
+// validate checks c against the -discovery mode: without Consul the jobs
+// would run on every instance, which takes -jobs.lock=local.
+func (c *jobsConfig) validate(discovery string) error {
+	switch {
+	case c.Lock != lockConsul && c.Lock != lockLocal:
+		return fmt.Errorf("-jobs.lock %q is not consul or local", c.Lock)
+	case c.Lock == lockConsul && discovery != "consul":
+		return fmt.Errorf("-jobs.lock=consul takes -discovery=consul, not %s: use -jobs.lock=local to run a single instance", discovery)
+	case c.Interval <= 0:
+		return fmt.Errorf("-jobs.interval %v is not positive", c.Interval)
+	case c.OrderExpiry <= 0:
+		return fmt.Errorf("-order.expiry %v is not positive", c.OrderExpiry)
+	case c.CartMaxAgeDays <= 0:
+		return fmt.Errorf("-cart.max-age-days %d is not positive", c.CartMaxAgeDays)
 	}
-	err := client.Register(reg)
-	return err
+	return nil
 }
@@ -1,13 +1,18 @@
 package authorize
 
 import (
+	"context"
 	"crypto/sha1"
 	"fmt"
 	"io"
+	"net/http"
 	"time"
 
 	jwtmiddleware "github.com/auth0/go-jwt-middleware"
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/dgrijalva/jwt-go/request"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
 )
 
 var (
@@ -15,26 +20,121 @@ var (
 	SecretKey = "welcome to dabanshan"
 	//JwtMiddleware jwt middleware
 	JwtMiddleware = jwtmiddleware.New(jwtmiddleware.Options{
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-			return []byte(SecretKey), nil
-		},
-		SigningMethod: jwt.SigningMethodHS256,
+		ValidationKeyGetter: keyFunc,
+		SigningMethod:       jwt.SigningMethodHS256,
 	})
+	// ErrNoUserClaim is returned when a valid token carries no user id.
+	ErrNoUserClaim = errs.New(errs.Unauthenticated, "token has no user id")
+	// ErrUnauthorized is returned by Authenticated for requests without a
+	// valid bearer token.
+	ErrUnauthorized = errs.New(errs.Unauthenticated, "Unauthorized")
+)
+
+type contextKey int
+
+const tokenContextKey contextKey = 0
+
+const (
+	// CartTokenCookie is the cookie carrying a guest cart token.
+	CartTokenCookie = "cart_token"
+	// CartTokenHeader is the header carrying a guest cart token, for clients
+	// without cookies.
+	CartTokenHeader = "X-Cart-Token"
+	// cartTokenMaxAge is how long browsers keep a guest cart cookie.
+	cartTokenMaxAge = 30 * 24 * 60 * 60
 )
 
 func init() {}
 
-// CreateJWT generat a jwt token
-func CreateJWT() (string, error) {
+func keyFunc(token *jwt.Token) (interface{}, error) {
+	return []byte(SecretKey), nil
+}
+
+// CreateJWT generat a jwt token for the given user
+func CreateJWT(userID string) (string, error) {
 	token := jwt.New(jwt.SigningMethodHS256)
 	claims := make(jwt.MapClaims)
 	claims["exp"] = time.Now().Add(time.Hour * time.Duration(1)).Unix()
 	claims["iat"] = time.Now().Unix()
+	claims["userId"] = userID
 	token.Claims = claims
 
 	return token.SignedString([]byte(SecretKey))
 }
 
+// UserID returns the id of the user authenticated by the bearer token of r.
+func UserID(r *http.Request) (string, error) {
+	token, err := request.ParseFromRequest(r, request.AuthorizationHeaderExtractor, keyFunc)
+	if err != nil {
+		return "", err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", ErrNoUserClaim
+	}
+	id, _ := claims["userId"].(string)
+	if id == "" {
+		return "", ErrNoUserClaim
+	}
+	return id, nil
+}
+
+// NewContext returns a copy of ctx carrying the bearer token.
+func NewContext(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenContextKey, token)
+}
+
+// HTTPToContext moves the bearer token of each request into the request
+// context, where Authenticated looks for it.
+func HTTPToContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, err := request.AuthorizationHeaderExtractor.ExtractToken(r); err == nil {
+			r = r.WithContext(NewContext(r.Context(), token))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Authenticated is an endpoint middleware rejecting requests whose context
+// carries no valid bearer token.
+func Authenticated(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, req interface{}) (interface{}, error) {
+		token, _ := ctx.Value(tokenContextKey).(string)
+		if token == "" {
+			return nil, ErrUnauthorized
+		}
+		if _, err := jwt.Parse(token, keyFunc); err != nil {
+			return nil, ErrUnauthorized
+		}
+		return next(ctx, req)
+	}
+}
+
+// CartToken returns the guest cart token sent with r, or "" if there is none.
+// The header takes precedence over the cookie.
+func CartToken(r *http.Request) string {
+	if t := r.Header.Get(CartTokenHeader); t != "" {
+		return t
+	}
+	if c, err := r.Cookie(CartTokenCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// SetCartToken hands a newly issued guest cart token to the client, both as a
+// cookie and as a response header.
+func SetCartToken(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CartTokenCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   cartTokenMaxAge,
+		HttpOnly: true,
+	})
+	w.Header().Set(CartTokenHeader, token)
+}
+
 func CalculatePassHash(pass, salt string) string {
 	h := sha1.New()
 	io.WriteString(h, salt)
@@ -0,0 +1,371 @@
+// Package bootstrap runs a service: it loads its configuration, sets up
+// logging, tracing, metrics and service discovery, connects to the database,
+// serves the handlers of the service on the debug, HTTP and gRPC listeners,
+// registers the instance while it is ready and drains it on shutdown.
+//
+// A service supplies its name, its database and a func building its handlers
+// from the dependencies set up here:
+//
+//	db.RegisterFlags(fs)
+//	mongo.RegisterFlags(fs)
+//	mongodb.RegisterFlags(fs)
+//	bootstrap.Run(fs, bootstrap.Service{
+//		Name:      "usersvc",
+//		Subsystem: "users",
+//		DB:        bootstrap.DB{Validate: mongo.Validate, Set: db.Set, Init: db.Init, Ping: db.Ping, Close: db.Close, Duration: &db.Duration},
+//		New: func(deps bootstrap.Deps) bootstrap.Server { ... },
+//	})
+package bootstrap
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+	"github.com/oklog/oklog/pkg/group"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+
+	"github.com/laidingqing/dabanshan-go/svcs/config"
+	"github.com/laidingqing/dabanshan-go/svcs/discovery"
+	"github.com/laidingqing/dabanshan-go/svcs/health"
+	"github.com/laidingqing/dabanshan-go/svcs/instrumenting"
+	"github.com/laidingqing/dabanshan-go/svcs/lifecycle"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
+	"github.com/laidingqing/dabanshan-go/svcs/tracing"
+)
+
+// Service describes a service to Run.
+type Service struct {
+	// Name is the default of -service.name, the name the instance registers
+	// under and logs and traces with.
+	Name string
+	// Subsystem is the Prometheus subsystem of the metrics of the service.
+	Subsystem string
+	// DebugAddr, HTTPAddr and GRPCAddr are the defaults of the listen
+	// addresses.
+	DebugAddr string
+	HTTPAddr  string
+	GRPCAddr  string
+	// DB is the database of the service.
+	DB DB
+	// Checks are the readiness checks of the service besides DB.Ping.
+	Checks map[string]health.Check
+	// Validate checks the settings of the service besides Config, if not
+	// nil.
+	Validate func() error
+	// New builds the handlers of the service, once the database is up.
+	New func(deps Deps) Server
+}
+
+// Config is the configuration common to the services, from their flags,
+// environment variables and config file, see package config.
+type Config struct {
+	Name            string
+	Instance        int
+	DebugAddr       string
+	HTTPAddr        string
+	GRPCAddr        string
+	DBBackoffMax    time.Duration
+	HealthInterval  time.Duration
+	HealthTimeout   time.Duration
+	ShutdownTimeout time.Duration
+}
+
+func (c *Config) register(fs *flag.FlagSet, svc Service) {
+	fs.StringVar(&c.Name, "service.name", svc.Name, "Name of the service")
+	fs.IntVar(&c.Instance, "instance", 1, "The instance count of the status service")
+	fs.StringVar(&c.DebugAddr, "debug.addr", svc.DebugAddr, "Debug and metrics listen address")
+	fs.StringVar(&c.HTTPAddr, "http-addr", svc.HTTPAddr, "HTTP listen address")
+	fs.StringVar(&c.GRPCAddr, "grpc-addr", svc.GRPCAddr, "gRPC listen address")
+	fs.DurationVar(&c.DBBackoffMax, "db.backoff-max", 30*time.Second, "Longest wait between two attempts to connect to the database")
+	fs.DurationVar(&c.HealthInterval, "health.interval", 10*time.Second, "How often readiness is checked, the instance being registered only while ready")
+	fs.DurationVar(&c.HealthTimeout, "health.timeout", 3*time.Second, "Time allowed to each readiness check")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown.timeout", 15*time.Second, "Time allowed on SIGTERM to the requests in flight")
+}
+
+// Validate reports the first invalid setting of c.
+func (c Config) Validate() error {
+	if c.Name == "" {
+		return errors.New("bootstrap: -service.name is empty")
+	}
+	if c.Instance < 1 {
+		return fmt.Errorf("bootstrap: -instance %d is not positive", c.Instance)
+	}
+	addrs := map[string]string{}
+	for _, a := range []struct{ flag, addr string }{
+		{"debug.addr", c.DebugAddr},
+		{"http-addr", c.HTTPAddr},
+		{"grpc-addr", c.GRPCAddr},
+	} {
+		if _, _, err := net.SplitHostPort(a.addr); err != nil {
+			return fmt.Errorf("bootstrap: -%s: %v", a.flag, err)
+		}
+		if other, ok := addrs[a.addr]; ok {
+			return fmt.Errorf("bootstrap: -%s and -%s are both %s", other, a.flag, a.addr)
+		}
+		addrs[a.addr] = a.flag
+	}
+	for _, d := range []struct {
+		flag string
+		d    time.Duration
+	}{
+		{"db.backoff-max", c.DBBackoffMax},
+		{"health.interval", c.HealthInterval},
+		{"health.timeout", c.HealthTimeout},
+		{"shutdown.timeout", c.ShutdownTimeout},
+	} {
+		if d.d <= 0 {
+			return fmt.Errorf("bootstrap: -%s %v is not positive", d.flag, d.d)
+		}
+	}
+	return nil
+}
+
+// reloadable are the settings of the services changed on SIGHUP.
+var reloadable = []string{"log.level"}
+
+// Validators returns a func running the validate funcs not nil in turn,
+// reporting the first error, for the settings of several packages.
+func Validators(validate ...func() error) func() error {
+	return func() error {
+		for _, v := range validate {
+			if v == nil {
+				continue
+			}
+			if err := v(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// DB is the database of a service, the funcs of its db package.
+type DB struct {
+	// Validate checks the settings of the database, if not nil.
+	Validate func() error
+	// Set selects the database named by the flags. Its errors are not
+	// retried.
+	Set func() error
+	// Init connects to the database, retried with backoff until it succeeds.
+	Init func() error
+	// Ping checks the database, for readiness.
+	Ping health.Check
+	// Close closes the database, once the servers are drained.
+	Close func()
+	// Duration is set to the histogram of the latency of db operations.
+	Duration *metrics.Histogram
+}
+
+// Deps are the dependencies Run gives the service.
+type Deps struct {
+	// Name is the service name, as set by -service.name.
+	Name      string
+	Logger    log.Logger
+	Tracer    stdopentracing.Tracer
+	Metrics   instrumenting.EndpointMetrics
+	Discovery discovery.Discovery
+}
+
+// Server is what a service serves.
+type Server struct {
+	// HTTP is the handler of the HTTP listener, next to the health checks.
+	HTTP http.Handler
+	// GRPC registers the gRPC server of the service on s.
+	GRPC func(s *grpc.Server)
+	// Actors are run along with the servers, such as background jobs.
+	Actors []Actor
+}
+
+// Actor is an actor of an oklog group.
+type Actor struct {
+	Execute   func() error
+	Interrupt func(error)
+}
+
+// Run runs svc with the flags of fs and the common flags, defined here, and
+// exits the process on failure. The environment variables of the settings
+// start with the upper cased svc.Name and _, ORDERSVC_LOG_LEVEL.
+func Run(fs *flag.FlagSet, svc Service) {
+	var cfg Config
+	cfg.register(fs, svc)
+	discoveryFlags := discovery.RegisterFlags(fs)
+	tracingFlags := tracing.RegisterFlags(fs)
+	loggingFlags := logging.RegisterFlags(fs)
+	loader := config.New(fs, strings.ToUpper(svc.Name)+"_")
+	fs.Usage = usageFor(fs, os.Args[0]+" [flags]")
+	if err := loader.Parse(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := Validators(svc.DB.Validate, svc.Validate)(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Create a single logger, which we'll use and give to other components.
+	logger, err := loggingFlags.New(cfg.Name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Announce the instance through the selected service discovery, once it
+	// is ready: see the readiness gate below.
+	disc, err := discoveryFlags.New(logger)
+	if err != nil {
+		level.Error(logger).Log("during", "discovery", "err", err)
+		os.Exit(1)
+	}
+	registrar := disc.Registrar(discovery.Instance{
+		Name:     cfg.Name,
+		ID:       cfg.Name + "-" + strconv.Itoa(cfg.Instance),
+		GRPCAddr: cfg.GRPCAddr,
+		HTTPAddr: cfg.HTTPAddr,
+	})
+
+	// Determine which tracer to use. We'll pass the tracer to all the
+	// components that use it, as a dependency.
+	tracer, closer, err := tracingFlags.New(cfg.Name, cfg.GRPCAddr, logger)
+	if err != nil {
+		level.Error(logger).Log("during", "tracing", "err", err)
+		os.Exit(1)
+	}
+	defer closer.Close()
+
+	if err := connect(svc.DB, cfg.DBBackoffMax, logger); err != nil {
+		level.Error(logger).Log("during", "db.Init", "err", err)
+		os.Exit(1)
+	}
+
+	// Endpoint-level and database-level metrics, the service creating its
+	// business-level ones.
+	endpointMetrics := instrumenting.NewEndpointMetrics(svc.Subsystem)
+	*svc.DB.Duration = instrumenting.NewDBDuration(svc.Subsystem)
+	http.DefaultServeMux.Handle("/metrics", promhttp.Handler())
+
+	// The liveness and readiness checks, served on both the HTTP and the
+	// debug listeners.
+	checks := health.New(cfg.HealthTimeout)
+	checks.Add("db", svc.DB.Ping)
+	for name, check := range svc.Checks {
+		checks.Add(name, check)
+	}
+	checks.Register(http.DefaultServeMux)
+
+	server := svc.New(Deps{
+		Name:      cfg.Name,
+		Logger:    logger,
+		Tracer:    tracer,
+		Metrics:   endpointMetrics,
+		Discovery: disc,
+	})
+	httpMux := http.NewServeMux()
+	checks.Register(httpMux)
+	httpMux.Handle("/", server.HTTP)
+	baseServer := grpc.NewServer()
+	server.GRPC(baseServer)
+
+	var g group.Group
+	{
+		// The instance is registered while ready, and deregistered when it
+		// stops being ready or on shutdown. Added first, it is deregistered
+		// before the servers below stop accepting connections and drain.
+		gate := health.NewGate(checks, registrar, cfg.HealthInterval, log.With(logger, "component", "health"))
+		g.Add(gate.Run, gate.Interrupt)
+	}
+	listen := func(transport, addr string) net.Listener {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			level.Error(logger).Log("transport", transport, "during", "Listen", "err", err)
+			os.Exit(1)
+		}
+		logger.Log("transport", transport, "addr", addr)
+		return l
+	}
+	g.Add(lifecycle.HTTPServer(&http.Server{Handler: http.DefaultServeMux}, listen("debug/HTTP", cfg.DebugAddr), cfg.ShutdownTimeout))
+	g.Add(lifecycle.HTTPServer(&http.Server{Handler: httpMux}, listen("HTTP", cfg.HTTPAddr), cfg.ShutdownTimeout))
+	g.Add(lifecycle.GRPCServer(baseServer, listen("gRPC", cfg.GRPCAddr), cfg.ShutdownTimeout))
+	for _, a := range server.Actors {
+		g.Add(a.Execute, a.Interrupt)
+	}
+	{
+		// Reload the settings safe to change on SIGHUP.
+		stop := make(chan struct{})
+		g.Add(func() error {
+			config.Notify(stop, func() {
+				changed, err := loader.Reload(reloadable...)
+				if err != nil {
+					level.Error(logger).Log("during", "reload", "err", err)
+					return
+				}
+				level.Info(logger).Log("reloaded", strings.Join(changed, ","))
+			})
+			return nil
+		}, func(error) {
+			close(stop)
+		})
+	}
+	// This function just sits and waits for ctrl-C or SIGTERM.
+	g.Add(lifecycle.Signals())
+	logger.Log("exit", g.Run())
+
+	// The servers are drained: close the database, and flush the spans
+	// left with the deferred closer of the tracer.
+	svc.DB.Close()
+}
+
+// connect selects and connects to the database, waiting between failed
+// attempts twice as long as the previous time, up to max, with jitter so
+// that instances restarted together do not retry in step.
+func connect(db DB, max time.Duration, logger log.Logger) error {
+	if err := db.Set(); err != nil {
+		return err
+	}
+	wait := 100 * time.Millisecond
+	for {
+		err := db.Init()
+		if err == nil {
+			return nil
+		}
+		if wait > max {
+			wait = max
+		}
+		sleep := wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		level.Warn(logger).Log("during", "db.Init", "err", err, "retry_in", sleep)
+		time.Sleep(sleep)
+		wait *= 2
+	}
+}
+
+func usageFor(fs *flag.FlagSet, short string) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "USAGE\n")
+		fmt.Fprintf(os.Stderr, "  %s\n", short)
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "FLAGS\n")
+		w := tabwriter.NewWriter(os.Stderr, 0, 2, 2, ' ', 0)
+		fs.VisitAll(func(f *flag.Flag) {
+			fmt.Fprintf(w, "\t-%s %s\t%s\n", f.Name, f.DefValue, f.Usage)
+		})
+		w.Flush()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+}
@@ -0,0 +1,216 @@
+// Package config loads the settings of a binary from its command line flags,
+// environment variables and a YAML or TOML config file, and reloads them on
+// SIGHUP.
+//
+// Every setting is a flag of the binary, and keeps its name in the other
+// sources. A setting given on the command line, -log.level=debug, wins over
+// the environment, PREFIX_LOG_LEVEL=debug with the flag name upper cased and
+// its . and - replaced by _, which wins over the file given by -config, which
+// wins over the default of the flag. In the file, .yaml, .yml or .toml,
+// nested keys are joined with dots and lists with commas:
+//
+//	log:
+//	  level: debug
+//	cors:
+//	  origins: [https://shop.example.com, https://admin.example.com]
+//
+// Keys of the file naming no flag are an error, so that typos do not go
+// unnoticed.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Loader loads the flags of a FlagSet from the command line, the environment
+// and the config file.
+type Loader struct {
+	fs     *flag.FlagSet
+	prefix string
+	file   *string
+	// cli are the flags set on the command line, which the other sources do
+	// not override.
+	cli map[string]bool
+}
+
+// New returns a Loader of the flags of fs, reading the environment variables
+// starting with prefix and defining -config on fs.
+func New(fs *flag.FlagSet, prefix string) *Loader {
+	return &Loader{
+		fs:     fs,
+		prefix: prefix,
+		file:   fs.String("config", "", "YAML or TOML config file, its settings overridden by the environment and the command line"),
+	}
+}
+
+// Parse parses the command line args and sets the flags not given there from
+// the environment and the config file.
+func (l *Loader) Parse(args []string) error {
+	if err := l.fs.Parse(args); err != nil {
+		return err
+	}
+	l.cli = map[string]bool{}
+	l.fs.Visit(func(f *flag.Flag) { l.cli[f.Name] = true })
+	return l.load(nil)
+}
+
+// Reload reads the environment and the config file again, setting the flags
+// named by keys, those safe to change while the binary runs, unless they
+// were given on the command line. It returns the keys whose value changed.
+func (l *Loader) Reload(keys ...string) ([]string, error) {
+	only := map[string]bool{}
+	for _, k := range keys {
+		only[k] = true
+	}
+	before := map[string]string{}
+	for _, k := range keys {
+		if f := l.fs.Lookup(k); f != nil {
+			before[k] = f.Value.String()
+		}
+	}
+	if err := l.load(only); err != nil {
+		return nil, err
+	}
+	var changed []string
+	for k, v := range before {
+		if l.fs.Lookup(k).Value.String() != v {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// load sets the flags, or those of only if not nil, from the environment and
+// the file. If a value is invalid, the flags set before it are set back, so
+// that a bad reload leaves the settings as they were.
+func (l *Loader) load(only map[string]bool) error {
+	values := map[string]string{}
+	if *l.file != "" {
+		file, err := readFile(*l.file)
+		if err != nil {
+			return err
+		}
+		for k, v := range file {
+			if l.fs.Lookup(k) == nil {
+				return fmt.Errorf("config: %s: unknown setting %s", *l.file, k)
+			}
+			values[k] = v
+		}
+	}
+	l.fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(l.EnvName(f.Name)); ok {
+			values[f.Name] = v
+		}
+	})
+	var names []string
+	for k := range values {
+		if !l.cli[k] && (only == nil || only[k]) && k != "config" {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	previous := map[string]string{}
+	for _, k := range names {
+		previous[k] = l.fs.Lookup(k).Value.String()
+		if err := l.fs.Set(k, values[k]); err != nil {
+			for k, v := range previous {
+				l.fs.Set(k, v)
+			}
+			return fmt.Errorf("config: %s: %v", k, err)
+		}
+	}
+	return nil
+}
+
+// EnvName is the environment variable of the flag name.
+func (l *Loader) EnvName(name string) string {
+	return l.prefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// Notify calls reload on every SIGHUP until stop is closed.
+func Notify(stop <-chan struct{}, reload func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-c:
+			reload()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// readFile reads the settings of a YAML or TOML file, flattened to flag
+// names.
+func readFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	case ".toml":
+		_, err = toml.Decode(string(data), &tree)
+	default:
+		return nil, fmt.Errorf("config: %s: unknown format, want .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config: %s: %v", path, err)
+	}
+	values := map[string]string{}
+	if err := flatten("", tree, values); err != nil {
+		return nil, fmt.Errorf("config: %s: %v", path, err)
+	}
+	return values, nil
+}
+
+func flatten(prefix string, v interface{}, values map[string]string) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range v {
+			if err := flatten(join(prefix, k), sub, values); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for k, sub := range v {
+			if err := flatten(join(prefix, fmt.Sprint(k)), sub, values); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		values[prefix] = strings.Join(items, ",")
+	case nil:
+		return fmt.Errorf("%s has no value", prefix)
+	default:
+		values[prefix] = fmt.Sprint(v)
+	}
+	return nil
+}
+
+func join(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
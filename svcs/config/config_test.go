@@ -0,0 +1,150 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type settings struct {
+	level, origins, addr string
+	retries              int
+}
+
+func newLoader(t *testing.T) (*Loader, *settings) {
+	t.Helper()
+	fs := flag.NewFlagSet("gateway", flag.ContinueOnError)
+	s := &settings{}
+	fs.StringVar(&s.level, "log.level", "info", "")
+	fs.StringVar(&s.origins, "cors.origins", "*", "")
+	fs.StringVar(&s.addr, "http.addr", ":8000", "")
+	fs.IntVar(&s.retries, "retry.max", 3, "")
+	return New(fs, "GATEWAY_"), s
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPrecedence(t *testing.T) {
+	file := writeFile(t, "gateway.yaml", `
+log:
+  level: debug
+cors:
+  origins: [https://shop.example.com, https://admin.example.com]
+http.addr: ":9000"
+retry:
+  max: 5
+`)
+	t.Setenv("GATEWAY_LOG_LEVEL", "warn")
+	t.Setenv("GATEWAY_HTTP_ADDR", ":9100")
+	l, s := newLoader(t)
+	if err := l.Parse([]string{"-config", file, "-log.level=error"}); err != nil {
+		t.Fatal(err)
+	}
+	want := settings{
+		level:   "error", // command line over the environment and the file
+		addr:    ":9100", // environment over the file
+		origins: "https://shop.example.com,https://admin.example.com",
+		retries: 5,
+	}
+	if *s != want {
+		t.Errorf("settings %+v, want %+v", *s, want)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	l, s := newLoader(t)
+	if err := l.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := (settings{level: "info", origins: "*", addr: ":8000", retries: 3}); *s != want {
+		t.Errorf("settings %+v, want the defaults %+v", *s, want)
+	}
+}
+
+func TestTOML(t *testing.T) {
+	file := writeFile(t, "gateway.toml", `
+[log]
+level = "debug"
+[retry]
+max = 4
+`)
+	l, s := newLoader(t)
+	if err := l.Parse([]string{"-config", file}); err != nil {
+		t.Fatal(err)
+	}
+	if s.level != "debug" || s.retries != 4 {
+		t.Errorf("settings %+v", *s)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name, file, content string
+	}{
+		{"unknown key", "gateway.yaml", "log:\n  levle: debug\n"},
+		{"unknown format", "gateway.json", `{"log.level": "debug"}`},
+		{"no value", "gateway.yaml", "log:\n  level:\n"},
+		{"invalid value", "gateway.yaml", "retry.max: many\n"},
+		{"invalid environment", "", "x"},
+	} {
+		args := []string{}
+		if tc.file != "" {
+			args = append(args, "-config", writeFile(t, tc.file, tc.content))
+		} else {
+			t.Setenv("GATEWAY_RETRY_MAX", tc.content)
+		}
+		l, _ := newLoader(t)
+		if err := l.Parse(args); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	file := writeFile(t, "gateway.yaml", "log.level: debug\nretry.max: 5\n")
+	l, s := newLoader(t)
+	if err := l.Parse([]string{"-config", file, "-retry.max=4"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte("log.level: warn\nretry.max: 6\nhttp.addr: \":9000\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := l.Reload("log.level", "retry.max")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"log.level"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed %q, want %q", changed, want)
+	}
+	// retry.max was given on the command line, http.addr takes a restart
+	if want := (settings{level: "warn", origins: "*", addr: ":8000", retries: 4}); *s != want {
+		t.Errorf("settings %+v, want %+v", *s, want)
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	file := writeFile(t, "gateway.yaml", "log.level: debug\n")
+	l, s := newLoader(t)
+	if err := l.Parse([]string{"-config", file}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte("cors.origins: https://shop.example.com\nlog.level: warn\nretry.max: many\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Reload("cors.origins", "log.level", "retry.max"); err == nil {
+		t.Error("reload of an invalid value: no error")
+	}
+	// the settings set before the invalid one are set back
+	if want := (settings{level: "debug", origins: "*", addr: ":8000", retries: 3}); *s != want {
+		t.Errorf("settings %+v, want %+v", *s, want)
+	}
+}
@@ -0,0 +1,114 @@
+// Package conformance connects the conformance tests of the backends of the
+// services, see svcs/order/db/conformance, to databases of their own, which
+// are dropped at the end of the test:
+//
+//	func TestConformance(t *testing.T) {
+//		conn := s_conformance.Driver(t, s_conformance.Name("orders"))
+//		o_conformance.Run(t, &Mongo{conn: conn})
+//	}
+//
+// The Mongo tests run against the server of MONGODB_TEST_URI and the
+// PostgreSQL ones against that of POSTGRES_TEST_DSN, a URL; they are skipped
+// when it is not set.
+package conformance
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/laidingqing/dabanshan-go/svcs/mongo"
+	"github.com/laidingqing/dabanshan-go/svcs/mongo/driver"
+	"github.com/laidingqing/dabanshan-go/svcs/sqldb"
+	"gopkg.in/mgo.v2"
+)
+
+// Name returns a database name for the tests of service no other run uses.
+func Name(service string) string {
+	return service + "_conformance_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+func mongoURI(t *testing.T) string {
+	t.Helper()
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+	return uri
+}
+
+// Session returns an mgo session to the server of MONGODB_TEST_URI, whose
+// database name is dropped at the end of t.
+func Session(t *testing.T, name string) *mgo.Session {
+	t.Helper()
+	session, err := mongo.Dial(context.Background(), mongoURI(t), mongo.DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		session.DB(name).DropDatabase()
+		session.Close()
+	})
+	return session
+}
+
+// Driver returns a connection to the database name of the server of
+// MONGODB_TEST_URI, dropped at the end of t.
+func Driver(t *testing.T, name string) *driver.Conn {
+	t.Helper()
+	ctx := context.Background()
+	conn, err := driver.ConnectTo(ctx, mongoURI(t), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.DB.Drop(ctx)
+		conn.Close()
+	})
+	return conn
+}
+
+// SQLite returns the SQLite database of file name in a directory of t.
+func SQLite(t *testing.T, name string) *sqldb.DB {
+	t.Helper()
+	db, err := sqldb.OpenDSN(context.Background(), sqldb.SQLite, sqldb.SQLiteDSN(filepath.Join(t.TempDir(), name+".db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Postgres returns the server of POSTGRES_TEST_DSN with the schema name as
+// search path, dropped at the end of t.
+func Postgres(t *testing.T, name string) *sqldb.DB {
+	t.Helper()
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN is not set")
+	}
+	ctx := context.Background()
+	admin, err := sqldb.OpenDSN(ctx, sqldb.Postgres, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	if _, err := admin.ExecContext(ctx, "CREATE SCHEMA "+name); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.ExecContext(ctx, "DROP SCHEMA "+name+" CASCADE") })
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	db, err := sqldb.OpenDSN(ctx, sqldb.Postgres, dsn+sep+"search_path="+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
@@ -0,0 +1,61 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	consulsd "github.com/go-kit/kit/sd/consul"
+	"github.com/hashicorp/consul/api"
+)
+
+// Consul discovers passing instances registered with a Consul agent.
+type Consul struct {
+	// Client is the agent client, for other Consul features such as locks.
+	Client *api.Client
+	client consulsd.Client
+	logger log.Logger
+}
+
+// NewConsul returns a Consul talking to the agent at addr, or the default
+// agent if addr is empty.
+func NewConsul(addr string, logger log.Logger) (*Consul, error) {
+	consulConfig := api.DefaultConfig()
+	if len(addr) > 0 {
+		consulConfig.Address = addr
+	}
+	client, err := api.NewClient(consulConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Consul{Client: client, client: consulsd.NewClient(client), logger: logger}, nil
+}
+
+// Instancer implements Discovery.
+func (c *Consul) Instancer(service string) (sd.Instancer, error) {
+	return consulsd.NewInstancer(c.client, c.logger, service, []string{}, true), nil
+}
+
+// Registrar implements Discovery. The agent checks the instance through its
+// HTTP /health/ready endpoint, so that an instance losing its database stops
+// receiving traffic even before it deregisters itself.
+func (c *Consul) Registrar(instance Instance) sd.Registrar {
+	check := &api.AgentServiceCheck{
+		HTTP:     fmt.Sprintf("http://127.0.0.1%v/health/ready", instance.HTTPAddr),
+		Interval: "10s",
+		Timeout:  "3s",
+	}
+	host, strPort, _ := net.SplitHostPort(instance.GRPCAddr)
+	port, _ := strconv.Atoi(strPort)
+	reg := &api.AgentServiceRegistration{
+		Name:    instance.Name,
+		Address: host,
+		Port:    port,
+		ID:      instance.ID,
+		Tags:    []string{"grpc"},
+		Check:   check,
+	}
+	return consulsd.NewRegistrar(c.client, reg, c.logger)
+}
@@ -0,0 +1,34 @@
+// Package discovery finds service instances and registers them, with Consul,
+// a static address list or DNS SRV records.
+package discovery
+
+import (
+	"github.com/go-kit/kit/sd"
+)
+
+// Instance is a running service instance to register.
+type Instance struct {
+	// Name is the service name clients look the instance up by.
+	Name string
+	// ID is unique among the instances of the service.
+	ID string
+	// GRPCAddr is the address clients dial.
+	GRPCAddr string
+	// HTTPAddr serves /health/ready, for discovery backends that check it.
+	HTTPAddr string
+}
+
+// Discovery finds the instances of services and announces this one.
+type Discovery interface {
+	// Instancer returns the instancer of the named service.
+	Instancer(service string) (sd.Instancer, error)
+	// Registrar returns the registrar announcing instance.
+	Registrar(instance Instance) sd.Registrar
+}
+
+// nopRegistrar is the registrar of backends where instances are listed
+// outside of the services, in flags, files or DNS.
+type nopRegistrar struct{}
+
+func (nopRegistrar) Register()   {}
+func (nopRegistrar) Deregister() {}
@@ -0,0 +1,35 @@
+package discovery
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/dnssrv"
+)
+
+// DNSSRV discovers services by polling DNS SRV records, as served by
+// Kubernetes headless services or Consul DNS.
+type DNSSRV struct {
+	nameFormat string
+	ttl        time.Duration
+	logger     log.Logger
+}
+
+// NewDNSSRV returns a DNSSRV looking up fmt.Sprintf(nameFormat, service)
+// every ttl, e.g. "_grpc._tcp.%s.service.consul".
+func NewDNSSRV(nameFormat string, ttl time.Duration, logger log.Logger) DNSSRV {
+	return DNSSRV{nameFormat: nameFormat, ttl: ttl, logger: logger}
+}
+
+// Instancer implements Discovery.
+func (d DNSSRV) Instancer(service string) (sd.Instancer, error) {
+	return dnssrv.NewInstancer(fmt.Sprintf(d.nameFormat, service), d.ttl, d.logger), nil
+}
+
+// Registrar implements Discovery. Records are managed by whoever serves
+// the zone, so there is nothing to register.
+func (d DNSSRV) Registrar(Instance) sd.Registrar {
+	return nopRegistrar{}
+}
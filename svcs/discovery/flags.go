@@ -0,0 +1,62 @@
+package discovery
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Flags are the command line flags selecting and configuring discovery.
+type Flags struct {
+	mode       *string
+	consulAddr *string
+	staticFile *string
+	static     map[string]*string
+	dnsName    *string
+	dnsTTL     *time.Duration
+}
+
+// RegisterFlags defines the discovery flags on fs, with a -<service>.addrs
+// flag for the static addresses of each of services.
+func RegisterFlags(fs *flag.FlagSet, services ...string) *Flags {
+	f := &Flags{
+		mode:       fs.String("discovery", "consul", "Service discovery: consul, static or dns"),
+		consulAddr: fs.String("consul.addr", "localhost:8500", "Consul agent address"),
+		staticFile: fs.String("static.file", "", "YAML file of service addresses for static discovery"),
+		static:     map[string]*string{},
+		dnsName:    fs.String("dns.name", "_grpc._tcp.%s.service.consul", "SRV record of a service for dns discovery, %s is the service name"),
+		dnsTTL:     fs.Duration("dns.ttl", 30*time.Second, "How often SRV records are looked up"),
+	}
+	for _, service := range services {
+		f.static[service] = fs.String(service+".addrs", "", "Comma separated host:port of "+service+" for static discovery")
+	}
+	return f
+}
+
+// New returns the Discovery selected by the flags.
+func (f *Flags) New(logger log.Logger) (Discovery, error) {
+	switch *f.mode {
+	case "consul":
+		return NewConsul(*f.consulAddr, logger)
+	case "static":
+		addrs := map[string][]string{}
+		if *f.staticFile != "" {
+			var err error
+			if addrs, err = LoadStaticFile(*f.staticFile); err != nil {
+				return nil, err
+			}
+		}
+		for service, v := range f.static {
+			if *v != "" {
+				addrs[service] = strings.Split(*v, ",")
+			}
+		}
+		return NewStatic(addrs), nil
+	case "dns":
+		return NewDNSSRV(*f.dnsName, *f.dnsTTL, logger), nil
+	}
+	return nil, fmt.Errorf("discovery: unknown mode %q", *f.mode)
+}
@@ -0,0 +1,50 @@
+package discovery
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-kit/kit/sd"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Static discovers services at fixed addresses, for running without a
+// discovery server.
+type Static struct {
+	addrs map[string][]string
+}
+
+// NewStatic returns a Static serving the addresses of each service, by
+// service name.
+func NewStatic(addrs map[string][]string) Static {
+	return Static{addrs: addrs}
+}
+
+// LoadStaticFile reads service addresses from a YAML file mapping service
+// names to lists of host:port.
+func LoadStaticFile(path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	addrs := map[string][]string{}
+	if err := yaml.UnmarshalStrict(data, &addrs); err != nil {
+		return nil, fmt.Errorf("discovery: %s: %v", path, err)
+	}
+	return addrs, nil
+}
+
+// Instancer implements Discovery.
+func (s Static) Instancer(service string) (sd.Instancer, error) {
+	addrs := s.addrs[service]
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("discovery: no static addresses for %s", service)
+	}
+	return sd.FixedInstancer(addrs), nil
+}
+
+// Registrar implements Discovery. Static instances are listed by their
+// clients, so there is nothing to register.
+func (s Static) Registrar(Instance) sd.Registrar {
+	return nopRegistrar{}
+}
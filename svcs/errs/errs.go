@@ -0,0 +1,272 @@
+// Package errs is the error model shared by the services: errors carry a
+// code telling what went wrong in a way clients can act on, mapped to a gRPC
+// status code and to an HTTP status, and survive the hop from a service to
+// its gRPC clients, so that a client compares the errors it gets with the
+// sentinels of the service as it would in process.
+package errs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Code is the kind of an error.
+type Code string
+
+// The codes of errors. Errors without one are Unknown.
+const (
+	Unknown          Code = "unknown"
+	InvalidArgument  Code = "invalid_argument"
+	NotFound         Code = "not_found"
+	Unauthenticated  Code = "unauthenticated"
+	PermissionDenied Code = "permission_denied"
+	Conflict         Code = "conflict"
+	Unavailable      Code = "unavailable"
+)
+
+// domain is the domain of the errdetails.ErrorInfo of the statuses of
+// errors, telling them from those of gRPC itself.
+const domain = "dabanshan"
+
+var grpcCodes = map[Code]codes.Code{
+	InvalidArgument:  codes.InvalidArgument,
+	NotFound:         codes.NotFound,
+	Unauthenticated:  codes.Unauthenticated,
+	PermissionDenied: codes.PermissionDenied,
+	Conflict:         codes.AlreadyExists,
+	Unavailable:      codes.Unavailable,
+}
+
+var httpStatuses = map[Code]int{
+	InvalidArgument:  http.StatusBadRequest,
+	NotFound:         http.StatusNotFound,
+	Unauthenticated:  http.StatusUnauthorized,
+	PermissionDenied: http.StatusForbidden,
+	Conflict:         http.StatusConflict,
+	Unavailable:      http.StatusServiceUnavailable,
+}
+
+// GRPC returns the gRPC status code of c.
+func (c Code) GRPC() codes.Code {
+	if code, ok := grpcCodes[c]; ok {
+		return code
+	}
+	return codes.Unknown
+}
+
+// HTTPStatus returns the HTTP status of c.
+func (c Code) HTTPStatus() int {
+	if s, ok := httpStatuses[c]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+// Error is an error with a code, encoded in HTTP responses as its JSON.
+type Error struct {
+	Code    Code              `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// WithDetails returns a copy of e with details added, such as the field of
+// an invalid argument. The copy is not e: compare errors by code then.
+func (e *Error) WithDetails(details map[string]string) *Error {
+	c := &Error{Code: e.Code, Message: e.Message, Details: map[string]string{}}
+	for k, v := range e.Details {
+		c.Details[k] = v
+	}
+	for k, v := range details {
+		c.Details[k] = v
+	}
+	return c
+}
+
+// GRPCStatus returns the status grpc-go sends for e, carrying its code in an
+// errdetails.ErrorInfo.
+func (e *Error) GRPCStatus() *status.Status {
+	s := status.New(e.Code.GRPC(), e.Message)
+	info := &errdetails.ErrorInfo{Reason: string(e.Code), Domain: domain, Metadata: e.Details}
+	if withInfo, err := s.WithDetails(info); err == nil {
+		return withInfo
+	}
+	return s
+}
+
+var (
+	mtx       sync.RWMutex
+	sentinels = map[Code]map[string]*Error{}
+)
+
+// New returns a sentinel error, to be declared once in a package variable:
+// errors decoded with the same code and message, and no details, are that
+// variable again. New panics if the code and message are already declared.
+func New(code Code, message string) *Error {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if sentinels[code] == nil {
+		sentinels[code] = map[string]*Error{}
+	}
+	if _, ok := sentinels[code][message]; ok {
+		panic(fmt.Sprintf("errs: %s error %q declared twice", code, message))
+	}
+	e := &Error{Code: code, Message: message}
+	sentinels[code][message] = e
+	return e
+}
+
+// Errorf returns an error of code with a formatted message, for errors
+// telling more than a sentinel would.
+func Errorf(code Code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// sentinel returns the sentinel e was encoded from, or e.
+func sentinel(e *Error) *Error {
+	if len(e.Details) > 0 {
+		return e
+	}
+	mtx.RLock()
+	defer mtx.RUnlock()
+	if s, ok := sentinels[e.Code][e.Message]; ok {
+		return s
+	}
+	return e
+}
+
+// From returns err as an *Error: itself if it is one, or else an error of
+// the code and message of its gRPC status, Unknown for errors of no status.
+func From(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	if s, ok := status.FromError(err); ok && s.Code() != codes.Unknown {
+		return &Error{Code: CodeOf(err), Message: s.Message()}
+	}
+	return &Error{Code: CodeOf(err), Message: err.Error()}
+}
+
+// CodeOf returns the code of err.
+func CodeOf(err error) Code {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	if err == context.DeadlineExceeded {
+		return Unavailable
+	}
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.OutOfRange:
+		return InvalidArgument
+	case codes.NotFound:
+		return NotFound
+	case codes.Unauthenticated:
+		return Unauthenticated
+	case codes.PermissionDenied:
+		return PermissionDenied
+	case codes.AlreadyExists, codes.Aborted:
+		return Conflict
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded:
+		return Unavailable
+	}
+	return Unknown
+}
+
+// HTTPStatus returns the HTTP status of err.
+func HTTPStatus(err error) int {
+	return CodeOf(err).HTTPStatus()
+}
+
+// FromGRPC returns the error a service sent as the status err, the sentinel
+// it was if any. Errors of other statuses, those of gRPC itself, are
+// returned as they are.
+func FromGRPC(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, d := range s.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Domain == domain {
+			return sentinel(&Error{Code: Code(info.Reason), Message: s.Message(), Details: info.Metadata})
+		}
+	}
+	return err
+}
+
+// ClientMiddleware decodes the errors of a gRPC client endpoint with
+// FromGRPC. It goes right after the endpoint, before tracing or circuit
+// breaking middlewares look at its errors.
+func ClientMiddleware(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		response, err := next(ctx, request)
+		return response, FromGRPC(err)
+	}
+}
+
+// Encode encodes err for the err fields of pb messages, "" for nil.
+func Encode(err error) string {
+	if err == nil {
+		return ""
+	}
+	e, ok := err.(*Error)
+	if !ok {
+		return err.Error()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return e.Message
+	}
+	return string(b)
+}
+
+// Decode decodes an err field encoded by Encode, nil for "".
+func Decode(s string) error {
+	if s == "" {
+		return nil
+	}
+	if strings.HasPrefix(s, "{") {
+		var e Error
+		if err := json.Unmarshal([]byte(s), &e); err == nil && e.Code != "" {
+			return sentinel(&e)
+		}
+	}
+	return errors.New(s)
+}
+
+// errInternal is written to HTTP clients in place of Unknown errors.
+var errInternal = New(Unknown, "internal error")
+
+// EncodeHTTP is a go-kit transport/http.ErrorEncoder writing err as the JSON
+// of From(err), with the status of its code. Unknown errors, whose text may
+// be that of a driver or of the internals of a service, are written as
+// "internal error" and logged with logging.FromContext.
+func EncodeHTTP(ctx context.Context, err error, w http.ResponseWriter) {
+	e := From(err)
+	if e.Code == Unknown {
+		logging.FromContext(ctx).Log("err", err)
+		e = errInternal
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(e.Code.HTTPStatus())
+	json.NewEncoder(w).Encode(e)
+}
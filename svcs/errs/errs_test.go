@@ -0,0 +1,190 @@
+package errs_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
+	"github.com/laidingqing/dabanshan-go/svcs/order/service"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+var allCodes = []struct {
+	code   errs.Code
+	grpc   codes.Code
+	status int
+}{
+	{errs.InvalidArgument, codes.InvalidArgument, http.StatusBadRequest},
+	{errs.NotFound, codes.NotFound, http.StatusNotFound},
+	{errs.Unauthenticated, codes.Unauthenticated, http.StatusUnauthorized},
+	{errs.PermissionDenied, codes.PermissionDenied, http.StatusForbidden},
+	{errs.Conflict, codes.AlreadyExists, http.StatusConflict},
+	{errs.Unavailable, codes.Unavailable, http.StatusServiceUnavailable},
+	{errs.Unknown, codes.Unknown, http.StatusInternalServerError},
+}
+
+// sentinels are declared as a service would, one per code.
+var sentinels = map[errs.Code]*errs.Error{}
+
+func init() {
+	for _, c := range allCodes {
+		sentinels[c.code] = errs.New(c.code, "errs test "+string(c.code))
+	}
+}
+
+// overTheWire returns err as a gRPC client gets it: the status grpc-go makes
+// of it, marshaled and unmarshaled.
+func overTheWire(t *testing.T, err error) error {
+	t.Helper()
+	b, merr := proto.Marshal(status.Convert(err).Proto())
+	if merr != nil {
+		t.Fatal(merr)
+	}
+	var s spb.Status
+	if merr := proto.Unmarshal(b, &s); merr != nil {
+		t.Fatal(merr)
+	}
+	return status.ErrorProto(&s)
+}
+
+func TestGRPCRoundTrip(t *testing.T) {
+	for _, c := range allCodes {
+		sent := sentinels[c.code]
+		got := overTheWire(t, sent)
+		if status.Code(got) != c.grpc {
+			t.Errorf("%s: gRPC code %v, want %v", c.code, status.Code(got), c.grpc)
+		}
+		if got := errs.FromGRPC(got); got != sent || !errors.Is(got, sent) {
+			t.Errorf("%s: FromGRPC = %#v, want the sentinel", c.code, got)
+		}
+		client := errs.ClientMiddleware(func(context.Context, interface{}) (interface{}, error) {
+			return nil, got
+		})
+		if _, err := client(context.Background(), nil); err != sent {
+			t.Errorf("%s: ClientMiddleware = %#v, want the sentinel", c.code, err)
+		}
+		if got := errs.HTTPStatus(errs.FromGRPC(got)); got != c.status {
+			t.Errorf("%s: HTTP status %d, want %d", c.code, got, c.status)
+		}
+	}
+}
+
+func TestServiceSentinel(t *testing.T) {
+	got := errs.FromGRPC(overTheWire(t, service.ErrOrderNotFound))
+	if !errors.Is(got, service.ErrOrderNotFound) || errs.HTTPStatus(got) != http.StatusNotFound {
+		t.Errorf("got %#v, status %d", got, errs.HTTPStatus(got))
+	}
+	got = errs.Decode(errs.Encode(service.ErrCartItemForbidden))
+	if !errors.Is(got, service.ErrCartItemForbidden) || errs.HTTPStatus(got) != http.StatusForbidden {
+		t.Errorf("pb err field: got %#v, status %d", got, errs.HTTPStatus(got))
+	}
+}
+
+func TestDetails(t *testing.T) {
+	sent := sentinels[errs.InvalidArgument].WithDetails(map[string]string{"field": "quantity"})
+	for name, got := range map[string]error{
+		"gRPC":     errs.FromGRPC(overTheWire(t, sent)),
+		"pb field": errs.Decode(errs.Encode(sent)),
+	} {
+		e, ok := got.(*errs.Error)
+		if !ok || e == sent || e.Code != errs.InvalidArgument || e.Details["field"] != "quantity" {
+			t.Errorf("%s: got %#v, want a copy with the details", name, got)
+		}
+	}
+}
+
+func TestPBField(t *testing.T) {
+	if errs.Encode(nil) != "" || errs.Decode("") != nil {
+		t.Error("nil is not encoded as an empty field")
+	}
+	for _, c := range allCodes {
+		sent := sentinels[c.code]
+		if got := errs.Decode(errs.Encode(sent)); got != sent {
+			t.Errorf("%s: decoded %#v, want the sentinel", c.code, got)
+		}
+	}
+	// errors of no code keep their text, as before codes
+	if got := errs.Decode(errs.Encode(errors.New("db down"))); got.Error() != "db down" || errs.CodeOf(got) != errs.Unknown {
+		t.Errorf("plain error: %#v", got)
+	}
+	// and so do messages of the same code and text not declared
+	got := errs.Decode(errs.Encode(errs.Errorf(errs.NotFound, "no order %s", "o1")))
+	if e, ok := got.(*errs.Error); !ok || e.Code != errs.NotFound || e.Message != "no order o1" {
+		t.Errorf("undeclared error: %#v", got)
+	}
+}
+
+func TestGRPCStatuses(t *testing.T) {
+	// statuses of gRPC itself are not errors of a service
+	for _, tc := range []struct {
+		grpc codes.Code
+		code errs.Code
+	}{
+		{codes.InvalidArgument, errs.InvalidArgument},
+		{codes.OutOfRange, errs.InvalidArgument},
+		{codes.NotFound, errs.NotFound},
+		{codes.Unauthenticated, errs.Unauthenticated},
+		{codes.PermissionDenied, errs.PermissionDenied},
+		{codes.AlreadyExists, errs.Conflict},
+		{codes.Aborted, errs.Conflict},
+		{codes.Unavailable, errs.Unavailable},
+		{codes.ResourceExhausted, errs.Unavailable},
+		{codes.DeadlineExceeded, errs.Unavailable},
+		{codes.Internal, errs.Unknown},
+	} {
+		err := status.Error(tc.grpc, "transport")
+		if got := errs.FromGRPC(err); got != err {
+			t.Errorf("%v: FromGRPC = %#v, want the status", tc.grpc, got)
+		}
+		if got := errs.CodeOf(err); got != tc.code {
+			t.Errorf("%v: code %s, want %s", tc.grpc, got, tc.code)
+		}
+	}
+	if got := errs.CodeOf(context.DeadlineExceeded); got != errs.Unavailable {
+		t.Errorf("deadline: code %s", got)
+	}
+}
+
+func TestEncodeHTTP(t *testing.T) {
+	var logged bytes.Buffer
+	prev := logging.Default()
+	logging.SetDefault(log.NewLogfmtLogger(&logged))
+	t.Cleanup(func() { logging.SetDefault(prev) })
+
+	for _, tc := range []struct {
+		err         error
+		status      int
+		code, text  string
+		logsTheText bool
+	}{
+		{service.ErrOrderNotFound, http.StatusNotFound, "not_found", "not found order", false},
+		{status.Error(codes.PermissionDenied, "not yours"), http.StatusForbidden, "permission_denied", "not yours", false},
+		{errors.New("pq: relation \"orders\" does not exist"), http.StatusInternalServerError, "unknown", "internal error", true},
+		{status.Error(codes.Internal, "mongo: no reachable servers"), http.StatusInternalServerError, "unknown", "internal error", true},
+	} {
+		logged.Reset()
+		rec := httptest.NewRecorder()
+		errs.EncodeHTTP(context.Background(), tc.err, rec)
+		var body errs.Error
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != tc.status || string(body.Code) != tc.code || body.Message != tc.text {
+			t.Errorf("%v: %d %+v, want %d %s %q", tc.err, rec.Code, body, tc.status, tc.code, tc.text)
+		}
+		if got := strings.Contains(logged.String(), "does not exist") || strings.Contains(logged.String(), "no reachable"); got != tc.logsTheText {
+			t.Errorf("%v: logged %q", tc.err, logged.String())
+		}
+	}
+}
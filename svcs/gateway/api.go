@@ -0,0 +1,98 @@
+package gateway
+
+import (
+	"github.com/laidingqing/dabanshan-go/pb"
+	"github.com/laidingqing/dabanshan-go/svcs/gateway/openapi"
+	o_model "github.com/laidingqing/dabanshan-go/svcs/order/model"
+	p_model "github.com/laidingqing/dabanshan-go/svcs/product/model"
+	u_model "github.com/laidingqing/dabanshan-go/svcs/user/model"
+)
+
+// APIVersion is the version of the HTTP API, the prefix of its paths.
+const APIVersion = "v1"
+
+var pageParams = []openapi.Param{
+	{Name: "pageIndex", Type: "integer", Description: "from 1"},
+	{Name: "pageSize", Type: "integer", Description: "up to 100"},
+}
+
+func timeParam(name, description string) openapi.Param {
+	return openapi.Param{Name: name, Description: description + ", RFC 3339 or 2006-01-02"}
+}
+
+// APIOperations describes every route the gateway serves under /api/v1/,
+// with the types its bodies are decoded into and encoded from: requests are
+// the pb messages of the rpcs routed by their google.api.http options, field
+// names as in the proto files, and responses the model types of the services,
+// the shapes of API v1. The spec served at /api/v1/openapi.json and request
+// validation are built from it, and a test keeps it in line with the routers
+// of the services.
+var APIOperations = []openapi.Operation{
+	{Method: "GET", Path: "/api/v1/products/", Tag: "products", Summary: "List products",
+		Query: []openapi.Param{
+			{Name: "userid", Type: "integer"},
+			{Name: "size", Type: "integer"},
+		},
+		Response: p_model.GetProductsResponse{}},
+	{Method: "POST", Path: "/api/v1/products/create", Tag: "products", Summary: "Create a product",
+		Body: pb.CreateProductRequest{}, Required: []string{"name"},
+		Response: p_model.CreateProductResponse{}},
+	{Method: "POST", Path: "/api/v1/products/upload", Tag: "products", Summary: "Upload a product image",
+		File: "file", Response: p_model.UploadProductResponse{}},
+
+	{Method: "GET", Path: "/api/v1/users/{userid}", Tag: "users", Summary: "Get a user",
+		Response: u_model.GetUserResponse{}},
+	{Method: "POST", Path: "/api/v1/users/", Tag: "users", Summary: "Register a user",
+		Body: pb.RegisterRequest{}, Required: []string{"username", "password", "firstname", "lastname"},
+		Response: u_model.RegisterUserResponse{}},
+	{Method: "POST", Path: "/api/v1/users/login", Tag: "users", Summary: "Log in, merging the guest cart of X-Cart-Token",
+		Body: pb.LoginRequest{}, Required: []string{"username", "password"},
+		Response: u_model.LoginResponse{}},
+
+	{Method: "POST", Path: "/api/v1/orders/", Tag: "orders", Summary: "Create an order",
+		Body: pb.CreateOrderRequest{}, Required: []string{"items"},
+		Response: o_model.CreatedOrderResponse{}},
+	{Method: "GET", Path: "/api/v1/orders/", Tag: "orders", Summary: "Search the orders of a user and/or tenant, at least one is required",
+		Query: append([]openapi.Param{
+			{Name: "userid"},
+			{Name: "tenantid"},
+			{Name: "status", Description: "comma separated order statuses"},
+			{Name: "productid", Description: "orders containing a product"},
+			timeParam("from", "created from"),
+			timeParam("to", "created until, a date includes the whole day"),
+			{Name: "minamount", Type: "number"},
+			{Name: "maxamount", Type: "number"},
+			{Name: "sort", Description: "comma separated createdAt, amount or status, - for descending"},
+		}, pageParams...),
+		Response: o_model.GetOrdersResponse{}},
+	{Method: "GET", Path: "/api/v1/orders/{orderid}/", Tag: "orders", Summary: "Get an order",
+		Response: o_model.GetOrderResponse{}},
+	{Method: "GET", Path: "/api/v1/orders/{id}/details", Tag: "orders", Summary: "Get an order with its products, buyer and tenant, for its buyer or tenant",
+		Response: OrderDetails{}, Auth: true},
+	{Method: "GET", Path: "/api/v1/orders/export", Tag: "orders", Summary: "Export the order items of a tenant",
+		Query: []openapi.Param{
+			{Name: "tenantId", Description: "the tenant of the bearer token, by default"},
+			{Name: "format", Enum: []string{"csv", "xlsx"}},
+			timeParam("from", "created from"),
+			timeParam("to", "created until, a date includes the whole day"),
+		},
+		Produces: []string{"text/csv", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"}, Auth: true},
+
+	{Method: "POST", Path: "/api/v1/carts/", Tag: "carts", Summary: "Add to the cart, of the user of the token or of X-Cart-Token",
+		Body: pb.OrderItemRecord{}, Required: []string{"productid", "quantity"},
+		Response: o_model.CreatedCartResponse{}},
+	{Method: "GET", Path: "/api/v1/carts/", Tag: "carts", Summary: "List the cart items, of the user of the token or of X-Cart-Token",
+		Response: o_model.GetCartItemsResponse{}},
+	{Method: "POST", Path: "/api/v1/carts/merge", Tag: "carts", Summary: "Merge the guest cart of X-Cart-Token into the user's cart",
+		Response: o_model.MergeCartResponse{}, Auth: true},
+	{Method: "PUT", Path: "/api/v1/carts/{cartid}/", Tag: "carts", Summary: "Update the quantity of a cart item",
+		Body: pb.UpdateQuantityRequest{}, Required: []string{"quantity"},
+		Response: o_model.UpdateQuantityResponse{}},
+	{Method: "DELETE", Path: "/api/v1/carts/{cartid}/", Tag: "carts", Summary: "Remove a cart item",
+		Response: o_model.RemoveCartItemResponse{}},
+}
+
+// NewAPISpec returns the spec of APIOperations.
+func NewAPISpec() (*openapi.Spec, error) {
+	return openapi.New("dabanshan", APIVersion, APIOperations)
+}
@@ -0,0 +1,167 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	stdopentracing "github.com/opentracing/opentracing-go"
+
+	o_endpoint "github.com/laidingqing/dabanshan-go/svcs/order/endpoint"
+	o_transport "github.com/laidingqing/dabanshan-go/svcs/order/transport"
+	p_endpoint "github.com/laidingqing/dabanshan-go/svcs/product/endpoint"
+	p_transport "github.com/laidingqing/dabanshan-go/svcs/product/transport"
+	u_endpoint "github.com/laidingqing/dabanshan-go/svcs/user/endpoint"
+	u_transport "github.com/laidingqing/dabanshan-go/svcs/user/transport"
+)
+
+// routes lists the routes of the handlers the gateway mounts under /api/v1/,
+// as "METHOD path". Routes without a handler are not served.
+func routes(t *testing.T) []string {
+	tracer := stdopentracing.GlobalTracer()
+	logger := log.NewNopLogger()
+	orders := o_transport.NewHTTPHandler(o_endpoint.Set{}, nil, tracer, logger)
+	handlers := []http.Handler{
+		p_transport.NewHTTPHandler(p_endpoint.Set{}, tracer, logger),
+		u_transport.NewHTTPHandler(u_endpoint.Set{}, tracer, logger),
+		orders,
+		NewOrderDetailsHandler(endpoint.Nop, orders, tracer, logger),
+	}
+	seen := map[string]bool{}
+	for _, h := range handlers {
+		router, ok := h.(*mux.Router)
+		if !ok {
+			t.Fatalf("handler %T is not a router", h)
+		}
+		err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+			path, err := route.GetPathTemplate()
+			if err != nil || !strings.HasPrefix(path, "/api/"+APIVersion+"/") || route.GetHandler() == nil {
+				return nil
+			}
+			methods, err := route.GetMethods()
+			if err != nil {
+				return nil
+			}
+			for _, m := range methods {
+				seen[m+" "+path] = true
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var list []string
+	for r := range seen {
+		list = append(list, r)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func TestSpecMatchesRoutes(t *testing.T) {
+	spec, err := NewAPISpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	documented := map[string]bool{}
+	for _, op := range spec.Operations() {
+		documented[op.ID()] = true
+	}
+	served := map[string]bool{}
+	for _, r := range routes(t) {
+		served[r] = true
+		if !documented[r] {
+			t.Errorf("route %s is missing from APIOperations", r)
+		}
+	}
+	for id := range documented {
+		if !served[id] {
+			t.Errorf("operation %s of APIOperations has no route", id)
+		}
+	}
+}
+
+func TestSpecDocument(t *testing.T) {
+	spec, err := NewAPISpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	spec.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/openapi.json", nil))
+	var doc struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("document is not JSON: %v", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("openapi = %q", doc.OpenAPI)
+	}
+	for _, name := range []string{"pb.RegisterRequest", "pb.CreateProductRequest", "order.Invoice", "gateway.OrderDetails"} {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("schema %s missing", name)
+		}
+	}
+	// Every reference resolves.
+	for _, ref := range strings.Split(rec.Body.String(), `"$ref": "#/components/schemas/`)[1:] {
+		name := ref[:strings.Index(ref, `"`)]
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("dangling reference to %s", name)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	spec, err := NewAPISpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	h := spec.Validate(1 << 20)(ok)
+	for _, tc := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{"POST", "/api/v1/users/", `{"username":"u","password":"p","firstname":"f","lastname":"l"}`, http.StatusOK},
+		{"POST", "/api/v1/users/", `{"username":"u","password":"p","firstName":"f","lastName":"l"}`, http.StatusOK},
+		{"POST", "/api/v1/users/", `{"username":"u","password":"p"}`, http.StatusBadRequest},
+		{"POST", "/api/v1/users/", `{"username":1,"password":"p","firstname":"f","lastname":"l"}`, http.StatusBadRequest},
+		{"POST", "/api/v1/users/login", `{"username":"u","password":"p"}`, http.StatusOK},
+		{"POST", "/api/v1/users/login", `not json`, http.StatusBadRequest},
+		{"PUT", "/api/v1/carts/c1/", `{"quantity":2}`, http.StatusOK},
+		{"PUT", "/api/v1/carts/c1/", `{"quantity":2.5}`, http.StatusBadRequest},
+		{"POST", "/api/v1/orders/", `{"items":[{"productid":"p1","quantity":1,"price":9.9}]}`, http.StatusOK},
+		{"POST", "/api/v1/orders/", `{"items":{}}`, http.StatusBadRequest},
+		{"POST", "/api/v1/orders/", `{"amount":9.9}`, http.StatusBadRequest},
+		{"GET", "/api/v1/orders/?userid=u1&pageSize=10", "", http.StatusOK},
+		{"GET", "/api/v1/orders/?userid=u1&pageSize=ten", "", http.StatusBadRequest},
+		{"POST", "/api/v1/carts/", `{"productid":"p1","quantity":1}`, http.StatusOK},
+		{"POST", "/api/v1/carts/", `{"productid":"p1"}`, http.StatusBadRequest},
+		{"GET", "/api/v1/orders/export?format=csv", "", http.StatusOK},
+		{"GET", "/api/v1/orders/export?tenantId=t1&format=pdf", "", http.StatusBadRequest},
+		{"GET", "/api/v1/orders/export?tenantId=t1&format=xlsx", "", http.StatusOK},
+		{"GET", "/api/v1/unknown", "", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, tc.target, bytes.NewReader([]byte(tc.body)))
+		if tc.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s %s %s: status %d, want %d (%s)", tc.method, tc.target, tc.body, rec.Code, tc.want, rec.Body.String())
+		}
+	}
+}
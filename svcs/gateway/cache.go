@@ -0,0 +1,366 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// TenantHeader carries the tenant of a request to the gateway, for clients
+// that do not pass it as the tenantId query parameter.
+const TenantHeader = "X-Tenant-ID"
+
+// RouteMatch matches requests by method and path prefix.
+type RouteMatch struct {
+	Method     string `yaml:"method"`
+	PathPrefix string `yaml:"pathPrefix"`
+}
+
+func (m RouteMatch) match(r *http.Request) bool {
+	return (m.Method == "" || m.Method == r.Method) && strings.HasPrefix(r.URL.Path, m.PathPrefix)
+}
+
+// CacheRule caches the successful GET responses under PathPrefix for TTL.
+// Only rules for responses that are the same for every user belong here.
+type CacheRule struct {
+	Name       string        `yaml:"name"`
+	PathPrefix string        `yaml:"pathPrefix"`
+	TTL        time.Duration `yaml:"ttl"`
+	// InvalidatedBy are the requests changing the cached data. Once one of
+	// them succeeds the entries of the rule are dropped.
+	InvalidatedBy []RouteMatch `yaml:"invalidatedBy"`
+}
+
+// DefaultCacheRules cache the product catalog, dropped whenever a product
+// changes through the gateway.
+var DefaultCacheRules = []CacheRule{
+	{
+		Name:       "products",
+		PathPrefix: "/api/v1/products/",
+		TTL:        30 * time.Second,
+		InvalidatedBy: []RouteMatch{
+			{Method: "POST", PathPrefix: "/api/v1/products/"},
+			{Method: "PUT", PathPrefix: "/api/v1/products/"},
+			{Method: "DELETE", PathPrefix: "/api/v1/products/"},
+		},
+	},
+}
+
+// CacheMetrics are labelled by rule.
+type CacheMetrics struct {
+	Hits          metrics.Counter
+	Misses        metrics.Counter
+	Invalidations metrics.Counter
+}
+
+type cacheEntry struct {
+	rule    string
+	status  int
+	header  http.Header
+	body    []byte
+	etag    string
+	stored  time.Time
+	expires time.Time
+}
+
+// ResponseCache keeps responses in memory, keyed by rule, path, query and
+// tenant.
+type ResponseCache struct {
+	mtx     sync.RWMutex
+	rules   []CacheRule
+	entries map[string]*cacheEntry
+	// generations counts the invalidations of each rule, so that responses
+	// fetched across one are not stored.
+	generations map[string]uint64
+	maxEntries  int
+	maxBody     int
+	metrics     CacheMetrics
+}
+
+// NewResponseCache returns a ResponseCache for rules holding up to
+// maxEntries responses of at most maxBody bytes each.
+func NewResponseCache(rules []CacheRule, maxEntries, maxBody int, m CacheMetrics) *ResponseCache {
+	return &ResponseCache{
+		rules:       rules,
+		entries:     map[string]*cacheEntry{},
+		generations: map[string]uint64{},
+		maxEntries:  maxEntries,
+		maxBody:     maxBody,
+		metrics:     m,
+	}
+}
+
+// Invalidate drops the entries of the named rule.
+func (c *ResponseCache) Invalidate(rule string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.generations[rule]++
+	for key, e := range c.entries {
+		if e.rule == rule {
+			delete(c.entries, key)
+		}
+	}
+	c.metrics.Invalidations.With("rule", rule).Add(1)
+}
+
+// ServeHTTP invalidates the rule named by the rule query parameter on POST,
+// for the debug listener and for services announcing changes.
+func (c *ResponseCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rule := r.URL.Query().Get("rule")
+	if _, ok := c.rule(rule); !ok {
+		http.Error(w, "unknown cache rule", http.StatusNotFound)
+		return
+	}
+	c.Invalidate(rule)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *ResponseCache) rule(name string) (CacheRule, bool) {
+	for _, rule := range c.rules {
+		if rule.Name == name {
+			return rule, true
+		}
+	}
+	return CacheRule{}, false
+}
+
+// Middleware serves cached responses, with ETags answered by 304 Not
+// Modified, and invalidates rules after the requests changing their data.
+func (c *ResponseCache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			c.serveChange(next, w, r)
+			return
+		}
+		var (
+			rule CacheRule
+			ok   bool
+		)
+		for _, candidate := range c.rules {
+			if strings.HasPrefix(r.URL.Path, candidate.PathPrefix) {
+				rule, ok = candidate, true
+				break
+			}
+		}
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := cacheKey(rule, r)
+		now := time.Now()
+		c.mtx.RLock()
+		e, hit := c.entries[key]
+		generation := c.generations[rule.Name]
+		c.mtx.RUnlock()
+		if hit && now.Before(e.expires) {
+			c.metrics.Hits.With("rule", rule.Name).Add(1)
+			writeEntry(w, r, e, now, "HIT")
+			return
+		}
+		c.metrics.Misses.With("rule", rule.Name).Add(1)
+
+		rec := &responseRecorder{w: w, maxBody: c.maxBody, header: http.Header{}, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.passed {
+			return
+		}
+		e = &cacheEntry{
+			rule:    rule.Name,
+			status:  rec.status,
+			header:  rec.header,
+			body:    rec.body.Bytes(),
+			stored:  now,
+			expires: now.Add(rule.TTL),
+		}
+		if e.status == http.StatusOK {
+			sum := sha1.Sum(e.body)
+			e.etag = `"` + hex.EncodeToString(sum[:10]) + `"`
+			if c.cacheable(e) {
+				c.store(key, e, generation)
+			}
+		}
+		writeEntry(w, r, e, now, "MISS")
+	})
+}
+
+// serveChange passes a request on and invalidates the rules it changes, if
+// it succeeded.
+func (c *ResponseCache) serveChange(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	var invalidated []string
+	for _, rule := range c.rules {
+		for _, m := range rule.InvalidatedBy {
+			if m.match(r) {
+				invalidated = append(invalidated, rule.Name)
+				break
+			}
+		}
+	}
+	if len(invalidated) == 0 {
+		next.ServeHTTP(w, r)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(sw, r)
+	if sw.status < 400 {
+		for _, rule := range invalidated {
+			c.Invalidate(rule)
+		}
+	}
+}
+
+func (c *ResponseCache) cacheable(e *cacheEntry) bool {
+	if e.header.Get("Set-Cookie") != "" {
+		return false
+	}
+	cc := e.header.Get("Cache-Control")
+	return !strings.Contains(cc, "no-store") && !strings.Contains(cc, "private")
+}
+
+// store stores e, fetched at generation of its rule, unless the rule was
+// invalidated since: e may then predate the change.
+func (c *ResponseCache) store(key string, e *cacheEntry, generation uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.generations[e.rule] != generation {
+		return
+	}
+	if len(c.entries) >= c.maxEntries {
+		for k, old := range c.entries {
+			if e.stored.After(old.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// Still full of fresh entries: make room at random.
+		for k := range c.entries {
+			if len(c.entries) < c.maxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = e
+}
+
+// cacheKey is the rule with the path, the query in canonical order and the
+// tenant of r.
+func cacheKey(rule CacheRule, r *http.Request) string {
+	query := r.URL.Query()
+	tenant := r.Header.Get(TenantHeader)
+	if tenant == "" {
+		tenant = query.Get("tenantId")
+	}
+	return rule.Name + "|" + r.URL.Path + "?" + query.Encode() + "|" + tenant
+}
+
+func writeEntry(w http.ResponseWriter, r *http.Request, e *cacheEntry, now time.Time, state string) {
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = v
+	}
+	h.Set("X-Cache", state)
+	if e.etag == "" {
+		w.WriteHeader(e.status)
+		w.Write(e.body)
+		return
+	}
+	h.Set("ETag", e.etag)
+	h.Set("Age", strconv.Itoa(int(now.Sub(e.stored).Seconds())))
+	if etagMatch(r.Header.Get("If-None-Match"), e.etag) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// responseRecorder holds a response back, to be stored before it is sent.
+// A response growing past maxBody, or flushed, cannot be stored: what was
+// held back is written to w and the rest passes through.
+type responseRecorder struct {
+	w       http.ResponseWriter
+	maxBody int
+	header  http.Header
+	status  int
+	body    bytes.Buffer
+	passed  bool
+}
+
+func (r *responseRecorder) Header() http.Header {
+	if r.passed {
+		return r.w.Header()
+	}
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.passed {
+		r.status = status
+	}
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if !r.passed && r.body.Len()+len(b) > r.maxBody {
+		r.pass()
+	}
+	if r.passed {
+		return r.w.Write(b)
+	}
+	return r.body.Write(b)
+}
+
+// Flush passes the response through, for streamed responses.
+func (r *responseRecorder) Flush() {
+	r.pass()
+	if f, ok := r.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// pass writes what was held back to w, once.
+func (r *responseRecorder) pass() {
+	if r.passed {
+		return
+	}
+	r.passed = true
+	h := r.w.Header()
+	for k, v := range r.header {
+		h[k] = v
+	}
+	h.Set("X-Cache", "MISS")
+	r.w.WriteHeader(r.status)
+	r.w.Write(r.body.Bytes())
+	r.body = bytes.Buffer{}
+}
+
+// statusWriter records the status of a response it passes through.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
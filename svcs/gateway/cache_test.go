@@ -0,0 +1,122 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+var discardCacheMetrics = CacheMetrics{
+	Hits:          discard.NewCounter(),
+	Misses:        discard.NewCounter(),
+	Invalidations: discard.NewCounter(),
+}
+
+// catalog serves the version of the products, bumped by POST.
+type catalog struct {
+	version int32
+	// fetching, if not nil, is called as a GET is served.
+	fetching func()
+}
+
+func (c *catalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		atomic.AddInt32(&c.version, 1)
+		return
+	}
+	v := atomic.LoadInt32(&c.version)
+	if c.fetching != nil {
+		c.fetching()
+	}
+	fmt.Fprintf(w, "v%d", v)
+}
+
+func cacheGet(t *testing.T, h http.Handler, etag string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/api/v1/products/", nil)
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestCache(t *testing.T) {
+	products := &catalog{}
+	h := NewResponseCache(DefaultCacheRules, 10, 1<<10, discardCacheMetrics).Middleware(products)
+
+	rec := cacheGet(t, h, "")
+	if rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "v0" {
+		t.Fatalf("first GET: %s %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	etag := rec.Header().Get("ETag")
+	if rec = cacheGet(t, h, ""); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "v0" {
+		t.Errorf("second GET: %s %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if rec = cacheGet(t, h, etag); rec.Code != http.StatusNotModified {
+		t.Errorf("GET with the ETag: status %d", rec.Code)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/v1/products/create", nil))
+	if rec = cacheGet(t, h, ""); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "v1" {
+		t.Errorf("GET after a change: %s %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
+
+func TestCacheInvalidatedWhileFetching(t *testing.T) {
+	products := &catalog{}
+	cache := NewResponseCache(DefaultCacheRules, 10, 1<<10, discardCacheMetrics)
+	h := cache.Middleware(products)
+
+	// The product changes while v0 is on its way back.
+	products.fetching = func() {
+		products.fetching = nil
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/v1/products/create", nil))
+	}
+	if rec := cacheGet(t, h, ""); rec.Body.String() != "v0" {
+		t.Fatalf("GET across the change: %q", rec.Body.String())
+	}
+	if rec := cacheGet(t, h, ""); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "v1" {
+		t.Errorf("GET after the change: %s %q, the stale response was stored", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
+
+func TestCacheExpires(t *testing.T) {
+	rules := []CacheRule{{Name: "products", PathPrefix: "/api/v1/products/", TTL: time.Nanosecond}}
+	h := NewResponseCache(rules, 10, 1<<10, discardCacheMetrics).Middleware(&catalog{})
+	cacheGet(t, h, "")
+	time.Sleep(time.Millisecond)
+	if rec := cacheGet(t, h, ""); rec.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("GET past the TTL: %s", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestCacheLargeResponse(t *testing.T) {
+	var calls int
+	h := NewResponseCache(DefaultCacheRules, 10, 8, discardCacheMetrics).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("01234"))
+		w.Write([]byte("56789"))
+		// the response passed maxBody: it is on its way rather than held back
+		if rec := w.(*responseRecorder).w.(*httptest.ResponseRecorder); rec.Body.String() != "0123456789" {
+			t.Errorf("written before the end of the response: %q", rec.Body.String())
+		}
+		w.Write([]byte("abc"))
+	}))
+	for i := 1; i <= 2; i++ {
+		rec := cacheGet(t, h, "")
+		if rec.Code != http.StatusOK || rec.Body.String() != "0123456789abc" || rec.Header().Get("X-Cache") != "MISS" || rec.Header().Get("Content-Type") != "text/plain" {
+			t.Errorf("GET %d: %d %s %q %v", i, rec.Code, rec.Header().Get("X-Cache"), rec.Body.String(), rec.Header())
+		}
+		if calls != i {
+			t.Errorf("GET %d: %d calls, want the response not stored", i, calls)
+		}
+	}
+}
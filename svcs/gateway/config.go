@@ -0,0 +1,117 @@
+package gateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config overrides the policies of the route table. It is read from YAML:
+//
+//	defaults:
+//	  retryMax: 3
+//	  timeout: 500ms
+//	  attemptTimeout: 200ms
+//	routes:
+//	  ordersvc.CreateOrder:
+//	    timeout: 2s
+//	    auth: true
+//	cors:
+//	  - pathPrefix: /
+//	    allowedOrigins: [https://shop.example.com]
+//	    allowCredentials: true
+//	    allowedMethods: [GET, POST, PUT, DELETE]
+//	cache:
+//	  - name: products
+//	    pathPrefix: /api/v1/products/
+//	    ttl: 30s
+//	    invalidatedBy:
+//	      - {method: POST, pathPrefix: /api/v1/products/}
+//	upstreams:
+//	  ordersvc:
+//	    maxInFlight: 200
+//	    breakerFailures: 5
+//	    breakerOpen: 30s
+//	rateLimits:
+//	  - name: login
+//	    method: POST
+//	    pathPrefix: /api/v1/users/login
+//	    perIP: {rate: 0.2, burst: 5}
+//
+// Settings under routes win over defaults, which win over the table.
+// rateLimits, cors and cache, when given, replace the defaults. An entry of upstreams
+// replaces the default upstream policy of its service as a whole.
+type Config struct {
+	Defaults   PolicyConfig              `yaml:"defaults"`
+	Routes     map[string]PolicyConfig   `yaml:"routes"`
+	RateLimits []RateGroup               `yaml:"rateLimits"`
+	Upstreams  map[string]UpstreamPolicy `yaml:"upstreams"`
+	CORS       []CORS                    `yaml:"cors"`
+	Cache      []CacheRule               `yaml:"cache"`
+}
+
+// PolicyConfig holds the Policy settings given in a config file, nil when
+// not set.
+type PolicyConfig struct {
+	RetryMax       *int           `yaml:"retryMax"`
+	Timeout        *time.Duration `yaml:"timeout"`
+	AttemptTimeout *time.Duration `yaml:"attemptTimeout"`
+	Auth           *bool          `yaml:"auth"`
+}
+
+// LoadConfig reads a Config from the YAML file at path.
+func LoadConfig(path string) (Config, error) {
+	var c Config
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return c, fmt.Errorf("gateway: %s: %v", path, err)
+	}
+	for _, cors := range c.CORS {
+		if err := cors.Validate(); err != nil {
+			return c, fmt.Errorf("%v, in %s", err, path)
+		}
+	}
+	return c, nil
+}
+
+// Apply returns routes with the policies of c. Unknown route names are an
+// error so that typos do not go unnoticed.
+func (c Config) Apply(routes []Route) ([]Route, error) {
+	known := map[string]bool{}
+	applied := make([]Route, len(routes))
+	for i, r := range routes {
+		known[r.Name()] = true
+		r.Policy = c.Defaults.apply(r.Policy)
+		if pc, ok := c.Routes[r.Name()]; ok {
+			r.Policy = pc.apply(r.Policy)
+		}
+		applied[i] = r
+	}
+	for name := range c.Routes {
+		if !known[name] {
+			return nil, fmt.Errorf("gateway: config has unknown route %s", name)
+		}
+	}
+	return applied, nil
+}
+
+func (pc PolicyConfig) apply(p Policy) Policy {
+	if pc.RetryMax != nil {
+		p.RetryMax = *pc.RetryMax
+	}
+	if pc.Timeout != nil {
+		p.Timeout = *pc.Timeout
+	}
+	if pc.AttemptTimeout != nil {
+		p.AttemptTimeout = *pc.AttemptTimeout
+	}
+	if pc.Auth != nil {
+		p.Auth = *pc.Auth
+	}
+	return p
+}
@@ -0,0 +1,196 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS is the cross origin policy of the paths under PathPrefix.
+type CORS struct {
+	PathPrefix string `yaml:"pathPrefix"`
+	// AllowedOrigins are origins such as "https://shop.example.com". "*"
+	// allows any origin and "https://*.example.com" any subdomain.
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+	// AllowCredentials lets browsers send cookies and Authorization. The
+	// origin is then echoed, never "*", and AllowedOrigins must list the
+	// origins: "*" would let any site call the api as its users.
+	AllowCredentials bool          `yaml:"allowCredentials"`
+	AllowedMethods   []string      `yaml:"allowedMethods"`
+	AllowedHeaders   []string      `yaml:"allowedHeaders"`
+	ExposedHeaders   []string      `yaml:"exposedHeaders"`
+	MaxAge           time.Duration `yaml:"maxAge"`
+}
+
+// DefaultCORS returns the policy of every path for origins, allowing the
+// methods and headers used by the web UI and exposing the headers it reads.
+func DefaultCORS(origins []string, credentials bool) CORS {
+	return CORS{
+		PathPrefix:       "/",
+		AllowedOrigins:   origins,
+		AllowCredentials: credentials,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders:   []string{"Origin", "Content-Type", "Authorization", "X-Cart-Token"},
+		ExposedHeaders: []string{
+			"X-Cart-Token", "Content-Disposition", "Retry-After",
+			"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset",
+		},
+		MaxAge: 10 * time.Minute,
+	}
+}
+
+// Validate reports whether c allows credentials to any origin.
+func (c CORS) Validate() error {
+	if !c.AllowCredentials {
+		return nil
+	}
+	if len(c.AllowedOrigins) == 0 {
+		return fmt.Errorf("gateway: cors %s: credentials need a list of allowed origins", c.PathPrefix)
+	}
+	if contains(c.AllowedOrigins, "*") {
+		return fmt.Errorf("gateway: cors %s: credentials cannot be allowed to any origin, *", c.PathPrefix)
+	}
+	return nil
+}
+
+// CORSMiddleware applies the first of policies whose PathPrefix matches each
+// request. Preflight requests are answered here and never reach next;
+// requests from origins that are not allowed get no CORS headers, which
+// makes browsers block them.
+func CORSMiddleware(policies []CORS) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			policy, ok := matchCORS(policies, r.URL.Path)
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+			if !ok || origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			if preflight {
+				h.Add("Vary", "Access-Control-Request-Method")
+				h.Add("Vary", "Access-Control-Request-Headers")
+				policy.preflight(w, r, origin)
+				return
+			}
+			if policy.allowOrigin(origin) {
+				policy.setOrigin(h, origin)
+				if len(policy.ExposedHeaders) > 0 {
+					h.Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func matchCORS(policies []CORS, path string) (CORS, bool) {
+	for _, p := range policies {
+		if strings.HasPrefix(path, p.PathPrefix) {
+			return p, true
+		}
+	}
+	return CORS{}, false
+}
+
+func (c CORS) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	method := r.Header.Get("Access-Control-Request-Method")
+	headers := splitHeaderList(r.Header.Get("Access-Control-Request-Headers"))
+	if !c.allowOrigin(origin) || !c.allowMethod(method) || !c.allowHeaders(headers) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h := w.Header()
+	c.setOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+	if len(headers) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c CORS) setOrigin(h http.Header, origin string) {
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+		return
+	}
+	if contains(c.AllowedOrigins, "*") {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+}
+
+func (c CORS) allowOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if i := strings.Index(allowed, "*"); i >= 0 {
+			prefix, suffix := allowed[:i], allowed[i+1:]
+			if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c CORS) allowMethod(method string) bool {
+	// Simple methods are always allowed by browsers.
+	if method == "GET" || method == "HEAD" || method == "POST" {
+		return true
+	}
+	for _, m := range c.AllowedMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c CORS) allowHeaders(headers []string) bool {
+	if contains(c.AllowedHeaders, "*") {
+		return true
+	}
+	for _, header := range headers {
+		ok := false
+		for _, allowed := range c.AllowedHeaders {
+			if strings.EqualFold(allowed, header) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func splitHeaderList(v string) []string {
+	var headers []string
+	for _, h := range strings.Split(v, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, h)
+		}
+	}
+	return headers
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cors    CORS
+		invalid bool
+	}{
+		{"any origin", CORS{AllowedOrigins: []string{"*"}}, false},
+		{"credentials to listed origins", CORS{AllowedOrigins: []string{"https://shop.example.com", "https://*.example.com"}, AllowCredentials: true}, false},
+		{"credentials to any origin", CORS{AllowedOrigins: []string{"https://shop.example.com", "*"}, AllowCredentials: true}, true},
+		{"credentials to no origin", CORS{AllowCredentials: true}, true},
+	} {
+		if err := tc.cors.Validate(); (err != nil) != tc.invalid {
+			t.Errorf("%s: Validate() = %v", tc.name, err)
+		}
+	}
+}
+
+func corsRequest(method, path, origin string, preflight ...string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	if len(preflight) > 0 {
+		r.Header.Set("Access-Control-Request-Method", preflight[0])
+	}
+	if len(preflight) > 1 {
+		r.Header.Set("Access-Control-Request-Headers", preflight[1])
+	}
+	return r
+}
+
+func TestCORSAllowOrigin(t *testing.T) {
+	c := CORS{AllowedOrigins: []string{"https://shop.example.com", "https://*.example.org"}}
+	for _, tc := range []struct {
+		origin string
+		ok     bool
+	}{
+		{"https://shop.example.com", true},
+		{"HTTPS://SHOP.EXAMPLE.COM", true},
+		{"https://admin.example.com", false},
+		{"http://shop.example.com", false},
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		// the wildcard stands for at least one character, and not for the
+		// domain itself
+		{"https://.example.org", false},
+		{"https://example.org", false},
+		{"https://evil-example.org", false},
+		{"https://a.example.org.evil.com", false},
+	} {
+		if got := c.allowOrigin(tc.origin); got != tc.ok {
+			t.Errorf("%s: allowed %v", tc.origin, got)
+		}
+	}
+	if !(CORS{AllowedOrigins: []string{"*"}}).allowOrigin("https://any.example.net") {
+		t.Error("* did not allow any origin")
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	var reached int
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached++ })
+	h := CORSMiddleware([]CORS{
+		{PathPrefix: "/api/v1/admin/", AllowedOrigins: []string{"https://admin.example.com"}, AllowCredentials: true, AllowedMethods: []string{"DELETE"}},
+		DefaultCORS([]string{"*"}, false),
+	})(next)
+	for _, tc := range []struct {
+		name    string
+		r       *http.Request
+		headers map[string]string
+		reached bool
+	}{
+		{"same origin", corsRequest("GET", "/api/v1/products/", ""),
+			map[string]string{"Access-Control-Allow-Origin": "", "Vary": ""}, true},
+		{"any origin", corsRequest("GET", "/api/v1/products/", "https://shop.example.com"),
+			map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "",
+				"Access-Control-Expose-Headers":    "X-Cart-Token, Content-Disposition, Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset",
+				"Vary":                             "Origin",
+			}, true},
+		{"credentials echo the origin", corsRequest("GET", "/api/v1/admin/orders", "https://admin.example.com"),
+			map[string]string{"Access-Control-Allow-Origin": "https://admin.example.com", "Access-Control-Allow-Credentials": "true"}, true},
+		{"origin not allowed", corsRequest("GET", "/api/v1/admin/orders", "https://shop.example.com"),
+			map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Credentials": ""}, true},
+		{"preflight", corsRequest("OPTIONS", "/api/v1/products/", "https://shop.example.com", "PUT", "content-type, x-cart-token"),
+			map[string]string{
+				"Access-Control-Allow-Origin":  "*",
+				"Access-Control-Allow-Methods": "GET, POST, PUT, DELETE",
+				"Access-Control-Allow-Headers": "content-type, x-cart-token",
+				"Access-Control-Max-Age":       "600",
+			}, false},
+		{"preflight of a header not allowed", corsRequest("OPTIONS", "/api/v1/products/", "https://shop.example.com", "GET", "X-Debug"),
+			map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Methods": ""}, false},
+		{"preflight of a method not allowed", corsRequest("OPTIONS", "/api/v1/products/", "https://shop.example.com", "PATCH"),
+			map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Methods": ""}, false},
+		{"preflight of a simple method", corsRequest("OPTIONS", "/api/v1/admin/orders", "https://admin.example.com", "POST"),
+			map[string]string{"Access-Control-Allow-Origin": "https://admin.example.com", "Access-Control-Allow-Methods": "DELETE"}, false},
+		{"OPTIONS that is no preflight", corsRequest("OPTIONS", "/api/v1/products/", "https://shop.example.com"),
+			map[string]string{"Access-Control-Allow-Origin": "*", "Access-Control-Allow-Methods": ""}, true},
+	} {
+		reached = 0
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, tc.r)
+		for k, want := range tc.headers {
+			if got := rec.Header().Get(k); got != want {
+				t.Errorf("%s: %s %q, want %q", tc.name, k, got, want)
+			}
+		}
+		if (reached == 1) != tc.reached {
+			t.Errorf("%s: reached the handler %d times", tc.name, reached)
+		}
+		if !tc.reached && rec.Code != http.StatusNoContent {
+			t.Errorf("%s: status %d", tc.name, rec.Code)
+		}
+	}
+}
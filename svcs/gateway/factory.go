@@ -0,0 +1,97 @@
+package gateway
+
+import (
+	"context"
+	"io"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc"
+
+	o_model "github.com/laidingqing/dabanshan-go/svcs/order/model"
+	o_service "github.com/laidingqing/dabanshan-go/svcs/order/service"
+	o_transport "github.com/laidingqing/dabanshan-go/svcs/order/transport"
+	p_service "github.com/laidingqing/dabanshan-go/svcs/product/service"
+	p_transport "github.com/laidingqing/dabanshan-go/svcs/product/transport"
+	u_service "github.com/laidingqing/dabanshan-go/svcs/user/service"
+	u_transport "github.com/laidingqing/dabanshan-go/svcs/user/transport"
+)
+
+// ProductFactory returns a factory making a product service endpoint over
+// gRPC.
+func ProductFactory(makeEndpoint func(p_service.Service) endpoint.Endpoint, tracer stdopentracing.Tracer, logger log.Logger) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		conn, err := grpc.Dial(instance, grpc.WithInsecure())
+		if err != nil {
+			return nil, nil, err
+		}
+		service := p_transport.NewGRPCClient(conn, tracer, logger)
+		return makeEndpoint(service), conn, nil
+	}
+}
+
+// UserFactory returns a factory making a user service endpoint over gRPC.
+func UserFactory(makeEndpoint func(u_service.Service) endpoint.Endpoint, tracer stdopentracing.Tracer, logger log.Logger) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		conn, err := grpc.Dial(instance, grpc.WithInsecure())
+		if err != nil {
+			return nil, nil, err
+		}
+		service := u_transport.NewGRPCClient(conn, tracer, logger)
+		return makeEndpoint(service), conn, nil
+	}
+}
+
+// OrderFactory returns a factory making an order service endpoint over gRPC.
+func OrderFactory(makeEndpoint func(o_service.Service) endpoint.Endpoint, tracer stdopentracing.Tracer, logger log.Logger) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		conn, err := grpc.Dial(instance, grpc.WithInsecure())
+		if err != nil {
+			return nil, nil, err
+		}
+		service := o_transport.NewGRPCClient(conn, tracer, logger)
+		return makeEndpoint(service), conn, nil
+	}
+}
+
+// OrderExporterFactory returns a factory whose endpoints return an
+// o_service.Exporter streaming from that instance.
+func OrderExporterFactory(tracer stdopentracing.Tracer, logger log.Logger) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		conn, err := grpc.Dial(instance, grpc.WithInsecure())
+		if err != nil {
+			return nil, nil, err
+		}
+		exporter := o_transport.NewGRPCExporter(conn, tracer, logger)
+		return func(context.Context, interface{}) (interface{}, error) {
+			return exporter, nil
+		}, conn, nil
+	}
+}
+
+// NewBalancedExporter returns an Exporter exporting from an order service
+// instance picked by balancer, whose endpoints come from OrderExporterFactory.
+// Exports stream for as long as the client reads, so no lb.Retry timeout
+// applies.
+func NewBalancedExporter(balancer lb.Balancer) o_service.Exporter {
+	return balancedExporter{balancer}
+}
+
+type balancedExporter struct {
+	balancer lb.Balancer
+}
+
+func (e balancedExporter) ExportOrders(ctx context.Context, req o_model.ExportOrdersRequest, fn func(o_model.OrderExportRow) error) error {
+	ep, err := e.balancer.Endpoint()
+	if err != nil {
+		return err
+	}
+	exporter, err := ep(ctx, req)
+	if err != nil {
+		return err
+	}
+	return exporter.(o_service.Exporter).ExportOrders(ctx, req, fn)
+}
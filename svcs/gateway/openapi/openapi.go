@@ -0,0 +1,334 @@
+// Package openapi describes HTTP APIs as OpenAPI 3 documents, with the
+// schemas of request and response bodies generated from the Go types the
+// handlers decode and encode, and validates requests against them.
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+)
+
+// Version is the OpenAPI version of the documents.
+const Version = "3.0.3"
+
+// Operation describes one route.
+type Operation struct {
+	Method string
+	// Path is the route template, with {name} path parameters.
+	Path    string
+	Summary string
+	Tag     string
+	Query   []Param
+	// Body is a value of the type of the JSON request body, nil if none.
+	Body interface{}
+	// Required lists the body fields a request must have.
+	Required []string
+	// File is the name of the multipart form field of an uploaded file.
+	File string
+	// Response is a value of the type of the JSON response, nil if none.
+	Response interface{}
+	// Produces lists non-JSON response content types.
+	Produces []string
+	// Auth requires a bearer token.
+	Auth bool
+}
+
+// ID is the operationId of o, the method and the path.
+func (o Operation) ID() string {
+	return o.Method + " " + o.Path
+}
+
+// Param is a query parameter.
+type Param struct {
+	Name        string
+	Description string
+	// Type is string, integer, number or boolean; string when empty.
+	Type     string
+	Format   string
+	Enum     []string
+	Required bool
+}
+
+// Document is an OpenAPI document.
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+}
+
+// Info describes the API.
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// PathItem holds the operations of a path by lower case method.
+type PathItem map[string]*OperationObject
+
+// OperationObject is an operation of a Document.
+type OperationObject struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []ParameterObject     `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]Response   `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+// ParameterObject is a path or query parameter.
+type ParameterObject struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// RequestBody is the body of the requests of an operation.
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// Response is a response of an operation.
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// MediaType is the schema of a content type.
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Components holds the schemas referenced by operations.
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+// SecurityScheme is how requests authenticate.
+type SecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme"`
+}
+
+// Spec is a Document with the operations it was built from, to validate
+// requests.
+type Spec struct {
+	Document Document
+	ops      []compiled
+	body     []byte
+}
+
+type compiled struct {
+	op       Operation
+	segments []string
+	object   *OperationObject
+}
+
+// New builds the Spec of ops. Operations are unique by method and path.
+func New(title, version string, ops []Operation) (*Spec, error) {
+	s := &Spec{
+		Document: Document{
+			OpenAPI: Version,
+			Info:    Info{Title: title, Version: version},
+			Paths:   map[string]PathItem{},
+			Components: Components{
+				Schemas: map[string]*Schema{},
+			},
+		},
+	}
+	g := &generator{schemas: s.Document.Components.Schemas}
+	for _, op := range ops {
+		item, ok := s.Document.Paths[op.Path]
+		if !ok {
+			item = PathItem{}
+			s.Document.Paths[op.Path] = item
+		}
+		method := strings.ToLower(op.Method)
+		if _, dup := item[method]; dup {
+			return nil, fmt.Errorf("openapi: duplicate operation %s", op.ID())
+		}
+		object, err := g.operation(op)
+		if err != nil {
+			return nil, err
+		}
+		if op.Auth {
+			s.Document.Components.SecuritySchemes = map[string]SecurityScheme{
+				"bearer": {Type: "http", Scheme: "bearer"},
+			}
+		}
+		item[method] = object
+		s.ops = append(s.ops, compiled{op: op, segments: strings.Split(op.Path, "/"), object: object})
+	}
+	// Literal segments win over parameters, as in the routers.
+	sort.SliceStable(s.ops, func(i, j int) bool {
+		return params(s.ops[i].segments) < params(s.ops[j].segments)
+	})
+	body, err := json.MarshalIndent(s.Document, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	s.body = body
+	return s, nil
+}
+
+// Operations returns the operations of s.
+func (s *Spec) Operations() []Operation {
+	ops := make([]Operation, 0, len(s.ops))
+	for _, c := range s.ops {
+		ops = append(ops, c.op)
+	}
+	return ops
+}
+
+// ServeHTTP serves the Document as JSON.
+func (s *Spec) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(s.body)
+}
+
+// match returns the operation of a request, with its path parameters.
+func (s *Spec) match(method, path string) (*compiled, map[string]string, bool) {
+	segments := strings.Split(path, "/")
+	for i := range s.ops {
+		c := &s.ops[i]
+		if c.op.Method != method || len(c.segments) != len(segments) {
+			continue
+		}
+		vars := map[string]string{}
+		ok := true
+		for k, seg := range c.segments {
+			if name, isParam := paramName(seg); isParam {
+				if segments[k] == "" {
+					ok = false
+					break
+				}
+				vars[name] = segments[k]
+			} else if seg != segments[k] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return c, vars, true
+		}
+	}
+	return nil, nil, false
+}
+
+func (g *generator) operation(op Operation) (*OperationObject, error) {
+	o := &OperationObject{
+		OperationID: op.ID(),
+		Summary:     op.Summary,
+		Responses:   map[string]Response{},
+	}
+	if op.Tag != "" {
+		o.Tags = []string{op.Tag}
+	}
+	for _, seg := range strings.Split(op.Path, "/") {
+		if name, ok := paramName(seg); ok {
+			o.Parameters = append(o.Parameters, ParameterObject{
+				Name:     name,
+				In:       "path",
+				Required: true,
+				Schema:   &Schema{Type: "string"},
+			})
+		}
+	}
+	for _, p := range op.Query {
+		typ := p.Type
+		if typ == "" {
+			typ = "string"
+		}
+		o.Parameters = append(o.Parameters, ParameterObject{
+			Name:        p.Name,
+			In:          "query",
+			Description: p.Description,
+			Required:    p.Required,
+			Schema:      &Schema{Type: typ, Format: p.Format, Enum: p.Enum},
+		})
+	}
+	switch {
+	case op.Body != nil:
+		schema, err := g.schemaOf(op.Body)
+		if err != nil {
+			return nil, fmt.Errorf("openapi: body of %s: %v", op.ID(), err)
+		}
+		if len(op.Required) > 0 {
+			// The body type is shared, the required fields are not.
+			schema = &Schema{AllOf: []*Schema{schema, {Type: "object", Required: op.Required}}}
+		}
+		o.RequestBody = &RequestBody{
+			Required: true,
+			Content:  map[string]MediaType{"application/json": {Schema: schema}},
+		}
+	case op.File != "":
+		o.RequestBody = &RequestBody{
+			Required: true,
+			Content: map[string]MediaType{"multipart/form-data": {Schema: &Schema{
+				Type:       "object",
+				Properties: map[string]*Schema{op.File: {Type: "string", Format: "binary"}},
+				Required:   []string{op.File},
+			}}},
+		}
+	}
+	ok := Response{Description: "OK", Content: map[string]MediaType{}}
+	if op.Response != nil {
+		schema, err := g.schemaOf(op.Response)
+		if err != nil {
+			return nil, fmt.Errorf("openapi: response of %s: %v", op.ID(), err)
+		}
+		ok.Content["application/json"] = MediaType{Schema: schema}
+	}
+	for _, ct := range op.Produces {
+		ok.Content[ct] = MediaType{Schema: &Schema{Type: "string", Format: "binary"}}
+	}
+	o.Responses["200"] = ok
+	o.Responses["default"] = Response{Description: "Error", Content: map[string]MediaType{
+		"application/json": {Schema: errorSchema},
+	}}
+	if op.Auth {
+		o.Security = []map[string][]string{{"bearer": {}}}
+	}
+	return o, nil
+}
+
+// errorSchema is the body of error responses, an errs.Error.
+var errorSchema = &Schema{
+	Type: "object",
+	Properties: map[string]*Schema{
+		"code": {Type: "string", Enum: []string{
+			string(errs.Unknown), string(errs.InvalidArgument), string(errs.NotFound), string(errs.Unauthenticated),
+			string(errs.PermissionDenied), string(errs.Conflict), string(errs.Unavailable),
+		}},
+		"message": {Type: "string"},
+		"details": {Type: "object", AdditionalProperties: &Schema{Type: "string"}},
+	},
+	Required: []string{"code", "message"},
+}
+
+func paramName(segment string) (string, bool) {
+	if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
+
+func params(segments []string) int {
+	n := 0
+	for _, seg := range segments {
+		if _, ok := paramName(seg); ok {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,192 @@
+package openapi
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Schema is a JSON schema, in the OpenAPI subset.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+}
+
+const refPrefix = "#/components/schemas/"
+
+var (
+	timeType  = reflect.TypeOf(time.Time{})
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// generator makes the schemas of Go types as encoding/json encodes them.
+// Named struct types go to schemas and are referenced.
+type generator struct {
+	schemas map[string]*Schema
+	names   map[reflect.Type]string
+}
+
+func (g *generator) schemaOf(v interface{}) (*Schema, error) {
+	return g.schema(reflect.TypeOf(v))
+}
+
+func (g *generator) schema(t reflect.Type) (*Schema, error) {
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}, nil
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return &Schema{Type: "string", Format: "byte"}, nil
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}, nil
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}, nil
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}, nil
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}, nil
+	case reflect.String:
+		return &Schema{Type: "string"}, nil
+	case reflect.Interface:
+		// Anything.
+		return &Schema{}, nil
+	case reflect.Slice, reflect.Array:
+		items, err := g.schema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "array", Items: items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("unsupported map key of %s", t)
+		}
+		values, err := g.schema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "object", AdditionalProperties: values}, nil
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		return g.ref(t)
+	}
+	return nil, fmt.Errorf("unsupported type %s", t)
+}
+
+// ref stores the schema of a named struct type and references it.
+func (g *generator) ref(t reflect.Type) (*Schema, error) {
+	if g.names == nil {
+		g.names = map[reflect.Type]string{}
+	}
+	if name, ok := g.names[t]; ok {
+		return &Schema{Ref: refPrefix + name}, nil
+	}
+	name := schemaName(t)
+	if _, taken := g.schemas[name]; taken {
+		return nil, fmt.Errorf("schema name %s of %s already taken", name, t)
+	}
+	g.names[t] = name
+	// Stored before its fields, so recursive types end in a reference.
+	g.schemas[name] = &Schema{}
+	s, err := g.object(t)
+	if err != nil {
+		return nil, err
+	}
+	*g.schemas[name] = *s
+	return &Schema{Ref: refPrefix + name}, nil
+}
+
+func (g *generator) object(t reflect.Type) (*Schema, error) {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		// Errors carry no information once encoded, they are reported by
+		// the error responses.
+		if f.Type == errorType {
+			continue
+		}
+		name, skip := jsonName(f)
+		if skip {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				embedded, err := g.object(ft)
+				if err != nil {
+					return nil, err
+				}
+				for k, v := range embedded.Properties {
+					if _, ok := s.Properties[k]; !ok {
+						s.Properties[k] = v
+					}
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fs, err := g.schema(f.Type)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", f.Name, err)
+		}
+		if f.Tag.Get("protobuf") != "" {
+			protoInt64(fs)
+		}
+		s.Properties[name] = fs
+	}
+	return s, nil
+}
+
+// protoInt64 retypes the 64 bit integers of a protobuf message field, which
+// jsonpb encodes as strings.
+func protoInt64(s *Schema) {
+	if s.Items != nil {
+		s = s.Items
+	}
+	if s.Type == "integer" && s.Format == "int64" {
+		s.Type = "string"
+	}
+}
+
+// jsonName is the name of f in its json tag, empty for the field name.
+func jsonName(f reflect.StructField) (name string, skip bool) {
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", true
+	}
+	return strings.Split(tag, ",")[0], false
+}
+
+// schemaName names the schema of t by its package, skipping the model
+// package of a service: order.Invoice, gateway.OrderDetails.
+func schemaName(t reflect.Type) string {
+	pkg := t.PkgPath()
+	base := path.Base(pkg)
+	if base == "model" {
+		base = path.Base(path.Dir(pkg))
+	}
+	return base + "." + t.Name()
+}
@@ -0,0 +1,224 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+)
+
+// ValidationError is a request not matching its operation.
+type ValidationError struct {
+	Operation string
+	Reason    string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid request to %s: %s", e.Operation, e.Reason)
+}
+
+// Validate returns a middleware rejecting requests that do not match their
+// operation with 400 Bad Request, and requests with bodies over maxBody bytes
+// with 413, both with an errs.InvalidArgument body. Paths of no operation are passed on for the router to answer.
+func (s *Spec) Validate(maxBody int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, _, ok := s.match(r.Method, r.URL.Path)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			status, err := s.validate(c, w, r, maxBody)
+			if err != nil {
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(status)
+				json.NewEncoder(w).Encode(errs.Errorf(errs.InvalidArgument, "%v", err))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *Spec) validate(c *compiled, w http.ResponseWriter, r *http.Request, maxBody int64) (int, error) {
+	invalid := func(format string, args ...interface{}) (int, error) {
+		return http.StatusBadRequest, &ValidationError{Operation: c.op.ID(), Reason: fmt.Sprintf(format, args...)}
+	}
+	query := r.URL.Query()
+	for _, p := range c.op.Query {
+		v := query.Get(p.Name)
+		if v == "" {
+			if p.Required {
+				return invalid("missing query parameter %s", p.Name)
+			}
+			continue
+		}
+		if err := checkParam(p, v); err != nil {
+			return invalid("query parameter %s: %v", p.Name, err)
+		}
+	}
+	if c.op.File != "" {
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			return invalid("expected a multipart/form-data body")
+		}
+		return 0, nil
+	}
+	if c.op.Body == nil {
+		return 0, nil
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/json") {
+		return invalid("expected a JSON body, got %s", ct)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+	r.Body.Close()
+	if err != nil {
+		if int64(len(body)) >= maxBody {
+			return http.StatusRequestEntityTooLarge, &ValidationError{Operation: c.op.ID(), Reason: "body too large"}
+		}
+		return invalid("reading body: %v", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return invalid("body is not JSON: %v", err)
+	}
+	schema := c.object.RequestBody.Content["application/json"].Schema
+	if err := s.check(schema, v, "body"); err != nil {
+		return invalid("%v", err)
+	}
+	return 0, nil
+}
+
+func checkParam(p Param, v string) error {
+	switch p.Type {
+	case "integer":
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			return fmt.Errorf("%q is not an integer", v)
+		}
+	case "number":
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return fmt.Errorf("%q is not a number", v)
+		}
+	case "boolean":
+		if _, err := strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("%q is not a boolean", v)
+		}
+	}
+	if len(p.Enum) > 0 {
+		for _, e := range p.Enum {
+			if v == e {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", v, strings.Join(p.Enum, ", "))
+	}
+	return nil
+}
+
+// check validates a decoded JSON value against schema. Like encoding/json,
+// field names match case insensitively and unknown fields are allowed.
+func (s *Spec) check(schema *Schema, v interface{}, at string) error {
+	if schema.Ref != "" {
+		return s.check(s.Document.Components.Schemas[strings.TrimPrefix(schema.Ref, refPrefix)], v, at)
+	}
+	for _, sub := range schema.AllOf {
+		if err := s.check(sub, v, at); err != nil {
+			return err
+		}
+	}
+	if v == nil {
+		// null leaves Go values at their zero value.
+		return nil
+	}
+	switch schema.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an object", at)
+		}
+		for _, name := range schema.Required {
+			if _, ok := field(obj, name); !ok {
+				return fmt.Errorf("%s: missing %s", at, name)
+			}
+		}
+		for name, fs := range schema.Properties {
+			if fv, ok := field(obj, name); ok {
+				if err := s.check(fs, fv, at+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+		if schema.AdditionalProperties != nil {
+			for name, fv := range obj {
+				if err := s.check(schema.AdditionalProperties, fv, at+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an array", at)
+		}
+		for i, item := range arr {
+			if err := s.check(schema.Items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if n, ok := v.(json.Number); ok && schema.Format == "int64" {
+			// 64 bit integers of protobuf messages may be numbers too.
+			if _, err := n.Int64(); err != nil {
+				return fmt.Errorf("%s: expected an integer", at)
+			}
+			return nil
+		}
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a string", at)
+		}
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return fmt.Errorf("%s: expected an RFC 3339 time", at)
+			}
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: expected an integer", at)
+		}
+		if _, err := n.Int64(); err != nil {
+			return fmt.Errorf("%s: expected an integer", at)
+		}
+	case "number":
+		if _, ok := v.(json.Number); !ok {
+			return fmt.Errorf("%s: expected a number", at)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: expected a boolean", at)
+		}
+	}
+	return nil
+}
+
+// field looks name up in obj the way encoding/json does, exact match first.
+func field(obj map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := obj[name]; ok {
+		return v, true
+	}
+	for k, v := range obj {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
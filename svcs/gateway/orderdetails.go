@@ -0,0 +1,285 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/go-kit/kit/tracing/opentracing"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/laidingqing/dabanshan-go/svcs/authorize"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
+	o_model "github.com/laidingqing/dabanshan-go/svcs/order/model"
+	p_model "github.com/laidingqing/dabanshan-go/svcs/product/model"
+	u_model "github.com/laidingqing/dabanshan-go/svcs/user/model"
+)
+
+var (
+	// ErrMissingOrderID is returned for order details requests without an id.
+	ErrMissingOrderID = errs.New(errs.InvalidArgument, "missing order id")
+	// ErrOrderDetailsForbidden is returned for the details of an order the
+	// user neither placed nor sold.
+	ErrOrderDetailsForbidden = errs.New(errs.PermissionDenied, "order of another user")
+)
+
+// OrderDetailsEndpoints are the service endpoints an order details view is
+// assembled from.
+type OrderDetailsEndpoints struct {
+	GetOrder         endpoint.Endpoint
+	GetProductsByIDs endpoint.Endpoint
+	GetUser          endpoint.Endpoint
+}
+
+// OrderDetailsRequest asks for the details of an order, on behalf of the
+// user of the bearer token.
+type OrderDetailsRequest struct {
+	OrderID string
+	UserID  string
+}
+
+// OrderDetails is an order with the products, buyer and tenant it refers to.
+// Parts that could not be fetched in time are listed in Missing and left
+// empty, the order itself is always there.
+type OrderDetails struct {
+	InvoiceID int64              `json:"invoiceID"`
+	Amount    float32            `json:"amount"`
+	Discount  float32            `json:"discount"`
+	Status    string             `json:"status"`
+	CreatedAt time.Time          `json:"createdAt"`
+	AddressID string             `json:"addressId"`
+	Buyer     OrderParty         `json:"buyer"`
+	Tenant    OrderParty         `json:"tenant"`
+	Items     []OrderDetailsItem `json:"items"`
+	Partial   bool               `json:"partial"`
+	// Missing names the parts of a partial view: "products", "buyer" or
+	// "tenant".
+	Missing []string `json:"missing,omitempty"`
+}
+
+// OrderParty is a user an order refers to. Tenants are users too.
+type OrderParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// OrderDetailsItem is an order item with its product.
+type OrderDetailsItem struct {
+	ProductID  string   `json:"productID"`
+	Name       string   `json:"name,omitempty"`
+	Thumbnails []string `json:"thumbnails,omitempty"`
+	Quantity   int32    `json:"quantity"`
+	Price      float32  `json:"price"`
+	Total      float32  `json:"total"`
+}
+
+// MakeOrderDetailsEndpoint returns an endpoint fetching an order, then its
+// products, buyer and tenant concurrently. The whole request is bounded by
+// timeout; lookups failing or still running by then leave a partial view
+// rather than failing the request. Only the buyer and the tenant of the order
+// get its details.
+func MakeOrderDetailsEndpoint(e OrderDetailsEndpoints, timeout time.Duration, logger log.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(OrderDetailsRequest)
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		resp, err := e.GetOrder(ctx, o_model.GetOrderRequest{OrderID: req.OrderID})
+		if err != nil {
+			return nil, err
+		}
+		order := resp.(o_model.GetOrderResponse)
+		if order.Err != nil {
+			return nil, order.Err
+		}
+		invoice := order.Order
+		tenantID := invoice.TenantID
+		var productIDs []string
+		seen := map[string]bool{}
+		for _, item := range invoice.OrdereItem {
+			if tenantID == "" {
+				tenantID = item.TenantID
+			}
+			if item.ProductID != "" && !seen[item.ProductID] {
+				seen[item.ProductID] = true
+				productIDs = append(productIDs, item.ProductID)
+			}
+		}
+		if req.UserID == "" || (req.UserID != invoice.UserID && req.UserID != tenantID) {
+			return nil, ErrOrderDetailsForbidden
+		}
+
+		var (
+			wg       sync.WaitGroup
+			products map[string]p_model.Product
+			buyer    *u_model.User
+			tenant   *u_model.User
+			failures = map[string]error{}
+			mtx      sync.Mutex
+		)
+		fail := func(part string, err error) {
+			mtx.Lock()
+			failures[part] = err
+			mtx.Unlock()
+			logging.With(ctx, logger).Log("orderID", req.OrderID, "part", part, "err", err)
+		}
+		if len(productIDs) > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := e.GetProductsByIDs(ctx, p_model.GetProductsByIDsRequest{IDs: productIDs})
+				if err == nil {
+					err = resp.(p_model.GetProductsByIDsResponse).Err
+				}
+				if err != nil {
+					fail("products", err)
+					return
+				}
+				products = map[string]p_model.Product{}
+				for _, p := range resp.(p_model.GetProductsByIDsResponse).Products {
+					products[p.ID] = p
+				}
+			}()
+		}
+		getUser := func(part, id string, user **u_model.User) {
+			defer wg.Done()
+			resp, err := e.GetUser(ctx, u_model.GetUserRequest{A: id})
+			if err == nil {
+				err = resp.(u_model.GetUserResponse).Err
+			}
+			if err != nil {
+				fail(part, err)
+				return
+			}
+			u := resp.(u_model.GetUserResponse).V
+			*user = &u
+		}
+		if invoice.UserID != "" {
+			wg.Add(1)
+			go getUser("buyer", invoice.UserID, &buyer)
+		}
+		if tenantID != "" && tenantID != invoice.UserID {
+			wg.Add(1)
+			go getUser("tenant", tenantID, &tenant)
+		}
+		wg.Wait()
+		if tenantID != "" && tenantID == invoice.UserID {
+			tenant = buyer
+			if err, ok := failures["buyer"]; ok {
+				failures["tenant"] = err
+			}
+		}
+
+		details := OrderDetails{
+			InvoiceID: invoice.InvoiceID,
+			Amount:    invoice.Amount,
+			Discount:  invoice.Discount,
+			Status:    invoice.Status.String(),
+			CreatedAt: invoice.CreatedAt,
+			AddressID: invoice.AddressID,
+			Buyer:     OrderParty{ID: invoice.UserID, Name: userName(buyer)},
+			Tenant:    OrderParty{ID: tenantID, Name: userName(tenant)},
+			Items:     make([]OrderDetailsItem, 0, len(invoice.OrdereItem)),
+		}
+		for _, item := range invoice.OrdereItem {
+			di := OrderDetailsItem{
+				ProductID: item.ProductID,
+				Quantity:  item.Quantity,
+				Price:     item.Price,
+				Total:     item.Total,
+			}
+			if p, ok := products[item.ProductID]; ok {
+				di.Name = p.Name
+				di.Thumbnails = p.Thumbnails
+			}
+			details.Items = append(details.Items, di)
+		}
+		for _, part := range []string{"products", "buyer", "tenant"} {
+			if _, ok := failures[part]; ok {
+				details.Missing = append(details.Missing, part)
+			}
+		}
+		details.Partial = len(details.Missing) > 0
+		return details, nil
+	}
+}
+
+func userName(u *u_model.User) string {
+	if u == nil {
+		return ""
+	}
+	if u.FirstName == "" && u.LastName == "" {
+		return u.Username
+	}
+	// Family name first, as names are written in Chinese.
+	return u.LastName + u.FirstName
+}
+
+// NewOrderDetailsHandler serves GET /api/v1/orders/{id}/details with
+// endpoint, made by MakeOrderDetailsEndpoint, to the users of a valid bearer
+// token, and passes every other request to next.
+func NewOrderDetailsHandler(e endpoint.Endpoint, next http.Handler, tracer stdopentracing.Tracer, logger log.Logger) http.Handler {
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/api/v1/orders/{id}/details").Handler(httptransport.NewServer(
+		TraceEndpoint(tracer, "OrderDetails")(e),
+		decodeOrderDetailsRequest,
+		encodeJSONResponse,
+		httptransport.ServerErrorEncoder(encodeJSONError),
+		httptransport.ServerErrorLogger(logger),
+		httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "OrderDetails", logger)),
+	))
+	r.PathPrefix("/").Handler(next)
+	return r
+}
+
+func decodeOrderDetailsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	userID, err := authorize.UserID(r)
+	if err != nil {
+		return nil, authorize.ErrUnauthorized
+	}
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		return nil, ErrMissingOrderID
+	}
+	return OrderDetailsRequest{OrderID: id, UserID: userID}, nil
+}
+
+func encodeJSONResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(response)
+}
+
+// encodeJSONError writes err as the services do, an errs.Error.
+func encodeJSONError(_ context.Context, err error, w http.ResponseWriter) {
+	if re, ok := err.(lb.RetryError); ok {
+		err = re.Final
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(errorStatus(err))
+	json.NewEncoder(w).Encode(errs.From(err))
+}
+
+// errorStatus is the status of an error of a gateway handler: that of its
+// code for errors of the gateway and the services, 504 for timeouts and 502
+// for the failures of upstreams.
+func errorStatus(err error) int {
+	if e, ok := err.(*errs.Error); ok {
+		return e.Code.HTTPStatus()
+	}
+	if err == context.DeadlineExceeded || status.Code(err) == codes.DeadlineExceeded {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
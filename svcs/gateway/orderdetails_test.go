@@ -0,0 +1,49 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/laidingqing/dabanshan-go/svcs/authorize"
+	o_model "github.com/laidingqing/dabanshan-go/svcs/order/model"
+	u_model "github.com/laidingqing/dabanshan-go/svcs/user/model"
+	stdopentracing "github.com/opentracing/opentracing-go"
+)
+
+func TestOrderDetailsAccess(t *testing.T) {
+	e := MakeOrderDetailsEndpoint(OrderDetailsEndpoints{
+		GetOrder: func(context.Context, interface{}) (interface{}, error) {
+			return o_model.GetOrderResponse{Order: o_model.Invoice{UserID: "buyer", TenantID: "tenant"}}, nil
+		},
+		GetUser: func(_ context.Context, request interface{}) (interface{}, error) {
+			return u_model.GetUserResponse{V: u_model.User{Username: request.(u_model.GetUserRequest).A}}, nil
+		},
+	}, 0, log.NewNopLogger())
+	h := NewOrderDetailsHandler(e, http.NotFoundHandler(), stdopentracing.GlobalTracer(), log.NewNopLogger())
+	for _, tc := range []struct {
+		user string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"other", http.StatusForbidden},
+		{"buyer", http.StatusOK},
+		{"tenant", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/api/v1/orders/o1/details", nil)
+		if tc.user != "" {
+			token, err := authorize.CreateJWT(tc.user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tc.want {
+			t.Errorf("user %q: status %d, want %d", tc.user, rec.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package gateway
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/laidingqing/dabanshan-go/svcs/authorize"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
+)
+
+// Limit is a token bucket refilled with Rate tokens per second up to Burst.
+// The zero Limit does not limit.
+type Limit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+func (l Limit) unlimited() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+// RateGroup limits the requests matching Method and PathPrefix.
+type RateGroup struct {
+	Name string `yaml:"name"`
+	// Method matches any method when empty.
+	Method     string `yaml:"method"`
+	PathPrefix string `yaml:"pathPrefix"`
+	// PerIP limits each client address, PerUser each authenticated user.
+	PerIP   Limit `yaml:"perIP"`
+	PerUser Limit `yaml:"perUser"`
+}
+
+func (g RateGroup) match(r *http.Request) bool {
+	return (g.Method == "" || g.Method == r.Method) && strings.HasPrefix(r.URL.Path, g.PathPrefix)
+}
+
+// DefaultRateGroups protects logins from password guessing and order
+// creation from floods, then limits everything else under /api/v1/.
+var DefaultRateGroups = []RateGroup{
+	{Name: "login", Method: "POST", PathPrefix: "/api/v1/users/login", PerIP: Limit{Rate: 0.2, Burst: 5}},
+	{Name: "register", Method: "POST", PathPrefix: "/api/v1/users/", PerIP: Limit{Rate: 0.1, Burst: 3}},
+	{Name: "order", Method: "POST", PathPrefix: "/api/v1/orders/", PerIP: Limit{Rate: 1, Burst: 10}, PerUser: Limit{Rate: 0.5, Burst: 5}},
+	{Name: "api", PathPrefix: "/api/v1/", PerIP: Limit{Rate: 20, Burst: 40}, PerUser: Limit{Rate: 20, Burst: 40}},
+}
+
+// RateGroups holds the rate groups in force, replaced when the config is
+// reloaded. Buckets are kept by group name, so that a group keeps its
+// buckets when its limits change.
+type RateGroups struct {
+	v atomic.Value // []RateGroup
+}
+
+// NewRateGroups returns the RateGroups holding groups.
+func NewRateGroups(groups []RateGroup) *RateGroups {
+	g := &RateGroups{}
+	g.Set(groups)
+	return g
+}
+
+// Get returns the groups in force.
+func (g *RateGroups) Get() []RateGroup {
+	return g.v.Load().([]RateGroup)
+}
+
+// Set replaces the groups in force.
+func (g *RateGroups) Set(groups []RateGroup) {
+	g.v.Store(groups)
+}
+
+// RateResult is the state of a bucket after taking a token.
+type RateResult struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is when the next token is available, if none was.
+	RetryAfter time.Duration
+	// Reset is when the bucket is full again.
+	Reset time.Duration
+}
+
+// RateStore keeps token buckets by key.
+type RateStore interface {
+	Take(key string, limit Limit, now time.Time) (RateResult, error)
+}
+
+// RateLimit returns an HTTP middleware applying the first of the groups in
+// force matching each request. Requests over a limit get 429 with Retry-After; every
+// limited response carries the X-RateLimit-* headers of its tightest bucket.
+// Store failures let requests through.
+func RateLimit(groups *RateGroups, store RateStore, trustForwarded bool, logger log.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			group, ok := matchGroup(groups.Get(), r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			now := time.Now()
+			var (
+				result RateResult
+				limit  Limit
+				taken  bool
+			)
+			take := func(key string, l Limit) {
+				if l.unlimited() {
+					return
+				}
+				res, err := store.Take(key, l, now)
+				if err != nil {
+					logging.With(r.Context(), logger).Log("component", "ratelimit", "key", key, "err", err)
+					return
+				}
+				if !taken || !res.Allowed || (result.Allowed && res.Remaining < result.Remaining) {
+					result, limit, taken = res, l, true
+				}
+			}
+			take("ip:"+group.Name+":"+clientIP(r, trustForwarded), group.PerIP)
+			if userID, err := authorize.UserID(r); err == nil && (!taken || result.Allowed) {
+				take("user:"+group.Name+":"+userID, group.PerUser)
+			}
+			if !taken {
+				next.ServeHTTP(w, r)
+				return
+			}
+			h := w.Header()
+			h.Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+			h.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			h.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+			if !result.Allowed {
+				h.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func matchGroup(groups []RateGroup, r *http.Request) (RateGroup, bool) {
+	for _, g := range groups {
+		if g.match(r) {
+			return g, true
+		}
+	}
+	return RateGroup{}, false
+}
+
+// clientIP is the address of the client, or of the first hop of
+// X-Forwarded-For when the gateway runs behind a trusted proxy.
+func clientIP(r *http.Request, trustForwarded bool) string {
+	if trustForwarded {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// bucketResult derives the result of a take from the tokens left in a bucket.
+func bucketResult(allowed bool, tokens float64, limit Limit) RateResult {
+	res := RateResult{
+		Allowed:   allowed,
+		Remaining: int(tokens),
+		Reset:     time.Duration((float64(limit.Burst) - tokens) / limit.Rate * float64(time.Second)),
+	}
+	if !allowed {
+		res.RetryAfter = time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	}
+	return res
+}
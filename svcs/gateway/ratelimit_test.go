@@ -0,0 +1,243 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/laidingqing/dabanshan-go/svcs/authorize"
+)
+
+// clockStore takes the tokens of store at the time of a fake clock rather
+// than at the time the middleware passes.
+type clockStore struct {
+	store RateStore
+	now   time.Time
+}
+
+func (s *clockStore) Take(key string, limit Limit, _ time.Time) (RateResult, error) {
+	return s.store.Take(key, limit, s.now)
+}
+
+func (s *clockStore) advance(d time.Duration) { s.now = s.now.Add(d) }
+
+type failingStore struct{}
+
+func (failingStore) Take(string, Limit, time.Time) (RateResult, error) {
+	return RateResult{}, errors.New("connection refused")
+}
+
+var t0 = time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func TestMemoryRateStore(t *testing.T) {
+	s := NewMemoryRateStore()
+	limit := Limit{Rate: 2, Burst: 3}
+	for _, tc := range []struct {
+		at   time.Duration
+		want RateResult
+	}{
+		{0, RateResult{Allowed: true, Remaining: 2, Reset: 500 * time.Millisecond}},
+		{0, RateResult{Allowed: true, Remaining: 1, Reset: time.Second}},
+		{0, RateResult{Allowed: true, Remaining: 0, Reset: 1500 * time.Millisecond}},
+		{0, RateResult{Allowed: false, Remaining: 0, RetryAfter: 500 * time.Millisecond, Reset: 1500 * time.Millisecond}},
+		{250 * time.Millisecond, RateResult{Allowed: false, Remaining: 0, RetryAfter: 250 * time.Millisecond, Reset: 1250 * time.Millisecond}},
+		{500 * time.Millisecond, RateResult{Allowed: true, Remaining: 0, Reset: 1500 * time.Millisecond}},
+		// a clock going back refills nothing
+		{0, RateResult{Allowed: false, Remaining: 0, RetryAfter: 500 * time.Millisecond, Reset: 1500 * time.Millisecond}},
+		// refills up to the burst
+		{time.Hour, RateResult{Allowed: true, Remaining: 2, Reset: 500 * time.Millisecond}},
+	} {
+		got, err := s.Take("ip:login:10.0.0.1", limit, t0.Add(tc.at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("take at %v: %+v, want %+v", tc.at, got, tc.want)
+		}
+	}
+	if got, _ := s.Take("ip:login:10.0.0.2", limit, t0); !got.Allowed || got.Remaining != 2 {
+		t.Errorf("other key: %+v, want a bucket of its own", got)
+	}
+}
+
+func TestMemoryRateStoreSweep(t *testing.T) {
+	s := NewMemoryRateStore()
+	limit := Limit{Rate: 1, Burst: 10}
+	s.Take("refilled", limit, t0)
+	s.Take("drained", Limit{Rate: 0.001, Burst: 10}, t0)
+	s.Take("new", limit, t0.Add(2*sweepInterval))
+	if _, ok := s.buckets["refilled"]; ok {
+		t.Error("a refilled bucket was kept")
+	}
+	if _, ok := s.buckets["drained"]; !ok {
+		t.Error("a bucket still refilling was dropped")
+	}
+}
+
+func rateRequest(method, path, remoteAddr, forwarded, user string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	r.RemoteAddr = remoteAddr
+	if forwarded != "" {
+		r.Header.Set("X-Forwarded-For", forwarded)
+	}
+	if user != "" {
+		token, err := authorize.CreateJWT(user)
+		if err != nil {
+			panic(err)
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func serveRate(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+var testRateGroups = []RateGroup{
+	{Name: "login", Method: "POST", PathPrefix: "/api/v1/users/login", PerIP: Limit{Rate: 1, Burst: 2}},
+	{Name: "order", Method: "POST", PathPrefix: "/api/v1/orders/", PerIP: Limit{Rate: 10, Burst: 10}, PerUser: Limit{Rate: 1, Burst: 1}},
+}
+
+func TestRateLimit(t *testing.T) {
+	store := &clockStore{store: NewMemoryRateStore(), now: t0}
+	h := RateLimit(NewRateGroups(testRateGroups), store, false, log.NewNopLogger())(http.NotFoundHandler())
+	login := func(addr string) *httptest.ResponseRecorder {
+		return serveRate(h, rateRequest("POST", "/api/v1/users/login", addr, "", ""))
+	}
+
+	for i, remaining := range []string{"1", "0"} {
+		rec := login("10.0.0.1:1234")
+		if rec.Code != http.StatusNotFound || rec.Header().Get("X-RateLimit-Remaining") != remaining {
+			t.Errorf("login %d: %d remaining %q, want %s", i, rec.Code, rec.Header().Get("X-RateLimit-Remaining"), remaining)
+		}
+		if rec.Header().Get("X-RateLimit-Limit") != "2" {
+			t.Errorf("login %d: limit %q", i, rec.Header().Get("X-RateLimit-Limit"))
+		}
+	}
+	rec := login("10.0.0.1:5678")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("login over the burst: %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "1" || rec.Header().Get("X-RateLimit-Reset") != "2" {
+		t.Errorf("Retry-After %q, X-RateLimit-Reset %q", rec.Header().Get("Retry-After"), rec.Header().Get("X-RateLimit-Reset"))
+	}
+	if rec := login("10.0.0.2:1234"); rec.Code != http.StatusNotFound {
+		t.Errorf("login from another address: %d", rec.Code)
+	}
+	store.advance(time.Second)
+	if rec := login("10.0.0.1:1234"); rec.Code != http.StatusNotFound {
+		t.Errorf("login a second later: %d", rec.Code)
+	}
+
+	for _, r := range []*http.Request{
+		rateRequest("GET", "/api/v1/users/login", "10.0.0.1:1234", "", ""),
+		rateRequest("GET", "/static/app.js", "10.0.0.1:1234", "", ""),
+	} {
+		if rec := serveRate(h, r); rec.Code != http.StatusNotFound || rec.Header().Get("X-RateLimit-Limit") != "" {
+			t.Errorf("%s %s, in no group: %d limit %q", r.Method, r.URL.Path, rec.Code, rec.Header().Get("X-RateLimit-Limit"))
+		}
+	}
+}
+
+func TestRateLimitPerUser(t *testing.T) {
+	store := &clockStore{store: NewMemoryRateStore(), now: t0}
+	h := RateLimit(NewRateGroups(testRateGroups), store, false, log.NewNopLogger())(http.NotFoundHandler())
+
+	rec := serveRate(h, rateRequest("POST", "/api/v1/orders/", "10.0.0.1:1234", "", "u1"))
+	if rec.Code != http.StatusNotFound || rec.Header().Get("X-RateLimit-Limit") != "1" {
+		t.Errorf("first order: %d limit %q, want that of the user", rec.Code, rec.Header().Get("X-RateLimit-Limit"))
+	}
+	// the user is limited whatever its address
+	if rec := serveRate(h, rateRequest("POST", "/api/v1/orders/", "10.0.0.2:1234", "", "u1")); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second order of the user: %d", rec.Code)
+	}
+	if rec := serveRate(h, rateRequest("POST", "/api/v1/orders/", "10.0.0.1:1234", "", "u2")); rec.Code != http.StatusNotFound {
+		t.Errorf("order of another user: %d", rec.Code)
+	}
+	rec = serveRate(h, rateRequest("POST", "/api/v1/orders/", "10.0.0.1:1234", "", ""))
+	if rec.Code != http.StatusNotFound || rec.Header().Get("X-RateLimit-Limit") != "10" {
+		t.Errorf("anonymous order: %d limit %q, want that of the address", rec.Code, rec.Header().Get("X-RateLimit-Limit"))
+	}
+}
+
+func TestRateLimitForwarded(t *testing.T) {
+	for _, tc := range []struct {
+		trust      bool
+		remoteAddr string
+		forwarded  []string
+		limited    bool
+	}{
+		// a client cannot escape its limit by forging X-Forwarded-For
+		{false, "10.0.0.1:1234", []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"}, true},
+		// behind a proxy, the clients are told apart by their first hop
+		{true, "10.0.0.9:1234", []string{"1.1.1.1", "2.2.2.2, 10.0.0.8", " 3.3.3.3 ,10.0.0.8"}, false},
+		{true, "10.0.0.9:1234", []string{"1.1.1.1", "1.1.1.1, 10.0.0.8", "1.1.1.1"}, true},
+	} {
+		store := &clockStore{store: NewMemoryRateStore(), now: t0}
+		h := RateLimit(NewRateGroups(testRateGroups), store, tc.trust, log.NewNopLogger())(http.NotFoundHandler())
+		limited := false
+		for _, fwd := range tc.forwarded {
+			rec := serveRate(h, rateRequest("POST", "/api/v1/users/login", tc.remoteAddr, fwd, ""))
+			limited = limited || rec.Code == http.StatusTooManyRequests
+		}
+		if limited != tc.limited {
+			t.Errorf("trust %v, X-Forwarded-For %q: limited %v", tc.trust, tc.forwarded, limited)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		remoteAddr, forwarded string
+		trust                 bool
+		want                  string
+	}{
+		{"10.0.0.1:1234", "", false, "10.0.0.1"},
+		{"[2001:db8::1]:1234", "", false, "2001:db8::1"},
+		{"10.0.0.1", "", false, "10.0.0.1"},
+		{"10.0.0.1:1234", "1.1.1.1", false, "10.0.0.1"},
+		{"10.0.0.1:1234", "1.1.1.1, 10.0.0.2", true, "1.1.1.1"},
+		{"10.0.0.1:1234", "", true, "10.0.0.1"},
+	} {
+		r := rateRequest("GET", "/", tc.remoteAddr, tc.forwarded, "")
+		if got := clientIP(r, tc.trust); got != tc.want {
+			t.Errorf("%s forwarded %q trust %v: %q, want %q", tc.remoteAddr, tc.forwarded, tc.trust, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimitFailOpen(t *testing.T) {
+	h := RateLimit(NewRateGroups(testRateGroups), failingStore{}, false, log.NewNopLogger())(http.NotFoundHandler())
+	for i := 0; i < 5; i++ {
+		rec := serveRate(h, rateRequest("POST", "/api/v1/users/login", "10.0.0.1:1234", "", ""))
+		if rec.Code != http.StatusNotFound || rec.Header().Get("X-RateLimit-Limit") != "" {
+			t.Fatalf("login %d with the store down: %d limit %q", i, rec.Code, rec.Header().Get("X-RateLimit-Limit"))
+		}
+	}
+}
+
+func TestRateGroupsReload(t *testing.T) {
+	store := &clockStore{store: NewMemoryRateStore(), now: t0}
+	groups := NewRateGroups(testRateGroups)
+	h := RateLimit(groups, store, false, log.NewNopLogger())(http.NotFoundHandler())
+	serveRate(h, rateRequest("POST", "/api/v1/users/login", "10.0.0.1:1234", "", ""))
+	serveRate(h, rateRequest("POST", "/api/v1/users/login", "10.0.0.1:1234", "", ""))
+
+	groups.Set([]RateGroup{{Name: "login", PathPrefix: "/api/v1/users/login", PerIP: Limit{Rate: 1, Burst: 5}}})
+	store.advance(time.Second)
+	rec := serveRate(h, rateRequest("POST", "/api/v1/users/login", "10.0.0.1:1234", "", ""))
+	if rec.Code != http.StatusNotFound || rec.Header().Get("X-RateLimit-Limit") != "5" {
+		t.Errorf("login after raising the limit: %d limit %q", rec.Code, rec.Header().Get("X-RateLimit-Limit"))
+	}
+	// the group kept its bucket, emptied by the logins before and refilled
+	// by one token since
+	if got := rec.Header().Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("remaining %q, want the bucket kept across the change", got)
+	}
+}
@@ -0,0 +1,138 @@
+package gateway
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the memory store drops buckets that have
+// refilled, and so hold nothing a new bucket would not.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// MemoryRateStore keeps buckets in process, each gateway instance limiting
+// on its own.
+type MemoryRateStore struct {
+	mtx       sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewMemoryRateStore returns an empty MemoryRateStore.
+func NewMemoryRateStore() *MemoryRateStore {
+	return &MemoryRateStore{buckets: map[string]*bucket{}}
+}
+
+// Take implements RateStore.
+func (s *MemoryRateStore) Take(key string, limit Limit, now time.Time) (RateResult, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if now.Sub(s.lastSweep) > sweepInterval {
+		s.sweep(now)
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		s.buckets[key] = b
+	}
+	b.limit = limit
+	b.tokens = refill(b.tokens, now.Sub(b.last), limit)
+	b.last = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return bucketResult(allowed, b.tokens, limit), nil
+}
+
+func (s *MemoryRateStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if refill(b.tokens, now.Sub(b.last), b.limit) >= float64(b.limit.Burst) {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+func refill(tokens float64, elapsed time.Duration, limit Limit) float64 {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(float64(limit.Burst), tokens+elapsed.Seconds()*limit.Rate)
+}
+
+// RedisEvaler runs a Lua script on a Redis compatible server. Adapters over
+// the common Redis clients are one line, e.g. for go-redis:
+//
+//	func (c adapter) Eval(script string, keys []string, args ...interface{}) (interface{}, error) {
+//		return c.Client.Eval(script, keys, args...).Result()
+//	}
+type RedisEvaler interface {
+	Eval(script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// RedisRateStore keeps buckets in Redis, shared by all gateway instances.
+type RedisRateStore struct {
+	client RedisEvaler
+	prefix string
+}
+
+// NewRedisRateStore returns a RedisRateStore keeping buckets under prefix.
+func NewRedisRateStore(client RedisEvaler, prefix string) *RedisRateStore {
+	return &RedisRateStore{client: client, prefix: prefix}
+}
+
+// takeScript is the token bucket of MemoryRateStore.Take run atomically in
+// Redis. Buckets expire once they would have refilled.
+const takeScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tokens, 'ts', now)
+redis.call('EXPIRE', KEYS[1], math.ceil(burst / rate) + 1)
+return {allowed, tostring(tokens)}
+`
+
+// Take implements RateStore.
+func (s *RedisRateStore) Take(key string, limit Limit, now time.Time) (RateResult, error) {
+	now64 := float64(now.UnixNano()) / float64(time.Second)
+	reply, err := s.client.Eval(takeScript, []string{s.prefix + key}, limit.Rate, limit.Burst, strconv.FormatFloat(now64, 'f', 3, 64))
+	if err != nil {
+		return RateResult{}, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return RateResult{}, fmt.Errorf("ratelimit: unexpected reply %v", reply)
+	}
+	allowed, _ := values[0].(int64)
+	var tokens float64
+	switch v := values[1].(type) {
+	case string:
+		tokens, err = strconv.ParseFloat(v, 64)
+	case []byte:
+		tokens, err = strconv.ParseFloat(string(v), 64)
+	default:
+		err = fmt.Errorf("ratelimit: unexpected reply %v", reply)
+	}
+	if err != nil {
+		return RateResult{}, err
+	}
+	return bucketResult(allowed == 1, tokens, limit), nil
+}
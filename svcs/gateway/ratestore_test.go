@@ -0,0 +1,153 @@
+package gateway
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeEvaler records the script calls and answers reply.
+type fakeEvaler struct {
+	reply interface{}
+	err   error
+	keys  []string
+	args  []interface{}
+}
+
+func (e *fakeEvaler) Eval(script string, keys []string, args ...interface{}) (interface{}, error) {
+	e.keys, e.args = keys, args
+	return e.reply, e.err
+}
+
+func TestRedisRateStore(t *testing.T) {
+	limit := Limit{Rate: 2, Burst: 3}
+	for _, tc := range []struct {
+		name  string
+		reply interface{}
+		err   error
+		want  RateResult
+		fails bool
+	}{
+		{"allowed", []interface{}{int64(1), "1.5"}, nil, RateResult{Allowed: true, Remaining: 1, Reset: 750 * time.Millisecond}, false},
+		{"bytes", []interface{}{int64(1), []byte("2")}, nil, RateResult{Allowed: true, Remaining: 2, Reset: 500 * time.Millisecond}, false},
+		{"denied", []interface{}{int64(0), "0.5"}, nil, RateResult{Remaining: 0, RetryAfter: 250 * time.Millisecond, Reset: 1250 * time.Millisecond}, false},
+		{"server down", nil, errors.New("connection refused"), RateResult{}, true},
+		{"not an array", "OK", nil, RateResult{}, true},
+		{"short array", []interface{}{int64(1)}, nil, RateResult{}, true},
+		{"tokens not a number", []interface{}{int64(1), "many"}, nil, RateResult{}, true},
+		{"tokens of another type", []interface{}{int64(1), int64(2)}, nil, RateResult{}, true},
+	} {
+		client := &fakeEvaler{reply: tc.reply, err: tc.err}
+		got, err := NewRedisRateStore(client, "gw:").Take("ip:login:10.0.0.1", limit, t0.Add(1500*time.Millisecond))
+		if (err != nil) != tc.fails || got != tc.want {
+			t.Errorf("%s: %+v, %v", tc.name, got, err)
+		}
+		if want := []string{"gw:ip:login:10.0.0.1"}; !reflect.DeepEqual(client.keys, want) {
+			t.Errorf("%s: keys %q, want %q", tc.name, client.keys, want)
+		}
+		if want := []interface{}{2.0, 3, "1496318401.500"}; !reflect.DeepEqual(client.args, want) {
+			t.Errorf("%s: args %v, want %v", tc.name, client.args, want)
+		}
+	}
+}
+
+// TestRedisRateStoreScript runs the script against the server of
+// REDIS_TEST_ADDR, host:port, checking that its buckets are those of the
+// memory store.
+func TestRedisRateStoreScript(t *testing.T) {
+	addr := os.Getenv("REDIS_TEST_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_TEST_ADDR is not set")
+	}
+	redis := NewRedisRateStore(respEvaler(addr), "ratelimit_test:"+strconv.FormatInt(time.Now().UnixNano(), 36)+":")
+	memory := NewMemoryRateStore()
+	limit := Limit{Rate: 2, Burst: 3}
+	for _, at := range []time.Duration{0, 0, 0, 0, 250 * time.Millisecond, 500 * time.Millisecond, 0, time.Hour} {
+		want, _ := memory.Take("k", limit, t0.Add(at))
+		got, err := redis.Take("k", limit, t0.Add(at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("take at %v: %+v, want %+v", at, got, want)
+		}
+	}
+}
+
+// respEvaler runs EVAL over the Redis protocol, one connection a call.
+type respEvaler string
+
+func (addr respEvaler) Eval(script string, keys []string, args ...interface{}) (interface{}, error) {
+	conn, err := net.DialTimeout("tcp", string(addr), time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	cmd := []string{"EVAL", script, strconv.Itoa(len(keys))}
+	cmd = append(cmd, keys...)
+	for _, a := range args {
+		cmd = append(cmd, fmt.Sprint(a))
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(cmd))
+	for _, c := range cmd {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(c), c)
+	}
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readReply(bufio.NewReader(conn))
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			v, err := readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
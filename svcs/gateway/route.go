@@ -0,0 +1,211 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/laidingqing/dabanshan-go/svcs/authorize"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+	"github.com/laidingqing/dabanshan-go/svcs/instrumenting"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/sony/gobreaker"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Policy is how the gateway calls the endpoint of a route.
+type Policy struct {
+	// RetryMax is how many instances are tried per request. Only failures
+	// to reach an instance are retried, see retryable.
+	RetryMax int
+	// Timeout bounds a request, including retries.
+	Timeout time.Duration
+	// AttemptTimeout bounds each try, so that a hung instance leaves time
+	// to retry another. Zero leaves only Timeout.
+	AttemptTimeout time.Duration
+	// Auth rejects requests without a valid bearer token before they reach
+	// the service.
+	Auth bool
+	// Once sends each request to a single instance, whatever RetryMax: the
+	// endpoint is not idempotent, a request that reached an instance slowly
+	// would be applied twice.
+	Once bool
+}
+
+// WithAuth returns a copy of p requiring a bearer token.
+func (p Policy) WithAuth() Policy {
+	p.Auth = true
+	return p
+}
+
+// WithOnce returns a copy of p trying a single instance per request.
+func (p Policy) WithOnce() Policy {
+	p.Once = true
+	p.RetryMax = 1
+	return p
+}
+
+// tries is how many instances are tried per request.
+func (p Policy) tries() int {
+	if p.Once {
+		return 1
+	}
+	return p.RetryMax
+}
+
+// Route is one endpoint of a backend service exposed by the gateway.
+type Route struct {
+	// Service is the name the service registers in service discovery.
+	Service string
+	// Method names the endpoint, it is unique within a service.
+	Method string
+	// Factory builds the endpoint for one instance of the service.
+	Factory sd.Factory
+	// Bind is the endpoint set field the built endpoint is stored in.
+	Bind   *endpoint.Endpoint
+	Policy Policy
+	// Middleware, if set, wraps the calls to the service within the
+	// metrics and the span of the route, for work the gateway adds to it.
+	Middleware endpoint.Middleware
+}
+
+// Name identifies the route as service.method.
+func (r Route) Name() string {
+	return r.Service + "." + r.Method
+}
+
+// Policies holds the policies of the routes by name, replaced when the
+// config is reloaded. The retries and timeouts of a route are read on each
+// request; Auth is fixed when its endpoint is built.
+type Policies struct {
+	v atomic.Value // map[string]Policy
+}
+
+// NewPolicies returns the Policies of routes.
+func NewPolicies(routes []Route) *Policies {
+	p := &Policies{}
+	p.Set(routes)
+	return p
+}
+
+// Get returns the policy of the route name.
+func (p *Policies) Get(name string) Policy {
+	return p.v.Load().(map[string]Policy)[name]
+}
+
+// Set replaces the policies with those of routes.
+func (p *Policies) Set(routes []Route) {
+	m := make(map[string]Policy, len(routes))
+	for _, r := range routes {
+		m[r.Name()] = r.Policy
+	}
+	p.v.Store(m)
+}
+
+// Endpoint builds the load balanced endpoint of r over the instances of its
+// service, traced as r.Name() with tracer and recorded in metrics under
+// that method. Each try goes through upstream, if not nil. Requests are
+// retried as set by the policy of r in policies at the time.
+func (r Route) Endpoint(instancer sd.Instancer, upstream *Upstream, policies *Policies, tracer stdopentracing.Tracer, metrics instrumenting.EndpointMetrics, logger log.Logger) endpoint.Endpoint {
+	name := r.Name()
+	factory := r.Factory
+	if upstream != nil {
+		guard := upstream.Middleware(func() time.Duration { return policies.Get(name).AttemptTimeout })
+		factory = func(instance string) (endpoint.Endpoint, io.Closer, error) {
+			e, closer, err := r.Factory(instance)
+			if err != nil {
+				return nil, nil, err
+			}
+			return guard(e), closer, nil
+		}
+	}
+	endpointer := sd.NewEndpointer(instancer, factory, logger)
+	balancer := lb.NewRoundRobin(endpointer)
+	e := serviceErrors(func(ctx context.Context, request interface{}) (interface{}, error) {
+		p := policies.Get(name)
+		retry := func(n int, err error) (bool, error) {
+			return n < p.tries() && retryable(ctx, err), nil
+		}
+		return lb.RetryWithCallback(p.Timeout, balancer, retry)(ctx, request)
+	})
+	if r.Middleware != nil {
+		e = r.Middleware(e)
+	}
+	if r.Policy.Auth {
+		e = authorize.Authenticated(e)
+	}
+	e = metrics.Middleware(r.Name())(e)
+	return TraceEndpoint(tracer, r.Name())(e)
+}
+
+// retryable reports whether a try failing with err may be retried on another
+// instance: the upstream was unavailable, the request was never sent, or the
+// try outlived AttemptTimeout within the deadline of the request. The errors
+// a service returned, NotFound or InvalidArgument, would be returned again.
+func retryable(ctx context.Context, err error) bool {
+	switch err {
+	case ErrBulkheadFull, gobreaker.ErrOpenState, gobreaker.ErrTooManyRequests:
+		return true
+	case context.DeadlineExceeded:
+		return ctx.Err() == nil
+	}
+	if e, ok := err.(*errs.Error); ok {
+		return e.Code == errs.Unavailable
+	}
+	switch status.Code(err) {
+	case codes.Unavailable:
+		return true
+	case codes.DeadlineExceeded:
+		return ctx.Err() == nil
+	}
+	return false
+}
+
+// serviceErrors returns the error a service returned on the last try, rather
+// than the lb.RetryError wrapping it, so that handlers see the errs.Error
+// sentinels of the services.
+func serviceErrors(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		response, err := next(ctx, request)
+		if re, ok := err.(lb.RetryError); ok {
+			if e, ok := re.Final.(*errs.Error); ok {
+				return response, e
+			}
+		}
+		return response, err
+	}
+}
+
+// Build builds the endpoint of every route and stores it in route.Bind.
+// instancers holds the instancer of each service, by service name. Calls
+// are guarded by the upstreams of their service, if upstreams is not nil,
+// traced with tracer and recorded in metrics. The returned Policies replace
+// the policies of the routes while they serve.
+func Build(routes []Route, instancers map[string]sd.Instancer, upstreams *Upstreams, tracer stdopentracing.Tracer, metrics instrumenting.EndpointMetrics, logger log.Logger) (*Policies, error) {
+	seen := map[string]bool{}
+	policies := NewPolicies(routes)
+	for _, r := range routes {
+		if seen[r.Name()] {
+			return nil, fmt.Errorf("gateway: duplicate route %s", r.Name())
+		}
+		seen[r.Name()] = true
+		instancer, ok := instancers[r.Service]
+		if !ok {
+			return nil, fmt.Errorf("gateway: no instancer for service %s of route %s", r.Service, r.Name())
+		}
+		var upstream *Upstream
+		if upstreams != nil {
+			upstream = upstreams.Get(r.Service)
+		}
+		*r.Bind = r.Endpoint(instancer, upstream, policies, tracer, metrics, logger)
+		logger.Log("route", r.Name(), "retryMax", r.Policy.tries(), "timeout", r.Policy.Timeout, "attemptTimeout", r.Policy.AttemptTimeout, "auth", r.Policy.Auth)
+	}
+	return policies, nil
+}
@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-kit/kit/sd"
+	"github.com/laidingqing/dabanshan-go/svcs/authorize"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+	"github.com/laidingqing/dabanshan-go/svcs/instrumenting"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var discardMetrics = instrumenting.EndpointMetrics{
+	Requests: discard.NewCounter(),
+	Errors:   discard.NewCounter(),
+	Duration: discard.NewHistogram(),
+}
+
+// tryRoute calls a route over three instances failing with err, returning
+// how many were tried.
+func tryRoute(t *testing.T, policy Policy, err error) int {
+	t.Helper()
+	var tries int32
+	r := Route{
+		Service: "svc",
+		Method:  "M",
+		Factory: func(string) (endpoint.Endpoint, io.Closer, error) {
+			return func(context.Context, interface{}) (interface{}, error) {
+				atomic.AddInt32(&tries, 1)
+				return nil, err
+			}, nil, nil
+		},
+		Policy: policy,
+	}
+	instancer := sd.FixedInstancer{"a:1", "b:1", "c:1"}
+	e := r.Endpoint(instancer, nil, NewPolicies([]Route{r}), stdopentracing.GlobalTracer(), discardMetrics, log.NewNopLogger())
+	if _, got := e(context.Background(), struct{}{}); got == nil {
+		t.Fatalf("%v: no error", err)
+	}
+	return int(atomic.LoadInt32(&tries))
+}
+
+func TestRetry(t *testing.T) {
+	policy := Policy{RetryMax: 3, Timeout: time.Second}
+	for _, tc := range []struct {
+		name   string
+		policy Policy
+		err    error
+		want   int
+	}{
+		{"unavailable", policy, status.Error(codes.Unavailable, "connection refused"), 3},
+		{"unavailable service", policy, errs.New(errs.Unavailable, "down"), 3},
+		{"bulkhead", policy, ErrBulkheadFull, 3},
+		{"attempt timeout", policy, context.DeadlineExceeded, 3},
+		{"not found", policy, errs.New(errs.NotFound, "no order"), 1},
+		{"invalid argument", policy, status.Error(codes.InvalidArgument, "bad"), 1},
+		{"unknown", policy, errors.New("boom"), 1},
+		{"once", policy.WithOnce(), status.Error(codes.Unavailable, "connection refused"), 1},
+	} {
+		if got := tryRoute(t, tc.policy, tc.err); got != tc.want {
+			t.Errorf("%s: %d tries, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRetryableRequestDeadline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if retryable(ctx, context.DeadlineExceeded) {
+		t.Error("retrying past the deadline of the request")
+	}
+}
+
+func TestRouteMiddleware(t *testing.T) {
+	var wrapped int
+	r := Route{
+		Service: "svc",
+		Method:  "M",
+		Factory: func(string) (endpoint.Endpoint, io.Closer, error) {
+			return func(context.Context, interface{}) (interface{}, error) { return "ok", nil }, nil, nil
+		},
+		Policy: Policy{RetryMax: 1, Timeout: time.Second, Auth: true},
+		Middleware: func(next endpoint.Endpoint) endpoint.Endpoint {
+			return func(ctx context.Context, request interface{}) (interface{}, error) {
+				wrapped++
+				return next(ctx, request)
+			}
+		},
+	}
+	e := r.Endpoint(sd.FixedInstancer{"a:1"}, nil, NewPolicies([]Route{r}), stdopentracing.GlobalTracer(), discardMetrics, log.NewNopLogger())
+	if _, err := e(context.Background(), struct{}{}); err == nil || wrapped != 0 {
+		t.Errorf("request of no token: %v, middleware called %d times", err, wrapped)
+	}
+	token, err := authorize.CreateJWT("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := authorize.NewContext(context.Background(), token)
+	if resp, err := e(ctx, struct{}{}); resp != "ok" || err != nil || wrapped != 1 {
+		t.Errorf("%v, %v, middleware called %d times", resp, err, wrapped)
+	}
+}
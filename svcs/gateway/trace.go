@@ -0,0 +1,43 @@
+package gateway
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/endpoint"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+type tracedKey struct{}
+
+// TraceEndpoint traces the calls to an endpoint as name. The first traced
+// endpoint a request calls takes over the server span the HTTP handler put
+// in the context, which the gateway's client endpoints would otherwise never
+// finish; traced endpoints called from within it get a child span. Route
+// endpoints are traced by Build, endpoints calling several routes, such as
+// the order details endpoint, are traced around them. The gRPC client spans
+// of the calls, propagated to the services, are children of these spans.
+func TraceEndpoint(tracer stdopentracing.Tracer, name string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			span := stdopentracing.SpanFromContext(ctx)
+			switch {
+			case ctx.Value(tracedKey{}) != nil:
+				span = tracer.StartSpan(name, stdopentracing.ChildOf(span.Context()))
+			case span != nil:
+				span.SetOperationName(name)
+			default:
+				span = tracer.StartSpan(name, ext.SpanKindRPCServer)
+			}
+			defer func() {
+				if err != nil {
+					ext.Error.Set(span, true)
+					span.LogKV("event", "error", "message", err.Error())
+				}
+				span.Finish()
+			}()
+			ctx = context.WithValue(stdopentracing.ContextWithSpan(ctx, span), tracedKey{}, true)
+			return next(ctx, request)
+		}
+	}
+}
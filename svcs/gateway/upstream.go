@@ -0,0 +1,218 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	"github.com/sony/gobreaker"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+)
+
+// ErrBulkheadFull is returned, without calling the upstream, when a service
+// already has its maximum of requests in flight.
+var ErrBulkheadFull = errs.New(errs.Unavailable, "too many requests in flight to upstream")
+
+// UpstreamPolicy guards the calls to one backend service, shared by all of
+// its routes.
+type UpstreamPolicy struct {
+	// MaxInFlight bounds the concurrent calls to the service; calls over it
+	// fail at once rather than queue. Zero means no bound.
+	MaxInFlight int `yaml:"maxInFlight"`
+	// BreakerFailures consecutive upstream failures open the breaker.
+	BreakerFailures uint32 `yaml:"breakerFailures"`
+	// BreakerOpen is how long an open breaker rejects calls before letting
+	// a trial call through.
+	BreakerOpen time.Duration `yaml:"breakerOpen"`
+}
+
+// UpstreamMetrics are labelled by service.
+type UpstreamMetrics struct {
+	// BreakerState is 0 closed, 1 half open, 2 open.
+	BreakerState metrics.Gauge
+	InFlight     metrics.Gauge
+	// Rejected counts calls refused by a reason of "breaker" or "bulkhead".
+	Rejected metrics.Counter
+}
+
+// Upstreams holds the guards of each backend service.
+type Upstreams struct {
+	mtx       sync.Mutex
+	defaults  UpstreamPolicy
+	policies  map[string]UpstreamPolicy
+	upstreams map[string]*Upstream
+	metrics   UpstreamMetrics
+}
+
+// NewUpstreams returns Upstreams guarding services with their entry of
+// policies, or with defaults.
+func NewUpstreams(defaults UpstreamPolicy, policies map[string]UpstreamPolicy, m UpstreamMetrics) *Upstreams {
+	return &Upstreams{
+		defaults:  defaults,
+		policies:  policies,
+		upstreams: map[string]*Upstream{},
+		metrics:   m,
+	}
+}
+
+// Get returns the guards of service, created on first use.
+func (u *Upstreams) Get(service string) *Upstream {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if up, ok := u.upstreams[service]; ok {
+		return up
+	}
+	policy, ok := u.policies[service]
+	if !ok {
+		policy = u.defaults
+	}
+	up := newUpstream(service, policy, u.metrics)
+	u.upstreams[service] = up
+	return up
+}
+
+// ServeHTTP lists the state of each upstream as JSON, for the debug
+// listener.
+func (u *Upstreams) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mtx.Lock()
+	states := make([]UpstreamState, 0, len(u.upstreams))
+	for _, up := range u.upstreams {
+		states = append(states, up.State())
+	}
+	u.mtx.Unlock()
+	sort.Slice(states, func(i, j int) bool { return states[i].Service < states[j].Service })
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(states)
+}
+
+// UpstreamState is a snapshot of the guards of a service.
+type UpstreamState struct {
+	Service     string `json:"service"`
+	Breaker     string `json:"breaker"`
+	InFlight    int    `json:"inFlight"`
+	MaxInFlight int    `json:"maxInFlight"`
+}
+
+// Upstream guards the calls to one backend service with a bulkhead and a
+// circuit breaker.
+type Upstream struct {
+	service string
+	policy  UpstreamPolicy
+	breaker *gobreaker.CircuitBreaker
+	slots   chan struct{}
+	metrics UpstreamMetrics
+}
+
+func newUpstream(service string, policy UpstreamPolicy, m UpstreamMetrics) *Upstream {
+	up := &Upstream{service: service, policy: policy, metrics: m}
+	if policy.MaxInFlight > 0 {
+		up.slots = make(chan struct{}, policy.MaxInFlight)
+	}
+	up.breaker = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:    service,
+		Timeout: policy.BreakerOpen,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return policy.BreakerFailures > 0 && counts.ConsecutiveFailures >= policy.BreakerFailures
+		},
+		OnStateChange: func(_ string, _, to gobreaker.State) {
+			m.BreakerState.With("service", service).Set(breakerStateValue(to))
+		},
+	})
+	m.BreakerState.With("service", service).Set(breakerStateValue(gobreaker.StateClosed))
+	return up
+}
+
+// State returns a snapshot of the guards.
+func (up *Upstream) State() UpstreamState {
+	return UpstreamState{
+		Service:     up.service,
+		Breaker:     up.breaker.State().String(),
+		InFlight:    len(up.slots),
+		MaxInFlight: up.policy.MaxInFlight,
+	}
+}
+
+// Middleware guards each attempt at calling an instance, bounding it by the
+// attemptTimeout of the moment when that is not zero. Only transport failures
+// count against the breaker, not errors returned by the service.
+func (up *Upstream) Middleware(attemptTimeout func() time.Duration) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if up.slots != nil {
+				select {
+				case up.slots <- struct{}{}:
+					defer func() { <-up.slots }()
+				default:
+					up.metrics.Rejected.With("service", up.service, "reason", "bulkhead").Add(1)
+					return nil, ErrBulkheadFull
+				}
+			}
+			up.metrics.InFlight.With("service", up.service).Add(1)
+			defer up.metrics.InFlight.With("service", up.service).Add(-1)
+
+			result, err := up.breaker.Execute(func() (interface{}, error) {
+				attemptCtx := ctx
+				if timeout := attemptTimeout(); timeout > 0 {
+					var cancel context.CancelFunc
+					attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+					defer cancel()
+				}
+				response, err := next(attemptCtx, request)
+				if upstreamFailure(err) {
+					return nil, err
+				}
+				return attemptResult{response, err}, nil
+			})
+			if err == gobreaker.ErrOpenState || err == gobreaker.ErrTooManyRequests {
+				up.metrics.Rejected.With("service", up.service, "reason", "breaker").Add(1)
+			}
+			if err != nil {
+				return nil, err
+			}
+			r := result.(attemptResult)
+			return r.response, r.err
+		}
+	}
+}
+
+// attemptResult carries the outcome of a call the breaker counts as a
+// success, even when the service returned an error.
+type attemptResult struct {
+	response interface{}
+	err      error
+}
+
+// upstreamFailure tells the errors of an unhealthy upstream from those of
+// the requests themselves. Internal is an error of the service handling a
+// request, such as a failed query, not of the upstream: it does not count.
+func upstreamFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+func breakerStateValue(s gobreaker.State) float64 {
+	switch s {
+	case gobreaker.StateHalfOpen:
+		return 1
+	case gobreaker.StateOpen:
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,161 @@
+package gateway
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+	"github.com/sony/gobreaker"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var discardUpstreamMetrics = UpstreamMetrics{
+	BreakerState: discard.NewGauge(),
+	InFlight:     discard.NewGauge(),
+	Rejected:     discard.NewCounter(),
+}
+
+func noAttemptTimeout() time.Duration { return 0 }
+
+func TestUpstreamBreaker(t *testing.T) {
+	up := newUpstream("ordersvc", UpstreamPolicy{BreakerFailures: 2, BreakerOpen: 50 * time.Millisecond}, discardUpstreamMetrics)
+	var (
+		calls int
+		err   error
+	)
+	e := up.Middleware(noAttemptTimeout)(func(context.Context, interface{}) (interface{}, error) {
+		calls++
+		return "ok", err
+	})
+	call := func() error {
+		_, err := e(context.Background(), nil)
+		return err
+	}
+
+	// errors of the requests are not failures of the upstream
+	err = errs.New(errs.NotFound, "no such order")
+	for i := 0; i < 3; i++ {
+		if got := call(); got != err {
+			t.Fatalf("service error: %v", got)
+		}
+	}
+	if s := up.breaker.State(); s != gobreaker.StateClosed {
+		t.Fatalf("breaker %v after service errors", s)
+	}
+
+	err = status.Error(codes.Unavailable, "connection refused")
+	call()
+	call()
+	if s := up.breaker.State(); s != gobreaker.StateOpen {
+		t.Fatalf("breaker %v after 2 failures", s)
+	}
+	calls = 0
+	if got := call(); got != gobreaker.ErrOpenState || calls != 0 {
+		t.Errorf("call to an open breaker: %v, %d calls", got, calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	err = nil
+	if got := call(); got != nil || calls != 1 {
+		t.Errorf("trial call: %v, %d calls", got, calls)
+	}
+	if s := up.breaker.State(); s != gobreaker.StateClosed {
+		t.Errorf("breaker %v after a trial call succeeded", s)
+	}
+}
+
+func TestUpstreamFailure(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{context.DeadlineExceeded, true},
+		{status.Error(codes.Unavailable, "connection refused"), true},
+		{status.Error(codes.DeadlineExceeded, "deadline"), true},
+		{status.Error(codes.ResourceExhausted, "too many streams"), true},
+		{status.Error(codes.Internal, "query failed"), false},
+		{status.Error(codes.Unknown, "boom"), false},
+		{errs.New(errs.InvalidArgument, "no product id"), false},
+	} {
+		if got := upstreamFailure(tc.err); got != tc.want {
+			t.Errorf("%v: failure %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestUpstreamBreakerNeverOpens(t *testing.T) {
+	up := newUpstream("ordersvc", UpstreamPolicy{BreakerOpen: time.Minute}, discardUpstreamMetrics)
+	e := up.Middleware(noAttemptTimeout)(func(context.Context, interface{}) (interface{}, error) {
+		return nil, status.Error(codes.Unavailable, "connection refused")
+	})
+	for i := 0; i < 10; i++ {
+		e(context.Background(), nil)
+	}
+	if s := up.breaker.State(); s != gobreaker.StateClosed {
+		t.Errorf("breaker %v with no BreakerFailures", s)
+	}
+}
+
+func TestUpstreamBulkhead(t *testing.T) {
+	up := newUpstream("ordersvc", UpstreamPolicy{MaxInFlight: 1}, discardUpstreamMetrics)
+	entered, release := make(chan struct{}), make(chan struct{})
+	e := up.Middleware(noAttemptTimeout)(func(context.Context, interface{}) (interface{}, error) {
+		entered <- struct{}{}
+		<-release
+		return nil, nil
+	})
+	done := make(chan error)
+	go func() {
+		_, err := e(context.Background(), nil)
+		done <- err
+	}()
+	<-entered
+	if up.State().InFlight != 1 {
+		t.Errorf("state %+v", up.State())
+	}
+	if _, err := e(context.Background(), nil); err != ErrBulkheadFull {
+		t.Errorf("call over the bulkhead: %v", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	go func() { <-entered }()
+	if _, err := e(context.Background(), nil); err != nil {
+		t.Errorf("call after the slot was freed: %v", err)
+	}
+}
+
+func TestUpstreamAttemptTimeout(t *testing.T) {
+	up := newUpstream("ordersvc", UpstreamPolicy{BreakerFailures: 1, BreakerOpen: time.Minute}, discardUpstreamMetrics)
+	e := up.Middleware(func() time.Duration { return time.Millisecond })(func(ctx context.Context, _ interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	if _, err := e(context.Background(), nil); err != context.DeadlineExceeded {
+		t.Errorf("slow attempt: %v", err)
+	}
+	if s := up.breaker.State(); s != gobreaker.StateOpen {
+		t.Errorf("breaker %v after an attempt timed out", s)
+	}
+}
+
+func TestUpstreamsState(t *testing.T) {
+	u := NewUpstreams(UpstreamPolicy{MaxInFlight: 10}, map[string]UpstreamPolicy{"ordersvc": {MaxInFlight: 5}}, discardUpstreamMetrics)
+	if u.Get("ordersvc") != u.Get("ordersvc") {
+		t.Error("a service got two upstreams")
+	}
+	u.Get("productsvc")
+	rec := httptest.NewRecorder()
+	u.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/upstreams", nil))
+	want := `[{"service":"ordersvc","breaker":"closed","inFlight":0,"maxInFlight":5},{"service":"productsvc","breaker":"closed","inFlight":0,"maxInFlight":10}]`
+	if got := strings.TrimSpace(rec.Body.String()); got != want {
+		t.Errorf("state %s, want %s", got, want)
+	}
+}
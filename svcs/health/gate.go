@@ -0,0 +1,82 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+)
+
+// Gate keeps an instance registered while its Health is ready: it registers
+// the instance once ready, deregisters it when a check fails and registers it
+// again when they pass. It is meant to be added to an oklog group with Run
+// and Interrupt, before the servers: Interrupt returns once the instance is
+// deregistered, so that no new traffic is sent while the servers drain.
+type Gate struct {
+	health     *Health
+	registrar  sd.Registrar
+	interval   time.Duration
+	logger     log.Logger
+	quit       chan struct{}
+	done       chan struct{}
+	once       sync.Once
+	registered bool
+}
+
+// NewGate returns a Gate checking h every interval.
+func NewGate(h *Health, registrar sd.Registrar, interval time.Duration, logger log.Logger) *Gate {
+	return &Gate{
+		health:    h,
+		registrar: registrar,
+		interval:  interval,
+		logger:    logger,
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Run checks readiness immediately and then every interval, until Interrupt
+// is called. The instance is deregistered before Run returns.
+func (g *Gate) Run() error {
+	defer close(g.done)
+	t := time.NewTicker(g.interval)
+	defer t.Stop()
+	for {
+		g.check()
+		select {
+		case <-t.C:
+		case <-g.quit:
+			if g.registered {
+				g.registrar.Deregister()
+			}
+			return nil
+		}
+	}
+}
+
+// Interrupt stops Run and waits for it to return.
+func (g *Gate) Interrupt(error) {
+	g.once.Do(func() { close(g.quit) })
+	<-g.done
+}
+
+func (g *Gate) check() {
+	report := g.health.Check(context.Background())
+	ready := report.Status == StatusUp
+	switch {
+	case ready && !g.registered:
+		g.registrar.Register()
+		g.registered = true
+		g.logger.Log("ready", true)
+	case !ready && g.registered:
+		g.registrar.Deregister()
+		g.registered = false
+		for name, c := range report.Components {
+			if c.Status != StatusUp {
+				g.logger.Log("ready", false, "component", name, "err", c.Error)
+			}
+		}
+	}
+}
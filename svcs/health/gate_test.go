@@ -0,0 +1,104 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// registrar records the calls of a Gate.
+type registrar struct {
+	mtx   sync.Mutex
+	calls []string
+}
+
+func (r *registrar) Register()   { r.record("register") }
+func (r *registrar) Deregister() { r.record("deregister") }
+
+func (r *registrar) record(call string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+// made returns the calls made so far.
+func (r *registrar) made() []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return append([]string(nil), r.calls...)
+}
+
+// waitFor fails t unless the calls of r are want within a second.
+func waitFor(t *testing.T, r *registrar, want ...string) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		calls := r.made()
+		if strings.Join(calls, " ") == strings.Join(want, " ") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("calls %q, want %q", calls, want)
+		}
+	}
+}
+
+func TestGate(t *testing.T) {
+	var (
+		mtx sync.Mutex
+		err = errors.New("not connected")
+	)
+	h := New(time.Second)
+	h.Add("db", func(context.Context) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return err
+	})
+	setErr := func(e error) {
+		mtx.Lock()
+		err = e
+		mtx.Unlock()
+	}
+	r := &registrar{}
+	g := NewGate(h, r, time.Millisecond, log.NewNopLogger())
+	done := make(chan error, 1)
+	go func() { done <- g.Run() }()
+
+	time.Sleep(10 * time.Millisecond)
+	if calls := r.made(); len(calls) != 0 {
+		t.Fatalf("calls %q before the instance was ready", calls)
+	}
+	setErr(nil)
+	waitFor(t, r, "register")
+	setErr(errors.New("no reachable servers"))
+	waitFor(t, r, "register", "deregister")
+	setErr(nil)
+	waitFor(t, r, "register", "deregister", "register")
+
+	// Interrupt returns once the instance is deregistered
+	g.Interrupt(nil)
+	if calls := r.made(); len(calls) != 4 || calls[3] != "deregister" {
+		t.Errorf("calls %q after Interrupt", calls)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	g.Interrupt(nil)
+}
+
+func TestGateNeverReady(t *testing.T) {
+	h := New(time.Second)
+	h.Add("db", func(context.Context) error { return errors.New("not connected") })
+	r := &registrar{}
+	g := NewGate(h, r, time.Millisecond, log.NewNopLogger())
+	go g.Run()
+	time.Sleep(5 * time.Millisecond)
+	g.Interrupt(nil)
+	if calls := r.made(); len(calls) != 0 {
+		t.Errorf("calls %q of an instance never ready", calls)
+	}
+}
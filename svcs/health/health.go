@@ -0,0 +1,153 @@
+// Package health reports whether a binary is alive and whether it is ready
+// to serve, checking the components it depends on, such as its database or
+// the services it calls, and keeps it registered in service discovery only
+// while it is ready.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The statuses of a component and of a report.
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// ErrTimeout is the error of checks not done within the timeout of a Health.
+var ErrTimeout = errors.New("health: check timed out")
+
+// Check checks a component, returning why it is not usable.
+type Check func(ctx context.Context) error
+
+// Component is the status of a component in a Report.
+type Component struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Took   string `json:"took"`
+}
+
+// Report is the status of a binary, up if all its components are.
+type Report struct {
+	Status     string               `json:"status"`
+	Components map[string]Component `json:"components,omitempty"`
+}
+
+// Health checks the components a binary needs to be ready.
+type Health struct {
+	timeout time.Duration
+	mtx     sync.RWMutex
+	names   []string
+	checks  map[string]Check
+}
+
+// New returns a Health whose checks each fail if not done within timeout.
+func New(timeout time.Duration) *Health {
+	return &Health{timeout: timeout, checks: map[string]Check{}}
+}
+
+// Add adds the check of the component name.
+func (h *Health) Add(name string, check Check) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+		sort.Strings(h.names)
+	}
+	h.checks[name] = check
+}
+
+// Check runs every check concurrently and reports their statuses.
+func (h *Health) Check(ctx context.Context) Report {
+	h.mtx.RLock()
+	names := append([]string(nil), h.names...)
+	checks := make([]Check, len(names))
+	for i, name := range names {
+		checks[i] = h.checks[name]
+	}
+	h.mtx.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	components := make([]Component, len(names))
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			components[i] = run(ctx, checks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusUp, Components: map[string]Component{}}
+	for i, name := range names {
+		report.Components[name] = components[i]
+		if components[i].Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+	return report
+}
+
+// run runs check until ctx is done. Checks blind to ctx, such as those of
+// drivers without one, are left to finish in the background.
+func run(ctx context.Context, check Check) Component {
+	begin := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ErrTimeout
+	}
+	c := Component{Status: StatusUp, Took: time.Since(begin).String()}
+	if err != nil {
+		c.Status, c.Error = StatusDown, err.Error()
+	}
+	return c
+}
+
+// LiveHandler answers 200 for as long as the binary serves HTTP, without
+// checking its components: a binary whose database is down is not to be
+// restarted, only kept out of the traffic.
+func LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, http.StatusOK, Report{Status: StatusUp})
+	})
+}
+
+// ReadyHandler answers the Report of h, with 200 if the binary is ready and
+// 503 if it is not.
+func (h *Health) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := h.Check(r.Context())
+		status := http.StatusOK
+		if report.Status != StatusUp {
+			status = http.StatusServiceUnavailable
+		}
+		writeReport(w, status, report)
+	})
+}
+
+// Register mounts the liveness handler on /health/live and /health, and the
+// readiness handler on /health/ready.
+func (h *Health) Register(mux *http.ServeMux) {
+	mux.Handle("/health", LiveHandler())
+	mux.Handle("/health/live", LiveHandler())
+	mux.Handle("/health/ready", h.ReadyHandler())
+}
+
+func writeReport(w http.ResponseWriter, status int, report Report) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,134 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/sd"
+)
+
+func up(context.Context) error { return nil }
+
+func TestCheck(t *testing.T) {
+	h := New(20 * time.Millisecond)
+	h.Add("db", up)
+	h.Add("productsvc", func(context.Context) error { return errors.New("connection refused") })
+	// a check blind to its context is abandoned at the timeout
+	h.Add("slow", func(context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	begin := time.Now()
+	report := h.Check(context.Background())
+	if took := time.Since(begin); took > 500*time.Millisecond {
+		t.Errorf("Check took %v, past the timeout", took)
+	}
+	if report.Status != StatusDown {
+		t.Errorf("status %s", report.Status)
+	}
+	for name, want := range map[string]Component{
+		"db":         {Status: StatusUp},
+		"productsvc": {Status: StatusDown, Error: "connection refused"},
+		"slow":       {Status: StatusDown, Error: ErrTimeout.Error()},
+	} {
+		got := report.Components[name]
+		if got.Status != want.Status || got.Error != want.Error || got.Took == "" {
+			t.Errorf("%s: %+v, want %+v", name, got, want)
+		}
+	}
+
+	h = New(time.Second)
+	h.Add("db", up)
+	h.Add("db", func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			return errors.New("no deadline")
+		}
+		return nil
+	})
+	if report := h.Check(context.Background()); report.Status != StatusUp || len(report.Components) != 1 {
+		t.Errorf("report %+v, want the check replaced and up", report)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	var err error
+	h := New(time.Second)
+	h.Add("db", func(context.Context) error { return err })
+	mux := http.NewServeMux()
+	h.Register(mux)
+	get := func(path string) (int, Report) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var report Report
+		if jerr := json.Unmarshal(rec.Body.Bytes(), &report); jerr != nil {
+			t.Fatalf("%s: %v", path, jerr)
+		}
+		if rec.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("%s: cached", path)
+		}
+		return rec.Code, report
+	}
+
+	if code, report := get("/health/ready"); code != http.StatusOK || report.Status != StatusUp {
+		t.Errorf("ready: %d %+v", code, report)
+	}
+	err = errors.New("no reachable servers")
+	if code, report := get("/health/ready"); code != http.StatusServiceUnavailable || report.Components["db"].Error != "no reachable servers" {
+		t.Errorf("not ready: %d %+v", code, report)
+	}
+	// alive whatever the components
+	for _, path := range []string{"/health", "/health/live"} {
+		if code, report := get(path); code != http.StatusOK || report.Status != StatusUp || report.Components != nil {
+			t.Errorf("%s: %d %+v", path, code, report)
+		}
+	}
+}
+
+// instancer is an sd.Instancer sending the events given to update.
+type instancer chan chan<- sd.Event
+
+func (i instancer) Register(ch chan<- sd.Event) { i <- ch }
+func (i instancer) Deregister(chan<- sd.Event)  {}
+func (i instancer) Stop()                       {}
+
+func TestInstances(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	registered := make(instancer, 1)
+	check := Instances(registered)
+	events := <-registered
+	ctx := context.Background()
+	if err := check(ctx); err != ErrNoInstances {
+		t.Errorf("before discovery: %v", err)
+	}
+	for _, tc := range []struct {
+		instances []string
+		ok        bool
+	}{
+		{[]string{closed.Addr().String(), l.Addr().String()}, true},
+		{[]string{closed.Addr().String()}, false},
+		{nil, false},
+	} {
+		events <- sd.Event{Instances: tc.instances}
+		// a second event makes sure the first was applied
+		events <- sd.Event{Instances: tc.instances}
+		if err := check(ctx); (err == nil) != tc.ok {
+			t.Errorf("%v: %v", tc.instances, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/go-kit/kit/sd"
+)
+
+// ErrNoInstances is the error of Instances while discovery has found none.
+var ErrNoInstances = errors.New("health: no instances")
+
+// Instances returns the check of a service the binary calls, passing while
+// at least one of the instances instancer discovers accepts TCP connections.
+func Instances(instancer sd.Instancer) Check {
+	w := &instanceWatcher{events: make(chan sd.Event), err: ErrNoInstances}
+	instancer.Register(w.events)
+	go w.watch()
+	return w.check
+}
+
+type instanceWatcher struct {
+	events    chan sd.Event
+	mtx       sync.RWMutex
+	instances []string
+	err       error
+}
+
+func (w *instanceWatcher) watch() {
+	for e := range w.events {
+		w.mtx.Lock()
+		w.instances, w.err = e.Instances, e.Err
+		if w.err == nil && len(w.instances) == 0 {
+			w.err = ErrNoInstances
+		}
+		w.mtx.Unlock()
+	}
+}
+
+func (w *instanceWatcher) check(ctx context.Context) error {
+	w.mtx.RLock()
+	instances, err := w.instances, w.err
+	w.mtx.RUnlock()
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	for _, instance := range instances {
+		conn, dialErr := d.DialContext(ctx, "tcp", instance)
+		if dialErr == nil {
+			conn.Close()
+			return nil
+		}
+		err = dialErr
+	}
+	return err
+}
@@ -0,0 +1,304 @@
+package httprule
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/gorilla/mux"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+)
+
+var unmarshaler = jsonpb.Unmarshaler{AllowUnknownFields: true}
+
+// binder makes the request message of an rpc from an HTTP request: the body
+// as the rule says, then the path variables, then the query parameters for
+// the fields left. Field names match the proto name or the json_name, case
+// insensitively, so clients of the former hand-written decoders keep working.
+type binder struct {
+	messages map[string]*descriptor.DescriptorProto
+	input    *descriptor.DescriptorProto
+	msgType  reflect.Type
+	body     string
+	before   func(*http.Request, proto.Message) error
+}
+
+func invalid(format string, args ...interface{}) error {
+	return errs.Errorf(errs.InvalidArgument, "invalid request: "+format, args...)
+}
+
+// check checks that the body names a field and the variables of path name
+// scalar fields. Only single segment variables are supported, {name} rather
+// than {name=*/x}.
+func (b *binder) check(path string) error {
+	if b.body != "" && b.body != "*" && fieldByName(b.input, b.body) == nil {
+		return fmt.Errorf("body %s is not a field", b.body)
+	}
+	for _, seg := range strings.Split(path, "/") {
+		if !strings.HasPrefix(seg, "{") {
+			if strings.Contains(seg, "*") {
+				return fmt.Errorf("unsupported wildcard in %s", path)
+			}
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(seg, "{"), "}")
+		if strings.Contains(name, "=") {
+			return fmt.Errorf("unsupported variable %s in %s", seg, path)
+		}
+		f, _ := b.field(strings.Split(name, "."))
+		if f == nil || f.GetType() == descriptor.FieldDescriptorProto_TYPE_MESSAGE || repeated(f) {
+			return fmt.Errorf("variable %s of %s is not a scalar field", name, path)
+		}
+	}
+	return nil
+}
+
+// field resolves a dotted field path from the input message.
+func (b *binder) field(path []string) (*descriptor.FieldDescriptorProto, []string) {
+	md := b.input
+	var names []string
+	for i, name := range path {
+		f := fieldByName(md, name)
+		if f == nil {
+			return nil, nil
+		}
+		names = append(names, f.GetName())
+		if i == len(path)-1 {
+			return f, names
+		}
+		if f.GetType() != descriptor.FieldDescriptorProto_TYPE_MESSAGE || repeated(f) {
+			return nil, nil
+		}
+		if md = b.messages[f.GetTypeName()]; md == nil {
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *binder) bind(r *http.Request) (proto.Message, error) {
+	obj := map[string]interface{}{}
+	if b.body != "" {
+		v, err := readJSON(r)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case v == nil:
+		case b.body == "*":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, invalid("body is not a JSON object")
+			}
+			obj = b.normalize(b.input, m)
+		default:
+			f := fieldByName(b.input, b.body)
+			obj[f.GetName()] = b.normalizeField(f, v)
+		}
+	}
+	for name, value := range mux.Vars(r) {
+		f, names := b.field(strings.Split(name, "."))
+		v, err := scalar(f, value)
+		if err != nil {
+			return nil, invalid("path variable %s: %v", name, err)
+		}
+		set(obj, names, v, true)
+	}
+	if b.body != "*" {
+		for key, values := range r.URL.Query() {
+			f, names := b.field(strings.Split(key, "."))
+			if f == nil || f.GetType() == descriptor.FieldDescriptorProto_TYPE_MESSAGE {
+				continue
+			}
+			var v interface{}
+			if repeated(f) {
+				var list []interface{}
+				for _, value := range values {
+					for _, s := range strings.Split(value, ",") {
+						if s = strings.TrimSpace(s); s == "" {
+							continue
+						}
+						sv, err := scalar(f, s)
+						if err != nil {
+							return nil, invalid("query parameter %s: %v", key, err)
+						}
+						list = append(list, sv)
+					}
+				}
+				v = list
+			} else {
+				if values[0] == "" {
+					continue
+				}
+				sv, err := scalar(f, values[0])
+				if err != nil {
+					return nil, invalid("query parameter %s: %v", key, err)
+				}
+				v = sv
+			}
+			set(obj, names, v, false)
+		}
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	msg := newMessage(b.msgType)
+	if err := unmarshaler.Unmarshal(bytes.NewReader(data), msg); err != nil {
+		return nil, invalid("%v", err)
+	}
+	if b.before != nil {
+		if err := b.before(r, msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// readJSON decodes the request body, nil when it is empty.
+func readJSON(r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, invalid("body is not JSON: %v", err)
+	}
+	return v, nil
+}
+
+// normalize renames the keys of a JSON object to the proto names of the
+// fields of md they match. Unknown keys are left to be ignored.
+func (b *binder) normalize(md *descriptor.DescriptorProto, obj map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		f := fieldByName(md, k)
+		if f == nil {
+			out[k] = v
+			continue
+		}
+		out[f.GetName()] = b.normalizeField(f, v)
+	}
+	return out
+}
+
+func (b *binder) normalizeField(f *descriptor.FieldDescriptorProto, v interface{}) interface{} {
+	md := b.messages[f.GetTypeName()]
+	if f.GetType() != descriptor.FieldDescriptorProto_TYPE_MESSAGE || md == nil || md.GetOptions().GetMapEntry() {
+		return v
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return b.normalize(md, v)
+	case []interface{}:
+		if !repeated(f) {
+			return v
+		}
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			if m, ok := item.(map[string]interface{}); ok {
+				out[i] = b.normalize(md, m)
+			} else {
+				out[i] = item
+			}
+		}
+		return out
+	}
+	return v
+}
+
+// set sets the value at a path of field names in obj, creating the objects
+// on the way. Values already set are kept unless override.
+func set(obj map[string]interface{}, names []string, v interface{}, override bool) {
+	for _, name := range names[:len(names)-1] {
+		next, ok := obj[name].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			obj[name] = next
+		}
+		obj = next
+	}
+	last := names[len(names)-1]
+	if _, ok := obj[last]; ok && !override {
+		return
+	}
+	obj[last] = v
+}
+
+// fieldByName finds the field of md named name, by proto name or json_name,
+// exact matches first.
+func fieldByName(md *descriptor.DescriptorProto, name string) *descriptor.FieldDescriptorProto {
+	for _, f := range md.Field {
+		if f.GetName() == name || f.GetJsonName() == name {
+			return f
+		}
+	}
+	for _, f := range md.Field {
+		if strings.EqualFold(f.GetName(), name) || strings.EqualFold(f.GetJsonName(), name) {
+			return f
+		}
+	}
+	return nil
+}
+
+func repeated(f *descriptor.FieldDescriptorProto) bool {
+	return f.GetLabel() == descriptor.FieldDescriptorProto_LABEL_REPEATED
+}
+
+// scalar converts a path or query value to the JSON value of field f.
+func scalar(f *descriptor.FieldDescriptorProto, v string) (interface{}, error) {
+	switch f.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", v)
+		}
+		return b, nil
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE, descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return nil, fmt.Errorf("%q is not a number", v)
+		}
+		return json.Number(v), nil
+	case descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_TYPE_SINT32, descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		if _, err := strconv.ParseInt(v, 10, 32); err != nil {
+			return nil, fmt.Errorf("%q is not an integer", v)
+		}
+		return json.Number(v), nil
+	case descriptor.FieldDescriptorProto_TYPE_INT64, descriptor.FieldDescriptorProto_TYPE_SINT64, descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("%q is not an integer", v)
+		}
+		return json.Number(v), nil
+	case descriptor.FieldDescriptorProto_TYPE_UINT32, descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		if _, err := strconv.ParseUint(v, 10, 32); err != nil {
+			return nil, fmt.Errorf("%q is not an unsigned integer", v)
+		}
+		return json.Number(v), nil
+	case descriptor.FieldDescriptorProto_TYPE_UINT64, descriptor.FieldDescriptorProto_TYPE_FIXED64:
+		if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("%q is not an unsigned integer", v)
+		}
+		return json.Number(v), nil
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		// By name or by number.
+		if _, err := strconv.ParseInt(v, 10, 32); err == nil {
+			return json.Number(v), nil
+		}
+		return v, nil
+	case descriptor.FieldDescriptorProto_TYPE_MESSAGE, descriptor.FieldDescriptorProto_TYPE_GROUP:
+		return nil, fmt.Errorf("%s is not a scalar field", f.GetName())
+	}
+	return v, nil
+}
@@ -0,0 +1,173 @@
+package httprule
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/gorilla/mux"
+	"github.com/laidingqing/dabanshan-go/pb"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+)
+
+// newBinder returns the binder of the message input of pb/order.proto, such
+// as "pb.GetOrdersRequest", for a rule of body.
+func newBinder(t *testing.T, input, body string) *binder {
+	t.Helper()
+	fd, err := fileDescriptor("order.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := map[string]*descriptor.DescriptorProto{}
+	addMessages(messages, "."+fd.GetPackage(), fd.MessageType)
+	return &binder{
+		messages: messages,
+		input:    messages["."+input],
+		msgType:  proto.MessageType(input),
+		body:     body,
+	}
+}
+
+func bindRequest(t *testing.T, b *binder, method, target, body string, vars map[string]string) (proto.Message, error) {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if vars != nil {
+		r = mux.SetURLVars(r, vars)
+	}
+	return b.bind(r)
+}
+
+func TestBindQuery(t *testing.T) {
+	b := newBinder(t, "pb.GetOrdersRequest", "")
+	for _, tc := range []struct {
+		target string
+		want   *pb.GetOrdersRequest
+	}{
+		{"/api/v1/orders/?userid=u1&pageSize=10", &pb.GetOrdersRequest{Userid: "u1", PageSize: 10}},
+		// names of the former decoders, case insensitively
+		{"/api/v1/orders/?userId=u1&tenantId=t1&productId=p1&minAmount=9.5", &pb.GetOrdersRequest{Userid: "u1", Tenantid: "t1", Productid: "p1", Minamount: 9.5}},
+		// repeated fields, comma separated and repeated
+		{"/api/v1/orders/?status=1,2&status=3&sort=-amount,status", &pb.GetOrdersRequest{Status: []int32{1, 2, 3}, Sort: []string{"-amount", "status"}}},
+		{"/api/v1/orders/?status=1,,2,%20", &pb.GetOrdersRequest{Status: []int32{1, 2}}},
+		{"/api/v1/orders/?createdfrom=1500000000", &pb.GetOrdersRequest{Createdfrom: 1500000000}},
+		// empty values and unknown parameters are left out
+		{"/api/v1/orders/?userid=&pageSize=&unknown=1&status=", &pb.GetOrdersRequest{}},
+	} {
+		msg, err := bindRequest(t, b, "GET", tc.target, "", nil)
+		if err != nil {
+			t.Errorf("%s: %v", tc.target, err)
+			continue
+		}
+		if !proto.Equal(msg, tc.want) {
+			t.Errorf("%s: bound %v, want %v", tc.target, msg, tc.want)
+		}
+	}
+}
+
+func TestBindInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		input, body, target, payload string
+	}{
+		{"pb.GetOrdersRequest", "", "/api/v1/orders/?pageSize=ten", ""},
+		{"pb.GetOrdersRequest", "", "/api/v1/orders/?status=1,x", ""},
+		{"pb.GetOrdersRequest", "", "/api/v1/orders/?minamount=cheap", ""},
+		{"pb.GetOrdersRequest", "", "/api/v1/orders/?createdfrom=99999999999999999999", ""},
+		{"pb.CreateOrderRequest", "*", "/api/v1/orders/", `not json`},
+		{"pb.CreateOrderRequest", "*", "/api/v1/orders/", `[1]`},
+		{"pb.CreateOrderRequest", "*", "/api/v1/orders/", `{"items":{}}`},
+		{"pb.CreateOrderRequest", "*", "/api/v1/orders/", `{"amount":"a lot"}`},
+	} {
+		_, err := bindRequest(t, newBinder(t, tc.input, tc.body), "POST", tc.target, tc.payload, nil)
+		if errs.CodeOf(err) != errs.InvalidArgument {
+			t.Errorf("%s %s: error %v, want invalid argument", tc.target, tc.payload, err)
+		}
+	}
+}
+
+func TestBindBody(t *testing.T) {
+	for _, tc := range []struct {
+		name, input, body, payload string
+		vars                       map[string]string
+		want                       proto.Message
+	}{
+		{"whole body", "pb.CreateOrderRequest", "*",
+			`{"amount":9.9,"userid":"u1","items":[{"productid":"p1","quantity":2}]}`, nil,
+			&pb.CreateOrderRequest{Amount: 9.9, Userid: "u1", Items: []*pb.OrderItemRecord{{Productid: "p1", Quantity: 2}}}},
+		{"names normalized in nested messages", "pb.CreateOrderRequest", "*",
+			`{"userId":"u1","TenantID":"t1","items":[{"productID":"p1","Quantity":2}],"unknown":true}`, nil,
+			&pb.CreateOrderRequest{Userid: "u1", Tenantid: "t1", Items: []*pb.OrderItemRecord{{Productid: "p1", Quantity: 2}}}},
+		{"empty body", "pb.CreateOrderRequest", "*", ``, nil, &pb.CreateOrderRequest{}},
+		{"body field", "pb.CreateCartRequest", "item",
+			`{"productID":"p1","price":1.5,"quantity":1}`, nil,
+			&pb.CreateCartRequest{Item: &pb.OrderItemRecord{Productid: "p1", Price: 1.5, Quantity: 1}}},
+		{"path variable over the body", "pb.UpdateQuantityRequest", "*",
+			`{"cartid":"c2","quantity":3}`, map[string]string{"cartid": "c1"},
+			&pb.UpdateQuantityRequest{Cartid: "c1", Quantity: 3}},
+	} {
+		msg, err := bindRequest(t, newBinder(t, tc.input, tc.body), "POST", "/?userid=ignored", tc.payload, tc.vars)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !proto.Equal(msg, tc.want) {
+			t.Errorf("%s: bound %v, want %v", tc.name, msg, tc.want)
+		}
+	}
+}
+
+func TestBindBefore(t *testing.T) {
+	b := newBinder(t, "pb.GetCartItemsRequest", "")
+	b.before = func(r *http.Request, msg proto.Message) error {
+		msg.(*pb.GetCartItemsRequest).Userid = "token user"
+		return nil
+	}
+	msg, err := bindRequest(t, b, "GET", "/api/v1/carts/?userid=u2", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.(*pb.GetCartItemsRequest).Userid; got != "token user" {
+		t.Errorf("userid %q, want that of before", got)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	b := newBinder(t, "pb.CreateOrderRequest", "*")
+	got := b.normalize(b.input, map[string]interface{}{
+		"UserID":  "u1",
+		"items":   []interface{}{map[string]interface{}{"ProductId": "p1"}, "not an object"},
+		"unknown": 1,
+	})
+	want := map[string]interface{}{
+		"userid":  "u1",
+		"items":   []interface{}{map[string]interface{}{"productid": "p1"}, "not an object"},
+		"unknown": 1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("normalize = %v, want %v", got, want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, tc := range []struct {
+		input, body, path string
+		ok                bool
+	}{
+		{"pb.UpdateQuantityRequest", "*", "/api/v1/carts/{cartid}/", true},
+		{"pb.GetOrderRequest", "", "/api/v1/orders/{orderId}/", true},
+		{"pb.CreateCartRequest", "item", "/api/v1/carts/", true},
+		{"pb.CreateCartRequest", "items", "/api/v1/carts/", false},
+		{"pb.CreateCartRequest", "", "/api/v1/carts/{item}/", false},
+		{"pb.CreateOrderRequest", "*", "/api/v1/orders/{items}/", false},
+		{"pb.UpdateQuantityRequest", "*", "/api/v1/carts/{unknown}/", false},
+		{"pb.UpdateQuantityRequest", "*", "/api/v1/carts/{cartid=*}/", false},
+		{"pb.UpdateQuantityRequest", "*", "/api/v1/carts/*/", false},
+	} {
+		if err := newBinder(t, tc.input, tc.body).check(tc.path); (err == nil) != tc.ok {
+			t.Errorf("%s %s body %q: check() = %v", tc.input, tc.path, tc.body, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Package httprule serves gRPC services over HTTP/JSON as described by the
+// google.api.http annotations of their rpcs, in the way of grpc-gateway but
+// in process: requests are bound to the rpc request message and go through
+// the gRPC server request codec and the go-kit endpoint of the rpc, so a
+// single proto definition drives both transports. Responses are the JSON of
+// the endpoint responses, as the hand-written handlers of /api/v1 wrote them,
+// not that of the pb messages.
+package httprule
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/tracing/opentracing"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/gorilla/mux"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"google.golang.org/genproto/googleapis/api/annotations"
+)
+
+// Binding serves one rpc over HTTP.
+type Binding struct {
+	Endpoint endpoint.Endpoint
+	// Decode is the request codec of the gRPC server of the rpc.
+	Decode grpctransport.DecodeRequestFunc
+	// Before completes the request message with what HTTP carries outside
+	// of the rule, such as the user of a bearer token. It runs once the rule
+	// is applied, and overrides it.
+	Before func(r *http.Request, msg proto.Message) error
+	// After sets response headers from the response of the endpoint.
+	After func(w http.ResponseWriter, response interface{})
+}
+
+// Options are shared by the routes of a service. Requests that cannot be
+// bound to their rpc fail with an errs.InvalidArgument error.
+type Options struct {
+	ErrorEncoder httptransport.ErrorEncoder
+	Tracer       stdopentracing.Tracer
+	Logger       log.Logger
+}
+
+// Register routes on r the rpcs of service, its full name as in
+// "pb.OrderRpcService", declared in the proto file named file. Every rpc
+// with an http rule needs a binding and every binding a rule; rpcs without
+// a rule have no HTTP route.
+func Register(r *mux.Router, file, service string, bindings map[string]Binding, opts Options) error {
+	fd, err := fileDescriptor(file)
+	if err != nil {
+		return err
+	}
+	var sd *descriptor.ServiceDescriptorProto
+	for _, s := range fd.Service {
+		if fd.GetPackage()+"."+s.GetName() == service {
+			sd = s
+		}
+	}
+	if sd == nil {
+		return fmt.Errorf("httprule: no service %s in %s", service, file)
+	}
+	messages := map[string]*descriptor.DescriptorProto{}
+	addMessages(messages, "."+fd.GetPackage(), fd.MessageType)
+
+	bound := map[string]bool{}
+	for _, md := range sd.Method {
+		rule, err := httpRule(md)
+		if err != nil {
+			return err
+		}
+		if rule == nil {
+			continue
+		}
+		b, ok := bindings[md.GetName()]
+		if !ok {
+			return fmt.Errorf("httprule: no binding for %s.%s", service, md.GetName())
+		}
+		bound[md.GetName()] = true
+		input := messages[md.GetInputType()]
+		msgType := proto.MessageType(strings.TrimPrefix(md.GetInputType(), "."))
+		if input == nil || msgType == nil {
+			return fmt.Errorf("httprule: unknown message %s of %s.%s", md.GetInputType(), service, md.GetName())
+		}
+		for _, rule := range append([]*annotations.HttpRule{rule}, rule.AdditionalBindings...) {
+			method, path, err := pattern(rule)
+			if err != nil {
+				return fmt.Errorf("httprule: %s.%s: %v", service, md.GetName(), err)
+			}
+			bd := &binder{
+				messages: messages,
+				input:    input,
+				msgType:  msgType,
+				body:     rule.Body,
+				before:   b.Before,
+			}
+			if err := bd.check(path); err != nil {
+				return fmt.Errorf("httprule: %s.%s: %v", service, md.GetName(), err)
+			}
+			r.Methods(method).Path(path).Handler(newServer(md.GetName(), b, bd, opts))
+		}
+	}
+	for name := range bindings {
+		if !bound[name] {
+			return fmt.Errorf("httprule: %s.%s has no http rule", service, name)
+		}
+	}
+	return nil
+}
+
+func newServer(name string, b Binding, bd *binder, opts Options) http.Handler {
+	decode := func(ctx context.Context, r *http.Request) (interface{}, error) {
+		msg, err := bd.bind(r)
+		if err != nil {
+			return nil, err
+		}
+		return b.Decode(ctx, msg)
+	}
+	encode := func(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+		if f, ok := response.(interface {
+			Failed() error
+		}); ok && f.Failed() != nil {
+			opts.ErrorEncoder(ctx, f.Failed(), w)
+			return nil
+		}
+		if b.After != nil {
+			b.After(w, response)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		return json.NewEncoder(w).Encode(response)
+	}
+	return httptransport.NewServer(
+		b.Endpoint,
+		decode,
+		encode,
+		httptransport.ServerErrorEncoder(opts.ErrorEncoder),
+		httptransport.ServerErrorLogger(opts.Logger),
+		httptransport.ServerBefore(opentracing.HTTPToContext(opts.Tracer, name, opts.Logger), logging.HTTPToContext),
+	)
+}
+
+// fileDescriptor returns the descriptor protoc-gen-go registered for file.
+func fileDescriptor(file string) (*descriptor.FileDescriptorProto, error) {
+	gz := proto.FileDescriptor(file)
+	if gz == nil {
+		return nil, fmt.Errorf("httprule: proto file %s is not registered", file)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	fd := &descriptor.FileDescriptorProto{}
+	if err := proto.Unmarshal(b, fd); err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+func addMessages(messages map[string]*descriptor.DescriptorProto, prefix string, mds []*descriptor.DescriptorProto) {
+	for _, md := range mds {
+		name := prefix + "." + md.GetName()
+		messages[name] = md
+		addMessages(messages, name, md.NestedType)
+	}
+}
+
+func httpRule(md *descriptor.MethodDescriptorProto) (*annotations.HttpRule, error) {
+	if md.Options == nil || !proto.HasExtension(md.Options, annotations.E_Http) {
+		return nil, nil
+	}
+	ext, err := proto.GetExtension(md.Options, annotations.E_Http)
+	if err != nil {
+		return nil, err
+	}
+	return ext.(*annotations.HttpRule), nil
+}
+
+func pattern(rule *annotations.HttpRule) (method, path string, err error) {
+	switch p := rule.Pattern.(type) {
+	case *annotations.HttpRule_Get:
+		return "GET", p.Get, nil
+	case *annotations.HttpRule_Post:
+		return "POST", p.Post, nil
+	case *annotations.HttpRule_Put:
+		return "PUT", p.Put, nil
+	case *annotations.HttpRule_Delete:
+		return "DELETE", p.Delete, nil
+	case *annotations.HttpRule_Patch:
+		return "PATCH", p.Patch, nil
+	case *annotations.HttpRule_Custom:
+		return p.Custom.Kind, p.Custom.Path, nil
+	}
+	return "", "", fmt.Errorf("unsupported http rule %v", rule)
+}
+
+// newMessage returns a new message of the type of t, a pointer type.
+func newMessage(t reflect.Type) proto.Message {
+	return reflect.New(t.Elem()).Interface().(proto.Message)
+}
@@ -0,0 +1,52 @@
+package httprule
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/laidingqing/dabanshan-go/pb"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+	stdopentracing "github.com/opentracing/opentracing-go"
+)
+
+// v1Order is a response in the shape of API v1, unlike its pb message.
+type v1Order struct {
+	InvoiceID int64  `json:"invoiceID"`
+	UserID    string `json:"userId"`
+	Err       error  `json:"-"`
+}
+
+func (r v1Order) Failed() error { return r.Err }
+
+func TestServerResponse(t *testing.T) {
+	notFound := errs.New(errs.NotFound, "order not found")
+	for _, tc := range []struct {
+		id, want string
+		status   int
+	}{
+		{"o1", `{"invoiceID":1234567890123,"userId":"u1"}`, 200},
+		{"missing", `not found`, 404},
+	} {
+		h := newServer("GetOrder", Binding{
+			Endpoint: func(_ context.Context, request interface{}) (interface{}, error) {
+				if request.(*pb.GetOrderRequest).Orderid == "missing" {
+					return v1Order{Err: notFound}, nil
+				}
+				return v1Order{InvoiceID: 1234567890123, UserID: "u1"}, nil
+			},
+			Decode: func(_ context.Context, msg interface{}) (interface{}, error) { return msg, nil },
+		}, newBinder(t, "pb.GetOrderRequest", ""), Options{
+			ErrorEncoder: errs.EncodeHTTP,
+			Tracer:       stdopentracing.GlobalTracer(),
+			Logger:       log.NewNopLogger(),
+		})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/orders/"+tc.id+"/?orderid="+tc.id, nil))
+		if rec.Code != tc.status || !strings.Contains(rec.Body.String(), tc.want) {
+			t.Errorf("%s: %d %s, want %d %s", tc.id, rec.Code, rec.Body.String(), tc.status, tc.want)
+		}
+	}
+}
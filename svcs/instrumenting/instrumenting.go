@@ -0,0 +1,132 @@
+// Package instrumenting holds the metrics every binary reports the same way:
+// the rate, errors and duration of its endpoints, by method and outcome, and
+// the latency of the database operations of the services. Business metrics
+// are each service's own, counted by its service instrumenting middleware.
+package instrumenting
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
+	"github.com/laidingqing/dabanshan-go/svcs/tracing"
+)
+
+// Namespace is the Prometheus namespace of the metrics of every binary.
+const Namespace = "dabanshan"
+
+// The outcomes of a call.
+const (
+	Success     = "success"
+	ClientError = "client_error"
+	ServerError = "server_error"
+)
+
+// Outcome returns the outcome of a call failing with err: Success for nil,
+// ClientError for errors of the caller, such as an invalid argument or an
+// unknown id, and ServerError for the others.
+func Outcome(err error) string {
+	if err == nil {
+		return Success
+	}
+	switch errs.CodeOf(err) {
+	case errs.InvalidArgument, errs.NotFound, errs.Unauthenticated, errs.PermissionDenied, errs.Conflict:
+		return ClientError
+	}
+	return ServerError
+}
+
+// EndpointMetrics are the RED metrics of the endpoints of a binary.
+type EndpointMetrics struct {
+	// Requests counts calls, by method and outcome.
+	Requests metrics.Counter
+	// Errors counts failed calls, by method and errs code.
+	Errors metrics.Counter
+	// Duration observes the latency of calls in seconds, by method and
+	// outcome.
+	Duration metrics.Histogram
+}
+
+// NewEndpointMetrics returns the Prometheus EndpointMetrics of subsystem,
+// such as "orders".
+func NewEndpointMetrics(subsystem string) EndpointMetrics {
+	return EndpointMetrics{
+		Requests: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: subsystem,
+			Name:      "requests_total",
+			Help:      "Requests served, by method and outcome.",
+		}, []string{"method", "outcome"}),
+		Errors: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: subsystem,
+			Name:      "request_errors_total",
+			Help:      "Requests failed, by method and error code.",
+		}, []string{"method", "code"}),
+		Duration: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: Namespace,
+			Subsystem: subsystem,
+			Name:      "request_duration_seconds",
+			Help:      "Request duration in seconds, by method and outcome.",
+			Buckets:   stdprometheus.DefBuckets,
+		}, []string{"method", "outcome"}),
+	}
+}
+
+// Middleware records the calls to the endpoint of method.
+func (m EndpointMetrics) Middleware(method string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			defer func(begin time.Time) {
+				outcome := Outcome(err)
+				m.Requests.With("method", method, "outcome", outcome).Add(1)
+				if err != nil {
+					m.Errors.With("method", method, "code", string(errs.CodeOf(err))).Add(1)
+				}
+				m.Duration.With("method", method, "outcome", outcome).Observe(time.Since(begin).Seconds())
+			}(time.Now())
+			return next(ctx, request)
+		}
+	}
+}
+
+// NewDBDuration returns the Prometheus histogram of the latency of the
+// database operations of subsystem, by db, operation and outcome, observed
+// by DBOperation.
+func NewDBDuration(subsystem string) metrics.Histogram {
+	return prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: subsystem,
+		Name:      "db_operation_duration_seconds",
+		Help:      "Database operation duration in seconds, by db, operation and outcome.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"db", "operation", "outcome"})
+}
+
+// DBOperation traces the operation op on the database db, observes its
+// latency with duration, labeled with the outcome success or error, and logs
+// it at debug level with the request id of ctx, until the returned func is
+// called with the error of the operation:
+//
+//	defer instrumenting.DBOperation(ctx, Duration, database, "GetOrder")(&err)
+func DBOperation(ctx context.Context, duration metrics.Histogram, db, op string) func(*error) {
+	finish := tracing.DBSpan(ctx, db, op)
+	begin := time.Now()
+	return func(err *error) {
+		outcome := Success
+		if *err != nil {
+			outcome = "error"
+		}
+		took := time.Since(begin)
+		duration.With("db", db, "operation", op, "outcome", outcome).Observe(took.Seconds())
+		level.Debug(logging.FromContext(ctx)).Log("db", db, "operation", op, "took", took, "err", *err)
+		finish(err)
+	}
+}
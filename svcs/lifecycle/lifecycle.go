@@ -0,0 +1,93 @@
+// Package lifecycle provides the actors of the oklog groups of the binaries:
+// servers that drain their requests when interrupted, and the wait for the
+// signals stopping a binary.
+//
+// A group interrupts its actors one after the other, in the order they were
+// added, and the interrupt funcs here return at once, the draining going on
+// in the background until the execute func returns. Actors that must be done
+// before the servers stop accepting connections, such as deregistering the
+// instance, are to be added before them and to block in their interrupt.
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// HTTPServer returns the actor serving srv on l. When interrupted, srv stops
+// accepting connections and the execute func returns once the requests in
+// flight are served, or timeout has passed and their connections are closed.
+func HTTPServer(srv *http.Server, l net.Listener, timeout time.Duration) (func() error, func(error)) {
+	drained := make(chan error, 1)
+	return func() error {
+			if err := srv.Serve(l); err != http.ErrServerClosed {
+				return err
+			}
+			return <-drained
+		}, func(error) {
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				err := srv.Shutdown(ctx)
+				if err == context.DeadlineExceeded {
+					err = srv.Close()
+				}
+				drained <- err
+			}()
+		}
+}
+
+// GRPCServer returns the actor serving srv on l. When interrupted, srv stops
+// accepting connections and calls, and the execute func returns once the
+// calls in flight are done, or timeout has passed and they are cancelled.
+func GRPCServer(srv *grpc.Server, l net.Listener, timeout time.Duration) (func() error, func(error)) {
+	drained := make(chan struct{})
+	return func() error {
+			if err := srv.Serve(l); err != nil && err != grpc.ErrServerStopped {
+				return err
+			}
+			<-drained
+			return nil
+		}, func(error) {
+			go func() {
+				defer close(drained)
+				stopped := make(chan struct{})
+				go func() {
+					srv.GracefulStop()
+					close(stopped)
+				}()
+				select {
+				case <-stopped:
+				case <-time.After(timeout):
+					srv.Stop()
+				}
+			}()
+		}
+}
+
+// Signals returns the actor returning when the binary receives SIGINT or
+// SIGTERM.
+func Signals() (func() error, func(error)) {
+	c := make(chan os.Signal, 1)
+	cancel := make(chan struct{})
+	return func() error {
+			signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+			defer signal.Stop(c)
+			select {
+			case sig := <-c:
+				return fmt.Errorf("received signal %s", sig)
+			case <-cancel:
+				return nil
+			}
+		}, func(error) {
+			close(cancel)
+		}
+}
@@ -0,0 +1,189 @@
+package lifecycle
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// run runs an actor, returning the channel its execute func returns on.
+func run(execute func() error) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- execute() }()
+	return done
+}
+
+func returned(t *testing.T, done <-chan error, within time.Duration) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(within):
+		t.Fatalf("not returned within %v", within)
+		return nil
+	}
+}
+
+func TestHTTPServerDrains(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		w.Write([]byte("served"))
+	})}
+	l := listen(t)
+	execute, interrupt := HTTPServer(srv, l, time.Minute)
+	done := run(execute)
+
+	answered := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			answered <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		answered <- string(body)
+	}()
+	<-entered
+	interrupt(nil)
+	time.Sleep(20 * time.Millisecond)
+	if _, err := net.DialTimeout("tcp", l.Addr().String(), time.Second); err == nil {
+		t.Error("new connections accepted while draining")
+	}
+	select {
+	case <-done:
+		t.Fatal("returned with a request in flight")
+	default:
+	}
+
+	close(release)
+	if err := returned(t, done, time.Second); err != nil {
+		t.Error(err)
+	}
+	if got := <-answered; got != "served" {
+		t.Errorf("request in flight: %q", got)
+	}
+}
+
+func TestHTTPServerTimeout(t *testing.T) {
+	entered := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-r.Context().Done()
+	})}
+	l := listen(t)
+	execute, interrupt := HTTPServer(srv, l, 20*time.Millisecond)
+	done := run(execute)
+	failed := make(chan error, 1)
+	go func() {
+		_, err := http.Get("http://" + l.Addr().String())
+		failed <- err
+	}()
+	<-entered
+	interrupt(nil)
+	if err := returned(t, done, time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := <-failed; err == nil {
+		t.Error("request past the timeout answered")
+	}
+}
+
+// blockingServer is a gRPC server whose every call blocks until release is
+// closed or the call is cancelled.
+func blockingServer(entered chan<- struct{}, release <-chan struct{}) *grpc.Server {
+	return grpc.NewServer(grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+		if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+			return err
+		}
+		entered <- struct{}{}
+		select {
+		case <-release:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+		return stream.SendMsg(&emptypb.Empty{})
+	}))
+}
+
+func call(t *testing.T, addr string) <-chan error {
+	t.Helper()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	errc := make(chan error, 1)
+	go func() {
+		errc <- conn.Invoke(context.Background(), "/test.Svc/Call", &emptypb.Empty{}, &emptypb.Empty{})
+	}()
+	return errc
+}
+
+func TestGRPCServerDrains(t *testing.T) {
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	l := listen(t)
+	execute, interrupt := GRPCServer(blockingServer(entered, release), l, time.Minute)
+	done := run(execute)
+	errc := call(t, l.Addr().String())
+	<-entered
+
+	interrupt(nil)
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("returned with a call in flight")
+	default:
+	}
+	close(release)
+	if err := returned(t, done, time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("call in flight: %v", err)
+	}
+}
+
+func TestGRPCServerTimeout(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	l := listen(t)
+	execute, interrupt := GRPCServer(blockingServer(entered, nil), l, 20*time.Millisecond)
+	done := run(execute)
+	errc := call(t, l.Addr().String())
+	<-entered
+
+	interrupt(nil)
+	if err := returned(t, done, time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := <-errc; err == nil {
+		t.Error("call past the timeout answered")
+	}
+}
+
+func TestSignalsInterrupt(t *testing.T) {
+	execute, interrupt := Signals()
+	done := run(execute)
+	interrupt(nil)
+	if err := returned(t, done, time.Second); err != nil {
+		t.Errorf("interrupted: %v", err)
+	}
+}
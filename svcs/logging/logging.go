@@ -0,0 +1,192 @@
+// Package logging sets up the structured logger of a binary, selected by
+// command line flags, and ties the log lines of a request together: the
+// gateway gives every request an id, passed on to the services in gRPC
+// metadata, and the loggers of the service, endpoint and db layers add it to
+// each line they write for the request.
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Flags are the command line flags configuring the logger.
+type Flags struct {
+	format *string
+	level  *Level
+}
+
+// RegisterFlags defines the logging flags on fs. -log.level may be set again
+// while the logger runs, on a config reload.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{
+		format: fs.String("log.format", "json", "Log format: json or logfmt"),
+		level:  &Level{},
+	}
+	f.level.Set("info")
+	fs.Var(f.level, "log.level", "Lowest level logged: debug, info, warn or error")
+	return f
+}
+
+// New returns the logger of service selected by the flags, writing to
+// stderr, and makes it the logger of FromContext.
+func (f *Flags) New(service string) (log.Logger, error) {
+	logger, err := newLogger(os.Stderr, *f.format, f.level)
+	if err != nil {
+		return nil, err
+	}
+	logger = log.With(logger, "service", service)
+	SetDefault(logger)
+	return logger, nil
+}
+
+// New returns a logger writing lines of format, json or logfmt, to w, with
+// a timestamp and the caller. Lines below level are dropped, lines without
+// a level are kept, and the values of sensitive keys are redacted.
+func New(w io.Writer, format, lvl string) (log.Logger, error) {
+	l := &Level{}
+	if err := l.Set(lvl); err != nil {
+		return nil, err
+	}
+	return newLogger(w, format, l)
+}
+
+func newLogger(w io.Writer, format string, lvl *Level) (log.Logger, error) {
+	var logger log.Logger
+	switch format {
+	case "json":
+		logger = log.NewJSONLogger(log.NewSyncWriter(w))
+	case "logfmt":
+		logger = log.NewLogfmtLogger(log.NewSyncWriter(w))
+	default:
+		return nil, fmt.Errorf("logging: unknown format %q", format)
+	}
+	logger = redactor{logger}
+	logger = filter{logger, lvl}
+	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+	logger = log.With(logger, "caller", log.DefaultCaller)
+	return logger, nil
+}
+
+// levels are the levels by increasing severity.
+var levels = []string{"debug", "info", "warn", "error"}
+
+// Level is the lowest level logged, a flag.Value that can be set while the
+// loggers filtering with it run.
+type Level struct {
+	min int32
+}
+
+// String implements flag.Value.
+func (l *Level) String() string {
+	if l == nil {
+		return ""
+	}
+	return levels[atomic.LoadInt32(&l.min)]
+}
+
+// Set implements flag.Value.
+func (l *Level) Set(s string) error {
+	for i, name := range levels {
+		if name == s {
+			atomic.StoreInt32(&l.min, int32(i))
+			return nil
+		}
+	}
+	return fmt.Errorf("logging: unknown level %q", s)
+}
+
+// filter drops the lines below its level. Lines without a level are kept.
+type filter struct {
+	next  log.Logger
+	level *Level
+}
+
+func (f filter) Log(keyvals ...interface{}) error {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] != level.Key() {
+			continue
+		}
+		v, ok := keyvals[i+1].(level.Value)
+		if !ok {
+			break
+		}
+		min := atomic.LoadInt32(&f.level.min)
+		for j, name := range levels {
+			if name == v.String() && int32(j) < min {
+				return nil
+			}
+		}
+		break
+	}
+	return f.next.Log(keyvals...)
+}
+
+// Redacted replaces the values of sensitive keys.
+const Redacted = "[redacted]"
+
+// sensitiveKeys are the substrings of the keys, lower cased, whose values are
+// never written.
+var sensitiveKeys = []string{"password", "passwd", "secret", "token", "authorization", "salt"}
+
+// Sensitive reports whether the values of key are redacted.
+func Sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactor replaces the values of sensitive keys before they are written.
+type redactor struct {
+	next log.Logger
+}
+
+func (r redactor) Log(keyvals ...interface{}) error {
+	var redacted []interface{}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		key, ok := keyvals[i].(string)
+		if !ok || !Sensitive(key) {
+			continue
+		}
+		if redacted == nil {
+			redacted = append([]interface{}(nil), keyvals...)
+		}
+		redacted[i+1] = Redacted
+	}
+	if redacted != nil {
+		keyvals = redacted
+	}
+	return r.next.Log(keyvals...)
+}
+
+var (
+	mtx           sync.RWMutex
+	defaultLogger = log.NewNopLogger()
+)
+
+// SetDefault makes logger the logger of FromContext, for the layers that are
+// given no logger, such as the db packages.
+func SetDefault(logger log.Logger) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	defaultLogger = logger
+}
+
+// Default returns the logger set by SetDefault, a nop logger until then.
+func Default() log.Logger {
+	mtx.RLock()
+	defer mtx.RUnlock()
+	return defaultLogger
+}
@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+func TestRedact(t *testing.T) {
+	for _, format := range []string{"json", "logfmt"} {
+		var buf bytes.Buffer
+		logger, err := New(&buf, format, "debug")
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger.Log("user", "u1", "password", "hunter2", "Token", "eyJhbGciOi", "authorization", "Bearer eyJhbGciOi", "newPassword", "hunter3")
+		line := buf.String()
+		for _, secret := range []string{"hunter2", "hunter3", "eyJhbGciOi"} {
+			if strings.Contains(line, secret) {
+				t.Errorf("%s: %q written in %s", format, secret, line)
+			}
+		}
+		if !strings.Contains(line, "u1") || strings.Count(line, Redacted) != 4 {
+			t.Errorf("%s: %s", format, line)
+		}
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := New(&buf, "json", "info")
+	logger.Log("msg", "login", "password", "hunter2")
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["password"] != Redacted || line["msg"] != "login" || line["ts"] == nil || line["caller"] == nil {
+		t.Errorf("line %v", line)
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Level{}
+	l.Set("info")
+	logger, err := newLogger(&buf, "logfmt", l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logAll := func() []string {
+		buf.Reset()
+		level.Debug(logger).Log("msg", "d")
+		level.Info(logger).Log("msg", "i")
+		level.Warn(logger).Log("msg", "w")
+		level.Error(logger).Log("msg", "e")
+		logger.Log("msg", "none")
+		var msgs []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			msgs = append(msgs, line[strings.LastIndex(line, "msg=")+4:])
+		}
+		return msgs
+	}
+	for _, tc := range []struct {
+		level string
+		want  string
+	}{
+		{"info", "i w e none"},
+		{"error", "e none"},
+		{"debug", "d i w e none"},
+		{"warn", "w e none"},
+	} {
+		if err := l.Set(tc.level); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(logAll(), " "); got != tc.want {
+			t.Errorf("level %s: logged %q, want %q", tc.level, got, tc.want)
+		}
+	}
+	if err := l.Set("verbose"); err == nil || l.String() != "warn" {
+		t.Errorf("unknown level: %v, level %s", err, l)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "xml", "info"); err == nil {
+		t.Error("unknown format: no error")
+	}
+	if _, err := New(&bytes.Buffer{}, "json", "trace"); err == nil {
+		t.Error("unknown level: no error")
+	}
+}
+
+func TestDefault(t *testing.T) {
+	prev := Default()
+	t.Cleanup(func() { SetDefault(prev) })
+	var buf bytes.Buffer
+	SetDefault(log.NewLogfmtLogger(&buf))
+	Default().Log("msg", "hello")
+	if buf.String() != "msg=hello\n" {
+		t.Errorf("logged %q", buf.String())
+	}
+}
@@ -0,0 +1,171 @@
+package logging
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"google.golang.org/grpc/metadata"
+)
+
+// RequestIDHeader is the header carrying the id of a request over HTTP, and
+// requestIDKey the gRPC metadata key.
+const (
+	RequestIDHeader = "X-Request-ID"
+	requestIDKey    = "x-request-id"
+)
+
+// maxRequestID bounds the length of the ids accepted from clients.
+const maxRequestID = 128
+
+type requestIDKeyType struct{}
+
+// NewContext returns a copy of ctx carrying the request id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKeyType{}, id)
+}
+
+// RequestID returns the request id of ctx, "" if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKeyType{}).(string)
+	return id
+}
+
+// NewRequestID returns a random request id.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether an id sent by a client is kept: printable
+// ASCII of reasonable length, so that it cannot forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// With returns logger adding the request id of ctx to its lines.
+func With(ctx context.Context, logger log.Logger) log.Logger {
+	if id := RequestID(ctx); id != "" {
+		return log.With(logger, "request_id", id)
+	}
+	return logger
+}
+
+// FromContext returns the default logger, adding the request id of ctx.
+func FromContext(ctx context.Context) log.Logger {
+	return With(ctx, Default())
+}
+
+// HTTPToContext is a go-kit transport/http.RequestFunc moving the
+// X-Request-ID header of requests into their context.
+func HTTPToContext(ctx context.Context, r *http.Request) context.Context {
+	if id := r.Header.Get(RequestIDHeader); validRequestID(id) {
+		return NewContext(ctx, id)
+	}
+	return ctx
+}
+
+// ContextToGRPC is a go-kit transport/grpc.ClientRequestFunc passing the
+// request id of the context on in the metadata of calls.
+func ContextToGRPC(ctx context.Context, md *metadata.MD) context.Context {
+	if id := RequestID(ctx); id != "" {
+		(*md)[requestIDKey] = []string{id}
+	}
+	return ctx
+}
+
+// GRPCToContext is a go-kit transport/grpc.ServerRequestFunc moving the
+// request id of the metadata of calls into their context.
+func GRPCToContext(ctx context.Context, md metadata.MD) context.Context {
+	if ids := md.Get(requestIDKey); len(ids) > 0 && validRequestID(ids[0]) {
+		return NewContext(ctx, ids[0])
+	}
+	return ctx
+}
+
+// RequestMiddleware gives every request an id, the X-Request-ID header of the
+// client if valid or a new one, returns it in the X-Request-ID header of the
+// response and puts it in the request context. Every request is logged once
+// served, with its status and duration.
+func RequestMiddleware(logger log.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if !validRequestID(id) {
+				id = NewRequestID()
+				r.Header.Set(RequestIDHeader, id)
+			}
+			w.Header().Set(RequestIDHeader, id)
+			ctx := NewContext(r.Context(), id)
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			begin := time.Now()
+			next.ServeHTTP(sw, r.WithContext(ctx))
+			lvl := level.Info
+			if sw.status >= http.StatusInternalServerError {
+				lvl = level.Error
+			}
+			lvl(With(ctx, logger)).Log(
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", sw.status,
+				"bytes", sw.bytes,
+				"took", time.Since(begin),
+				"remote", r.RemoteAddr,
+			)
+		})
+	}
+}
+
+// statusWriter records the status and size of a response. Flush passes
+// through, for streamed responses such as order exports.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+	wrote  bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wrote {
+		w.status, w.wrote = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("logging: response writer does not support hijacking")
+}
@@ -0,0 +1,97 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc/metadata"
+)
+
+// serve runs a request with the X-Request-ID header id, "" for none,
+// through RequestMiddleware, returning the response, the id the handler
+// got in its context and the log line.
+func serve(t *testing.T, id string) (*httptest.ResponseRecorder, string, string) {
+	t.Helper()
+	var logged bytes.Buffer
+	var got string
+	h := RequestMiddleware(log.NewLogfmtLogger(&logged))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = RequestID(r.Context())
+		if r.Header.Get(RequestIDHeader) != got {
+			t.Errorf("header %q, context %q", r.Header.Get(RequestIDHeader), got)
+		}
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	r := httptest.NewRequest("GET", "/api/v1/orders/", nil)
+	if id != "" {
+		r.Header.Set(RequestIDHeader, id)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec, got, logged.String()
+}
+
+func TestRequestMiddleware(t *testing.T) {
+	rec, id, line := serve(t, "req-42")
+	if id != "req-42" || rec.Header().Get(RequestIDHeader) != "req-42" {
+		t.Errorf("id %q, response header %q, want the id of the client", id, rec.Header().Get(RequestIDHeader))
+	}
+	if !strings.Contains(line, "request_id=req-42") || !strings.Contains(line, "status=418") || !strings.Contains(line, "path=/api/v1/orders/") {
+		t.Errorf("logged %q", line)
+	}
+
+	for _, invalid := range []string{"", "a b", "id\nlevel=error", strings.Repeat("x", maxRequestID+1)} {
+		rec, id, _ := serve(t, invalid)
+		if id == invalid || len(id) != 32 || rec.Header().Get(RequestIDHeader) != id {
+			t.Errorf("%q: id %q, response header %q, want a new id", invalid, id, rec.Header().Get(RequestIDHeader))
+		}
+	}
+	if _, a, _ := serve(t, ""); a == id {
+		t.Error("two requests of one id")
+	}
+}
+
+func TestHTTPToContext(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(RequestIDHeader, "req-42")
+	if id := RequestID(HTTPToContext(context.Background(), r)); id != "req-42" {
+		t.Errorf("id %q", id)
+	}
+	r.Header.Set(RequestIDHeader, "a\tb")
+	if id := RequestID(HTTPToContext(context.Background(), r)); id != "" {
+		t.Errorf("invalid id kept: %q", id)
+	}
+}
+
+func TestGRPCMetadata(t *testing.T) {
+	// the client side writes the metadata, the server side gets it as sent
+	md := metadata.MD{}
+	ContextToGRPC(NewContext(context.Background(), "req-42"), &md)
+	sent, _ := metadata.FromOutgoingContext(metadata.NewOutgoingContext(context.Background(), md))
+	ctx := GRPCToContext(context.Background(), sent)
+	if id := RequestID(ctx); id != "req-42" {
+		t.Errorf("id %q carried, want req-42", id)
+	}
+
+	md = metadata.MD{}
+	ContextToGRPC(context.Background(), &md)
+	if len(md) != 0 {
+		t.Errorf("metadata %v of no request id", md)
+	}
+	if id := RequestID(GRPCToContext(context.Background(), metadata.Pairs(requestIDKey, "a\nb"))); id != "" {
+		t.Errorf("invalid id kept: %q", id)
+	}
+}
+
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+	With(NewContext(context.Background(), "req-42"), log.NewLogfmtLogger(&buf)).Log("msg", "hello")
+	With(context.Background(), log.NewLogfmtLogger(&buf)).Log("msg", "bye")
+	if want := "request_id=req-42 msg=hello\nmsg=bye\n"; buf.String() != want {
+		t.Errorf("logged %q, want %q", buf.String(), want)
+	}
+}
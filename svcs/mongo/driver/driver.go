@@ -0,0 +1,142 @@
+// Package driver connects the backends of the services built on the official
+// MongoDB driver, with the pool and timeouts of the -mongo.* flags of
+// svcs/mongo.
+//
+// The servers are given by -mongodriver.uri, a connection string which may
+// name a replica set and turn on TLS:
+//
+//	mongodb://db1:27017,db2:27017,db3:27017/?replicaSet=rs0&tls=true&tlsCAFile=/etc/ssl/mongo-ca.pem
+package driver
+
+import (
+	"context"
+	"flag"
+	"strings"
+
+	s_mongo "github.com/laidingqing/dabanshan-go/svcs/mongo"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
+)
+
+var (
+	uri      = "mongodb://127.0.0.1:27017"
+	database = "test"
+)
+
+// RegisterFlags defines the flags of the connection on fs.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&uri, "mongodriver.uri", uri, "MongoDB connection string, with the replica set, credentials and TLS options")
+	fs.StringVar(&database, "mongodriver.database", database, "MongoDB database")
+}
+
+// Conn is a connection to the database of -mongodriver.database.
+type Conn struct {
+	Client *mongo.Client
+	DB     *mongo.Database
+	// Transactions is whether the servers support multi-document
+	// transactions: replica sets and sharded clusters do, a standalone server
+	// does not.
+	Transactions bool
+	opts         s_mongo.Options
+}
+
+// Connect connects to the servers of -mongodriver.uri, waiting for them to
+// answer within -mongo.dial-timeout.
+func Connect(ctx context.Context) (*Conn, error) {
+	return ConnectTo(ctx, uri, database)
+}
+
+// ConnectTo connects to the database name of the servers of uri.
+func ConnectTo(ctx context.Context, uri, name string) (*Conn, error) {
+	o := s_mongo.Flags()
+	client, err := mongo.Connect(options.Client().
+		ApplyURI(uri).
+		SetConnectTimeout(o.DialTimeout).
+		SetServerSelectionTimeout(o.DialTimeout).
+		SetMaxPoolSize(uint64(o.PoolSize)).
+		// Decode like mgo: doubles into the float32 fields of the models,
+		// times in the local time zone.
+		SetBSONOptions(&options.BSONOptions{AllowTruncatingDoubles: true, UseLocalTimeZone: true}))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, o.DialTimeout)
+	defer cancel()
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	return &Conn{
+		Client:       client,
+		DB:           client.Database(name),
+		Transactions: hello.SetName != "" || hello.Msg == "isdbgrid",
+		opts:         o,
+	}, nil
+}
+
+// Context returns ctx bounded by -mongo.timeout, for one operation.
+func (c *Conn) Context(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, c.opts.Timeout)
+}
+
+// Ping checks that the primary answers.
+func (c *Conn) Ping(ctx context.Context) error {
+	ctx, cancel := c.Context(ctx)
+	defer cancel()
+	return c.Client.Ping(ctx, readpref.Primary())
+}
+
+// Close disconnects, waiting for the operations in flight up to
+// -mongo.timeout.
+func (c *Conn) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+	c.Client.Disconnect(ctx)
+}
+
+// Transaction runs fn in a transaction if the servers support them, retried
+// on transient errors by the driver, or else runs it as is.
+func (c *Conn) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !c.Transactions {
+		return fn(ctx)
+	}
+	session, err := c.Client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+	_, err = session.WithTransaction(ctx, func(ctx context.Context) (interface{}, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
+
+// ObjectID parses the hex id, reporting whether it is valid.
+func ObjectID(id string) (bson.ObjectID, bool) {
+	oid, err := bson.ObjectIDFromHex(id)
+	return oid, err == nil
+}
+
+// Sort translates sort fields, prefixed with "-" for descending order, into a
+// sort document.
+func Sort(fields []string) bson.D {
+	sort := bson.D{}
+	for _, f := range fields {
+		if strings.HasPrefix(f, "-") {
+			sort = append(sort, bson.E{Key: strings.TrimPrefix(f, "-"), Value: -1})
+		} else {
+			sort = append(sort, bson.E{Key: f, Value: 1})
+		}
+	}
+	return sort
+}
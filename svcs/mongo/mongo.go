@@ -0,0 +1,176 @@
+// Package mongo holds the pool and timeout settings shared by the Mongo
+// backends of the services, and runs the operations of their mgo backends
+// within the deadline of their request.
+//
+// mgo cannot cancel an operation in flight, so Do bounds it instead: the
+// socket and server selection timeouts of its session are cut to the time
+// left before the deadline of the context, and Do returns as soon as the
+// context is done, the operation winding down in the background within that
+// deadline.
+package mongo
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Options are the settings of the connection pool and the timeouts of the
+// operations.
+type Options struct {
+	// DialTimeout bounds connecting to the servers in Dial.
+	DialTimeout time.Duration
+	// Timeout bounds each operation, whatever the deadline of its request.
+	Timeout time.Duration
+	// PoolSize is the most connections open to each server.
+	PoolSize int
+	// SocketTimeout bounds each read or write of a connection.
+	SocketTimeout time.Duration
+}
+
+// DefaultOptions are the defaults of the flags of RegisterFlags.
+var DefaultOptions = Options{
+	DialTimeout:   5 * time.Second,
+	Timeout:       5 * time.Second,
+	PoolSize:      100,
+	SocketTimeout: 30 * time.Second,
+}
+
+// flags are the Options set by the flags of RegisterFlags.
+var flags = DefaultOptions
+
+// RegisterFlags defines the flags of the Options of the backends on fs.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&flags.DialTimeout, "mongo.dial-timeout", flags.DialTimeout, "Time allowed to connect to Mongo")
+	fs.DurationVar(&flags.Timeout, "mongo.timeout", flags.Timeout, "Time allowed to each Mongo operation, within the deadline of its request")
+	fs.IntVar(&flags.PoolSize, "mongo.pool-size", flags.PoolSize, "Most connections open to each Mongo server")
+	fs.DurationVar(&flags.SocketTimeout, "mongo.socket-timeout", flags.SocketTimeout, "Time allowed to each read or write of a Mongo connection, with mgo")
+}
+
+// Flags returns the Options set by the flags of RegisterFlags.
+func Flags() Options {
+	return flags
+}
+
+// Validate reports the first invalid setting of the flags of RegisterFlags.
+func Validate() error {
+	return flags.Validate()
+}
+
+// Validate reports the first invalid setting of o.
+func (o Options) Validate() error {
+	switch {
+	case o.DialTimeout <= 0:
+		return fmt.Errorf("-mongo.dial-timeout %v is not positive", o.DialTimeout)
+	case o.Timeout <= 0:
+		return fmt.Errorf("-mongo.timeout %v is not positive", o.Timeout)
+	case o.PoolSize <= 0:
+		return fmt.Errorf("-mongo.pool-size %d is not positive", o.PoolSize)
+	case o.SocketTimeout <= 0:
+		return fmt.Errorf("-mongo.socket-timeout %v is not positive", o.SocketTimeout)
+	}
+	return nil
+}
+
+// ErrNotConnected is returned by Do before the session is dialed.
+var ErrNotConnected = errors.New("mongodb: not connected")
+
+// Dial connects to the servers of url with the pool and timeouts of o, within
+// the deadline of ctx if sooner than o.DialTimeout.
+func Dial(ctx context.Context, url string, o Options) (*mgo.Session, error) {
+	info, err := mgo.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	info.Timeout = within(ctx, o.DialTimeout)
+	info.PoolLimit = o.PoolSize
+	s, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	s.SetSocketTimeout(o.SocketTimeout)
+	return s, nil
+}
+
+// Do runs fn on a copy of master, with the timeouts of the copy bounded by
+// o.Timeout and the deadline of ctx. It returns the error of ctx if ctx is
+// done first. After a network error the copy is refreshed, dropping its
+// broken connection, so that mgo redials for the next operation.
+func Do(ctx context.Context, master *mgo.Session, o Options, fn func(*mgo.Session) error) error {
+	return do(ctx, master, o, false, fn)
+}
+
+// Retry is Do for operations that are safe to run twice, reads and upserts by
+// id: after a network error fn is run once more, on the refreshed copy.
+func Retry(ctx context.Context, master *mgo.Session, o Options, fn func(*mgo.Session) error) error {
+	return do(ctx, master, o, true, fn)
+}
+
+func do(ctx context.Context, master *mgo.Session, o Options, retry bool, fn func(*mgo.Session) error) error {
+	if master == nil {
+		return ErrNotConnected
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, o.Timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		s := master.Copy()
+		defer s.Close()
+		err := run(ctx, s, o, fn)
+		if IsNetworkError(err) {
+			s.Refresh()
+			if retry && ctx.Err() == nil {
+				err = run(ctx, s, o, fn)
+			}
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func run(ctx context.Context, s *mgo.Session, o Options, fn func(*mgo.Session) error) error {
+	s.SetSyncTimeout(within(ctx, o.Timeout))
+	s.SetSocketTimeout(within(ctx, o.SocketTimeout))
+	return fn(s)
+}
+
+// within returns d, or the time left before the deadline of ctx if sooner.
+func within(ctx context.Context, d time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < d {
+			if left <= 0 {
+				// mgo takes 0 for no timeout.
+				return time.Millisecond
+			}
+			return left
+		}
+	}
+	return d
+}
+
+// IsNetworkError reports whether err comes from a broken or timed out
+// connection, rather than from the server.
+func IsNetworkError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
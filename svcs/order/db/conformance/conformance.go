@@ -0,0 +1,269 @@
+// Package conformance holds the behaviour every backend of svcs/order/db
+// shares, as tests each backend runs against a live database, connected by
+// svcs/conformance, in its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, &Mongo{conn: s_conformance.Driver(t, name)})
+//	}
+package conformance
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/laidingqing/dabanshan-go/svcs/order/db"
+	m_order "github.com/laidingqing/dabanshan-go/svcs/order/model"
+	"github.com/laidingqing/dabanshan-go/utils"
+)
+
+// MissingID is an id in the format of every backend that no order or cart
+// item has.
+const MissingID = "000000000000000000000001"
+
+// Run runs the tests against d, connected. The orders and carts it creates
+// belong to users of their own, but CancelExpiredOrders and PurgeCarts are
+// run on all of them: d should hold no data worth keeping.
+func Run(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	user := func(name string) string { return name + "-" + suffix }
+	createOrder := func(t *testing.T, userID string, amount float32, productID string) string {
+		t.Helper()
+		inv := m_order.New()
+		inv.UserID = userID
+		inv.TenantID = "tenant-" + suffix
+		inv.Amount = amount
+		inv.Status = m_order.OrderStatusCreated
+		inv.OrdereItem = []m_order.OrderItem{{ProductID: productID, Quantity: 1, Price: amount, Total: amount}}
+		id, err := d.CreateOrder(ctx, &inv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	addCart := func(t *testing.T, userID, cartToken, productID string, quantity int32) m_order.Cart {
+		t.Helper()
+		cart := m_order.Cart{UserID: userID, CartToken: cartToken, ProductID: productID, Price: 2.5, Quantity: quantity}
+		id, err := d.AddCart(ctx, &cart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == "" || cart.CartID != id {
+			t.Fatalf("AddCart: id %q, cart id %q", id, cart.CartID)
+		}
+		return cart
+	}
+	quantities := func(t *testing.T, userID, cartToken string) map[string]int32 {
+		t.Helper()
+		items, err := d.GetCartItems(ctx, userID, cartToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := map[string]int32{}
+		for _, item := range items {
+			q[item.ProductID] = item.Quantity
+		}
+		return q
+	}
+
+	t.Run("Ping", func(t *testing.T) {
+		if err := d.Ping(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("CreateOrder", func(t *testing.T) {
+		id := createOrder(t, user("create"), 12.5, "p1")
+		got, err := d.GetOrder(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.UserID != user("create") || got.Amount != 12.5 || got.Status != m_order.OrderStatusCreated || got.CreatedAt.IsZero() {
+			t.Errorf("GetOrder: got %+v", got)
+		}
+		if len(got.OrdereItem) != 1 || got.OrdereItem[0].ProductID != "p1" {
+			t.Errorf("GetOrder: items %+v", got.OrdereItem)
+		}
+		if _, err := d.GetOrder(ctx, MissingID); err != db.ErrNotFound {
+			t.Errorf("GetOrder: got %v, want %v", err, db.ErrNotFound)
+		}
+		if _, err := d.GetOrder(ctx, "not an id"); err != db.ErrInvalidID {
+			t.Errorf("GetOrder: got %v, want %v", err, db.ErrInvalidID)
+		}
+	})
+
+	t.Run("FindOrders", func(t *testing.T) {
+		u := user("find")
+		createOrder(t, u, 10, "p1")
+		createOrder(t, u, 20, "p2")
+		createOrder(t, u, 30, "p2")
+		for _, tc := range []struct {
+			name  string
+			query m_order.OrderQuery
+			page  utils.Pagination
+			count int
+			want  []float32
+		}{
+			{"first page", m_order.OrderQuery{UserID: u}, utils.Pagination{PageIndex: 1, PageSize: 2, Sortor: []string{"-amount"}}, 3, []float32{30, 20}},
+			{"last page", m_order.OrderQuery{UserID: u}, utils.Pagination{PageIndex: 2, PageSize: 2, Sortor: []string{"-amount"}}, 3, []float32{10}},
+			{"ascending", m_order.OrderQuery{UserID: u}, utils.Pagination{PageIndex: 1, PageSize: 10, Sortor: []string{"amount"}}, 3, []float32{10, 20, 30}},
+			{"amount", m_order.OrderQuery{UserID: u, MinAmount: 15, MaxAmount: 25}, utils.Pagination{PageIndex: 1, PageSize: 10}, 1, []float32{20}},
+			{"product", m_order.OrderQuery{UserID: u, ProductID: "p2"}, utils.Pagination{PageIndex: 1, PageSize: 10, Sortor: []string{"amount"}}, 2, []float32{20, 30}},
+			{"status", m_order.OrderQuery{UserID: u, Status: []m_order.OrderStatus{m_order.OrderStatusFinished}}, utils.Pagination{PageIndex: 1, PageSize: 10}, 0, nil},
+			{"created", m_order.OrderQuery{UserID: u, CreatedTo: time.Now().Add(-time.Hour)}, utils.Pagination{PageIndex: 1, PageSize: 10}, 0, nil},
+		} {
+			page, err := d.FindOrders(ctx, tc.query, tc.page)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			orders, _ := page.Data.([]m_order.Invoice)
+			var amounts []float32
+			for _, o := range orders {
+				amounts = append(amounts, o.Amount)
+			}
+			if page.Count != tc.count || !equal(amounts, tc.want) {
+				t.Errorf("%s: got %d orders %v, want %d %v", tc.name, page.Count, amounts, tc.count, tc.want)
+			}
+		}
+	})
+
+	t.Run("EachOrder", func(t *testing.T) {
+		u := user("each")
+		createOrder(t, u, 1, "p1")
+		createOrder(t, u, 2, "p1")
+		var n int
+		err := d.EachOrder(ctx, m_order.OrderQuery{UserID: u}, func(m_order.Invoice) error {
+			n++
+			return nil
+		})
+		if err != nil || n != 2 {
+			t.Errorf("got %d orders, %v", n, err)
+		}
+		stop := errors.New("stop")
+		n = 0
+		err = d.EachOrder(ctx, m_order.OrderQuery{UserID: u}, func(m_order.Invoice) error {
+			n++
+			return stop
+		})
+		if err != stop || n != 1 {
+			t.Errorf("got %d orders, %v, want 1, %v", n, err, stop)
+		}
+	})
+
+	t.Run("Cart", func(t *testing.T) {
+		u := user("cart")
+		first := addCart(t, u, "", "p1", 2)
+		again := addCart(t, u, "", "p1", 3)
+		if again.CartID != first.CartID || again.Quantity != 5 {
+			t.Errorf("AddCart: got %+v, want the quantities of %s summed", again, first.CartID)
+		}
+		items, err := d.GetCartItems(ctx, u, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 1 || items[0].CartID != first.CartID || items[0].Quantity != 5 {
+			t.Errorf("GetCartItems: got %+v", items)
+		}
+		updated, err := d.UpdateQuantity(ctx, &m_order.Cart{CartID: first.CartID, Quantity: 7})
+		if err != nil || updated.Quantity != 7 || updated.UserID != u {
+			t.Errorf("UpdateQuantity: got %+v, %v", updated, err)
+		}
+		item, err := d.GetCartItem(ctx, first.CartID)
+		if err != nil || item.Quantity != 7 || item.ProductID != "p1" || item.CartID != first.CartID {
+			t.Errorf("GetCartItem: got %+v, %v", item, err)
+		}
+		if ok, err := d.RemoveCartItem(ctx, first.CartID); !ok || err != nil {
+			t.Errorf("RemoveCartItem: got %v, %v", ok, err)
+		}
+		if _, err := d.RemoveCartItem(ctx, first.CartID); err != db.ErrNotFound {
+			t.Errorf("RemoveCartItem: got %v, want %v", err, db.ErrNotFound)
+		}
+		if _, err := d.GetCartItem(ctx, first.CartID); err != db.ErrNotFound {
+			t.Errorf("GetCartItem: got %v, want %v", err, db.ErrNotFound)
+		}
+		if _, err := d.UpdateQuantity(ctx, &m_order.Cart{CartID: MissingID, Quantity: 1}); err != db.ErrNotFound {
+			t.Errorf("UpdateQuantity: got %v, want %v", err, db.ErrNotFound)
+		}
+		for _, id := range []string{"", "not an id"} {
+			if _, err := d.GetCartItem(ctx, id); err != db.ErrInvalidID {
+				t.Errorf("GetCartItem(%q): got %v, want %v", id, err, db.ErrInvalidID)
+			}
+			if _, err := d.RemoveCartItem(ctx, id); err != db.ErrInvalidID {
+				t.Errorf("RemoveCartItem(%q): got %v, want %v", id, err, db.ErrInvalidID)
+			}
+		}
+	})
+
+	t.Run("MergeCart", func(t *testing.T) {
+		u, token := user("merge"), "token-"+suffix
+		addCart(t, u, "", "p1", 3)
+		addCart(t, "", token, "p1", 1)
+		addCart(t, "", token, "p2", 2)
+		if q := quantities(t, "", token); len(q) != 2 {
+			t.Fatalf("guest cart: got %v", q)
+		}
+		if err := d.MergeCart(ctx, token, u); err != nil {
+			t.Fatal(err)
+		}
+		if q := quantities(t, u, ""); len(q) != 2 || q["p1"] != 4 || q["p2"] != 2 {
+			t.Errorf("user cart: got %v, want p1:4 p2:2", q)
+		}
+		if q := quantities(t, "", token); len(q) != 0 {
+			t.Errorf("guest cart: got %v, want it empty", q)
+		}
+	})
+
+	t.Run("CancelExpiredOrders", func(t *testing.T) {
+		id := createOrder(t, user("expired"), 1, "p1")
+		n, err := d.CancelExpiredOrders(ctx, time.Now().Add(time.Second))
+		if err != nil || n < 1 {
+			t.Fatalf("got %d, %v", n, err)
+		}
+		got, err := d.GetOrder(ctx, id)
+		if err != nil || got.Status != m_order.OrderStatusCanceled {
+			t.Errorf("GetOrder: got %v, %v", got.Status, err)
+		}
+	})
+
+	t.Run("PurgeCarts", func(t *testing.T) {
+		u := user("purge")
+		addCart(t, u, "", "p1", 1)
+		if n, err := d.PurgeCarts(ctx, time.Now().Add(-time.Hour)); err != nil || quantities(t, u, "")["p1"] != 1 {
+			t.Fatalf("purged a fresh cart item: %d, %v", n, err)
+		}
+		n, err := d.PurgeCarts(ctx, time.Now().Add(time.Second))
+		if err != nil || n < 1 {
+			t.Fatalf("got %d, %v", n, err)
+		}
+		if q := quantities(t, u, ""); len(q) != 0 {
+			t.Errorf("cart: got %v, want it empty", q)
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := d.FindOrders(ctx, m_order.OrderQuery{}, utils.Pagination{PageIndex: 1, PageSize: 1}); err == nil {
+			t.Error("FindOrders: no error with a canceled context")
+		}
+		err := d.EachOrder(ctx, m_order.OrderQuery{}, func(m_order.Invoice) error { return nil })
+		if err == nil {
+			t.Error("EachOrder: no error with a canceled context")
+		}
+	})
+}
+
+func equal(a, b []float32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
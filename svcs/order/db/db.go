@@ -1,42 +1,59 @@
 package db
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"fmt"
-	corelog "log"
+	"time"
 
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
 	"github.com/laidingqing/dabanshan-go/utils"
 	m_order "github.com/laidingqing/dabanshan-go/svcs/order/model"
+	"github.com/laidingqing/dabanshan-go/svcs/instrumenting"
 )
 
 // Database represents a simple interface so we can switch to a new system easily
 type Database interface {
-	Init() error
-	CreateOrder(*m_order.Invoice) (string, error)
-	GetOrdersByUser(usrID string, page utils.Pagination) (utils.Pagination, error)
-	GetOrdersByTenant(usrID string, page utils.Pagination) (utils.Pagination, error)
-	GetOrder(id string) (m_order.Invoice, error)
-	AddCart(cart *m_order.Cart) (string, error)
-	RemoveCartItem(cartID string) (bool, error)
-	GetCartItems(userID string) ([]m_order.Cart, error)
-	UpdateQuantity(cart *m_order.Cart) (m_order.Cart, error)
+	Init(context.Context) error
+	Ping(context.Context) error
+	Close()
+	CreateOrder(context.Context, *m_order.Invoice) (string, error)
+	FindOrders(ctx context.Context, query m_order.OrderQuery, page utils.Pagination) (utils.Pagination, error)
+	EachOrder(ctx context.Context, query m_order.OrderQuery, fn func(m_order.Invoice) error) error
+	GetOrder(ctx context.Context, id string) (m_order.Invoice, error)
+	AddCart(ctx context.Context, cart *m_order.Cart) (string, error)
+	GetCartItem(ctx context.Context, cartID string) (m_order.Cart, error)
+	RemoveCartItem(ctx context.Context, cartID string) (bool, error)
+	GetCartItems(ctx context.Context, userID, cartToken string) ([]m_order.Cart, error)
+	UpdateQuantity(ctx context.Context, cart *m_order.Cart) (m_order.Cart, error)
+	MergeCart(ctx context.Context, cartToken, userID string) error
+	CancelExpiredOrders(ctx context.Context, createdBefore time.Time) (int, error)
+	PurgeCarts(ctx context.Context, updatedBefore time.Time) (int, error)
 }
 
 var (
-	database string
+	database = "mongodb"
 	//DefaultDb is the database set for the microservice
 	DefaultDb Database
+	//Duration observes the latency of the operations on DefaultDb, see instrumenting.NewDBDuration
+	Duration metrics.Histogram = discard.NewHistogram()
 	//DBTypes is a map of DB interfaces that can be used for this service
 	DBTypes = map[string]Database{}
 	//ErrNoDatabaseFound error returnes when database interface does not exists in DBTypes
 	ErrNoDatabaseFound = "No database with name %v registered"
 	//ErrNoDatabaseSelected is returned when no database was designated in the flag or env
 	ErrNoDatabaseSelected = errors.New("No DB selected")
+	//ErrInvalidID is returned when an id is not in the format the database expects
+	ErrInvalidID = errors.New("Invalid Id")
+	//ErrNotFound is returned when no record matches the given id
+	ErrNotFound = errors.New("Record not found")
 )
 
-func init() {
-	//database = *flag.String("database", "mongodb", "Database to use")
-	database = "mongodb"
+//RegisterFlags defines the flag selecting the database on fs
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&database, "database", database, "Database to use")
 }
 
 //Init inits the selected DB in DefaultDb
@@ -48,7 +65,22 @@ func Init() error {
 	if err != nil {
 		return err
 	}
-	return DefaultDb.Init()
+	return DefaultDb.Init(context.Background())
+}
+
+//Ping checks that DefaultDb is reachable, for the readiness check
+func Ping(ctx context.Context) error {
+	if DefaultDb == nil {
+		return ErrNoDatabaseSelected
+	}
+	return DefaultDb.Ping(ctx)
+}
+
+//Close closes DefaultDb, once the requests using it are served
+func Close() {
+	if DefaultDb != nil {
+		DefaultDb.Close()
+	}
 }
 
 //Set the DefaultDb
@@ -66,42 +98,81 @@ func Register(name string, db Database) {
 }
 
 // CreateOrder db operator
-func CreateOrder(mo *m_order.Invoice) (string, error) {
-	return DefaultDb.CreateOrder(mo)
+func CreateOrder(ctx context.Context, mo *m_order.Invoice) (id string, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "CreateOrder")(&err)
+	return DefaultDb.CreateOrder(ctx, mo)
 }
 
-// GetOrdersByUser ...
-func GetOrdersByUser(usrID string, page utils.Pagination) (utils.Pagination, error) {
-	return DefaultDb.GetOrdersByUser(usrID, page)
+// FindOrders returns the page of orders matching query, sorted by
+// page.Sortor.
+func FindOrders(ctx context.Context, query m_order.OrderQuery, page utils.Pagination) (_ utils.Pagination, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "FindOrders")(&err)
+	return DefaultDb.FindOrders(ctx, query, page)
 }
 
-// GetOrdersByTenant ...
-func GetOrdersByTenant(tenantID string, page utils.Pagination) (utils.Pagination, error) {
-	return DefaultDb.GetOrdersByTenant(tenantID, page)
+// EachOrder calls fn for every order matching query, oldest first, without
+// loading them all into memory. It stops at the first error returned by fn.
+func EachOrder(ctx context.Context, query m_order.OrderQuery, fn func(m_order.Invoice) error) (err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "EachOrder")(&err)
+	return DefaultDb.EachOrder(ctx, query, fn)
 }
 
 // GetOrder ...
-func GetOrder(id string) (m_order.Invoice, error) {
-	return DefaultDb.GetOrder(id)
+func GetOrder(ctx context.Context, id string) (_ m_order.Invoice, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "GetOrder")(&err)
+	return DefaultDb.GetOrder(ctx, id)
 }
 
-// AddCart ..
-func AddCart(cart *m_order.Cart) (string, error) {
-	return DefaultDb.AddCart(cart)
+// AddCart adds cart.Quantity of a product to the user's cart, or to the guest
+// cart of cart.CartToken if there is no user, merging with an existing line for
+// the same product.
+func AddCart(ctx context.Context, cart *m_order.Cart) (id string, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "AddCart")(&err)
+	return DefaultDb.AddCart(ctx, cart)
+}
+
+// GetCartItem ..
+func GetCartItem(ctx context.Context, cartID string) (_ m_order.Cart, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "GetCartItem")(&err)
+	return DefaultDb.GetCartItem(ctx, cartID)
 }
 
 // RemoveCartItem ..
-func RemoveCartItem(cartID string) (bool, error) {
-	corelog.Print("cartID is " + cartID)
-	return DefaultDb.RemoveCartItem(cartID)
+func RemoveCartItem(ctx context.Context, cartID string) (_ bool, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "RemoveCartItem")(&err)
+	return DefaultDb.RemoveCartItem(ctx, cartID)
 }
 
-// GetCartItems ..
-func GetCartItems(userID string) ([]m_order.Cart, error) {
-	return DefaultDb.GetCartItems(userID)
+// GetCartItems returns the user's cart items, or the guest cart items of
+// cartToken if userID is empty.
+func GetCartItems(ctx context.Context, userID, cartToken string) (_ []m_order.Cart, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "GetCartItems")(&err)
+	return DefaultDb.GetCartItems(ctx, userID, cartToken)
 }
 
 // UpdateQuantity ..
-func UpdateQuantity(cart *m_order.Cart) (m_order.Cart, error) {
-	return DefaultDb.UpdateQuantity(cart)
+func UpdateQuantity(ctx context.Context, cart *m_order.Cart) (_ m_order.Cart, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "UpdateQuantity")(&err)
+	return DefaultDb.UpdateQuantity(ctx, cart)
+}
+
+// MergeCart folds the guest cart of cartToken into the user's cart, summing
+// the quantities of products present in both.
+func MergeCart(ctx context.Context, cartToken, userID string) (err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "MergeCart")(&err)
+	return DefaultDb.MergeCart(ctx, cartToken, userID)
+}
+
+// CancelExpiredOrders cancels orders still waiting for payment that were
+// created before createdBefore, returning how many were canceled.
+func CancelExpiredOrders(ctx context.Context, createdBefore time.Time) (_ int, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "CancelExpiredOrders")(&err)
+	return DefaultDb.CancelExpiredOrders(ctx, createdBefore)
+}
+
+// PurgeCarts removes cart items not touched since updatedBefore, returning how
+// many were removed.
+func PurgeCarts(ctx context.Context, updatedBefore time.Time) (_ int, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "PurgeCarts")(&err)
+	return DefaultDb.PurgeCarts(ctx, updatedBefore)
 }
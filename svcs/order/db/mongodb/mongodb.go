@@ -1,14 +1,14 @@
 package mongodb
 
 import (
+	"context"
 	"errors"
 	"flag"
-	corelog "log"
 	"net/url"
-	"os"
 	"time"
 
-	"github.com/go-kit/kit/log"
+	"github.com/laidingqing/dabanshan-go/svcs/mongo"
+	o_db "github.com/laidingqing/dabanshan-go/svcs/order/db"
 	m_order "github.com/laidingqing/dabanshan-go/svcs/order/model"
 	"github.com/laidingqing/dabanshan-go/utils"
 	"gopkg.in/mgo.v2"
@@ -18,31 +18,34 @@ import (
 var (
 	name             string
 	password         string
-	host             string
+	host             = "127.0.0.1:27017"
 	db               = "test"
 	orderCollections = "orders"
 	cartCollections  = "carts"
+	opts             = mongo.DefaultOptions
 	ErrInvalidHexID  = errors.New("Invalid Id Hex")
 )
 
-var logger log.Logger
-
-func init() {
-	name = *flag.String("mongouser", "", "Mongo user")
-	password = *flag.String("mongopassword", "", "Mongo password")
-	host = *flag.String("mongohost", "127.0.0.1:27017", "mongo host")
-
-	{
-		logger = log.NewLogfmtLogger(os.Stderr)
-		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
-		logger = log.With(logger, "caller", log.DefaultCaller)
-	}
+// RegisterFlags defines the flags of the MongoDB connection on fs.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&name, "mongouser", name, "Mongo user")
+	fs.StringVar(&password, "mongopassword", password, "Mongo password")
+	fs.StringVar(&host, "mongohost", host, "mongo host")
 }
 
 // Mongo meets the Database interface requirements
 type Mongo struct {
 	//Session is a MongoDB Session
 	Session *mgo.Session
+	// Database is the name of the database, "test" if empty.
+	Database string
+}
+
+func (m *Mongo) database() string {
+	if m.Database != "" {
+		return m.Database
+	}
+	return db
 }
 
 // MongoOrder is a wrapper for the users
@@ -74,29 +77,124 @@ func NewCart() MongoCart {
 }
 
 // Init MongoDB
-func (m *Mongo) Init() error {
+func (m *Mongo) Init(ctx context.Context) error {
 	u := getURL()
 	var err error
-	m.Session, err = mgo.DialWithTimeout(u.String(), time.Duration(5)*time.Second)
+	opts = mongo.Flags()
+	m.Session, err = mongo.Dial(ctx, u.String(), opts)
 	if err != nil {
 		return err
 	}
 	return m.EnsureIndexes()
 }
 
+// Ping checks that the session reaches the server.
+func (m *Mongo) Ping(ctx context.Context) error {
+	return mongo.Do(ctx, m.Session, opts, func(s *mgo.Session) error {
+		return s.Ping()
+	})
+}
+
+// Close closes the session and its connections.
+func (m *Mongo) Close() {
+	if m.Session != nil {
+		m.Session.Close()
+	}
+}
+
 // EnsureIndexes ensures userid is unique
 func (m *Mongo) EnsureIndexes() error {
 	s := m.Session.Copy()
 	defer s.Close()
-	i := mgo.Index{
-		Key:        []string{"userId"},
-		Unique:     false,
-		DropDups:   true,
+	c := s.DB(m.database()).C(orderCollections)
+	// order lists of a user or tenant, newest first, optionally by status
+	for _, key := range [][]string{
+		{"userId", "-createdAt"},
+		{"userId", "status", "-createdAt"},
+		{"tenantID", "-createdAt"},
+		{"tenantID", "status", "-createdAt"},
+		{"tenantID", "userId", "-createdAt"},
+		{"items.productId", "-createdAt"},
+		{"status", "createdAt"},
+	} {
+		i := mgo.Index{
+			Key:        key,
+			Background: true,
+		}
+		if err := c.EnsureIndex(i); err != nil {
+			return err
+		}
+	}
+	// one cart line per user, or guest cart, and product, see AddCart
+	cc := s.DB(m.database()).C(cartCollections)
+	// the lines of guest carts, all of user "", share the former index
+	if err := cc.DropIndex("userID", "productID"); err != nil && !isIndexNotFound(err) {
+		return err
+	}
+	if err := mergeCartLines(cc); err != nil {
+		return err
+	}
+	// lines written before updatedAt are aged from now on, see PurgeCarts
+	if _, err := cc.UpdateAll(bson.M{"updatedAt": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"updatedAt": time.Now()}}); err != nil {
+		return err
+	}
+	ci := mgo.Index{
+		Key:        []string{"userID", "cartToken", "productID"},
+		Unique:     true,
 		Background: true,
-		Sparse:     false,
 	}
-	c := s.DB(db).C(orderCollections)
-	return c.EnsureIndex(i)
+	return cc.EnsureIndex(ci)
+}
+
+// cartIndex is the name of the unique index of the cart lines.
+const cartIndex = "userID_1_cartToken_1_productID_1"
+
+// mergeCartLines merges the cart lines of a user, or guest cart, and product
+// that carts written before the unique cart index hold more than once, summing
+// their quantities, so that the index can be built.
+func mergeCartLines(c *mgo.Collection) error {
+	indexes, err := c.Indexes()
+	if err != nil && !isIndexNotFound(err) {
+		return err
+	}
+	for _, i := range indexes {
+		if i.Name == cartIndex {
+			return nil
+		}
+	}
+	var dup struct {
+		IDs      []bson.ObjectId `bson:"ids"`
+		Quantity int32           `bson:"quantity"`
+	}
+	iter := c.Pipe([]bson.M{
+		{"$group": bson.M{
+			"_id":      bson.M{"userID": "$userID", "cartToken": "$cartToken", "productID": "$productID"},
+			"ids":      bson.M{"$push": "$_id"},
+			"quantity": bson.M{"$sum": "$quantity"},
+			"count":    bson.M{"$sum": 1},
+		}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	}).AllowDiskUse().Iter()
+	for iter.Next(&dup) {
+		if err := c.UpdateId(dup.IDs[0], bson.M{"$set": bson.M{"quantity": dup.Quantity}}); err != nil {
+			iter.Close()
+			return err
+		}
+		if _, err := c.RemoveAll(bson.M{"_id": bson.M{"$in": dup.IDs[1:]}}); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// isIndexNotFound reports whether err is the server failing to find an
+// index, or the collection, that does not exist.
+func isIndexNotFound(err error) bool {
+	if qe, ok := err.(*mgo.QueryError); ok {
+		return qe.Code == 27 || qe.Code == 26
+	}
+	return false
 }
 
 func getURL() url.URL {
@@ -113,38 +211,40 @@ func getURL() url.URL {
 }
 
 // CreateOrder Insert user to MongoDB
-func (m *Mongo) CreateOrder(u *m_order.Invoice) (string, error) {
+func (m *Mongo) CreateOrder(ctx context.Context, u *m_order.Invoice) (string, error) {
 	u.CreatedAt = time.Now()
-	s := m.Session.Copy()
-	defer s.Close()
 	id := bson.NewObjectId()
 	mu := NewOrder()
 	mu.Invoice = *u
 	mu.ID = id
-	c := s.DB(db).C(orderCollections)
-	_, err := c.UpsertId(mu.ID, mu)
+	err := mongo.Retry(ctx, m.Session, opts, func(s *mgo.Session) error {
+		_, err := s.DB(m.database()).C(orderCollections).UpsertId(mu.ID, mu)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
 	return mu.ID.Hex(), nil
 }
 
-// GetOrdersByUser 根据用户查询订单列表.
-func (m *Mongo) GetOrdersByUser(usrID string, page utils.Pagination) (utils.Pagination, error) {
-	s := m.Session.Copy()
-	defer s.Close()
-	c := s.DB(db).C(orderCollections)
-	var orders []m_order.Invoice
-	q := c.Find(bson.M{"userId": usrID})
-	total, err := q.Count()
-
-	if len(page.Sortor) > 0 {
-		q = q.Sort(page.Sortor...)
-	}
-	q = q.Skip((page.PageIndex - 1) * page.PageSize).Limit(page.PageSize)
-
-	err = q.All(&orders)
-
+// FindOrders 根据条件查询订单列表.
+func (m *Mongo) FindOrders(ctx context.Context, query m_order.OrderQuery, page utils.Pagination) (utils.Pagination, error) {
+	var (
+		orders []m_order.Invoice
+		total  int
+	)
+	err := mongo.Retry(ctx, m.Session, opts, func(s *mgo.Session) error {
+		q := s.DB(m.database()).C(orderCollections).Find(orderSelector(query))
+		var err error
+		if total, err = q.Count(); err != nil {
+			return err
+		}
+		if len(page.Sortor) > 0 {
+			q = q.Sort(page.Sortor...)
+		}
+		q = q.Skip((page.PageIndex - 1) * page.PageSize).Limit(page.PageSize)
+		return q.All(&orders)
+	})
 	if err != nil {
 		return utils.Pagination{}, err
 	}
@@ -154,82 +254,174 @@ func (m *Mongo) GetOrdersByUser(usrID string, page utils.Pagination) (utils.Pagi
 	return page, nil
 }
 
-// GetOrdersByTenant 根据租户查询订单列表.
-func (m *Mongo) GetOrdersByTenant(tenantID string, page utils.Pagination) (utils.Pagination, error) {
+// EachOrder iterates the matching orders with a cursor. The exports it feeds
+// outlast -mongo.timeout, so it is bounded by ctx only: it stops once ctx is
+// done, each batch read within -mongo.socket-timeout.
+func (m *Mongo) EachOrder(ctx context.Context, query m_order.OrderQuery, fn func(m_order.Invoice) error) error {
+	if m.Session == nil {
+		return mongo.ErrNotConnected
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	s := m.Session.Copy()
 	defer s.Close()
-	c := s.DB(db).C(orderCollections)
-	var orders []m_order.Invoice
-	q := c.Find(bson.M{"tenantId": tenantID})
-	total, err := q.Count()
-
-	if len(page.Sortor) > 0 {
-		q = q.Sort(page.Sortor...)
+	c := s.DB(m.database()).C(orderCollections)
+	iter := c.Find(orderSelector(query)).Sort("createdAt").Iter()
+	var order m_order.Invoice
+	for iter.Next(&order) {
+		if err := ctx.Err(); err != nil {
+			iter.Close()
+			return err
+		}
+		if err := fn(order); err != nil {
+			iter.Close()
+			return err
+		}
+		order = m_order.Invoice{}
 	}
-	q = q.Skip((page.PageIndex - 1) * page.PageSize).Limit(page.PageSize)
-
-	err = q.All(&orders)
+	return iter.Close()
+}
 
-	if err != nil {
-		return utils.Pagination{}, err
+// orderSelector translates query into a Mongo selector.
+func orderSelector(query m_order.OrderQuery) bson.M {
+	selector := bson.M{}
+	if query.UserID != "" {
+		selector["userId"] = query.UserID
 	}
-	page.Data = orders
-	page.Count = total
-
-	return page, nil
+	if query.TenantID != "" {
+		selector["tenantID"] = query.TenantID
+	}
+	if len(query.Status) > 0 {
+		selector["status"] = bson.M{"$in": query.Status}
+	}
+	if query.ProductID != "" {
+		selector["items.productId"] = query.ProductID
+	}
+	created := bson.M{}
+	if !query.CreatedFrom.IsZero() {
+		created["$gte"] = query.CreatedFrom
+	}
+	if !query.CreatedTo.IsZero() {
+		created["$lt"] = query.CreatedTo
+	}
+	if len(created) > 0 {
+		selector["createdAt"] = created
+	}
+	amount := bson.M{}
+	if query.MinAmount > 0 {
+		amount["$gte"] = query.MinAmount
+	}
+	if query.MaxAmount > 0 {
+		amount["$lte"] = query.MaxAmount
+	}
+	if len(amount) > 0 {
+		selector["amount"] = amount
+	}
+	return selector
 }
 
 // GetOrder 根据用户查询订单.
-func (m *Mongo) GetOrder(id string) (m_order.Invoice, error) {
-	s := m.Session.Copy()
-	defer s.Close()
-	c := s.DB(db).C(orderCollections)
+func (m *Mongo) GetOrder(ctx context.Context, id string) (m_order.Invoice, error) {
+	if !bson.IsObjectIdHex(id) {
+		return m_order.Invoice{}, o_db.ErrInvalidID
+	}
 	var order m_order.Invoice
-	err := c.FindId(id).One(&order)
-
+	err := mongo.Retry(ctx, m.Session, opts, func(s *mgo.Session) error {
+		return s.DB(m.database()).C(orderCollections).FindId(bson.ObjectIdHex(id)).One(&order)
+	})
+	if err == mgo.ErrNotFound {
+		return m_order.Invoice{}, o_db.ErrNotFound
+	}
 	if err != nil {
 		return m_order.Invoice{}, err
 	}
 	return order, nil
 }
 
+// cartOwner selects the cart items of a user, or of a guest cart when the user
+// is unknown.
+func cartOwner(userID, cartToken string) bson.M {
+	if userID != "" {
+		return bson.M{"userID": userID}
+	}
+	return bson.M{"userID": "", "cartToken": cartToken}
+}
+
 // GetCartItems ..
-func (m *Mongo) GetCartItems(userID string) ([]m_order.Cart, error) {
-	s := m.Session.Copy()
-	defer s.Close()
-	c := s.DB(db).C(cartCollections)
-	var cartItems []m_order.Cart
-	err := c.Find(bson.M{"userID": userID}).All(&cartItems)
-	// not debug data.
+func (m *Mongo) GetCartItems(ctx context.Context, userID, cartToken string) ([]m_order.Cart, error) {
+	var mcs []MongoCart
+	err := mongo.Retry(ctx, m.Session, opts, func(s *mgo.Session) error {
+		return s.DB(m.database()).C(cartCollections).Find(cartOwner(userID, cartToken)).All(&mcs)
+	})
 	if err != nil {
 		return nil, err
 	}
+	cartItems := make([]m_order.Cart, 0, len(mcs))
+	for _, mc := range mcs {
+		mc.CartID = mc.ID.Hex()
+		cartItems = append(cartItems, mc.Cart)
+	}
 	return cartItems, nil
 }
 
-// AddCart ..
-func (m *Mongo) AddCart(cart *m_order.Cart) (string, error) {
-	s := m.Session.Copy()
-	defer s.Close()
-	id := bson.NewObjectId()
-	mu := NewCart()
-	mu.ID = id
-	mu.Cart = *cart
-	c := s.DB(db).C(cartCollections)
-	_, err := c.UpsertId(id, mu)
+// GetCartItem ..
+func (m *Mongo) GetCartItem(ctx context.Context, cartID string) (m_order.Cart, error) {
+	if !bson.IsObjectIdHex(cartID) {
+		return m_order.Cart{}, o_db.ErrInvalidID
+	}
+	mc := NewCart()
+	err := mongo.Retry(ctx, m.Session, opts, func(s *mgo.Session) error {
+		return s.DB(m.database()).C(cartCollections).FindId(bson.ObjectIdHex(cartID)).One(&mc)
+	})
+	if err == mgo.ErrNotFound {
+		return m_order.Cart{}, o_db.ErrNotFound
+	}
+	if err != nil {
+		return m_order.Cart{}, err
+	}
+	mc.CartID = mc.ID.Hex()
+	return mc.Cart, nil
+}
+
+// AddCart upserts the cart line keyed by user, or guest cart, and product,
+// adding cart.Quantity to any quantity already in the cart.
+func (m *Mongo) AddCart(ctx context.Context, cart *m_order.Cart) (string, error) {
+	change := mgo.Change{
+		Update: bson.M{
+			"$inc": bson.M{"quantity": cart.Quantity},
+			"$set": bson.M{"price": cart.Price, "updatedAt": time.Now()},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	selector := cartOwner(cart.UserID, cart.CartToken)
+	selector["productID"] = cart.ProductID
+	mc := NewCart()
+	// Not retried: the quantity would be added twice.
+	err := mongo.Do(ctx, m.Session, opts, func(s *mgo.Session) error {
+		_, err := s.DB(m.database()).C(cartCollections).Find(selector).Apply(change, &mc)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
-	return id.Hex(), nil
+	mc.CartID = mc.ID.Hex()
+	*cart = mc.Cart
+	return mc.CartID, nil
 }
 
 // RemoveCartItem ..
-func (m *Mongo) RemoveCartItem(cartID string) (bool, error) {
-	s := m.Session.Copy()
-	defer s.Close()
-	c := s.DB(db).C(cartCollections)
-	corelog.Print("cartID:" + cartID)
-	err := c.RemoveId(bson.ObjectIdHex(cartID))
+func (m *Mongo) RemoveCartItem(ctx context.Context, cartID string) (bool, error) {
+	if !bson.IsObjectIdHex(cartID) {
+		return false, o_db.ErrInvalidID
+	}
+	err := mongo.Do(ctx, m.Session, opts, func(s *mgo.Session) error {
+		return s.DB(m.database()).C(cartCollections).RemoveId(bson.ObjectIdHex(cartID))
+	})
+	if err == mgo.ErrNotFound {
+		return false, o_db.ErrNotFound
+	}
 	if err != nil {
 		return false, err
 	}
@@ -237,22 +429,86 @@ func (m *Mongo) RemoveCartItem(cartID string) (bool, error) {
 }
 
 // UpdateQuantity update quantity of cartitem
-func (m *Mongo) UpdateQuantity(cart *m_order.Cart) (m_order.Cart, error) {
-	s := m.Session.Copy()
-	defer s.Close()
-	c := s.DB(db).C(cartCollections)
-
-	corelog.Print("cartID:" + cart.CartID)
-	var item m_order.Cart
-	err := c.FindId(bson.ObjectIdHex(cart.CartID)).One(&item)
+func (m *Mongo) UpdateQuantity(ctx context.Context, cart *m_order.Cart) (m_order.Cart, error) {
+	if !bson.IsObjectIdHex(cart.CartID) {
+		return m_order.Cart{}, o_db.ErrInvalidID
+	}
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"quantity": cart.Quantity, "updatedAt": time.Now()}},
+		ReturnNew: true,
+	}
+	mc := NewCart()
+	err := mongo.Retry(ctx, m.Session, opts, func(s *mgo.Session) error {
+		_, err := s.DB(m.database()).C(cartCollections).FindId(bson.ObjectIdHex(cart.CartID)).Apply(change, &mc)
+		return err
+	})
+	if err == mgo.ErrNotFound {
+		return m_order.Cart{}, o_db.ErrNotFound
+	}
 	if err != nil {
 		return m_order.Cart{}, err
 	}
-	item.CartID = cart.CartID
-	item.Quantity = cart.Quantity
-	err = c.UpdateId(bson.ObjectIdHex(item.CartID), item)
+	mc.CartID = mc.ID.Hex()
+	return mc.Cart, nil
+}
+
+// MergeCart moves the guest cart items of cartToken into the user's cart.
+// Each guest line is claimed, removed, before its quantity is added to the
+// user's line, so that merges running together, or retried, add it once.
+func (m *Mongo) MergeCart(ctx context.Context, cartToken, userID string) error {
+	for {
+		g := NewCart()
+		err := mongo.Do(ctx, m.Session, opts, func(s *mgo.Session) error {
+			_, err := s.DB(m.database()).C(cartCollections).Find(cartOwner("", cartToken)).Apply(mgo.Change{Remove: true}, &g)
+			return err
+		})
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		item := g.Cart
+		item.UserID = userID
+		item.CartToken = ""
+		if _, err := m.AddCart(ctx, &item); err != nil {
+			// give the line back to the guest cart for the next merge
+			mongo.Do(context.Background(), m.Session, opts, func(s *mgo.Session) error {
+				return s.DB(m.database()).C(cartCollections).Insert(g)
+			})
+			return err
+		}
+	}
+}
+
+// CancelExpiredOrders ..
+func (m *Mongo) CancelExpiredOrders(ctx context.Context, createdBefore time.Time) (int, error) {
+	var info *mgo.ChangeInfo
+	err := mongo.Do(ctx, m.Session, opts, func(s *mgo.Session) error {
+		var err error
+		info, err = s.DB(m.database()).C(orderCollections).UpdateAll(
+			bson.M{"status": m_order.OrderStatusCreated, "createdAt": bson.M{"$lt": createdBefore}},
+			bson.M{"$set": bson.M{"status": m_order.OrderStatusCanceled}},
+		)
+		return err
+	})
 	if err != nil {
-		return m_order.Cart{}, err
+		return 0, err
+	}
+	return info.Updated, nil
+}
+
+// PurgeCarts removes the cart items not touched since updatedBefore. Items
+// older than updatedAt got theirs from EnsureIndexes.
+func (m *Mongo) PurgeCarts(ctx context.Context, updatedBefore time.Time) (int, error) {
+	var info *mgo.ChangeInfo
+	err := mongo.Do(ctx, m.Session, opts, func(s *mgo.Session) error {
+		var err error
+		info, err = s.DB(m.database()).C(cartCollections).RemoveAll(bson.M{"updatedAt": bson.M{"$lt": updatedBefore}})
+		return err
+	})
+	if err != nil {
+		return 0, err
 	}
-	return item, nil
+	return info.Removed, nil
 }
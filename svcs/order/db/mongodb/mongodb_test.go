@@ -0,0 +1,17 @@
+package mongodb
+
+import (
+	"testing"
+
+	s_conformance "github.com/laidingqing/dabanshan-go/svcs/conformance"
+	"github.com/laidingqing/dabanshan-go/svcs/order/db/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	name := s_conformance.Name("orders")
+	m := &Mongo{Session: s_conformance.Session(t, name), Database: name}
+	if err := m.EnsureIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	conformance.Run(t, m)
+}
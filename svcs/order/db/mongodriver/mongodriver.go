@@ -0,0 +1,463 @@
+// Package mongodriver stores orders and carts in MongoDB with the official
+// driver, registered as the "mongodriver" database. It reads the documents of
+// the mgo backend, svcs/order/db/mongodb, so either can run on the same data.
+//
+// On a replica set or sharded cluster, MergeCart moves the items of a guest
+// cart in a transaction.
+package mongodriver
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"time"
+
+	s_mongo "github.com/laidingqing/dabanshan-go/svcs/mongo"
+	"github.com/laidingqing/dabanshan-go/svcs/mongo/driver"
+	o_db "github.com/laidingqing/dabanshan-go/svcs/order/db"
+	m_order "github.com/laidingqing/dabanshan-go/svcs/order/model"
+	"github.com/laidingqing/dabanshan-go/utils"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	orderCollections = "orders"
+	cartCollections  = "carts"
+)
+
+// RegisterFlags defines the flags of the MongoDB connection on fs.
+func RegisterFlags(fs *flag.FlagSet) {
+	driver.RegisterFlags(fs)
+}
+
+// Mongo meets the Database interface requirements
+type Mongo struct {
+	conn *driver.Conn
+}
+
+// mongoOrder is the document of an order.
+type mongoOrder struct {
+	m_order.Invoice `bson:",inline"`
+	ID              bson.ObjectID `bson:"_id"`
+}
+
+// mongoCart is the document of a cart item.
+type mongoCart struct {
+	m_order.Cart `bson:",inline"`
+	ID           bson.ObjectID `bson:"_id"`
+}
+
+func (mc mongoCart) cart() m_order.Cart {
+	mc.CartID = mc.ID.Hex()
+	return mc.Cart
+}
+
+// Init connects and ensures the indexes.
+func (m *Mongo) Init(ctx context.Context) error {
+	conn, err := driver.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	m.conn = conn
+	return m.EnsureIndexes(ctx)
+}
+
+// EnsureIndexes creates the indexes of the mgo backend, migrating its carts
+// as it does.
+func (m *Mongo) EnsureIndexes(ctx context.Context) error {
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	// order lists of a user or tenant, newest first, optionally by status
+	var orders []mongo.IndexModel
+	for _, key := range [][]string{
+		{"userId", "-createdAt"},
+		{"userId", "status", "-createdAt"},
+		{"tenantID", "-createdAt"},
+		{"tenantID", "status", "-createdAt"},
+		{"tenantID", "userId", "-createdAt"},
+		{"items.productId", "-createdAt"},
+		{"status", "createdAt"},
+	} {
+		orders = append(orders, mongo.IndexModel{Keys: driver.Sort(key)})
+	}
+	if _, err := m.conn.DB.Collection(orderCollections).Indexes().CreateMany(ctx, orders); err != nil {
+		return err
+	}
+	// one cart line per user, or guest cart, and product, see AddCart
+	carts := m.carts()
+	// the lines of guest carts, all of user "", share the former index
+	err := carts.Indexes().DropOne(ctx, "userID_1_productID_1")
+	var se mongo.ServerError
+	if err != nil && !(errors.As(err, &se) && (se.HasErrorCode(27) || se.HasErrorCode(26))) {
+		return err
+	}
+	if err := mergeCartLines(ctx, carts); err != nil {
+		return err
+	}
+	// lines written before updatedAt are aged from now on, see PurgeCarts
+	_, err = carts.UpdateMany(ctx, bson.M{"updatedAt": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"updatedAt": time.Now()}})
+	if err != nil {
+		return err
+	}
+	_, err = carts.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    driver.Sort([]string{"userID", "cartToken", "productID"}),
+		Options: options.Index().SetUnique(true).SetName(cartIndex),
+	})
+	return err
+}
+
+// cartIndex is the name of the unique index of the cart lines.
+const cartIndex = "userID_1_cartToken_1_productID_1"
+
+// mergeCartLines merges the cart lines of a user, or guest cart, and product
+// that carts written before the unique cart index hold more than once, summing
+// their quantities, so that the index can be built.
+func mergeCartLines(ctx context.Context, c *mongo.Collection) error {
+	specs, err := c.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if spec.Name == cartIndex {
+			return nil
+		}
+	}
+	cur, err := c.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id":      bson.M{"userID": "$userID", "cartToken": "$cartToken", "productID": "$productID"},
+			"ids":      bson.M{"$push": "$_id"},
+			"quantity": bson.M{"$sum": "$quantity"},
+			"count":    bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var dup struct {
+			IDs      []bson.ObjectID `bson:"ids"`
+			Quantity int64           `bson:"quantity"`
+		}
+		if err := cur.Decode(&dup); err != nil {
+			return err
+		}
+		if _, err := c.UpdateByID(ctx, dup.IDs[0], bson.M{"$set": bson.M{"quantity": int32(dup.Quantity)}}); err != nil {
+			return err
+		}
+		if _, err := c.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": dup.IDs[1:]}}); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// Ping checks that the primary answers.
+func (m *Mongo) Ping(ctx context.Context) error {
+	if m.conn == nil {
+		return s_mongo.ErrNotConnected
+	}
+	return m.conn.Ping(ctx)
+}
+
+// Close disconnects.
+func (m *Mongo) Close() {
+	if m.conn != nil {
+		m.conn.Close()
+	}
+}
+
+func (m *Mongo) orders() *mongo.Collection {
+	return m.conn.DB.Collection(orderCollections)
+}
+
+func (m *Mongo) carts() *mongo.Collection {
+	return m.conn.DB.Collection(cartCollections)
+}
+
+// CreateOrder inserts the order, created now.
+func (m *Mongo) CreateOrder(ctx context.Context, u *m_order.Invoice) (string, error) {
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	u.CreatedAt = time.Now()
+	mo := mongoOrder{Invoice: *u, ID: bson.NewObjectID()}
+	if _, err := m.orders().InsertOne(ctx, mo); err != nil {
+		return "", err
+	}
+	return mo.ID.Hex(), nil
+}
+
+// FindOrders returns the page of orders matching query.
+func (m *Mongo) FindOrders(ctx context.Context, query m_order.OrderQuery, page utils.Pagination) (utils.Pagination, error) {
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	filter := orderFilter(query)
+	total, err := m.orders().CountDocuments(ctx, filter)
+	if err != nil {
+		return utils.Pagination{}, err
+	}
+	opts := options.Find().
+		SetSkip(int64((page.PageIndex - 1) * page.PageSize)).
+		SetLimit(int64(page.PageSize))
+	if len(page.Sortor) > 0 {
+		opts.SetSort(driver.Sort(page.Sortor))
+	}
+	cur, err := m.orders().Find(ctx, filter, opts)
+	if err != nil {
+		return utils.Pagination{}, err
+	}
+	var orders []m_order.Invoice
+	if err := cur.All(ctx, &orders); err != nil {
+		return utils.Pagination{}, err
+	}
+	page.Data = orders
+	page.Count = int(total)
+	return page, nil
+}
+
+// EachOrder iterates the matching orders with a cursor. The exports it feeds
+// outlast -mongo.timeout, so it is bounded by ctx only.
+func (m *Mongo) EachOrder(ctx context.Context, query m_order.OrderQuery, fn func(m_order.Invoice) error) error {
+	cur, err := m.orders().Find(ctx, orderFilter(query), options.Find().SetSort(driver.Sort([]string{"createdAt"})))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.Background())
+	for cur.Next(ctx) {
+		var order m_order.Invoice
+		if err := cur.Decode(&order); err != nil {
+			return err
+		}
+		if err := fn(order); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// orderFilter translates query into a filter, the selector of the mgo
+// backend.
+func orderFilter(query m_order.OrderQuery) bson.M {
+	filter := bson.M{}
+	if query.UserID != "" {
+		filter["userId"] = query.UserID
+	}
+	if query.TenantID != "" {
+		filter["tenantID"] = query.TenantID
+	}
+	if len(query.Status) > 0 {
+		filter["status"] = bson.M{"$in": query.Status}
+	}
+	if query.ProductID != "" {
+		filter["items.productId"] = query.ProductID
+	}
+	created := bson.M{}
+	if !query.CreatedFrom.IsZero() {
+		created["$gte"] = query.CreatedFrom
+	}
+	if !query.CreatedTo.IsZero() {
+		created["$lt"] = query.CreatedTo
+	}
+	if len(created) > 0 {
+		filter["createdAt"] = created
+	}
+	amount := bson.M{}
+	if query.MinAmount > 0 {
+		amount["$gte"] = query.MinAmount
+	}
+	if query.MaxAmount > 0 {
+		amount["$lte"] = query.MaxAmount
+	}
+	if len(amount) > 0 {
+		filter["amount"] = amount
+	}
+	return filter
+}
+
+// GetOrder returns the order of id.
+func (m *Mongo) GetOrder(ctx context.Context, id string) (m_order.Invoice, error) {
+	oid, ok := driver.ObjectID(id)
+	if !ok {
+		return m_order.Invoice{}, o_db.ErrInvalidID
+	}
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	var order m_order.Invoice
+	err := m.orders().FindOne(ctx, bson.M{"_id": oid}).Decode(&order)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return m_order.Invoice{}, o_db.ErrNotFound
+	}
+	if err != nil {
+		return m_order.Invoice{}, err
+	}
+	return order, nil
+}
+
+// cartOwner selects the cart items of a user, or of a guest cart when the user
+// is unknown.
+func cartOwner(userID, cartToken string) bson.M {
+	if userID != "" {
+		return bson.M{"userID": userID}
+	}
+	return bson.M{"userID": "", "cartToken": cartToken}
+}
+
+// GetCartItems returns the cart items of the user, or of the guest cart.
+func (m *Mongo) GetCartItems(ctx context.Context, userID, cartToken string) ([]m_order.Cart, error) {
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	cur, err := m.carts().Find(ctx, cartOwner(userID, cartToken))
+	if err != nil {
+		return nil, err
+	}
+	var mcs []mongoCart
+	if err := cur.All(ctx, &mcs); err != nil {
+		return nil, err
+	}
+	cartItems := make([]m_order.Cart, 0, len(mcs))
+	for _, mc := range mcs {
+		cartItems = append(cartItems, mc.cart())
+	}
+	return cartItems, nil
+}
+
+// GetCartItem returns the cart item of cartID.
+func (m *Mongo) GetCartItem(ctx context.Context, cartID string) (m_order.Cart, error) {
+	oid, ok := driver.ObjectID(cartID)
+	if !ok {
+		return m_order.Cart{}, o_db.ErrInvalidID
+	}
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	var mc mongoCart
+	err := m.carts().FindOne(ctx, bson.M{"_id": oid}).Decode(&mc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return m_order.Cart{}, o_db.ErrNotFound
+	}
+	if err != nil {
+		return m_order.Cart{}, err
+	}
+	return mc.cart(), nil
+}
+
+// AddCart upserts the cart line keyed by user, or guest cart, and product,
+// adding cart.Quantity to any quantity already in the cart.
+func (m *Mongo) AddCart(ctx context.Context, cart *m_order.Cart) (string, error) {
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	mc, err := m.addCart(ctx, *cart)
+	if err != nil {
+		return "", err
+	}
+	*cart = mc.cart()
+	return cart.CartID, nil
+}
+
+func (m *Mongo) addCart(ctx context.Context, cart m_order.Cart) (mongoCart, error) {
+	filter := cartOwner(cart.UserID, cart.CartToken)
+	filter["productID"] = cart.ProductID
+	update := bson.M{
+		"$inc": bson.M{"quantity": cart.Quantity},
+		"$set": bson.M{"price": cart.Price, "updatedAt": time.Now()},
+	}
+	var mc mongoCart
+	err := m.carts().FindOneAndUpdate(ctx, filter, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&mc)
+	return mc, err
+}
+
+// RemoveCartItem removes the cart item of cartID.
+func (m *Mongo) RemoveCartItem(ctx context.Context, cartID string) (bool, error) {
+	oid, ok := driver.ObjectID(cartID)
+	if !ok {
+		return false, o_db.ErrInvalidID
+	}
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	res, err := m.carts().DeleteOne(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return false, err
+	}
+	if res.DeletedCount == 0 {
+		return false, o_db.ErrNotFound
+	}
+	return true, nil
+}
+
+// UpdateQuantity sets the quantity of the cart item of cart.CartID.
+func (m *Mongo) UpdateQuantity(ctx context.Context, cart *m_order.Cart) (m_order.Cart, error) {
+	oid, ok := driver.ObjectID(cart.CartID)
+	if !ok {
+		return m_order.Cart{}, o_db.ErrInvalidID
+	}
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	var mc mongoCart
+	err := m.carts().FindOneAndUpdate(ctx,
+		bson.M{"_id": oid},
+		bson.M{"$set": bson.M{"quantity": cart.Quantity, "updatedAt": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&mc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return m_order.Cart{}, o_db.ErrNotFound
+	}
+	if err != nil {
+		return m_order.Cart{}, err
+	}
+	return mc.cart(), nil
+}
+
+// MergeCart moves the guest cart items of cartToken into the user's cart, in
+// a transaction when the servers support them.
+func (m *Mongo) MergeCart(ctx context.Context, cartToken, userID string) error {
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	return m.conn.Transaction(ctx, func(ctx context.Context) error {
+		for {
+			// claimed by removing it, the line is added once however many
+			// merges run, with or without transactions
+			var g mongoCart
+			err := m.carts().FindOneAndDelete(ctx, cartOwner("", cartToken)).Decode(&g)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			item := g.Cart
+			item.UserID = userID
+			item.CartToken = ""
+			if _, err := m.addCart(ctx, item); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// CancelExpiredOrders cancels the orders waiting for payment created before
+// createdBefore.
+func (m *Mongo) CancelExpiredOrders(ctx context.Context, createdBefore time.Time) (int, error) {
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	res, err := m.orders().UpdateMany(ctx,
+		bson.M{"status": m_order.OrderStatusCreated, "createdAt": bson.M{"$lt": createdBefore}},
+		bson.M{"$set": bson.M{"status": m_order.OrderStatusCanceled}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.ModifiedCount), nil
+}
+
+// PurgeCarts removes the cart items not touched since updatedBefore.
+func (m *Mongo) PurgeCarts(ctx context.Context, updatedBefore time.Time) (int, error) {
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	res, err := m.carts().DeleteMany(ctx, bson.M{"updatedAt": bson.M{"$lt": updatedBefore}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
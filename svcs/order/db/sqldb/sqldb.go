@@ -0,0 +1,525 @@
+// Package sqldb stores orders and carts in a SQL database, registered as the
+// "postgres" and "sqlite" databases: orders in the invoices table, their items
+// in order_items, and cart items in carts, one line per user, or guest cart,
+// and product.
+//
+// Orders are created, and guest carts merged, in transactions.
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	o_db "github.com/laidingqing/dabanshan-go/svcs/order/db"
+	m_order "github.com/laidingqing/dabanshan-go/svcs/order/model"
+	s_sqldb "github.com/laidingqing/dabanshan-go/svcs/sqldb"
+	"github.com/laidingqing/dabanshan-go/utils"
+)
+
+// migrations are the schema of the orders and carts, see
+// s_sqldb.DB.Migrate.
+var migrations = []string{
+	`CREATE TABLE invoices (
+	id          CHAR(24) PRIMARY KEY,
+	invoice_id  BIGINT NOT NULL,
+	amount      REAL NOT NULL,
+	discount    REAL NOT NULL,
+	discount_id REAL NOT NULL,
+	user_id     TEXT NOT NULL,
+	address_id  TEXT NOT NULL,
+	tenant_id   TEXT NOT NULL,
+	status      INTEGER NOT NULL,
+	created_at  TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX invoices_user_id ON invoices (user_id, created_at);
+CREATE INDEX invoices_tenant_id ON invoices (tenant_id, created_at);
+CREATE INDEX invoices_status ON invoices (status, created_at);
+CREATE TABLE order_items (
+	invoice_id CHAR(24) NOT NULL REFERENCES invoices (id) ON DELETE CASCADE,
+	line       INTEGER NOT NULL,
+	product_id TEXT NOT NULL,
+	quantity   INTEGER NOT NULL,
+	price      REAL NOT NULL,
+	total      REAL NOT NULL,
+	cart_id    TEXT NOT NULL,
+	tenant_id  TEXT NOT NULL,
+	PRIMARY KEY (invoice_id, line)
+);
+CREATE INDEX order_items_product_id ON order_items (product_id);
+CREATE TABLE carts (
+	id         CHAR(24) PRIMARY KEY,
+	user_id    TEXT NOT NULL,
+	cart_token TEXT NOT NULL,
+	product_id TEXT NOT NULL,
+	price      REAL NOT NULL,
+	quantity   INTEGER NOT NULL,
+	total      REAL NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL,
+	UNIQUE (user_id, cart_token, product_id)
+);
+CREATE INDEX carts_updated_at ON carts (updated_at)`,
+}
+
+const (
+	// orderColumns are the columns of an order joined with one of its
+	// items, i and oi, the items of an order without any read as line -1.
+	orderColumns = `i.id, i.invoice_id, i.amount, i.discount, i.discount_id, i.user_id, i.address_id, i.tenant_id, i.status, i.created_at,
+	COALESCE(oi.line, -1), COALESCE(oi.product_id, ''), COALESCE(oi.quantity, 0), COALESCE(oi.price, 0), COALESCE(oi.total, 0), COALESCE(oi.cart_id, ''), COALESCE(oi.tenant_id, '')`
+	cartColumns = `id, user_id, cart_token, product_id, price, quantity, total, updated_at`
+)
+
+// sortColumns are the columns of the fields orders may be sorted by.
+var sortColumns = map[string]string{
+	"createdAt": "created_at",
+	"amount":    "amount",
+	"status":    "status",
+}
+
+// RegisterFlags defines the flags of the SQL connection on fs.
+func RegisterFlags(fs *flag.FlagSet) {
+	s_sqldb.RegisterFlags(fs)
+}
+
+// SQL meets the Database interface requirements
+type SQL struct {
+	Dialect s_sqldb.Dialect
+	db      *s_sqldb.DB
+}
+
+// querier runs queries on the database or in a transaction.
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Init connects and migrates the schema.
+func (s *SQL) Init(ctx context.Context) error {
+	db, err := s_sqldb.Open(ctx, s.Dialect)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	return s.Migrate(ctx)
+}
+
+// Migrate brings the tables of the orders and carts up to date.
+func (s *SQL) Migrate(ctx context.Context) error {
+	return s.db.Migrate(ctx, "orders", migrations)
+}
+
+// Ping checks that the database answers.
+func (s *SQL) Ping(ctx context.Context) error {
+	if s.db == nil {
+		return s_sqldb.ErrNotConnected
+	}
+	return s.db.Ping(ctx)
+}
+
+// Close closes the connections.
+func (s *SQL) Close() {
+	if s.db != nil {
+		s.db.Close()
+	}
+}
+
+// CreateOrder inserts the order, created now, and its items.
+func (s *SQL) CreateOrder(ctx context.Context, u *m_order.Invoice) (string, error) {
+	ctx, cancel := s.db.Context(ctx)
+	defer cancel()
+	u.CreatedAt = time.Now()
+	id := s_sqldb.NewID()
+	err := s.db.Tx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO invoices (id, invoice_id, amount, discount, discount_id, user_id, address_id, tenant_id, status, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			id, u.InvoiceID, u.Amount, u.Discount, u.DiscountID, u.UserID, u.AddressID, u.TenantID, int(u.Status), s.db.Time(u.CreatedAt))
+		if err != nil {
+			return err
+		}
+		for line, item := range u.OrdereItem {
+			_, err := tx.ExecContext(ctx, `INSERT INTO order_items (invoice_id, line, product_id, quantity, price, total, cart_id, tenant_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+				id, line, item.ProductID, item.Quantity, item.Price, item.Total, item.CartID, item.TenantID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// FindOrders returns the page of orders matching query.
+func (s *SQL) FindOrders(ctx context.Context, query m_order.OrderQuery, page utils.Pagination) (utils.Pagination, error) {
+	sortBy, err := orderBy(page.Sortor, "")
+	if err != nil {
+		return utils.Pagination{}, err
+	}
+	joinedBy, _ := orderBy(page.Sortor, "i.")
+	ctx, cancel := s.db.Context(ctx)
+	defer cancel()
+	where, args := s.orderFilter(query)
+	var total int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM invoices`+where, args...).Scan(&total); err != nil {
+		return utils.Pagination{}, err
+	}
+	args = append(args, page.PageSize, (page.PageIndex-1)*page.PageSize)
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`SELECT %s
+FROM (SELECT * FROM invoices%s ORDER BY %s LIMIT $%d OFFSET $%d) i
+LEFT JOIN order_items oi ON oi.invoice_id = i.id
+ORDER BY %s, oi.line`, orderColumns, where, sortBy, len(args)-1, len(args), joinedBy), args...)
+	if err != nil {
+		return utils.Pagination{}, err
+	}
+	orders := []m_order.Invoice{}
+	err = scanOrders(rows, func(order m_order.Invoice) error {
+		orders = append(orders, order)
+		return nil
+	})
+	if err != nil {
+		return utils.Pagination{}, err
+	}
+	page.Data = orders
+	page.Count = total
+	return page, nil
+}
+
+// EachOrder iterates the matching orders, oldest first, as they are read. The
+// exports it feeds outlast -sql.timeout, so it is bounded by ctx only.
+func (s *SQL) EachOrder(ctx context.Context, query m_order.OrderQuery, fn func(m_order.Invoice) error) error {
+	where, args := s.orderFilter(query)
+	rows, err := s.db.QueryContext(ctx, `SELECT `+orderColumns+`
+FROM (SELECT * FROM invoices`+where+`) i
+LEFT JOIN order_items oi ON oi.invoice_id = i.id
+ORDER BY i.created_at, i.id, oi.line`, args...)
+	if err != nil {
+		return err
+	}
+	return scanOrders(rows, fn)
+}
+
+// GetOrder returns the order of id.
+func (s *SQL) GetOrder(ctx context.Context, id string) (m_order.Invoice, error) {
+	id, ok := s_sqldb.ID(id)
+	if !ok {
+		return m_order.Invoice{}, o_db.ErrInvalidID
+	}
+	ctx, cancel := s.db.Context(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT `+orderColumns+`
+FROM invoices i
+LEFT JOIN order_items oi ON oi.invoice_id = i.id
+WHERE i.id = $1
+ORDER BY oi.line`, id)
+	if err != nil {
+		return m_order.Invoice{}, err
+	}
+	var (
+		order m_order.Invoice
+		found bool
+	)
+	err = scanOrders(rows, func(o m_order.Invoice) error {
+		order, found = o, true
+		return nil
+	})
+	if err != nil {
+		return m_order.Invoice{}, err
+	}
+	if !found {
+		return m_order.Invoice{}, o_db.ErrNotFound
+	}
+	return order, nil
+}
+
+// scanOrders calls fn for each order of rows, of orderColumns, the rows of an
+// order next to each other in the order of its items. It closes rows.
+func scanOrders(rows *sql.Rows, fn func(m_order.Invoice) error) error {
+	defer rows.Close()
+	var (
+		order   m_order.Invoice
+		orderID string
+	)
+	for rows.Next() {
+		var (
+			o    m_order.Invoice
+			id   string
+			line int
+			item m_order.OrderItem
+		)
+		err := rows.Scan(&id, &o.InvoiceID, &o.Amount, &o.Discount, &o.DiscountID, &o.UserID, &o.AddressID, &o.TenantID, &o.Status, &o.CreatedAt,
+			&line, &item.ProductID, &item.Quantity, &item.Price, &item.Total, &item.CartID, &item.TenantID)
+		if err != nil {
+			return err
+		}
+		if id != orderID {
+			if orderID != "" {
+				if err := fn(order); err != nil {
+					return err
+				}
+			}
+			o.CreatedAt = o.CreatedAt.Local()
+			order, orderID = o, id
+		}
+		if line >= 0 {
+			order.OrdereItem = append(order.OrdereItem, item)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if orderID != "" {
+		return fn(order)
+	}
+	return nil
+}
+
+// orderFilter translates query into the WHERE clause of a query of the
+// invoices table, and its arguments.
+func (s *SQL) orderFilter(query m_order.OrderQuery) (string, []interface{}) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if query.UserID != "" {
+		conds = append(conds, "user_id = "+arg(query.UserID))
+	}
+	if query.TenantID != "" {
+		conds = append(conds, "tenant_id = "+arg(query.TenantID))
+	}
+	if len(query.Status) > 0 {
+		var in []string
+		for _, status := range query.Status {
+			in = append(in, arg(int(status)))
+		}
+		conds = append(conds, "status IN ("+strings.Join(in, ", ")+")")
+	}
+	if query.ProductID != "" {
+		conds = append(conds, "EXISTS (SELECT 1 FROM order_items WHERE order_items.invoice_id = invoices.id AND order_items.product_id = "+arg(query.ProductID)+")")
+	}
+	if !query.CreatedFrom.IsZero() {
+		conds = append(conds, "created_at >= "+arg(s.db.Time(query.CreatedFrom)))
+	}
+	if !query.CreatedTo.IsZero() {
+		conds = append(conds, "created_at < "+arg(s.db.Time(query.CreatedTo)))
+	}
+	if query.MinAmount > 0 {
+		conds = append(conds, "amount >= "+arg(query.MinAmount))
+	}
+	if query.MaxAmount > 0 {
+		conds = append(conds, "amount <= "+arg(query.MaxAmount))
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// orderBy translates sort fields, prefixed with "-" for descending order,
+// into an ORDER BY list of the columns of table, the id last so that pages
+// do not overlap.
+func orderBy(fields []string, table string) (string, error) {
+	var order []string
+	for _, f := range fields {
+		column, ok := sortColumns[strings.TrimPrefix(f, "-")]
+		if !ok {
+			return "", fmt.Errorf("sqldb: cannot sort orders by %q", f)
+		}
+		if strings.HasPrefix(f, "-") {
+			column += " DESC"
+		}
+		order = append(order, table+column)
+	}
+	return strings.Join(append(order, table+"id"), ", "), nil
+}
+
+// cartOwner selects the cart items of a user, or of a guest cart when the user
+// is unknown, with the argument $n.
+func cartOwner(userID, cartToken string, n int) (string, string) {
+	if userID != "" {
+		return fmt.Sprintf("user_id = $%d", n), userID
+	}
+	return fmt.Sprintf("user_id = '' AND cart_token = $%d", n), cartToken
+}
+
+// scanCart reads a row of cartColumns.
+func scanCart(row interface{ Scan(...interface{}) error }) (m_order.Cart, error) {
+	var cart m_order.Cart
+	err := row.Scan(&cart.CartID, &cart.UserID, &cart.CartToken, &cart.ProductID, &cart.Price, &cart.Quantity, &cart.Total, &cart.UpdatedAt)
+	cart.UpdatedAt = cart.UpdatedAt.Local()
+	return cart, err
+}
+
+// GetCartItems returns the cart items of the user, or of the guest cart.
+func (s *SQL) GetCartItems(ctx context.Context, userID, cartToken string) ([]m_order.Cart, error) {
+	ctx, cancel := s.db.Context(ctx)
+	defer cancel()
+	cond, arg := cartOwner(userID, cartToken, 1)
+	rows, err := s.db.QueryContext(ctx, `SELECT `+cartColumns+` FROM carts WHERE `+cond+` ORDER BY id`, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cartItems := []m_order.Cart{}
+	for rows.Next() {
+		cart, err := scanCart(rows)
+		if err != nil {
+			return nil, err
+		}
+		cartItems = append(cartItems, cart)
+	}
+	return cartItems, rows.Err()
+}
+
+// GetCartItem returns the cart item of cartID.
+func (s *SQL) GetCartItem(ctx context.Context, cartID string) (m_order.Cart, error) {
+	id, ok := s_sqldb.ID(cartID)
+	if !ok {
+		return m_order.Cart{}, o_db.ErrInvalidID
+	}
+	ctx, cancel := s.db.Context(ctx)
+	defer cancel()
+	cart, err := scanCart(s.db.QueryRowContext(ctx, `SELECT `+cartColumns+` FROM carts WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return m_order.Cart{}, o_db.ErrNotFound
+	}
+	if err != nil {
+		return m_order.Cart{}, err
+	}
+	return cart, nil
+}
+
+// AddCart upserts the cart line keyed by user, or guest cart, and product,
+// adding cart.Quantity to any quantity already in the cart.
+func (s *SQL) AddCart(ctx context.Context, cart *m_order.Cart) (string, error) {
+	ctx, cancel := s.db.Context(ctx)
+	defer cancel()
+	added, err := s.addCart(ctx, s.db, *cart)
+	if err != nil {
+		return "", err
+	}
+	*cart = added
+	return cart.CartID, nil
+}
+
+func (s *SQL) addCart(ctx context.Context, q querier, cart m_order.Cart) (m_order.Cart, error) {
+	if cart.UserID != "" {
+		cart.CartToken = ""
+	}
+	return scanCart(q.QueryRowContext(ctx, `INSERT INTO carts (`+cartColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (user_id, cart_token, product_id) DO UPDATE
+SET quantity = carts.quantity + excluded.quantity, price = excluded.price, updated_at = excluded.updated_at
+RETURNING `+cartColumns,
+		s_sqldb.NewID(), cart.UserID, cart.CartToken, cart.ProductID, cart.Price, cart.Quantity, cart.Total, s.db.Time(time.Now())))
+}
+
+// RemoveCartItem removes the cart item of cartID.
+func (s *SQL) RemoveCartItem(ctx context.Context, cartID string) (bool, error) {
+	id, ok := s_sqldb.ID(cartID)
+	if !ok {
+		return false, o_db.ErrInvalidID
+	}
+	ctx, cancel := s.db.Context(ctx)
+	defer cancel()
+	res, err := s.db.ExecContext(ctx, `DELETE FROM carts WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, o_db.ErrNotFound
+	}
+	return true, nil
+}
+
+// UpdateQuantity sets the quantity of the cart item of cart.CartID.
+func (s *SQL) UpdateQuantity(ctx context.Context, cart *m_order.Cart) (m_order.Cart, error) {
+	id, ok := s_sqldb.ID(cart.CartID)
+	if !ok {
+		return m_order.Cart{}, o_db.ErrInvalidID
+	}
+	ctx, cancel := s.db.Context(ctx)
+	defer cancel()
+	updated, err := scanCart(s.db.QueryRowContext(ctx, `UPDATE carts SET quantity = $1, updated_at = $2 WHERE id = $3 RETURNING `+cartColumns,
+		cart.Quantity, s.db.Time(time.Now()), id))
+	if err == sql.ErrNoRows {
+		return m_order.Cart{}, o_db.ErrNotFound
+	}
+	if err != nil {
+		return m_order.Cart{}, err
+	}
+	return updated, nil
+}
+
+// MergeCart moves the guest cart items of cartToken into the user's cart, in
+// a transaction.
+func (s *SQL) MergeCart(ctx context.Context, cartToken, userID string) error {
+	ctx, cancel := s.db.Context(ctx)
+	defer cancel()
+	return s.db.Tx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT `+cartColumns+` FROM carts WHERE user_id = '' AND cart_token = $1`, cartToken)
+		if err != nil {
+			return err
+		}
+		var guest []m_order.Cart
+		for rows.Next() {
+			cart, err := scanCart(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			guest = append(guest, cart)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, item := range guest {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM carts WHERE id = $1`, item.CartID); err != nil {
+				return err
+			}
+			item.UserID = userID
+			if _, err := s.addCart(ctx, tx, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CancelExpiredOrders cancels the orders waiting for payment created before
+// createdBefore.
+func (s *SQL) CancelExpiredOrders(ctx context.Context, createdBefore time.Time) (int, error) {
+	ctx, cancel := s.db.Context(ctx)
+	defer cancel()
+	res, err := s.db.ExecContext(ctx, `UPDATE invoices SET status = $1 WHERE status = $2 AND created_at < $3`,
+		int(m_order.OrderStatusCanceled), int(m_order.OrderStatusCreated), s.db.Time(createdBefore))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// PurgeCarts removes the cart items not touched since updatedBefore.
+func (s *SQL) PurgeCarts(ctx context.Context, updatedBefore time.Time) (int, error) {
+	ctx, cancel := s.db.Context(ctx)
+	defer cancel()
+	res, err := s.db.ExecContext(ctx, `DELETE FROM carts WHERE updated_at < $1`, s.db.Time(updatedBefore))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -2,33 +2,24 @@ package endpoint
 
 import (
 	"context"
-	"fmt"
 	"time"
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/log/level"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
 )
 
-func InstrumentingMiddleware(duration metrics.Histogram) endpoint.Middleware {
-	return func(next endpoint.Endpoint) endpoint.Endpoint {
-		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-
-			defer func(begin time.Time) {
-				duration.With("success", fmt.Sprint(err == nil)).Observe(time.Since(begin).Seconds())
-			}(time.Now())
-			return next(ctx, request)
-
-		}
-	}
-}
-
 func LoggingMiddleware(logger log.Logger) endpoint.Middleware {
 	return func(next endpoint.Endpoint) endpoint.Endpoint {
 		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 
 			defer func(begin time.Time) {
-				logger.Log("transport_error", err, "took", time.Since(begin))
+				lvl := level.Debug
+				if err != nil {
+					lvl = level.Error
+				}
+				lvl(logging.With(ctx, logger)).Log("transport_error", err, "took", time.Since(begin))
 			}(time.Now())
 			return next(ctx, request)
 
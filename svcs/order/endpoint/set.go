@@ -6,8 +6,8 @@ import (
 	"github.com/go-kit/kit/circuitbreaker"
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/metrics"
 	"github.com/go-kit/kit/tracing/opentracing"
+	"github.com/laidingqing/dabanshan-go/svcs/instrumenting"
 	m_order "github.com/laidingqing/dabanshan-go/svcs/order/model"
 	"github.com/laidingqing/dabanshan-go/svcs/order/service"
 	stdopentracing "github.com/opentracing/opentracing-go"
@@ -25,11 +25,12 @@ type Set struct {
 	GetCartItemsEndpoint   endpoint.Endpoint
 	RemoveCartItemEndpoint endpoint.Endpoint
 	UpdateQuantityEndpoint endpoint.Endpoint
+	MergeCartEndpoint      endpoint.Endpoint
 }
 
 // New returns a Set that wraps the provided server, and wires in all of the
 // expected endpoint middlewares via the various parameters.
-func New(svc service.Service, logger log.Logger, duration metrics.Histogram, trace stdopentracing.Tracer) Set {
+func New(svc service.Service, logger log.Logger, metrics instrumenting.EndpointMetrics, trace stdopentracing.Tracer) Set {
 	var (
 		createOrderEndpoint    endpoint.Endpoint
 		getOrdersEndpoint      endpoint.Endpoint
@@ -38,6 +39,7 @@ func New(svc service.Service, logger log.Logger, duration metrics.Histogram, tra
 		getCartItemsEndpoint   endpoint.Endpoint
 		removeCartItemEndpoint endpoint.Endpoint
 		updateQuantityEndpoint endpoint.Endpoint
+		mergeCartEndpoint      endpoint.Endpoint
 	)
 	{
 		createOrderEndpoint = MakeCreateOrderEndpoint(svc)
@@ -45,7 +47,7 @@ func New(svc service.Service, logger log.Logger, duration metrics.Histogram, tra
 		createOrderEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(createOrderEndpoint)
 		createOrderEndpoint = opentracing.TraceServer(trace, "CreateOrder")(createOrderEndpoint)
 		createOrderEndpoint = LoggingMiddleware(log.With(logger, "method", "CreateOrder"))(createOrderEndpoint)
-		createOrderEndpoint = InstrumentingMiddleware(duration.With("method", "CreateOrder"))(createOrderEndpoint)
+		createOrderEndpoint = metrics.Middleware("CreateOrder")(createOrderEndpoint)
 	}
 	{
 		getOrdersEndpoint = MakeGetOrdersEndpoint(svc)
@@ -53,7 +55,7 @@ func New(svc service.Service, logger log.Logger, duration metrics.Histogram, tra
 		getOrdersEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(getOrdersEndpoint)
 		getOrdersEndpoint = opentracing.TraceServer(trace, "GetOrders")(getOrdersEndpoint)
 		getOrdersEndpoint = LoggingMiddleware(log.With(logger, "method", "GetOrders"))(getOrdersEndpoint)
-		getOrdersEndpoint = InstrumentingMiddleware(duration.With("method", "GetOrders"))(getOrdersEndpoint)
+		getOrdersEndpoint = metrics.Middleware("GetOrders")(getOrdersEndpoint)
 
 	}
 	{
@@ -62,7 +64,7 @@ func New(svc service.Service, logger log.Logger, duration metrics.Histogram, tra
 		getOrderEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(getOrderEndpoint)
 		getOrderEndpoint = opentracing.TraceServer(trace, "GetOrder")(getOrderEndpoint)
 		getOrderEndpoint = LoggingMiddleware(log.With(logger, "method", "GetOrder"))(getOrderEndpoint)
-		getOrderEndpoint = InstrumentingMiddleware(duration.With("method", "GetOrder"))(getOrderEndpoint)
+		getOrderEndpoint = metrics.Middleware("GetOrder")(getOrderEndpoint)
 
 	}
 	{
@@ -71,7 +73,7 @@ func New(svc service.Service, logger log.Logger, duration metrics.Histogram, tra
 		addCartEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(addCartEndpoint)
 		addCartEndpoint = opentracing.TraceServer(trace, "AddCart")(addCartEndpoint)
 		addCartEndpoint = LoggingMiddleware(log.With(logger, "method", "AddCart"))(addCartEndpoint)
-		addCartEndpoint = InstrumentingMiddleware(duration.With("method", "AddCart"))(addCartEndpoint)
+		addCartEndpoint = metrics.Middleware("AddCart")(addCartEndpoint)
 	}
 	{
 		getCartItemsEndpoint = MakeGetCartItemsEndpoint(svc)
@@ -79,7 +81,7 @@ func New(svc service.Service, logger log.Logger, duration metrics.Histogram, tra
 		getCartItemsEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(getCartItemsEndpoint)
 		getCartItemsEndpoint = opentracing.TraceServer(trace, "GetCartItems")(getCartItemsEndpoint)
 		getCartItemsEndpoint = LoggingMiddleware(log.With(logger, "method", "GetCartItems"))(getCartItemsEndpoint)
-		getCartItemsEndpoint = InstrumentingMiddleware(duration.With("method", "GetCartItems"))(getCartItemsEndpoint)
+		getCartItemsEndpoint = metrics.Middleware("GetCartItems")(getCartItemsEndpoint)
 	}
 	{
 		removeCartItemEndpoint = MakeRemoveCartItemEndpoint(svc)
@@ -87,7 +89,7 @@ func New(svc service.Service, logger log.Logger, duration metrics.Histogram, tra
 		removeCartItemEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(removeCartItemEndpoint)
 		removeCartItemEndpoint = opentracing.TraceServer(trace, "RemoveCartItem")(removeCartItemEndpoint)
 		removeCartItemEndpoint = LoggingMiddleware(log.With(logger, "method", "RemoveCartItem"))(removeCartItemEndpoint)
-		removeCartItemEndpoint = InstrumentingMiddleware(duration.With("method", "RemoveCartItem"))(removeCartItemEndpoint)
+		removeCartItemEndpoint = metrics.Middleware("RemoveCartItem")(removeCartItemEndpoint)
 	}
 	{
 		updateQuantityEndpoint = MakeUpdateQuantityEndpoint(svc)
@@ -95,7 +97,14 @@ func New(svc service.Service, logger log.Logger, duration metrics.Histogram, tra
 		updateQuantityEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(updateQuantityEndpoint)
 		updateQuantityEndpoint = opentracing.TraceServer(trace, "UpdateQuantity")(updateQuantityEndpoint)
 		updateQuantityEndpoint = LoggingMiddleware(log.With(logger, "method", "UpdateQuantity"))(updateQuantityEndpoint)
-		updateQuantityEndpoint = InstrumentingMiddleware(duration.With("method", "UpdateQuantity"))(updateQuantityEndpoint)
+		updateQuantityEndpoint = metrics.Middleware("UpdateQuantity")(updateQuantityEndpoint)
+	}
+	{
+		mergeCartEndpoint = MakeMergeCartEndpoint(svc)
+		mergeCartEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(mergeCartEndpoint)
+		mergeCartEndpoint = opentracing.TraceServer(trace, "MergeCart")(mergeCartEndpoint)
+		mergeCartEndpoint = LoggingMiddleware(log.With(logger, "method", "MergeCart"))(mergeCartEndpoint)
+		mergeCartEndpoint = metrics.Middleware("MergeCart")(mergeCartEndpoint)
 	}
 
 	return Set{
@@ -106,6 +115,7 @@ func New(svc service.Service, logger log.Logger, duration metrics.Histogram, tra
 		GetCartItemsEndpoint:   getCartItemsEndpoint,
 		RemoveCartItemEndpoint: removeCartItemEndpoint,
 		UpdateQuantityEndpoint: updateQuantityEndpoint,
+		MergeCartEndpoint:      mergeCartEndpoint,
 	}
 }
 
@@ -169,6 +179,16 @@ func (s Set) UpdateQuantity(ctx context.Context, req m_order.UpdateQuantityReque
 	return response, response.Err
 }
 
+// MergeCart implements the service interface.
+func (s Set) MergeCart(ctx context.Context, req m_order.MergeCartRequest) (m_order.MergeCartResponse, error) {
+	resp, err := s.MergeCartEndpoint(ctx, req)
+	if err != nil {
+		return m_order.MergeCartResponse{}, err
+	}
+	response := resp.(m_order.MergeCartResponse)
+	return response, response.Err
+}
+
 // RemoveCartItem implements the service interface
 func (s Set) RemoveCartItem(ctx context.Context, model m_order.RemoveCartItemRequest) (m_order.RemoveCartItemResponse, error) {
 	resp, err := s.RemoveCartItemEndpoint(ctx, model)
@@ -241,3 +261,12 @@ func MakeUpdateQuantityEndpoint(s service.Service) endpoint.Endpoint {
 		return v, err
 	}
 }
+
+// MakeMergeCartEndpoint constructs a MergeCart endpoint wrapping the service.
+func MakeMergeCartEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(m_order.MergeCartRequest)
+		v, err := s.MergeCart(ctx, req)
+		return v, err
+	}
+}
@@ -0,0 +1,32 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/laidingqing/dabanshan-go/svcs/order/db"
+)
+
+// CancelExpiredOrders returns a job canceling orders left unpaid for longer
+// than timeout.
+func CancelExpiredOrders(timeout, interval time.Duration) Job {
+	return Job{
+		Name:     "cancel-expired-orders",
+		Interval: interval,
+		Run: func(ctx context.Context) (int, error) {
+			return db.CancelExpiredOrders(ctx, time.Now().Add(-timeout))
+		},
+	}
+}
+
+// PurgeStaleCarts returns a job removing cart items not touched for longer
+// than maxAge.
+func PurgeStaleCarts(maxAge, interval time.Duration) Job {
+	return Job{
+		Name:     "purge-stale-carts",
+		Interval: interval,
+		Run: func(ctx context.Context) (int, error) {
+			return db.PurgeCarts(ctx, time.Now().Add(-maxAge))
+		},
+	}
+}
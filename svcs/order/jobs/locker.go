@@ -0,0 +1,78 @@
+package jobs
+
+import (
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ConsulLocker elects job leaders with Consul session locks, so that only one
+// instance of a service runs each job.
+type ConsulLocker struct {
+	client *api.Client
+	prefix string
+	mtx    sync.Mutex
+	locks  map[string]*api.Lock
+}
+
+// NewConsulLocker returns a ConsulLocker keeping its locks under
+// service/<service>/jobs/ in the Consul KV store.
+func NewConsulLocker(client *api.Client, service string) *ConsulLocker {
+	return &ConsulLocker{
+		client: client,
+		prefix: "service/" + service + "/jobs/",
+		locks:  map[string]*api.Lock{},
+	}
+}
+
+// Lock implements Locker.
+func (l *ConsulLocker) Lock(name string, stop <-chan struct{}) (<-chan struct{}, error) {
+	lock, err := l.client.LockOpts(&api.LockOptions{
+		Key:         l.prefix + name,
+		SessionName: name,
+		SessionTTL:  "15s",
+	})
+	if err != nil {
+		return nil, err
+	}
+	lost, err := lock.Lock(stop)
+	if err != nil || lost == nil {
+		return nil, err
+	}
+	l.mtx.Lock()
+	l.locks[name] = lock
+	l.mtx.Unlock()
+	return lost, nil
+}
+
+// Unlock implements Locker.
+func (l *ConsulLocker) Unlock(name string) error {
+	l.mtx.Lock()
+	lock, ok := l.locks[name]
+	delete(l.locks, name)
+	l.mtx.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := lock.Unlock(); err != nil && err != api.ErrLockNotHeld {
+		return err
+	}
+	return nil
+}
+
+// LocalLocker grants every lock immediately. Use it when a single instance is
+// running or no Consul agent is available.
+type LocalLocker struct{}
+
+// Lock implements Locker.
+func (LocalLocker) Lock(name string, stop <-chan struct{}) (<-chan struct{}, error) {
+	select {
+	case <-stop:
+		return nil, nil
+	default:
+		return make(chan struct{}), nil
+	}
+}
+
+// Unlock implements Locker.
+func (LocalLocker) Unlock(name string) error { return nil }
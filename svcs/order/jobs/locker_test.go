@@ -0,0 +1,62 @@
+package jobs
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// TestConsulLocker runs two lockers against the agent of CONSUL_TEST_ADDR,
+// host:port, checking that one holds a lock at a time.
+func TestConsulLocker(t *testing.T) {
+	addr := os.Getenv("CONSUL_TEST_ADDR")
+	if addr == "" {
+		t.Skip("CONSUL_TEST_ADDR is not set")
+	}
+	client, err := api.NewClient(&api.Config{Address: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := "jobs_test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	a, b := NewConsulLocker(client, service), NewConsulLocker(client, service)
+	defer client.KV().DeleteTree("service/"+service+"/", nil)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if lost, err := a.Lock("j", stop); lost == nil || err != nil {
+		t.Fatalf("first lock: %v, %v", lost, err)
+	}
+	won := make(chan error, 1)
+	go func() {
+		lost, err := b.Lock("j", stop)
+		if err == nil && lost == nil {
+			err = os.ErrClosed
+		}
+		won <- err
+	}()
+	select {
+	case err := <-won:
+		t.Fatalf("second lock taken while held: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if err := a.Unlock("j"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-won:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("second lock not taken once released")
+	}
+	if err := b.Unlock("j"); err != nil {
+		t.Error(err)
+	}
+	if err := a.Unlock("j"); err != nil {
+		t.Errorf("unlock of a lock not held: %v", err)
+	}
+}
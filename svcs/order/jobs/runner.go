@@ -0,0 +1,132 @@
+package jobs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// lockRetry is how long a job waits before retrying a failed lock attempt.
+const lockRetry = 10 * time.Second
+
+// Job is a unit of background work, run every Interval by at most one
+// service instance at a time.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	// Run does the work and reports how many records it touched.
+	Run func(ctx context.Context) (int, error)
+}
+
+// Locker elects the instance allowed to run a job.
+type Locker interface {
+	// Lock blocks until the lock for name is held or stop is closed, in which
+	// case it returns a nil channel. The returned channel is closed when the
+	// lock is lost.
+	Lock(name string, stop <-chan struct{}) (<-chan struct{}, error)
+	// Unlock releases the lock for name.
+	Unlock(name string) error
+}
+
+// Runner runs jobs on their intervals while holding their locks. It is meant
+// to be added to an oklog group with Run and Interrupt.
+type Runner struct {
+	locker Locker
+	logger log.Logger
+	jobs   []Job
+	quit   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+// NewRunner returns a Runner for jobs.
+func NewRunner(locker Locker, logger log.Logger, jobs ...Job) *Runner {
+	return &Runner{
+		locker: locker,
+		logger: logger,
+		jobs:   jobs,
+		quit:   make(chan struct{}),
+	}
+}
+
+// Run starts all jobs and blocks until Interrupt is called and running jobs
+// have finished.
+func (r *Runner) Run() error {
+	for _, j := range r.jobs {
+		r.wg.Add(1)
+		go func(j Job) {
+			defer r.wg.Done()
+			r.lead(j)
+		}(j)
+	}
+	<-r.quit
+	r.wg.Wait()
+	return nil
+}
+
+// Interrupt stops all jobs, cancelling the context of running ones.
+func (r *Runner) Interrupt(error) {
+	r.once.Do(func() { close(r.quit) })
+}
+
+// lead acquires the lock of j and runs it for as long as the lock is held,
+// competing for it again when it is lost.
+func (r *Runner) lead(j Job) {
+	logger := log.With(r.logger, "job", j.Name)
+	for {
+		lost, err := r.locker.Lock(j.Name, r.quit)
+		if err != nil {
+			logger.Log("during", "Lock", "err", err)
+			select {
+			case <-time.After(lockRetry):
+				continue
+			case <-r.quit:
+				return
+			}
+		}
+		if lost == nil {
+			return
+		}
+		logger.Log("leader", true)
+		r.tick(j, lost, logger)
+		if err := r.locker.Unlock(j.Name); err != nil {
+			logger.Log("during", "Unlock", "err", err)
+		}
+		select {
+		case <-r.quit:
+			return
+		default:
+			logger.Log("leader", false)
+		}
+	}
+}
+
+// tick runs j immediately and then every interval, until the lock is lost or
+// the runner is interrupted.
+func (r *Runner) tick(j Job, lost <-chan struct{}, logger log.Logger) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-lost:
+		case <-r.quit:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	t := time.NewTicker(j.Interval)
+	defer t.Stop()
+	for {
+		begin := time.Now()
+		n, err := j.Run(ctx)
+		logger.Log("affected", n, "took", time.Since(begin), "err", err)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
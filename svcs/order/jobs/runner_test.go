@@ -0,0 +1,197 @@
+package jobs
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// memLocker is a Locker held by one runner at a time, its holder losing it
+// on revoke.
+type memLocker struct {
+	sem  chan struct{}
+	mtx  sync.Mutex
+	lost chan struct{}
+}
+
+func newMemLocker() *memLocker {
+	return &memLocker{sem: make(chan struct{}, 1)}
+}
+
+func (l *memLocker) Lock(name string, stop <-chan struct{}) (<-chan struct{}, error) {
+	select {
+	case l.sem <- struct{}{}:
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+		l.lost = make(chan struct{})
+		return l.lost, nil
+	case <-stop:
+		return nil, nil
+	}
+}
+
+func (l *memLocker) Unlock(name string) error {
+	<-l.sem
+	return nil
+}
+
+// revoke makes the holder lose the lock, as an expired Consul session would.
+func (l *memLocker) revoke() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	close(l.lost)
+}
+
+// waitFor fails t unless cond holds within a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// start runs r, returning the channel its Run returns on.
+func start(r *Runner) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- r.Run() }()
+	return done
+}
+
+// counter counts the runs of a job by instance and fails t if two overlap.
+type counter struct {
+	t       *testing.T
+	mtx     sync.Mutex
+	running int
+	runs    map[string]int
+}
+
+func (c *counter) job(instance string) Job {
+	return Job{
+		Name:     "cancel-expired-orders",
+		Interval: time.Millisecond,
+		Run: func(ctx context.Context) (int, error) {
+			c.mtx.Lock()
+			c.running++
+			if c.running > 1 {
+				c.t.Errorf("%s runs the job along with another instance", instance)
+			}
+			c.runs[instance]++
+			c.mtx.Unlock()
+			time.Sleep(time.Millisecond)
+			c.mtx.Lock()
+			c.running--
+			c.mtx.Unlock()
+			return 1, nil
+		},
+	}
+}
+
+func (c *counter) count(instance string) int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.runs[instance]
+}
+
+func TestRunnerExclusive(t *testing.T) {
+	locker := newMemLocker()
+	c := &counter{t: t, runs: map[string]int{}}
+	a := NewRunner(locker, log.NewNopLogger(), c.job("a"))
+	b := NewRunner(locker, log.NewNopLogger(), c.job("b"))
+
+	aDone := start(a)
+	waitFor(t, "a to run the job on its interval", func() bool { return c.count("a") >= 3 })
+	bDone := start(b)
+	time.Sleep(20 * time.Millisecond)
+	if n := c.count("b"); n != 0 {
+		t.Errorf("b ran the job %d times while a held the lock", n)
+	}
+
+	a.Interrupt(nil)
+	if err := <-aDone; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "b to take over", func() bool { return c.count("b") >= 1 })
+	b.Interrupt(nil)
+	if err := <-bDone; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunnerInterrupt(t *testing.T) {
+	running, canceled := make(chan struct{}), make(chan error, 1)
+	r := NewRunner(LocalLocker{}, log.NewNopLogger(), Job{
+		Name:     "purge-stale-carts",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) (int, error) {
+			close(running)
+			<-ctx.Done()
+			canceled <- ctx.Err()
+			return 0, ctx.Err()
+		},
+	})
+	done := start(r)
+	<-running
+	r.Interrupt(nil)
+	r.Interrupt(nil)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return on Interrupt")
+	}
+	if err := <-canceled; err != context.Canceled {
+		t.Errorf("running job: %v, want its context canceled", err)
+	}
+}
+
+func TestRunnerLockLost(t *testing.T) {
+	locker := newMemLocker()
+	var (
+		mtx  sync.Mutex
+		runs int
+	)
+	r := NewRunner(locker, log.NewNopLogger(), Job{
+		Name:     "cancel-expired-orders",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) (int, error) {
+			mtx.Lock()
+			runs++
+			mtx.Unlock()
+			<-ctx.Done()
+			return 0, nil
+		},
+	})
+	done := start(r)
+	n := func() int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return runs
+	}
+	waitFor(t, "the first run", func() bool { return n() == 1 })
+	locker.revoke()
+	// the job stops, the lock is competed for again and won
+	waitFor(t, "the run after the lock was won again", func() bool { return n() == 2 })
+	r.Interrupt(nil)
+	<-done
+}
+
+func TestLocalLocker(t *testing.T) {
+	stop := make(chan struct{})
+	var l LocalLocker
+	for i := 0; i < 2; i++ {
+		if lost, err := l.Lock("j", stop); lost == nil || err != nil {
+			t.Fatalf("lock %d: %v, %v, want it granted", i, lost, err)
+		}
+	}
+	close(stop)
+	if lost, err := l.Lock("j", stop); lost != nil || err != nil {
+		t.Errorf("lock once stopped: %v, %v", lost, err)
+	}
+	if err := l.Unlock("j"); err != nil {
+		t.Error(err)
+	}
+}
@@ -39,14 +39,16 @@ type Procurement struct {
 	OrdereItem []OrderItem `json:"items" bson:"items"`
 }
 
-// Cart represents.
+// Cart represents. Guest cart items have no UserID and are keyed by CartToken.
 type Cart struct {
-	UserID    string  `json:"userID" bson:"userID"`
-	ProductID string  `json:"productID" bson:"productID"`
-	Price     float32 `json:"price" bson:"price"`
-	Quantity  int32   `json:"quantity" bson:"quantity"`
-	CartID    string  `json:"id" bson:"-"`
-	Total     float32 `json:"total" bson:"total"`
+	UserID    string    `json:"userID" bson:"userID"`
+	CartToken string    `json:"-" bson:"cartToken,omitempty"`
+	ProductID string    `json:"productID" bson:"productID"`
+	Price     float32   `json:"price" bson:"price"`
+	Quantity  int32     `json:"quantity" bson:"quantity"`
+	CartID    string    `json:"id" bson:"-"`
+	Total     float32   `json:"total" bson:"total"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
 }
 
 // New ..
@@ -74,26 +76,45 @@ type CreatedOrderResponse struct {
 type CreateCartRequest struct {
 	ProductID string  `json:"productID"`
 	UserID    string  `json:"userID"`
+	CartToken string  `json:"-"`
 	Price     float32 `json:"price"`
+	Quantity  int32   `json:"quantity"`
 }
 
-// GetOrdersRequest struct
+// OrderQuery filters orders. Zero values match all orders, and filters on
+// several fields must all match.
+type OrderQuery struct {
+	UserID      string        `json:"userID"`
+	TenantID    string        `json:"TenantID"`
+	Status      []OrderStatus `json:"status,omitempty"`
+	ProductID   string        `json:"productID,omitempty"`
+	CreatedFrom time.Time     `json:"from,omitempty"`
+	CreatedTo   time.Time     `json:"to,omitempty"`
+	MinAmount   float32       `json:"minAmount,omitempty"`
+	MaxAmount   float32       `json:"maxAmount,omitempty"`
+}
+
+// GetOrdersRequest struct. Sort lists fields to order by, prefixed with "-"
+// for descending order.
 type GetOrdersRequest struct {
-	UserID    string `json:"userID"`
-	TenantID  string `json:"TenantID"`
-	PageIndex int    `json:"pageIndex"`
-	PageSize  int    `json:"pageSize"`
+	OrderQuery
+	Sort      []string `json:"sort,omitempty"`
+	PageIndex int      `json:"pageIndex"`
+	PageSize  int      `json:"pageSize"`
 }
 
 // GetOrderRequest struct
 type GetOrderRequest struct {
 	OrderID string `json:"orderID"`
+	// UserID, if set, must be the buyer or the tenant of the order.
+	UserID string `json:"userID"`
 }
 
-// CreatedCartResponse ...
+// CreatedCartResponse ... CartToken is set when a new guest cart was issued.
 type CreatedCartResponse struct {
-	ID  string `json:"id"`
-	Err error  `json:"-"`
+	ID        string `json:"id"`
+	CartToken string `json:"cartToken,omitempty"`
+	Err       error  `json:"-"`
 }
 
 // GetOrdersResponse ...
@@ -112,7 +133,8 @@ type GetOrderResponse struct {
 
 // GetCartItemsRequest ...
 type GetCartItemsRequest struct {
-	UserID string `json:"userID"`
+	UserID    string `json:"userID"`
+	CartToken string `json:"-"`
 }
 
 // GetCartItemsResponse ..
@@ -123,7 +145,9 @@ type GetCartItemsResponse struct {
 
 // RemoveCartItemRequest ..
 type RemoveCartItemRequest struct {
-	CartID string
+	CartID    string `json:"cartID"`
+	UserID    string `json:"userID"`
+	CartToken string `json:"-"`
 }
 
 // RemoveCartItemResponse ..
@@ -145,9 +169,11 @@ type UpdateCartItemResponse struct {
 
 // UpdateQuantityRequest ...
 type UpdateQuantityRequest struct {
-	CartID   string  `json:"cartID"`
-	Quantity int32   `json:"quantity"`
-	Price    float32 `json:"price"`
+	CartID    string  `json:"cartID"`
+	UserID    string  `json:"userID"`
+	CartToken string  `json:"-"`
+	Quantity  int32   `json:"quantity"`
+	Price     float32 `json:"price"`
 }
 
 // UpdateQuantityResponse ...
@@ -155,6 +181,35 @@ type UpdateQuantityResponse struct {
 	Err error `json:"-"`
 }
 
+// MergeCartRequest ..
+type MergeCartRequest struct {
+	CartToken string `json:"-"`
+	UserID    string `json:"userID"`
+}
+
+// MergeCartResponse ..
+type MergeCartResponse struct {
+	Err error `json:"-"`
+}
+
+// ExportOrdersRequest selects the orders of a tenant to export.
+type ExportOrdersRequest struct {
+	TenantID string    `json:"tenantID"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+}
+
+// OrderExportRow is one exported order item.
+type OrderExportRow struct {
+	InvoiceID int64       `json:"invoiceID"`
+	UserID    string      `json:"userID"`
+	ProductID string      `json:"productID"`
+	Quantity  int32       `json:"quantity"`
+	Price     float32     `json:"price"`
+	Status    OrderStatus `json:"status"`
+	CreatedAt time.Time   `json:"createdAt"`
+}
+
 // Failer ...
 type Failer interface {
 	Failed() error
@@ -17,3 +17,20 @@ const (
 	// OrderStatusCanceled 关闭
 	OrderStatusCanceled
 )
+
+var orderStatusNames = map[OrderStatus]string{
+	OrderStatusUnknown:    "unknown",
+	OrderStatusCreated:    "created",
+	OrderStatusPaymented:  "paymented",
+	OrderStatusDispatched: "dispatched",
+	OrderStatusFinished:   "finished",
+	OrderStatusCanceled:   "canceled",
+}
+
+// String returns the name of the status.
+func (s OrderStatus) String() string {
+	if name, ok := orderStatusNames[s]; ok {
+		return name
+	}
+	return orderStatusNames[OrderStatusUnknown]
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
 	"github.com/laidingqing/dabanshan-go/svcs/order/model"
 )
 
@@ -25,72 +26,91 @@ type loggingMiddleware struct {
 
 func (mw loggingMiddleware) CreateOrder(ctx context.Context, a model.CreateOrderRequest) (v model.CreatedOrderResponse, err error) {
 	defer func() {
-		mw.logger.Log("method", "CreateOrder", "err", err)
+		logging.With(ctx, mw.logger).Log("method", "CreateOrder", "err", err)
 	}()
 	return mw.next.CreateOrder(ctx, a)
 }
 
 func (mw loggingMiddleware) GetOrders(ctx context.Context, a model.GetOrdersRequest) (v model.GetOrdersResponse, err error) {
 	defer func() {
-		mw.logger.Log("method", "GetOrders", "userId", a.UserID, "pageIndex", a.PageIndex, "pageSize", a.PageSize, "err", err)
+		logging.With(ctx, mw.logger).Log("method", "GetOrders", "userId", a.UserID, "tenantId", a.TenantID, "pageIndex", a.PageIndex, "pageSize", a.PageSize, "err", err)
 	}()
 	return mw.next.GetOrders(ctx, a)
 }
 
 func (mw loggingMiddleware) GetOrder(ctx context.Context, a model.GetOrderRequest) (v model.GetOrderResponse, err error) {
 	defer func() {
-		mw.logger.Log("method", "GetOrder", "err", err)
+		logging.With(ctx, mw.logger).Log("method", "GetOrder", "err", err)
 	}()
 	return mw.next.GetOrder(ctx, a)
 }
 
 func (mw loggingMiddleware) AddCart(ctx context.Context, a model.CreateCartRequest) (v model.CreatedCartResponse, err error) {
 	defer func() {
-		mw.logger.Log("method", "AddCart", "err", err)
+		logging.With(ctx, mw.logger).Log("method", "AddCart", "userID", a.UserID, "productID", a.ProductID, "quantity", a.Quantity, "err", err)
 	}()
 	return mw.next.AddCart(ctx, a)
 }
 
+func (mw loggingMiddleware) MergeCart(ctx context.Context, req model.MergeCartRequest) (v model.MergeCartResponse, err error) {
+	defer func() {
+		logging.With(ctx, mw.logger).Log("method", "MergeCart", "userID", req.UserID, "err", err)
+	}()
+	return mw.next.MergeCart(ctx, req)
+}
+
 func (mw loggingMiddleware) GetCartItems(ctx context.Context, req model.GetCartItemsRequest) (v model.GetCartItemsResponse, err error) {
 	defer func() {
-		mw.logger.Log("method", "GetCartItems", "userID", req.UserID, "err", err)
+		logging.With(ctx, mw.logger).Log("method", "GetCartItems", "userID", req.UserID, "err", err)
 	}()
 	return mw.next.GetCartItems(ctx, req)
 }
 
 func (mw loggingMiddleware) RemoveCartItem(ctx context.Context, req model.RemoveCartItemRequest) (v model.RemoveCartItemResponse, err error) {
 	defer func() {
-		mw.logger.Log("method", "RemoveCartItem", "cartID", req.CartID, "err", err)
+		logging.With(ctx, mw.logger).Log("method", "RemoveCartItem", "userID", req.UserID, "cartID", req.CartID, "err", err)
 	}()
 	return mw.next.RemoveCartItem(ctx, req)
 }
 
 func (mw loggingMiddleware) UpdateQuantity(ctx context.Context, req model.UpdateQuantityRequest) (v model.UpdateQuantityResponse, err error) {
 	defer func() {
-		mw.logger.Log("method", "UpdateQuantity", "err", err)
+		logging.With(ctx, mw.logger).Log("method", "UpdateQuantity", "userID", req.UserID, "cartID", req.CartID, "quantity", req.Quantity, "err", err)
 	}()
 	return mw.next.UpdateQuantity(ctx, req)
 }
 
-// InstrumentingMiddleware ..
-func InstrumentingMiddleware(ints, chars metrics.Counter) Middleware {
+// Metrics are the business metrics of the order service.
+type Metrics struct {
+	// OrdersCreated counts the orders created.
+	OrdersCreated metrics.Counter
+	// OrderValue observes the amount of the orders created.
+	OrderValue metrics.Histogram
+	// CartsAdded counts the items added to carts, by cart: user or guest.
+	CartsAdded metrics.Counter
+}
+
+// InstrumentingMiddleware counts the orders and cart items added with m.
+func InstrumentingMiddleware(m Metrics) Middleware {
 	return func(next Service) Service {
 		return instrumentingMiddleware{
-			ints:  ints,
-			chars: chars,
-			next:  next,
+			metrics: m,
+			next:    next,
 		}
 	}
 }
 
 type instrumentingMiddleware struct {
-	ints  metrics.Counter
-	chars metrics.Counter
-	next  Service
+	metrics Metrics
+	next    Service
 }
 
 func (mw instrumentingMiddleware) CreateOrder(ctx context.Context, a model.CreateOrderRequest) (model.CreatedOrderResponse, error) {
 	v, err := mw.next.CreateOrder(ctx, a)
+	if err == nil {
+		mw.metrics.OrdersCreated.Add(1)
+		mw.metrics.OrderValue.Observe(float64(a.Invoice.Amount))
+	}
 	return v, err
 }
 
@@ -105,6 +125,13 @@ func (mw instrumentingMiddleware) GetOrder(ctx context.Context, a model.GetOrder
 
 func (mw instrumentingMiddleware) AddCart(ctx context.Context, a model.CreateCartRequest) (model.CreatedCartResponse, error) {
 	v, err := mw.next.AddCart(ctx, a)
+	if err == nil {
+		cart := "user"
+		if a.UserID == "" {
+			cart = "guest"
+		}
+		mw.metrics.CartsAdded.With("cart", cart).Add(1)
+	}
 	return v, err
 }
 func (mw instrumentingMiddleware) GetCartItems(ctx context.Context, req model.GetCartItemsRequest) (model.GetCartItemsResponse, error) {
@@ -121,3 +148,31 @@ func (mw instrumentingMiddleware) UpdateQuantity(ctx context.Context, req model.
 	v, err := mw.next.UpdateQuantity(ctx, req)
 	return v, err
 }
+
+func (mw instrumentingMiddleware) MergeCart(ctx context.Context, req model.MergeCartRequest) (model.MergeCartResponse, error) {
+	v, err := mw.next.MergeCart(ctx, req)
+	return v, err
+}
+
+// ExporterLoggingMiddleware logs every export with the number of rows written.
+func ExporterLoggingMiddleware(logger log.Logger) func(Exporter) Exporter {
+	return func(next Exporter) Exporter {
+		return exporterLoggingMiddleware{logger, next}
+	}
+}
+
+type exporterLoggingMiddleware struct {
+	logger log.Logger
+	next   Exporter
+}
+
+func (mw exporterLoggingMiddleware) ExportOrders(ctx context.Context, req model.ExportOrdersRequest, fn func(model.OrderExportRow) error) (err error) {
+	rows := 0
+	defer func() {
+		logging.With(ctx, mw.logger).Log("method", "ExportOrders", "tenantId", req.TenantID, "rows", rows, "err", err)
+	}()
+	return mw.next.ExportOrders(ctx, req, func(row model.OrderExportRow) error {
+		rows++
+		return fn(row)
+	})
+}
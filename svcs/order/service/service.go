@@ -2,10 +2,13 @@ package service
 
 import (
 	"context"
-	"errors"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
 
 	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/metrics"
+	"github.com/laidingqing/dabanshan-go/svcs/authorize"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
 	"github.com/laidingqing/dabanshan-go/svcs/order/db"
 	"github.com/laidingqing/dabanshan-go/svcs/order/model"
 	"github.com/laidingqing/dabanshan-go/utils"
@@ -13,9 +16,35 @@ import (
 
 var (
 	// ErrOrderNotFound ...
-	ErrOrderNotFound = errors.New("not found order")
+	ErrOrderNotFound = errs.New(errs.NotFound, "not found order")
+	// ErrInvalidCartID 购物车ID格式错误
+	ErrInvalidCartID = errs.New(errs.InvalidArgument, "invalid cart id")
+	// ErrCartItemNotFound 购物车项不存在
+	ErrCartItemNotFound = errs.New(errs.NotFound, "not found cart item")
+	// ErrCartItemForbidden 购物车项不属于当前用户
+	ErrCartItemForbidden = errs.New(errs.PermissionDenied, "cart item belongs to another user")
+	// ErrInvalidQuantity 数量错误
+	ErrInvalidQuantity = errs.New(errs.InvalidArgument, "invalid quantity")
+	// ErrInvalidOrderQuery 订单查询条件错误
+	ErrInvalidOrderQuery = errs.New(errs.InvalidArgument, "invalid order query")
+	// ErrCartOwnerRequired 购物车请求缺少用户或购物车令牌
+	ErrCartOwnerRequired = errs.New(errs.InvalidArgument, "user or cart token is required")
+	// ErrOrderForbidden 订单不属于当前用户
+	ErrOrderForbidden = errs.New(errs.PermissionDenied, "order belongs to another user")
 )
 
+const (
+	defaultPageSize = 10
+	maxPageSize     = 100
+)
+
+// sortableOrderFields are the fields orders may be sorted by.
+var sortableOrderFields = map[string]bool{
+	"createdAt": true,
+	"amount":    true,
+	"status":    true,
+}
+
 // Service describes a service that adds things together.
 type Service interface {
 	CreateOrder(ctx context.Context, order model.CreateOrderRequest) (model.CreatedOrderResponse, error)
@@ -25,21 +54,34 @@ type Service interface {
 	GetCartItems(ctx context.Context, req model.GetCartItemsRequest) (model.GetCartItemsResponse, error)
 	RemoveCartItem(ctx context.Context, req model.RemoveCartItemRequest) (model.RemoveCartItemResponse, error)
 	UpdateQuantity(ctx context.Context, req model.UpdateQuantityRequest) (model.UpdateQuantityResponse, error)
+	MergeCart(ctx context.Context, req model.MergeCartRequest) (model.MergeCartResponse, error)
+}
+
+// Exporter streams orders row by row. It is kept apart from Service because
+// go-kit endpoints can only return a whole response.
+type Exporter interface {
+	ExportOrders(ctx context.Context, req model.ExportOrdersRequest, fn func(model.OrderExportRow) error) error
+}
+
+// NewExporter returns an Exporter reading from the order db.
+func NewExporter(logger log.Logger) Exporter {
+	return ExporterLoggingMiddleware(logger)(basicService{})
 }
 
 // New returns a basic Service with all of the expected middlewares wired in.
-func New(logger log.Logger, ints, chars metrics.Counter) Service {
+func New(logger log.Logger, metrics Metrics) Service {
 	var svc Service
 	{
 		svc = NewBasicService()
 		svc = LoggingMiddleware(logger)(svc)
-		svc = InstrumentingMiddleware(ints, chars)(svc)
+		svc = InstrumentingMiddleware(metrics)(svc)
 	}
 	return svc
 }
 
 var (
-	ErrUnauthorized = errors.New("Unauthorized")
+	// ErrUnauthorized is authorize.ErrUnauthorized, for requests of no user.
+	ErrUnauthorized = authorize.ErrUnauthorized
 )
 
 const ()
@@ -53,7 +95,10 @@ type basicService struct{}
 
 // GetUser get user by id
 func (s basicService) CreateOrder(ctx context.Context, order model.CreateOrderRequest) (model.CreatedOrderResponse, error) {
-	id, err := db.CreateOrder(&order.Invoice)
+	if order.Invoice.Status == model.OrderStatusUnknown {
+		order.Invoice.Status = model.OrderStatusCreated
+	}
+	id, err := db.CreateOrder(ctx, &order.Invoice)
 	if err != nil {
 		return model.CreatedOrderResponse{ID: "", Err: err}, err
 	}
@@ -63,27 +108,33 @@ func (s basicService) CreateOrder(ctx context.Context, order model.CreateOrderRe
 	}, nil
 }
 
-// GetOrders get orders by user id or tenant id
+// GetOrders searches orders of a user and/or tenant.
 func (s basicService) GetOrders(ctx context.Context, req model.GetOrdersRequest) (model.GetOrdersResponse, error) {
-
-	var orders utils.Pagination
-	var err error
-	if req.UserID != "" {
-		orders, err = db.GetOrdersByUser(req.UserID, utils.Pagination{
-			PageIndex: req.PageIndex,
-			PageSize:  req.PageSize,
-		})
-	}
-
+	sortor, err := orderSortor(req.Sort)
 	if err != nil {
 		return model.GetOrdersResponse{Err: err}, err
 	}
+	if req.MaxAmount > 0 && req.MinAmount > req.MaxAmount {
+		return model.GetOrdersResponse{Err: ErrInvalidOrderQuery}, ErrInvalidOrderQuery
+	}
+	page := utils.Pagination{
+		PageIndex: req.PageIndex,
+		PageSize:  req.PageSize,
+		Sortor:    sortor,
+	}
+	if page.PageIndex < 1 {
+		page.PageIndex = 1
+	}
+	if page.PageSize <= 0 {
+		page.PageSize = defaultPageSize
+	}
+	if page.PageSize > maxPageSize {
+		page.PageSize = maxPageSize
+	}
 
-	if req.TenantID != "" {
-		orders, err = db.GetOrdersByTenant(req.TenantID, utils.Pagination{
-			PageIndex: req.PageIndex,
-			PageSize:  req.PageSize,
-		})
+	orders, err := db.FindOrders(ctx, req.OrderQuery, page)
+	if err != nil {
+		return model.GetOrdersResponse{Err: err}, err
 	}
 
 	return model.GetOrdersResponse{
@@ -94,14 +145,34 @@ func (s basicService) GetOrders(ctx context.Context, req model.GetOrdersRequest)
 	}, nil
 }
 
-// GetOrder get order by id
-func (s basicService) GetOrder(ctx context.Context, req model.GetOrderRequest) (model.GetOrderResponse, error) {
+// orderSortor checks the sort fields of an order search, newest orders first
+// by default.
+func orderSortor(sort []string) ([]string, error) {
+	if len(sort) == 0 {
+		return []string{"-createdAt"}, nil
+	}
+	for _, field := range sort {
+		if !sortableOrderFields[strings.TrimPrefix(field, "-")] {
+			return nil, ErrInvalidOrderQuery
+		}
+	}
+	return sort, nil
+}
 
-	order, err := db.GetOrder(req.OrderID)
+// GetOrder get order by id, only for its buyer or tenant when req.UserID is
+// set.
+func (s basicService) GetOrder(ctx context.Context, req model.GetOrderRequest) (model.GetOrderResponse, error) {
 
+	order, err := db.GetOrder(ctx, req.OrderID)
+	if err == db.ErrInvalidID || err == db.ErrNotFound {
+		err = ErrOrderNotFound
+	}
 	if err != nil {
 		return model.GetOrderResponse{Err: err}, err
 	}
+	if req.UserID != "" && req.UserID != order.UserID && req.UserID != order.TenantID {
+		return model.GetOrderResponse{Err: ErrOrderForbidden}, ErrOrderForbidden
+	}
 
 	return model.GetOrderResponse{
 		Order: order,
@@ -109,26 +180,50 @@ func (s basicService) GetOrder(ctx context.Context, req model.GetOrderRequest) (
 	}, nil
 }
 
-// GetUser get user by id
+// AddCart adds a product to the user's cart, merging with an existing line
+// for the same product. A zero quantity adds one item. Without a user the item
+// goes to the guest cart of order.CartToken, and a new guest cart is issued if
+// there is no token either.
 func (s basicService) AddCart(ctx context.Context, order model.CreateCartRequest) (model.CreatedCartResponse, error) {
+	if order.Quantity < 0 {
+		return model.CreatedCartResponse{Err: ErrInvalidQuantity}, ErrInvalidQuantity
+	}
+	var issued string
+	if order.UserID == "" && order.CartToken == "" {
+		token, err := newCartToken()
+		if err != nil {
+			return model.CreatedCartResponse{Err: err}, err
+		}
+		order.CartToken, issued = token, token
+	}
 	c := model.Cart{}
 	c.Price = order.Price
 	c.ProductID = order.ProductID
 	c.UserID = order.UserID
-	// TODO 校验等
-	id, err := db.AddCart(&c)
+	if c.UserID == "" {
+		c.CartToken = order.CartToken
+	}
+	c.Quantity = order.Quantity
+	if c.Quantity == 0 {
+		c.Quantity = 1
+	}
+	id, err := db.AddCart(ctx, &c)
 	if err != nil {
 		return model.CreatedCartResponse{ID: "", Err: err}, err
 	}
 	return model.CreatedCartResponse{
-		ID:  id,
-		Err: nil,
+		ID:        id,
+		CartToken: issued,
+		Err:       nil,
 	}, nil
 }
 
-// GetCartItems find user's cart items
+// GetCartItems find user's or guest cart items
 func (s basicService) GetCartItems(ctx context.Context, req model.GetCartItemsRequest) (model.GetCartItemsResponse, error) {
-	items, err := db.GetCartItems(req.UserID)
+	if req.UserID == "" && req.CartToken == "" {
+		return model.GetCartItemsResponse{Items: []model.Cart{}}, nil
+	}
+	items, err := db.GetCartItems(ctx, req.UserID, req.CartToken)
 	if err != nil {
 		return model.GetCartItemsResponse{
 			Err: err,
@@ -142,8 +237,14 @@ func (s basicService) GetCartItems(ctx context.Context, req model.GetCartItemsRe
 
 // RemoveCartItem remove cart item by id
 func (s basicService) RemoveCartItem(ctx context.Context, req model.RemoveCartItemRequest) (model.RemoveCartItemResponse, error) {
-	_, err := db.RemoveCartItem(req.CartID)
+	if _, err := ownedCartItem(ctx, req.UserID, req.CartToken, req.CartID); err != nil {
+		return model.RemoveCartItemResponse{
+			Err: err,
+		}, err
+	}
+	_, err := db.RemoveCartItem(ctx, req.CartID)
 	if err != nil {
+		err = cartErr(err)
 		return model.RemoveCartItemResponse{
 			Err: err,
 		}, err
@@ -154,15 +255,29 @@ func (s basicService) RemoveCartItem(ctx context.Context, req model.RemoveCartIt
 	}, nil
 }
 
+// UpdateQuantity sets the quantity of a cart item, removing it when the
+// quantity is not positive.
 func (s basicService) UpdateQuantity(ctx context.Context, req model.UpdateQuantityRequest) (model.UpdateQuantityResponse, error) {
-	var cart = model.Cart{
-		CartID:   req.CartID,
-		Quantity: req.Quantity,
-		Price:    req.Price,
+	if _, err := ownedCartItem(ctx, req.UserID, req.CartToken, req.CartID); err != nil {
+		return model.UpdateQuantityResponse{
+			Err: err,
+		}, err
+	}
+
+	var err error
+	if req.Quantity <= 0 {
+		_, err = db.RemoveCartItem(ctx, req.CartID)
+	} else {
+		var cart = model.Cart{
+			CartID:   req.CartID,
+			Quantity: req.Quantity,
+			Price:    req.Price,
+		}
+		_, err = db.UpdateQuantity(ctx, &cart)
 	}
-	cart, err := db.UpdateQuantity(&cart)
 
 	if err != nil {
+		err = cartErr(err)
 		return model.UpdateQuantityResponse{
 			Err: err,
 		}, err
@@ -170,3 +285,91 @@ func (s basicService) UpdateQuantity(ctx context.Context, req model.UpdateQuanti
 
 	return model.UpdateQuantityResponse{}, nil
 }
+
+// MergeCart folds the guest cart into the user's cart, called on login.
+func (s basicService) MergeCart(ctx context.Context, req model.MergeCartRequest) (model.MergeCartResponse, error) {
+	if req.UserID == "" {
+		return model.MergeCartResponse{Err: ErrUnauthorized}, ErrUnauthorized
+	}
+	if req.CartToken == "" {
+		return model.MergeCartResponse{}, nil
+	}
+	if err := db.MergeCart(ctx, req.CartToken, req.UserID); err != nil {
+		return model.MergeCartResponse{Err: err}, err
+	}
+	return model.MergeCartResponse{}, nil
+}
+
+// ExportOrders calls fn for every item of the tenant's orders.
+func (s basicService) ExportOrders(ctx context.Context, req model.ExportOrdersRequest, fn func(model.OrderExportRow) error) error {
+	if req.TenantID == "" {
+		return ErrInvalidOrderQuery
+	}
+	if !req.From.IsZero() && !req.To.IsZero() && req.From.After(req.To) {
+		return ErrInvalidOrderQuery
+	}
+	query := model.OrderQuery{
+		TenantID:    req.TenantID,
+		CreatedFrom: req.From,
+		CreatedTo:   req.To,
+	}
+	return db.EachOrder(ctx, query, func(order model.Invoice) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, item := range order.OrdereItem {
+			err := fn(model.OrderExportRow{
+				InvoiceID: order.InvoiceID,
+				UserID:    order.UserID,
+				ProductID: item.ProductID,
+				Quantity:  item.Quantity,
+				Price:     item.Price,
+				Status:    order.Status,
+				CreatedAt: order.CreatedAt,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ownedCartItem loads a cart item and checks that it belongs to userID, or to
+// the guest cart of cartToken when there is no user.
+func ownedCartItem(ctx context.Context, userID, cartToken, cartID string) (model.Cart, error) {
+	if userID == "" && cartToken == "" {
+		return model.Cart{}, ErrCartOwnerRequired
+	}
+	item, err := db.GetCartItem(ctx, cartID)
+	if err != nil {
+		return model.Cart{}, cartErr(err)
+	}
+	if userID != "" && item.UserID != userID {
+		return model.Cart{}, ErrCartItemForbidden
+	}
+	if userID == "" && (item.UserID != "" || item.CartToken != cartToken) {
+		return model.Cart{}, ErrCartItemForbidden
+	}
+	return item, nil
+}
+
+// newCartToken issues an opaque token identifying a guest cart.
+func newCartToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// cartErr translates db errors on cart ids into service errors.
+func cartErr(err error) error {
+	switch err {
+	case db.ErrInvalidID:
+		return ErrInvalidCartID
+	case db.ErrNotFound:
+		return ErrCartItemNotFound
+	}
+	return err
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/laidingqing/dabanshan-go/svcs/order/db"
+	"github.com/laidingqing/dabanshan-go/svcs/order/model"
+)
+
+// memoryDB keeps cart lines in memory, one line per owner and product as in
+// the backends. The other methods of db.Database are not used.
+type memoryDB struct {
+	db.Database
+	carts map[string]model.Cart
+	next  int
+}
+
+func (m *memoryDB) AddCart(_ context.Context, cart *model.Cart) (string, error) {
+	for id, line := range m.carts {
+		if line.UserID == cart.UserID && line.CartToken == cart.CartToken && line.ProductID == cart.ProductID {
+			line.Quantity += cart.Quantity
+			m.carts[id] = line
+			return id, nil
+		}
+	}
+	m.next++
+	cart.CartID = fmt.Sprintf("%024x", m.next)
+	m.carts[cart.CartID] = *cart
+	return cart.CartID, nil
+}
+
+func (m *memoryDB) GetCartItem(_ context.Context, cartID string) (model.Cart, error) {
+	if len(cartID) != 24 {
+		return model.Cart{}, db.ErrInvalidID
+	}
+	line, ok := m.carts[cartID]
+	if !ok {
+		return model.Cart{}, db.ErrNotFound
+	}
+	return line, nil
+}
+
+func (m *memoryDB) RemoveCartItem(ctx context.Context, cartID string) (bool, error) {
+	if _, err := m.GetCartItem(ctx, cartID); err != nil {
+		return false, err
+	}
+	delete(m.carts, cartID)
+	return true, nil
+}
+
+func (m *memoryDB) GetCartItems(_ context.Context, userID, cartToken string) ([]model.Cart, error) {
+	var lines []model.Cart
+	for _, line := range m.carts {
+		if line.UserID == userID && (userID != "" || line.CartToken == cartToken) {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+func (m *memoryDB) UpdateQuantity(ctx context.Context, cart *model.Cart) (model.Cart, error) {
+	line, err := m.GetCartItem(ctx, cart.CartID)
+	if err != nil {
+		return model.Cart{}, err
+	}
+	line.Quantity = cart.Quantity
+	m.carts[cart.CartID] = line
+	return line, nil
+}
+
+func (m *memoryDB) MergeCart(ctx context.Context, cartToken, userID string) error {
+	for id, line := range m.carts {
+		if line.UserID == "" && line.CartToken == cartToken {
+			delete(m.carts, id)
+			line.UserID, line.CartToken = userID, ""
+			m.AddCart(ctx, &line)
+		}
+	}
+	return nil
+}
+
+// useMemoryDB makes a memoryDB the db of the service until the end of t.
+func useMemoryDB(t *testing.T) *memoryDB {
+	m := &memoryDB{carts: map[string]model.Cart{}}
+	prev := db.DefaultDb
+	db.DefaultDb = m
+	t.Cleanup(func() { db.DefaultDb = prev })
+	return m
+}
+
+// quantities returns the quantity of each product in a cart, failing t if
+// a product has more than one line.
+func quantities(t *testing.T, s Service, userID, cartToken string) map[string]int32 {
+	t.Helper()
+	resp, err := s.GetCartItems(context.Background(), model.GetCartItemsRequest{UserID: userID, CartToken: cartToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := map[string]int32{}
+	for _, line := range resp.Items {
+		if _, ok := q[line.ProductID]; ok {
+			t.Errorf("cart %q %q: product %s on two lines", userID, cartToken, line.ProductID)
+		}
+		q[line.ProductID] = line.Quantity
+	}
+	return q
+}
+
+func TestAddCart(t *testing.T) {
+	useMemoryDB(t)
+	s := NewBasicService()
+	ctx := context.Background()
+
+	for _, quantity := range []int32{2, 0} {
+		resp, err := s.AddCart(ctx, model.CreateCartRequest{UserID: "u1", CartToken: "g1", ProductID: "p1", Quantity: quantity})
+		if err != nil || resp.CartToken != "" {
+			t.Fatalf("user: %+v, %v", resp, err)
+		}
+	}
+	if q := quantities(t, s, "u1", ""); len(q) != 1 || q["p1"] != 3 {
+		t.Errorf("user cart %v, want p1:3", q)
+	}
+	if q := quantities(t, s, "", "g1"); len(q) != 0 {
+		t.Errorf("guest cart %v, want the user's items kept out of it", q)
+	}
+
+	resp, err := s.AddCart(ctx, model.CreateCartRequest{ProductID: "p1"})
+	if err != nil || resp.CartToken == "" {
+		t.Fatalf("anonymous: %+v, %v, want a guest cart issued", resp, err)
+	}
+	resp2, err := s.AddCart(ctx, model.CreateCartRequest{CartToken: resp.CartToken, ProductID: "p1"})
+	if err != nil || resp2.CartToken != "" || resp2.ID != resp.ID {
+		t.Errorf("guest: %+v, %v, want the line of the guest cart", resp2, err)
+	}
+
+	if _, err := s.AddCart(ctx, model.CreateCartRequest{UserID: "u1", ProductID: "p1", Quantity: -1}); err != ErrInvalidQuantity {
+		t.Errorf("negative quantity: %v", err)
+	}
+}
+
+func TestCartItemOwner(t *testing.T) {
+	m := useMemoryDB(t)
+	s := NewBasicService()
+	ctx := context.Background()
+	userLine, _ := m.AddCart(ctx, &model.Cart{UserID: "u1", ProductID: "p1", Quantity: 1})
+	guestLine, _ := m.AddCart(ctx, &model.Cart{CartToken: "g1", ProductID: "p1", Quantity: 1})
+
+	for _, tc := range []struct {
+		name, user, token, cartID string
+		want                      error
+	}{
+		{"another user", "u2", "", userLine, ErrCartItemForbidden},
+		{"a guest", "", "g1", userLine, ErrCartItemForbidden},
+		{"another guest", "", "g2", guestLine, ErrCartItemForbidden},
+		{"a user with the guest cart", "u1", "g1", guestLine, ErrCartItemForbidden},
+		{"no user or token", "", "", userLine, ErrCartOwnerRequired},
+		{"missing line", "u1", "", "000000000000000000000099", ErrCartItemNotFound},
+		{"malformed id", "u1", "", "p1", ErrInvalidCartID},
+	} {
+		_, err := s.UpdateQuantity(ctx, model.UpdateQuantityRequest{CartID: tc.cartID, UserID: tc.user, CartToken: tc.token, Quantity: 5})
+		if err != tc.want {
+			t.Errorf("UpdateQuantity by %s: %v, want %v", tc.name, err, tc.want)
+		}
+		_, err = s.RemoveCartItem(ctx, model.RemoveCartItemRequest{CartID: tc.cartID, UserID: tc.user, CartToken: tc.token})
+		if err != tc.want {
+			t.Errorf("RemoveCartItem by %s: %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	if len(m.carts) != 2 || m.carts[userLine].Quantity != 1 || m.carts[guestLine].Quantity != 1 {
+		t.Errorf("lines changed by others: %v", m.carts)
+	}
+
+	if _, err := s.UpdateQuantity(ctx, model.UpdateQuantityRequest{CartID: guestLine, CartToken: "g1", Quantity: 5}); err != nil || m.carts[guestLine].Quantity != 5 {
+		t.Errorf("UpdateQuantity by the guest: %v, %v", err, m.carts[guestLine])
+	}
+	if _, err := s.RemoveCartItem(ctx, model.RemoveCartItemRequest{CartID: userLine, UserID: "u1"}); err != nil {
+		t.Errorf("RemoveCartItem by the user: %v", err)
+	}
+	if _, ok := m.carts[userLine]; ok {
+		t.Error("the line removed by its user is still there")
+	}
+}
+
+func TestUpdateQuantityRemoves(t *testing.T) {
+	m := useMemoryDB(t)
+	s := NewBasicService()
+	ctx := context.Background()
+	for _, quantity := range []int32{0, -1} {
+		id, _ := m.AddCart(ctx, &model.Cart{UserID: "u1", ProductID: fmt.Sprint("p", quantity), Quantity: 2})
+		if _, err := s.UpdateQuantity(ctx, model.UpdateQuantityRequest{CartID: id, UserID: "u1", Quantity: quantity}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.carts[id]; ok {
+			t.Errorf("quantity %d: the line is still there", quantity)
+		}
+	}
+}
+
+func TestMergeCart(t *testing.T) {
+	m := useMemoryDB(t)
+	s := NewBasicService()
+	ctx := context.Background()
+	m.AddCart(ctx, &model.Cart{UserID: "u1", ProductID: "p1", Quantity: 3})
+	m.AddCart(ctx, &model.Cart{CartToken: "g1", ProductID: "p1", Quantity: 1})
+	m.AddCart(ctx, &model.Cart{CartToken: "g1", ProductID: "p2", Quantity: 2})
+
+	if _, err := s.MergeCart(ctx, model.MergeCartRequest{UserID: "u1", CartToken: "g1"}); err != nil {
+		t.Fatal(err)
+	}
+	if q := quantities(t, s, "u1", ""); len(q) != 2 || q["p1"] != 4 || q["p2"] != 2 {
+		t.Errorf("user cart %v, want p1:4 p2:2", q)
+	}
+	if q := quantities(t, s, "", "g1"); len(q) != 0 {
+		t.Errorf("guest cart %v, want it empty", q)
+	}
+
+	if _, err := s.MergeCart(ctx, model.MergeCartRequest{CartToken: "g1"}); err != ErrUnauthorized {
+		t.Errorf("merge into no user: %v", err)
+	}
+	if _, err := s.MergeCart(ctx, model.MergeCartRequest{UserID: "u1"}); err != nil {
+		t.Errorf("merge of no guest cart: %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+package transport
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/tracing/opentracing"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
+	"github.com/laidingqing/dabanshan-go/svcs/order/model"
+	"github.com/laidingqing/dabanshan-go/svcs/order/service"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/xuri/excelize/v2"
+)
+
+// csvFlushRows is how many csv rows are buffered before they are flushed to
+// the client.
+const csvFlushRows = 100
+
+// ErrExportForbidden is returned for exports of the orders of another tenant.
+var ErrExportForbidden = errs.New(errs.PermissionDenied, "orders of another tenant")
+
+var exportHeader = []string{"invoice_id", "customer", "product", "quantity", "price", "status", "created_at"}
+
+// rowWriter writes export rows in one file format.
+type rowWriter interface {
+	Write(row model.OrderExportRow) error
+	// Close completes the file; Discard drops it without writing anything more.
+	Close() error
+	Discard()
+	// Streams reports whether rows are sent to the client as they are
+	// written, rather than on Close.
+	Streams() bool
+}
+
+// newExportHandler streams the orders of the tenant authenticated by the
+// bearer token as csv or xlsx. Nothing is written until the first row
+// arrives, and xlsx files not before they are complete, so errors raised
+// before that are still reported with a status code. A csv export failing
+// once sent is aborted, so that the client sees a broken transfer rather
+// than a truncated file.
+func newExportHandler(exporter service.Exporter, tracer stdopentracing.Tracer, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := opentracing.HTTPToContext(tracer, "ExportOrders", logger)(r.Context(), r)
+		ctx = logging.HTTPToContext(ctx, r)
+		var err error
+		defer func() { finishSpan(stdopentracing.SpanFromContext(ctx), &err) }()
+		r = r.WithContext(ctx)
+
+		req, err := decodeHTTPExportOrdersRequest(r)
+		if err != nil {
+			errs.EncodeHTTP(r.Context(), err, w)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "csv"
+		}
+		var rw rowWriter
+		switch format {
+		case "csv":
+			rw = newCSVRowWriter(w)
+		case "xlsx":
+			if rw, err = newXLSXRowWriter(w); err != nil {
+				errs.EncodeHTTP(r.Context(), err, w)
+				return
+			}
+		default:
+			errs.EncodeHTTP(r.Context(), ErrInvalidQueryParam, w)
+			return
+		}
+
+		started := false
+		start := func() {
+			if !started {
+				started = true
+				setExportHeaders(w, req, format)
+			}
+		}
+		err = exporter.ExportOrders(r.Context(), req, func(row model.OrderExportRow) error {
+			start()
+			return rw.Write(row)
+		})
+		if err != nil && (!started || !rw.Streams()) {
+			rw.Discard()
+			w.Header().Del("Content-Disposition")
+			errs.EncodeHTTP(r.Context(), err, w)
+			return
+		}
+		if err == nil {
+			start()
+			err = rw.Close()
+		}
+		if err != nil {
+			// The response is already on its way, all we can do is cut it short.
+			logging.With(ctx, logger).Log("method", "ExportOrders", "tenantId", req.TenantID, "err", err)
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// decodeHTTPExportOrdersRequest reads an export of the orders of the
+// authenticated tenant, the tenantId query parameter if given.
+func decodeHTTPExportOrdersRequest(r *http.Request) (model.ExportOrdersRequest, error) {
+	var req model.ExportOrdersRequest
+	userID, err := authUserID(r)
+	if err != nil {
+		return req, err
+	}
+	q := r.URL.Query()
+	req.TenantID = q.Get("tenantId")
+	if req.TenantID == "" {
+		req.TenantID = userID
+	}
+	if req.TenantID != userID {
+		return req, ErrExportForbidden
+	}
+	if req.From, err = parseTimeParam(q.Get("from"), false); err != nil {
+		return req, err
+	}
+	if req.To, err = parseTimeParam(q.Get("to"), true); err != nil {
+		return req, err
+	}
+	return req, nil
+}
+
+func setExportHeaders(w http.ResponseWriter, req model.ExportOrdersRequest, format string) {
+	contentType := "text/csv; charset=utf-8"
+	if format == "xlsx" {
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	name := fmt.Sprintf("orders-%s-%s.%s", req.TenantID, time.Now().Format("20060102"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+}
+
+func exportRecord(row model.OrderExportRow) []string {
+	return []string{
+		strconv.FormatInt(row.InvoiceID, 10),
+		row.UserID,
+		row.ProductID,
+		strconv.Itoa(int(row.Quantity)),
+		strconv.FormatFloat(float64(row.Price), 'f', 2, 32),
+		row.Status.String(),
+		row.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+type csvRowWriter struct {
+	w      io.Writer
+	csv    *csv.Writer
+	rows   int
+	header bool
+}
+
+func newCSVRowWriter(w io.Writer) *csvRowWriter {
+	return &csvRowWriter{w: w, csv: csv.NewWriter(w)}
+}
+
+func (c *csvRowWriter) writeHeader() error {
+	if c.header {
+		return nil
+	}
+	c.header = true
+	return c.csv.Write(exportHeader)
+}
+
+func (c *csvRowWriter) Write(row model.OrderExportRow) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	if err := c.csv.Write(exportRecord(row)); err != nil {
+		return err
+	}
+	c.rows++
+	if c.rows%csvFlushRows == 0 {
+		return c.flush()
+	}
+	return nil
+}
+
+func (c *csvRowWriter) Close() error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+func (c *csvRowWriter) Discard() {}
+
+func (c *csvRowWriter) Streams() bool { return true }
+
+func (c *csvRowWriter) flush() error {
+	c.csv.Flush()
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return c.csv.Error()
+}
+
+// xlsxRowWriter streams rows into a temporary sheet file, which is copied to
+// the client on Close since a xlsx archive can only be written once complete.
+type xlsxRowWriter struct {
+	w      io.Writer
+	file   *excelize.File
+	stream *excelize.StreamWriter
+	row    int
+}
+
+func newXLSXRowWriter(w io.Writer) (*xlsxRowWriter, error) {
+	file := excelize.NewFile()
+	stream, err := file.NewStreamWriter(file.GetSheetName(0))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	x := &xlsxRowWriter{w: w, file: file, stream: stream}
+	header := make([]interface{}, len(exportHeader))
+	for i, name := range exportHeader {
+		header[i] = name
+	}
+	if err := x.setRow(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *xlsxRowWriter) setRow(values []interface{}) error {
+	x.row++
+	cell, err := excelize.CoordinatesToCellName(1, x.row)
+	if err != nil {
+		return err
+	}
+	return x.stream.SetRow(cell, values)
+}
+
+func (x *xlsxRowWriter) Write(row model.OrderExportRow) error {
+	return x.setRow([]interface{}{
+		row.InvoiceID,
+		row.UserID,
+		row.ProductID,
+		row.Quantity,
+		row.Price,
+		row.Status.String(),
+		row.CreatedAt,
+	})
+}
+
+func (x *xlsxRowWriter) Discard() {
+	x.file.Close()
+}
+
+func (x *xlsxRowWriter) Streams() bool { return false }
+
+func (x *xlsxRowWriter) Close() error {
+	defer x.file.Close()
+	if err := x.stream.Flush(); err != nil {
+		return err
+	}
+	return x.file.Write(x.w)
+}
@@ -0,0 +1,97 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/laidingqing/dabanshan-go/svcs/authorize"
+	"github.com/laidingqing/dabanshan-go/svcs/order/model"
+	stdopentracing "github.com/opentracing/opentracing-go"
+)
+
+// exporter exports rows, then fails with err if not nil.
+type exporter struct {
+	rows int
+	err  error
+	req  model.ExportOrdersRequest
+}
+
+func (e *exporter) ExportOrders(_ context.Context, req model.ExportOrdersRequest, fn func(model.OrderExportRow) error) error {
+	e.req = req
+	for i := 0; i < e.rows; i++ {
+		if err := fn(model.OrderExportRow{InvoiceID: int64(i), UserID: "u1", ProductID: "p1", Quantity: 1}); err != nil {
+			return err
+		}
+	}
+	return e.err
+}
+
+func exportRequest(t *testing.T, target, userID string) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest("GET", target, nil)
+	if userID != "" {
+		token, err := authorize.CreateJWT(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestExportAuth(t *testing.T) {
+	for _, tc := range []struct {
+		name, target, user string
+		want               int
+		tenant             string
+	}{
+		{"anonymous", "/api/v1/orders/export?tenantId=t1", "", http.StatusUnauthorized, ""},
+		{"other tenant", "/api/v1/orders/export?tenantId=t1", "t2", http.StatusForbidden, ""},
+		{"own tenant", "/api/v1/orders/export?tenantId=t1", "t1", http.StatusOK, "t1"},
+		{"default tenant", "/api/v1/orders/export", "t1", http.StatusOK, "t1"},
+	} {
+		e := &exporter{rows: 1}
+		h := newExportHandler(e, stdopentracing.GlobalTracer(), log.NewNopLogger())
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, exportRequest(t, tc.target, tc.user))
+		if rec.Code != tc.want || e.req.TenantID != tc.tenant {
+			t.Errorf("%s: status %d exporting %q, want %d %q", tc.name, rec.Code, e.req.TenantID, tc.want, tc.tenant)
+		}
+	}
+}
+
+func TestExportFailure(t *testing.T) {
+	failed := errors.New("db down")
+	h := newExportHandler(&exporter{rows: 3, err: failed}, stdopentracing.GlobalTracer(), log.NewNopLogger())
+
+	// xlsx files are sent once complete: the failure is reported.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, exportRequest(t, "/api/v1/orders/export?format=xlsx", "t1"))
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get("Content-Disposition") != "" {
+		t.Errorf("xlsx: status %d, Content-Disposition %q, want 500 and none", rec.Code, rec.Header().Get("Content-Disposition"))
+	}
+
+	// csv rows are on their way: the response is aborted.
+	rec = httptest.NewRecorder()
+	func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Errorf("csv: recovered %v, want http.ErrAbortHandler", p)
+			}
+		}()
+		h.ServeHTTP(rec, exportRequest(t, "/api/v1/orders/export?format=csv", "t1"))
+	}()
+
+	// A complete export is sent whole.
+	h = newExportHandler(&exporter{rows: 2}, stdopentracing.GlobalTracer(), log.NewNopLogger())
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, exportRequest(t, "/api/v1/orders/export?format=csv", "t1"))
+	if lines := strings.Count(rec.Body.String(), "\n"); rec.Code != http.StatusOK || lines != 3 {
+		t.Errorf("csv: status %d, %d lines, want 200 and 3", rec.Code, lines)
+	}
+}
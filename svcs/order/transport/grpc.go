@@ -1,6 +1,8 @@
 package transport
 
 import (
+	"context"
+	"io"
 	"time"
 
 	"github.com/go-kit/kit/circuitbreaker"
@@ -9,12 +11,17 @@ import (
 	"github.com/go-kit/kit/tracing/opentracing"
 	grpctransport "github.com/go-kit/kit/transport/grpc"
 	"github.com/laidingqing/dabanshan-go/pb"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
 	o_endpoint "github.com/laidingqing/dabanshan-go/svcs/order/endpoint"
+	"github.com/laidingqing/dabanshan-go/svcs/order/model"
 	"github.com/laidingqing/dabanshan-go/svcs/order/service"
 	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/sony/gobreaker"
 	oldcontext "golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 type grpcServer struct {
@@ -25,14 +32,22 @@ type grpcServer struct {
 	getCartItems   grpctransport.Handler
 	removeCartItem grpctransport.Handler
 	updateQuantity grpctransport.Handler
+	mergeCart      grpctransport.Handler
+	exporter       service.Exporter
+	tracer         stdopentracing.Tracer
+	logger         log.Logger
 }
 
 // NewGRPCServer ...
-func NewGRPCServer(endpoints o_endpoint.Set, tracer stdopentracing.Tracer, logger log.Logger) pb.OrderRpcServiceServer {
+func NewGRPCServer(endpoints o_endpoint.Set, exporter service.Exporter, tracer stdopentracing.Tracer, logger log.Logger) pb.OrderRpcServiceServer {
 	options := []grpctransport.ServerOption{
 		grpctransport.ServerErrorLogger(logger),
+		grpctransport.ServerBefore(logging.GRPCToContext),
 	}
 	return &grpcServer{
+		exporter: exporter,
+		tracer:   tracer,
+		logger:   logger,
 		createOrder: grpctransport.NewServer(
 			endpoints.CreateOrderEndpoint,
 			decodeGRPCCreateOrderRequest,
@@ -75,6 +90,12 @@ func NewGRPCServer(endpoints o_endpoint.Set, tracer stdopentracing.Tracer, logge
 			encodeGRPCUpdateQuantityResponse,
 			append(options, grpctransport.ServerBefore(opentracing.GRPCToContext(tracer, "UpdateQuantity", logger)))...,
 		),
+		mergeCart: grpctransport.NewServer(
+			endpoints.MergeCartEndpoint,
+			decodeGRPCMergeCartRequest,
+			encodeGRPCMergeCartResponse,
+			append(options, grpctransport.ServerBefore(opentracing.GRPCToContext(tracer, "MergeCart", logger)))...,
+		),
 	}
 }
 
@@ -149,6 +170,79 @@ func (s *grpcServer) UpdateQuantity(ctx oldcontext.Context, req *pb.UpdateQuanti
 	return res, nil
 }
 
+// MergeCart
+func (s *grpcServer) MergeCart(ctx oldcontext.Context, req *pb.MergeCartRequest) (*pb.MergeCartResponse, error) {
+	_, rep, err := s.mergeCart.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	res := rep.(*pb.MergeCartResponse)
+	return res, nil
+}
+
+// ExportOrders streams rows straight from the exporter; go-kit's grpc
+// transport has no support for streaming rpcs, so the span of the stream is
+// joined to the one of the client and finished here.
+func (s *grpcServer) ExportOrders(req *pb.ExportOrdersRequest, stream pb.OrderRpcService_ExportOrdersServer) (err error) {
+	ctx := stream.Context()
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = opentracing.GRPCToContext(s.tracer, "ExportOrders", s.logger)(ctx, md)
+	ctx = logging.GRPCToContext(ctx, md)
+	defer finishSpan(stdopentracing.SpanFromContext(ctx), &err)
+	return s.exporter.ExportOrders(ctx, pbExportRequest2Model(req), func(row model.OrderExportRow) error {
+		return stream.Send(modelExportRow2Pb(row))
+	})
+}
+
+// NewGRPCExporter returns an Exporter backed by the ExportOrders stream of
+// the remote instance.
+func NewGRPCExporter(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger log.Logger) service.Exporter {
+	return grpcExporter{client: pb.NewOrderRpcServiceClient(conn), tracer: tracer, logger: logger}
+}
+
+type grpcExporter struct {
+	client pb.OrderRpcServiceClient
+	tracer stdopentracing.Tracer
+	logger log.Logger
+}
+
+func (e grpcExporter) ExportOrders(ctx context.Context, req model.ExportOrdersRequest, fn func(model.OrderExportRow) error) (err error) {
+	var parent stdopentracing.SpanContext
+	if span := stdopentracing.SpanFromContext(ctx); span != nil {
+		parent = span.Context()
+	}
+	span := e.tracer.StartSpan("ExportOrders", stdopentracing.ChildOf(parent), ext.SpanKindRPCClient)
+	defer finishSpan(span, &err)
+	md := metadata.MD{}
+	ctx = opentracing.ContextToGRPC(e.tracer, e.logger)(stdopentracing.ContextWithSpan(ctx, span), &md)
+	ctx = logging.ContextToGRPC(ctx, &md)
+	stream, err := e.client.ExportOrders(metadata.NewOutgoingContext(ctx, md), modelExportRequest2Pb(req))
+	if err != nil {
+		return err
+	}
+	for {
+		row, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(pbExportRow2Model(row)); err != nil {
+			return err
+		}
+	}
+}
+
+// finishSpan finishes span, tagged with the error *err if any.
+func finishSpan(span stdopentracing.Span, err *error) {
+	if *err != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("event", "error", "message", (*err).Error())
+	}
+	span.Finish()
+}
+
 // NewGRPCClient ...
 func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger log.Logger) service.Service {
 	//	limiter := ratelimit.NewTokenBucketLimiter(jujuratelimit.NewBucketWithRate(100, 100))
@@ -159,6 +253,7 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 	var getCartItemsEndpoint endpoint.Endpoint
 	var removeCartItemEndpoint endpoint.Endpoint
 	var updateQuantityEndpoint endpoint.Endpoint
+	var mergeCartEndpoint endpoint.Endpoint
 	{
 		createOrderEndpoint = grpctransport.NewClient(
 			conn,
@@ -167,8 +262,9 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 			encodeGRPCCreateOrderRequest,
 			decodeGRPCCreateOrderResponse,
 			pb.CreatedOrderResponse{},
-			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger)),
+			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger), logging.ContextToGRPC),
 		).Endpoint()
+		createOrderEndpoint = errs.ClientMiddleware(createOrderEndpoint)
 		createOrderEndpoint = opentracing.TraceClient(tracer, "CreateOrder")(createOrderEndpoint)
 		//	createOrderEndpoint = limiter(createOrderEndpoint)
 		createOrderEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
@@ -183,8 +279,9 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 			encodeGRPCGetOrdersRequest,
 			decodeGRPCGetOrdersResponse,
 			pb.GetOrdersResponse{},
-			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger)),
+			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger), logging.ContextToGRPC),
 		).Endpoint()
+		getOrdersEndpoint = errs.ClientMiddleware(getOrdersEndpoint)
 		getOrdersEndpoint = opentracing.TraceClient(tracer, "GetOrders")(getOrdersEndpoint)
 		//		getOrdersEndpoint = limiter(getOrdersEndpoint)
 		getOrdersEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
@@ -198,10 +295,11 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 			"GetOrder",
 			encodeGRPCGetOrderRequest,
 			decodeGRPCGetOrderResponse,
-			pb.GetOrdersResponse{},
-			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger)),
+			pb.GetOrderResponse{},
+			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger), logging.ContextToGRPC),
 		).Endpoint()
-		getOrderEndpoint = opentracing.TraceClient(tracer, "GetOrders")(getOrderEndpoint)
+		getOrderEndpoint = errs.ClientMiddleware(getOrderEndpoint)
+		getOrderEndpoint = opentracing.TraceClient(tracer, "GetOrder")(getOrderEndpoint)
 		//	getOrderEndpoint = limiter(getOrderEndpoint)
 		getOrderEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
 			Name:    "GetOrder",
@@ -215,8 +313,9 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 			encodeGRPCAddCartRequest,
 			decodeGRPCAddCartResponse,
 			pb.CreatedCartResponse{},
-			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger)),
+			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger), logging.ContextToGRPC),
 		).Endpoint()
+		addCartEndpoint = errs.ClientMiddleware(addCartEndpoint)
 		addCartEndpoint = opentracing.TraceClient(tracer, "AddCart")(addCartEndpoint)
 		//		addCartEndpoint = limiter(addCartEndpoint)
 		addCartEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
@@ -231,8 +330,9 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 			encodeGRPCCartItemsRequest,
 			decodeGRPCCartItemsResponse,
 			pb.GetCartItemsResponse{},
-			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger)),
+			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger), logging.ContextToGRPC),
 		).Endpoint()
+		getCartItemsEndpoint = errs.ClientMiddleware(getCartItemsEndpoint)
 		getCartItemsEndpoint = opentracing.TraceClient(tracer, "GetCartItems")(getCartItemsEndpoint)
 		//		getCartItemsEndpoint = limiter(getCartItemsEndpoint)
 		getCartItemsEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
@@ -247,8 +347,9 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 			encodeGRPCRemoveCartItemRequest,
 			decodeGRPCRemoveCartItemResponse,
 			pb.RemoveCartItemResponse{},
-			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger)),
+			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger), logging.ContextToGRPC),
 		).Endpoint()
+		removeCartItemEndpoint = errs.ClientMiddleware(removeCartItemEndpoint)
 		removeCartItemEndpoint = opentracing.TraceClient(tracer, "RemoveCartItem")(removeCartItemEndpoint)
 		//	removeCartItemEndpoint = limiter(removeCartItemEndpoint)
 		removeCartItemEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
@@ -263,14 +364,31 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 			encodeGRPCUpdateQuantityRequest,
 			decodeGRPCUpdateQuantityResponse,
 			pb.UpdateQuantityResponse{},
-			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger)),
+			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger), logging.ContextToGRPC),
 		).Endpoint()
+		updateQuantityEndpoint = errs.ClientMiddleware(updateQuantityEndpoint)
 		updateQuantityEndpoint = opentracing.TraceClient(tracer, "UpdateQuantity")(updateQuantityEndpoint)
 		//	updateQuantityEndpoint = limiter(updateQuantityEndpoint)
 		updateQuantityEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
 			Name:    "UpdateQuantity",
 			Timeout: 30 * time.Second,
 		}))(updateQuantityEndpoint)
+
+		mergeCartEndpoint = grpctransport.NewClient(
+			conn,
+			"pb.OrderRpcService",
+			"MergeCart",
+			encodeGRPCMergeCartRequest,
+			decodeGRPCMergeCartResponse,
+			pb.MergeCartResponse{},
+			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger), logging.ContextToGRPC),
+		).Endpoint()
+		mergeCartEndpoint = errs.ClientMiddleware(mergeCartEndpoint)
+		mergeCartEndpoint = opentracing.TraceClient(tracer, "MergeCart")(mergeCartEndpoint)
+		mergeCartEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:    "MergeCart",
+			Timeout: 30 * time.Second,
+		}))(mergeCartEndpoint)
 	}
 	return o_endpoint.Set{
 		CreateOrderEndpoint:    createOrderEndpoint,
@@ -280,5 +398,6 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 		GetCartItemsEndpoint:   getCartItemsEndpoint,
 		RemoveCartItemEndpoint: removeCartItemEndpoint,
 		UpdateQuantityEndpoint: updateQuantityEndpoint,
+		MergeCartEndpoint:      mergeCartEndpoint,
 	}
 }
@@ -2,22 +2,31 @@ package transport
 
 import (
 	"context"
-	"errors"
+	"time"
 
 	"github.com/laidingqing/dabanshan-go/pb"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
 	"github.com/laidingqing/dabanshan-go/svcs/order/model"
+	"github.com/laidingqing/dabanshan-go/svcs/order/service"
 	"github.com/laidingqing/dabanshan-go/utils"
 )
 
+var (
+	// ErrRequestParams ...
+	ErrRequestParams = errs.New(errs.InvalidArgument, "userID or tenantID is required.")
+	// ErrCartItemRequired is returned for an AddCart request without an item.
+	ErrCartItemRequired = errs.New(errs.InvalidArgument, "cart item is required")
+)
+
 // CreateOrder encode/decode
 func decodeGRPCCreateOrderRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
 	req := grpcReq.(*pb.CreateOrderRequest)
-	logger := utils.NewLogger()
-	logger.Log("amount", req.Amount, "userId", req.Userid)
 	return model.CreateOrderRequest{
 		Invoice: model.Invoice{
 			Amount:     req.Amount,
 			UserID:     req.Userid,
+			TenantID:   req.Tenantid,
+			AddressID:  req.Addressid,
 			OrdereItem: pbInvoice2Model(req.Items),
 		},
 	}, nil
@@ -27,7 +36,7 @@ func encodeGRPCCreateOrderResponse(_ context.Context, response interface{}) (int
 	resp := response.(model.CreatedOrderResponse)
 	return &pb.CreatedOrderResponse{
 		Id:  resp.ID,
-		Err: err2str(resp.Err),
+		Err: errs.Encode(resp.Err),
 	}, nil
 }
 
@@ -35,25 +44,45 @@ func encodeGRPCCreateOrderResponse(_ context.Context, response interface{}) (int
 
 func decodeGRPCGetOrdersRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
 	req := grpcReq.(*pb.GetOrdersRequest)
+	if req.Userid == "" && req.Tenantid == "" {
+		return nil, ErrRequestParams
+	}
+	for _, status := range req.Status {
+		if status < int32(model.OrderStatusUnknown) || status > int32(model.OrderStatusCanceled) {
+			return nil, service.ErrInvalidOrderQuery
+		}
+	}
+	if req.Minamount < 0 || req.Maxamount < 0 {
+		return nil, service.ErrInvalidOrderQuery
+	}
 	return model.GetOrdersRequest{
-		UserID:   req.Userid,
-		TenantID: req.Tenantid,
+		OrderQuery: model.OrderQuery{
+			UserID:      req.Userid,
+			TenantID:    req.Tenantid,
+			Status:      pbStatus2Model(req.Status),
+			ProductID:   req.Productid,
+			CreatedFrom: unix2Time(req.Createdfrom),
+			CreatedTo:   unix2Time(req.Createdto),
+			MinAmount:   req.Minamount,
+			MaxAmount:   req.Maxamount,
+		},
+		Sort:      req.Sort,
+		PageIndex: int(req.PageIndex),
+		PageSize:  int(req.PageSize),
 	}, nil
 }
 
 func encodeGRPCGetOrdersResponse(_ context.Context, response interface{}) (interface{}, error) {
 	resp := response.(model.GetOrdersResponse)
-	logger := utils.NewLogger()
-	logger.Log("userID", resp.UserID)
-
-	invoices := resp.Orders.Data.([]model.Invoice)
+	invoices, _ := resp.Orders.Data.([]model.Invoice)
 	return &pb.GetOrdersResponse{
 		Userid:    resp.UserID,
 		Tenantid:  resp.TenantID,
 		PageIndex: int32(resp.Orders.PageIndex),
 		PageSize:  int32(resp.Orders.PageSize),
+		Count:     int32(resp.Orders.Count),
 		Invoices:  modelOrder2Pb(invoices),
-		Err:       err2str(resp.Err),
+		Err:       errs.Encode(resp.Err),
 	}, nil
 }
 
@@ -63,14 +92,17 @@ func decodeGRPCGetOrderRequest(_ context.Context, grpcReq interface{}) (interfac
 	req := grpcReq.(*pb.GetOrderRequest)
 	return model.GetOrderRequest{
 		OrderID: req.Orderid,
+		UserID:  req.Userid,
 	}, nil
 }
 
 func encodeGRPCGetOrderResponse(_ context.Context, response interface{}) (interface{}, error) {
 	resp := response.(model.GetOrderResponse)
+	if resp.Err != nil {
+		return &pb.GetOrderResponse{Err: errs.Encode(resp.Err)}, nil
+	}
 	return &pb.GetOrderResponse{
-		Invoice: &pb.InvoiceRecord{}, //todo
-		Err:     err2str(resp.Err),
+		Invoice: modelOrder2Pb([]model.Invoice{resp.Order})[0],
 	}, nil
 }
 
@@ -78,18 +110,24 @@ func encodeGRPCGetOrderResponse(_ context.Context, response interface{}) (interf
 
 func decodeGRPCAddCartRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
 	req := grpcReq.(*pb.CreateCartRequest)
+	if req.Item == nil {
+		return nil, ErrCartItemRequired
+	}
 	return model.CreateCartRequest{
 		UserID:    req.Item.Userid,
 		Price:     req.Item.Price,
 		ProductID: req.Item.Productid,
+		CartToken: req.Item.Carttoken,
+		Quantity:  req.Item.Quantity,
 	}, nil
 }
 
 func encodeGRPCAddCartResponse(_ context.Context, response interface{}) (interface{}, error) {
 	resp := response.(model.CreatedCartResponse)
 	return &pb.CreatedCartResponse{
-		Id:  resp.ID,
-		Err: err2str(resp.Err),
+		Id:        resp.ID,
+		Carttoken: resp.CartToken,
+		Err:       errs.Encode(resp.Err),
 	}, nil
 }
 
@@ -98,7 +136,8 @@ func encodeGRPCAddCartResponse(_ context.Context, response interface{}) (interfa
 func decodeGRPCGetCartItemsRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
 	req := grpcReq.(*pb.GetCartItemsRequest)
 	return model.GetCartItemsRequest{
-		UserID: req.Userid,
+		UserID:    req.Userid,
+		CartToken: req.Carttoken,
 	}, nil
 }
 
@@ -106,7 +145,7 @@ func encodeGRPCGetCartItemsResponse(_ context.Context, response interface{}) (in
 	resp := response.(model.GetCartItemsResponse)
 	return &pb.GetCartItemsResponse{
 		Items: modelCartItem2Pb(resp.Items),
-		Err:   err2str(resp.Err),
+		Err:   errs.Encode(resp.Err),
 	}, nil
 }
 
@@ -114,29 +153,48 @@ func encodeGRPCGetCartItemsResponse(_ context.Context, response interface{}) (in
 func decodeGRPCRemoveCartItemRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
 	req := grpcReq.(*pb.RemoveCartItemRequest)
 	return model.RemoveCartItemRequest{
-		CartID: req.Cartid,
+		CartID:    req.Cartid,
+		UserID:    req.Userid,
+		CartToken: req.Carttoken,
 	}, nil
 }
 
 func encodeGRPCRemoveCartItemResponse(_ context.Context, response interface{}) (interface{}, error) {
 	resp := response.(model.RemoveCartItemResponse)
 	return &pb.RemoveCartItemResponse{
-		Err: err2str(resp.Err),
+		Err: errs.Encode(resp.Err),
 	}, nil
 }
 
 func decodeGRPCUpdateQuantityRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
 	req := grpcReq.(*pb.UpdateQuantityRequest)
 	return model.UpdateQuantityRequest{
-		CartID:   req.Cartid,
-		Quantity: req.Quantity,
+		CartID:    req.Cartid,
+		UserID:    req.Userid,
+		CartToken: req.Carttoken,
+		Quantity:  req.Quantity,
 	}, nil
 }
 
 func encodeGRPCUpdateQuantityResponse(_ context.Context, response interface{}) (interface{}, error) {
 	resp := response.(model.UpdateQuantityResponse)
 	return &pb.UpdateQuantityResponse{
-		Err: err2str(resp.Err),
+		Err: errs.Encode(resp.Err),
+	}, nil
+}
+
+func decodeGRPCMergeCartRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.MergeCartRequest)
+	return model.MergeCartRequest{
+		CartToken: req.Carttoken,
+		UserID:    req.Userid,
+	}, nil
+}
+
+func encodeGRPCMergeCartResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(model.MergeCartResponse)
+	return &pb.MergeCartResponse{
+		Err: errs.Encode(resp.Err),
 	}, nil
 }
 
@@ -144,12 +202,12 @@ func encodeGRPCUpdateQuantityResponse(_ context.Context, response interface{}) (
 
 func encodeGRPCCreateOrderRequest(_ context.Context, request interface{}) (interface{}, error) {
 	req := request.(model.CreateOrderRequest)
-	logger := utils.NewLogger()
-	logger.Log("amount", req.Invoice.Amount, "userId", req.Invoice.UserID)
 	return &pb.CreateOrderRequest{
-		Amount: req.Invoice.Amount,
-		Userid: req.Invoice.UserID,
-		Items:  modelInvoice2Pb(req.Invoice.OrdereItem),
+		Amount:    req.Invoice.Amount,
+		Userid:    req.Invoice.UserID,
+		Tenantid:  req.Invoice.TenantID,
+		Addressid: req.Invoice.AddressID,
+		Items:     modelInvoice2Pb(req.Invoice.OrdereItem),
 	}, nil
 }
 
@@ -157,7 +215,7 @@ func decodeGRPCCreateOrderResponse(_ context.Context, grpcReply interface{}) (in
 	reply := grpcReply.(*pb.CreatedOrderResponse)
 	return model.CreatedOrderResponse{
 		ID:  reply.Id,
-		Err: str2err(reply.Err)}, nil
+		Err: errs.Decode(reply.Err)}, nil
 }
 
 // getOrders encode/decode func
@@ -165,9 +223,17 @@ func decodeGRPCCreateOrderResponse(_ context.Context, grpcReply interface{}) (in
 func encodeGRPCGetOrdersRequest(_ context.Context, request interface{}) (interface{}, error) {
 	req := request.(model.GetOrdersRequest)
 	return &pb.GetOrdersRequest{
-		Userid:    req.UserID,
-		PageIndex: int32(req.PageIndex),
-		PageSize:  int32(req.PageSize),
+		Userid:      req.UserID,
+		Tenantid:    req.TenantID,
+		PageIndex:   int32(req.PageIndex),
+		PageSize:    int32(req.PageSize),
+		Status:      modelStatus2Pb(req.Status),
+		Productid:   req.ProductID,
+		Createdfrom: time2Unix(req.CreatedFrom),
+		Createdto:   time2Unix(req.CreatedTo),
+		Minamount:   req.MinAmount,
+		Maxamount:   req.MaxAmount,
+		Sort:        req.Sort,
 	}, nil
 }
 
@@ -177,11 +243,12 @@ func decodeGRPCGetOrdersResponse(_ context.Context, grpcReply interface{}) (inte
 		UserID:   reply.Userid,
 		TenantID: reply.Tenantid,
 		Orders: utils.Pagination{
+			Count:     int(reply.Count),
 			PageIndex: int(reply.PageIndex),
 			PageSize:  int(reply.PageSize),
 			Data:      pbOrder2Model(reply.Invoices),
 		},
-		Err: str2err(reply.Err)}, nil
+		Err: errs.Decode(reply.Err)}, nil
 }
 
 // getOrder encode/decode func
@@ -190,14 +257,18 @@ func encodeGRPCGetOrderRequest(_ context.Context, request interface{}) (interfac
 	req := request.(model.GetOrderRequest)
 	return &pb.GetOrderRequest{
 		Orderid: req.OrderID,
+		Userid:  req.UserID,
 	}, nil
 }
 
 func decodeGRPCGetOrderResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
 	reply := grpcReply.(*pb.GetOrderResponse)
+	if reply.Invoice == nil {
+		return model.GetOrderResponse{Err: errs.Decode(reply.Err)}, nil
+	}
 	return model.GetOrderResponse{
-		Order: model.Invoice{}, // TODO
-		Err:   str2err(reply.Err)}, nil
+		Order: pbOrder2Model([]*pb.InvoiceRecord{reply.Invoice})[0],
+		Err:   errs.Decode(reply.Err)}, nil
 }
 
 func encodeGRPCAddCartRequest(_ context.Context, request interface{}) (interface{}, error) {
@@ -207,6 +278,8 @@ func encodeGRPCAddCartRequest(_ context.Context, request interface{}) (interface
 			Price:     req.Price,
 			Productid: req.ProductID,
 			Userid:    req.UserID,
+			Carttoken: req.CartToken,
+			Quantity:  req.Quantity,
 		},
 	}, nil
 }
@@ -214,14 +287,16 @@ func encodeGRPCAddCartRequest(_ context.Context, request interface{}) (interface
 func decodeGRPCAddCartResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
 	reply := grpcReply.(*pb.CreatedCartResponse)
 	return model.CreatedCartResponse{
-		ID:  reply.Id,
-		Err: str2err(reply.Err)}, nil
+		ID:        reply.Id,
+		CartToken: reply.Carttoken,
+		Err:       errs.Decode(reply.Err)}, nil
 }
 
 func encodeGRPCCartItemsRequest(_ context.Context, request interface{}) (interface{}, error) {
 	req := request.(model.GetCartItemsRequest)
 	return &pb.GetCartItemsRequest{
-		Userid: req.UserID,
+		Userid:    req.UserID,
+		Carttoken: req.CartToken,
 	}, nil
 }
 
@@ -229,20 +304,22 @@ func decodeGRPCCartItemsResponse(_ context.Context, grpcReply interface{}) (inte
 	reply := grpcReply.(*pb.GetCartItemsResponse)
 	return model.GetCartItemsResponse{
 		Items: pbCartItem2Model(reply.Items),
-		Err:   str2err(reply.Err)}, nil
+		Err:   errs.Decode(reply.Err)}, nil
 }
 
 func encodeGRPCRemoveCartItemRequest(_ context.Context, request interface{}) (interface{}, error) {
 	req := request.(model.RemoveCartItemRequest)
 	return &pb.RemoveCartItemRequest{
-		Cartid: req.CartID,
+		Cartid:    req.CartID,
+		Userid:    req.UserID,
+		Carttoken: req.CartToken,
 	}, nil
 }
 
 func decodeGRPCRemoveCartItemResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
 	reply := grpcReply.(*pb.RemoveCartItemResponse)
 	return model.RemoveCartItemResponse{
-		Err: str2err(reply.Err)}, nil
+		Err: errs.Decode(reply.Err)}, nil
 }
 
 // UpdateQuantity encode/decode
@@ -250,38 +327,43 @@ func decodeGRPCRemoveCartItemResponse(_ context.Context, grpcReply interface{})
 func encodeGRPCUpdateQuantityRequest(_ context.Context, request interface{}) (interface{}, error) {
 	req := request.(model.UpdateQuantityRequest)
 	return &pb.UpdateQuantityRequest{
-		Cartid:   req.CartID,
-		Quantity: req.Quantity,
+		Cartid:    req.CartID,
+		Userid:    req.UserID,
+		Carttoken: req.CartToken,
+		Quantity:  req.Quantity,
 	}, nil
 }
 
 func decodeGRPCUpdateQuantityResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
 	reply := grpcReply.(*pb.UpdateQuantityResponse)
 	return model.UpdateQuantityResponse{
-		Err: str2err(reply.Err)}, nil
+		Err: errs.Decode(reply.Err)}, nil
 }
 
-func str2err(s string) error {
-	if s == "" {
-		return nil
-	}
-	return errors.New(s)
+// MergeCart encode/decode
+
+func encodeGRPCMergeCartRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(model.MergeCartRequest)
+	return &pb.MergeCartRequest{
+		Carttoken: req.CartToken,
+		Userid:    req.UserID,
+	}, nil
 }
 
-func err2str(err error) string {
-	if err == nil {
-		return ""
-	}
-	return err.Error()
+func decodeGRPCMergeCartResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*pb.MergeCartResponse)
+	return model.MergeCartResponse{
+		Err: errs.Decode(reply.Err)}, nil
 }
 
 func pbInvoice2Model(records []*pb.OrderItemRecord) []model.OrderItem {
 	var models []model.OrderItem
 	for _, record := range records {
 		models = append(models, model.OrderItem{
-			CartID:   record.Cartid,
-			Quantity: record.Quantity,
-			Price:    record.Price,
+			CartID:    record.Cartid,
+			ProductID: record.Productid,
+			Quantity:  record.Quantity,
+			Price:     record.Price,
 		})
 	}
 	return models
@@ -291,9 +373,10 @@ func modelInvoice2Pb(records []model.OrderItem) []*pb.OrderItemRecord {
 	var models []*pb.OrderItemRecord
 	for _, record := range records {
 		models = append(models, &pb.OrderItemRecord{
-			Cartid:   record.CartID,
-			Quantity: record.Quantity,
-			Price:    record.Price,
+			Cartid:    record.CartID,
+			Productid: record.ProductID,
+			Quantity:  record.Quantity,
+			Price:     record.Price,
 		})
 	}
 	return models
@@ -344,8 +427,12 @@ func pbOrder2Model(records []*pb.InvoiceRecord) []model.Invoice {
 	var models []model.Invoice
 	for _, record := range records {
 		models = append(models, model.Invoice{
+			InvoiceID:  record.Invoiceid,
 			UserID:     record.Userid,
+			TenantID:   record.Tenantid,
 			Amount:     record.Amount,
+			Status:     model.OrderStatus(record.Status),
+			CreatedAt:  unix2Time(record.Createdat),
 			OrdereItem: pbOrderItem2Model(record.Items),
 		})
 	}
@@ -356,11 +443,86 @@ func modelOrder2Pb(models []model.Invoice) []*pb.InvoiceRecord {
 	var records []*pb.InvoiceRecord
 	for _, model := range models {
 		records = append(records, &pb.InvoiceRecord{
-			Amount: model.Amount,
-			Userid: model.UserID,
-			Items:  modelInvoice2Pb(model.OrdereItem),
+			Invoiceid: model.InvoiceID,
+			Amount:    model.Amount,
+			Userid:    model.UserID,
+			Tenantid:  model.TenantID,
+			Status:    int32(model.Status),
+			Createdat: time2Unix(model.CreatedAt),
+			Items:     modelInvoice2Pb(model.OrdereItem),
 		})
 	}
 
 	return records
 }
+
+func pbExportRequest2Model(req *pb.ExportOrdersRequest) model.ExportOrdersRequest {
+	return model.ExportOrdersRequest{
+		TenantID: req.Tenantid,
+		From:     unix2Time(req.Createdfrom),
+		To:       unix2Time(req.Createdto),
+	}
+}
+
+func modelExportRequest2Pb(req model.ExportOrdersRequest) *pb.ExportOrdersRequest {
+	return &pb.ExportOrdersRequest{
+		Tenantid:    req.TenantID,
+		Createdfrom: time2Unix(req.From),
+		Createdto:   time2Unix(req.To),
+	}
+}
+
+func modelExportRow2Pb(row model.OrderExportRow) *pb.OrderExportRow {
+	return &pb.OrderExportRow{
+		Invoiceid: row.InvoiceID,
+		Userid:    row.UserID,
+		Productid: row.ProductID,
+		Quantity:  row.Quantity,
+		Price:     row.Price,
+		Status:    int32(row.Status),
+		Createdat: time2Unix(row.CreatedAt),
+	}
+}
+
+func pbExportRow2Model(row *pb.OrderExportRow) model.OrderExportRow {
+	return model.OrderExportRow{
+		InvoiceID: row.Invoiceid,
+		UserID:    row.Userid,
+		ProductID: row.Productid,
+		Quantity:  row.Quantity,
+		Price:     row.Price,
+		Status:    model.OrderStatus(row.Status),
+		CreatedAt: unix2Time(row.Createdat),
+	}
+}
+
+func pbStatus2Model(records []int32) []model.OrderStatus {
+	var models []model.OrderStatus
+	for _, record := range records {
+		models = append(models, model.OrderStatus(record))
+	}
+	return models
+}
+
+func modelStatus2Pb(models []model.OrderStatus) []int32 {
+	var records []int32
+	for _, model := range models {
+		records = append(records, int32(model))
+	}
+	return records
+}
+
+// unix2Time converts unix seconds, where 0 means unset.
+func unix2Time(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+func time2Unix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,22 @@
+package transport
+
+import (
+	"context"
+	"testing"
+
+	"github.com/laidingqing/dabanshan-go/pb"
+	"github.com/laidingqing/dabanshan-go/svcs/order/model"
+)
+
+func TestDecodeAddCart(t *testing.T) {
+	if _, err := decodeGRPCAddCartRequest(context.Background(), &pb.CreateCartRequest{}); err != ErrCartItemRequired {
+		t.Errorf("no item: %v, want ErrCartItemRequired", err)
+	}
+	req, err := decodeGRPCAddCartRequest(context.Background(), &pb.CreateCartRequest{
+		Item: &pb.OrderItemRecord{Userid: "u1", Productid: "p1", Price: 1.5, Quantity: 2},
+	})
+	want := model.CreateCartRequest{UserID: "u1", ProductID: "p1", Price: 1.5, Quantity: 2}
+	if err != nil || req != want {
+		t.Errorf("decoded %+v, %v, want %+v", req, err, want)
+	}
+}
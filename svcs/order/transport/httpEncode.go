@@ -4,106 +4,150 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"io/ioutil"
 	"net/http"
-	"strconv"
+	"time"
 
-	"github.com/gorilla/mux"
+	"github.com/golang/protobuf/proto"
+	"github.com/laidingqing/dabanshan-go/pb"
+	"github.com/laidingqing/dabanshan-go/svcs/authorize"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
 	"github.com/laidingqing/dabanshan-go/svcs/order/model"
 	"github.com/laidingqing/dabanshan-go/svcs/order/service"
-	"github.com/laidingqing/dabanshan-go/utils"
 )
 
 var (
-	// ErrRequestParams ...
-	ErrRequestParams = errors.New("userID or tenantID is required.")
+	// ErrInvalidQueryParam ...
+	ErrInvalidQueryParam = errs.New(errs.InvalidArgument, "invalid query parameter")
 )
 
-func decodeHTTPCreateOrderRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	logger := utils.NewLogger()
-
-	defer r.Body.Close()
-	a := model.CreateOrderRequest{}
-	err := json.NewDecoder(r.Body).Decode(&a)
-	logger.Log("amount", a.Invoice.Amount, "userId", a.Invoice.UserID, "items", len(a.Invoice.OrdereItem))
+// authUserID returns the user authenticated by the request's bearer token.
+func authUserID(r *http.Request) (string, error) {
+	id, err := authorize.UserID(r)
 	if err != nil {
-		return nil, err
+		return "", service.ErrUnauthorized
 	}
-	return a, nil
+	return id, nil
 }
 
-func decodeHTTPGetOrdersRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	userID := r.FormValue("userId")
-	tenantID := r.FormValue("tenantId")
-	pageIndex, _ := strconv.Atoi(r.FormValue("pageIndex"))
-	pageSize, _ := strconv.Atoi(r.FormValue("pageSize"))
+// cartOwner returns the authenticated user of a cart request, or the guest
+// cart token when the request carries no valid bearer token.
+func cartOwner(r *http.Request) (userID, cartToken string) {
+	if id, err := authorize.UserID(r); err == nil {
+		return id, ""
+	}
+	return "", authorize.CartToken(r)
+}
 
-	if !(userID != "" || tenantID != "") {
-		return nil, ErrRequestParams
+// beforeHTTPGetOrders limits the search to the orders the authenticated user
+// sold, with its id as tenantid, or else bought, and reads the from and to
+// query parameters, RFC 3339 times or dates, into the unix seconds of the
+// request.
+func beforeHTTPGetOrders(r *http.Request, msg proto.Message) error {
+	req := msg.(*pb.GetOrdersRequest)
+	userID, err := authUserID(r)
+	if err != nil {
+		return err
 	}
-	a := model.GetOrdersRequest{
-		UserID:    userID,
-		TenantID:  tenantID,
-		PageIndex: pageIndex,
-		PageSize:  pageSize,
+	if req.Tenantid != userID {
+		if req.Userid != "" && req.Userid != userID {
+			return service.ErrOrderForbidden
+		}
+		req.Userid = userID
 	}
-	return a, nil
+	q := r.URL.Query()
+	if v := q.Get("from"); v != "" {
+		from, err := parseTimeParam(v, false)
+		if err != nil {
+			return err
+		}
+		req.Createdfrom = time2Unix(from)
+	}
+	if v := q.Get("to"); v != "" {
+		to, err := parseTimeParam(v, true)
+		if err != nil {
+			return err
+		}
+		req.Createdto = time2Unix(to)
+	}
+	return nil
 }
 
-func decodeHTTPGetOrderRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	vars := mux.Vars(r)
-	id, _ := vars["orderId"]
-	a := model.GetOrderRequest{
-		OrderID: id,
+// beforeHTTPGetOrder reads the order for the authenticated user, its buyer
+// or tenant.
+func beforeHTTPGetOrder(r *http.Request, msg proto.Message) error {
+	userID, err := authUserID(r)
+	if err != nil {
+		return err
 	}
-	return a, nil
+	msg.(*pb.GetOrderRequest).Userid = userID
+	return nil
 }
 
-func decodeHTTPAddCartRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	defer r.Body.Close()
-	a := model.CreateCartRequest{}
-	err := json.NewDecoder(r.Body).Decode(&a)
+// parseTimeParam parses an RFC 3339 time or a 2006-01-02 date. A date used as
+// the end of a range includes the whole day.
+func parseTimeParam(v string, end bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
 	if err != nil {
-		return nil, err
+		return time.Time{}, ErrInvalidQueryParam
 	}
-	return a, nil
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
 }
 
-func decodeHTTPGetCartItemsRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	id := r.FormValue("userId")
-	return model.GetCartItemsRequest{
-		UserID: id,
-	}, nil
+func beforeHTTPAddCart(r *http.Request, msg proto.Message) error {
+	req := msg.(*pb.CreateCartRequest)
+	if req.Item == nil {
+		req.Item = &pb.OrderItemRecord{}
+	}
+	req.Item.Userid, req.Item.Carttoken = cartOwner(r)
+	return nil
 }
 
-func decodeHTTPRemoveCartItemRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	vars := mux.Vars(r)
-	id, _ := vars["cartId"]
-	return model.RemoveCartItemRequest{
-		CartID: id,
-	}, nil
+// afterHTTPAddCart hands a newly issued guest cart token to the client.
+func afterHTTPAddCart(w http.ResponseWriter, response interface{}) {
+	if resp, ok := response.(model.CreatedCartResponse); ok && resp.CartToken != "" {
+		authorize.SetCartToken(w, resp.CartToken)
+	}
 }
 
-func decodeHTTPUpdateQuantityRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	vars := mux.Vars(r)
-	id, _ := vars["cartId"]
+// beforeHTTPGetCartItems lists the cart of the authenticated user, or else
+// the guest cart of the cart token, whatever the userid query parameter.
+func beforeHTTPGetCartItems(r *http.Request, msg proto.Message) error {
+	req := msg.(*pb.GetCartItemsRequest)
+	req.Userid, req.Carttoken = cartOwner(r)
+	return nil
+}
 
-	defer r.Body.Close()
-	a := model.UpdateQuantityRequest{}
-	err := json.NewDecoder(r.Body).Decode(&a)
-	if err != nil {
-		return nil, err
-	}
-	return model.UpdateQuantityRequest{
-		CartID:   id,
-		Quantity: a.Quantity,
-	}, nil
+func beforeHTTPRemoveCartItem(r *http.Request, msg proto.Message) error {
+	req := msg.(*pb.RemoveCartItemRequest)
+	req.Userid, req.Carttoken = cartOwner(r)
+	return nil
 }
 
-func errorEncoder(_ context.Context, err error, w http.ResponseWriter) {
-	w.WriteHeader(err2code(err))
-	json.NewEncoder(w).Encode(errorWrapper{Error: err.Error()})
+func beforeHTTPUpdateQuantity(r *http.Request, msg proto.Message) error {
+	req := msg.(*pb.UpdateQuantityRequest)
+	req.Userid, req.Carttoken = cartOwner(r)
+	return nil
+}
+
+func beforeHTTPMergeCart(r *http.Request, msg proto.Message) error {
+	req := msg.(*pb.MergeCartRequest)
+	userID, err := authUserID(r)
+	if err != nil {
+		return err
+	}
+	req.Userid = userID
+	req.Carttoken = authorize.CartToken(r)
+	return nil
 }
 
 // encodeHTTPGenericRequest is a transport/http.EncodeRequestFunc that
@@ -116,26 +160,3 @@ func encodeHTTPGenericRequest(_ context.Context, r *http.Request, request interf
 	r.Body = ioutil.NopCloser(&buf)
 	return nil
 }
-
-// encodeHTTPGenericResponse is a transport/http.EncodeResponseFunc that encodes
-// the response as JSON to the response writer. Primarily useful in a server.
-func encodeHTTPGenericResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
-	if f, ok := response.(model.Failer); ok && f.Failed() != nil {
-		errorEncoder(ctx, f.Failed(), w)
-		return nil
-	}
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	return json.NewEncoder(w).Encode(response)
-}
-
-type errorWrapper struct {
-	Error string `json:"error"`
-}
-
-func err2code(err error) int {
-	switch err {
-	case service.ErrOrderNotFound:
-		return http.StatusBadRequest
-	}
-	return http.StatusInternalServerError
-}
@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"testing"
+
+	"github.com/laidingqing/dabanshan-go/pb"
+	"github.com/laidingqing/dabanshan-go/svcs/authorize"
+	"github.com/laidingqing/dabanshan-go/svcs/order/service"
+)
+
+func TestGetCartItemsOwner(t *testing.T) {
+	for _, tc := range []struct {
+		name, user, token   string
+		wantUser, wantToken string
+	}{
+		{"user", "u1", "", "u1", ""},
+		{"user with a guest cart", "u1", "g1", "u1", ""},
+		{"guest", "", "g1", "", "g1"},
+		{"anonymous", "", "", "", ""},
+	} {
+		r := exportRequest(t, "/api/v1/carts/?userid=u2", tc.user)
+		if tc.token != "" {
+			r.Header.Set(authorize.CartTokenHeader, tc.token)
+		}
+		req := &pb.GetCartItemsRequest{Userid: "u2"}
+		if err := beforeHTTPGetCartItems(r, req); err != nil {
+			t.Fatal(err)
+		}
+		if req.Userid != tc.wantUser || req.Carttoken != tc.wantToken {
+			t.Errorf("%s: listing %q %q, want %q %q", tc.name, req.Userid, req.Carttoken, tc.wantUser, tc.wantToken)
+		}
+	}
+}
+
+func TestGetOrdersOwner(t *testing.T) {
+	for _, tc := range []struct {
+		name, user, target   string
+		wantUser, wantTenant string
+		want                 error
+	}{
+		{"own orders", "u1", "/api/v1/orders/", "u1", "", nil},
+		{"own orders by id", "u1", "/api/v1/orders/?userid=u1", "u1", "", nil},
+		{"orders of the tenant", "t1", "/api/v1/orders/?tenantid=t1", "", "t1", nil},
+		{"orders of a buyer of the tenant", "t1", "/api/v1/orders/?tenantid=t1&userid=u1", "u1", "t1", nil},
+		{"own orders at another tenant", "u1", "/api/v1/orders/?tenantid=t2", "u1", "t2", nil},
+		{"orders of another user", "u1", "/api/v1/orders/?userid=u2", "", "", service.ErrOrderForbidden},
+		{"orders of another tenant", "t1", "/api/v1/orders/?tenantid=t2&userid=u2", "", "", service.ErrOrderForbidden},
+		{"anonymous", "", "/api/v1/orders/?tenantid=t1", "", "", service.ErrUnauthorized},
+	} {
+		r := exportRequest(t, tc.target, tc.user)
+		q := r.URL.Query()
+		req := &pb.GetOrdersRequest{Userid: q.Get("userid"), Tenantid: q.Get("tenantid")}
+		err := beforeHTTPGetOrders(r, req)
+		if err != tc.want {
+			t.Errorf("%s: error %v, want %v", tc.name, err, tc.want)
+			continue
+		}
+		if err == nil && (req.Userid != tc.wantUser || req.Tenantid != tc.wantTenant) {
+			t.Errorf("%s: searching %q %q, want %q %q", tc.name, req.Userid, req.Tenantid, tc.wantUser, tc.wantTenant)
+		}
+	}
+}
+
+func TestGetOrderOwner(t *testing.T) {
+	req := &pb.GetOrderRequest{Orderid: "o1", Userid: "u2"}
+	if err := beforeHTTPGetOrder(exportRequest(t, "/api/v1/orders/o1/?userid=u2", "u1"), req); err != nil || req.Userid != "u1" {
+		t.Errorf("reading for %q, %v, want the user of the token", req.Userid, err)
+	}
+	if err := beforeHTTPGetOrder(exportRequest(t, "/api/v1/orders/o1/", ""), &pb.GetOrderRequest{}); err != service.ErrUnauthorized {
+		t.Errorf("anonymous: %v", err)
+	}
+}
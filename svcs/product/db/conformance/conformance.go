@@ -0,0 +1,83 @@
+// Package conformance holds the behaviour every backend of svcs/product/db
+// shares, as tests each backend runs against a live database, connected by
+// svcs/conformance, in its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, &Mongo{conn: s_conformance.Driver(t, name)})
+//	}
+package conformance
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/laidingqing/dabanshan-go/svcs/product/db"
+	m_product "github.com/laidingqing/dabanshan-go/svcs/product/model"
+)
+
+// MissingID is an id in the format of every backend that no product has.
+const MissingID = "000000000000000000000001"
+
+// Run runs the tests against d, connected.
+func Run(t *testing.T, d db.Database) {
+	ctx := context.Background()
+
+	t.Run("Ping", func(t *testing.T) {
+		if err := d.Ping(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.PingGridFS(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("CreateProduct", func(t *testing.T) {
+		p := m_product.New()
+		p.Name = "tea"
+		p.Price = "12.50"
+		p.UserID = "user"
+		p.TenantID = "tenant"
+		p.CatalogID = "drinks"
+		p.Status = 1
+		p.Thumbnails = []string{"1", "2"}
+		id, err := d.CreateProduct(ctx, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == "" || p.ID != id {
+			t.Fatalf("got id %q, product id %q", id, p.ID)
+		}
+		got, err := d.GetProductsByIDs(ctx, []string{id, MissingID, "not an id"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || !reflect.DeepEqual(got[0], p) {
+			t.Errorf("GetProductsByIDs: got %+v, want %+v", got, p)
+		}
+	})
+
+	t.Run("NoProducts", func(t *testing.T) {
+		for _, ids := range [][]string{nil, {MissingID}, {"not an id"}} {
+			got, err := d.GetProductsByIDs(ctx, ids)
+			if err != nil || len(got) != 0 {
+				t.Errorf("GetProductsByIDs(%q): got %+v, %v", ids, got, err)
+			}
+		}
+	})
+
+	t.Run("UploadGfs", func(t *testing.T) {
+		id, err := d.UploadGfs(ctx, []byte("image"), "md5", "image.png")
+		if err != nil || id == "" {
+			t.Errorf("got %q, %v", id, err)
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := d.GetProductsByIDs(ctx, []string{MissingID}); err == nil {
+			t.Error("GetProductsByIDs: no error with a canceled context")
+		}
+	})
+}
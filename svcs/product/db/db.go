@@ -1,24 +1,34 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 
 	m_product "github.com/laidingqing/dabanshan-go/svcs/product/model"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/laidingqing/dabanshan-go/svcs/instrumenting"
 )
 
 // Database represents a simple interface so we can switch to a new system easily
 type Database interface {
-	Init() error
-	CreateProduct(*m_product.Product) (string, error)
-	UploadGfs(body []byte, md5 string, name string) (string, error)
+	Init(context.Context) error
+	Ping(context.Context) error
+	Close()
+	CreateProduct(context.Context, *m_product.Product) (string, error)
+	GetProductsByIDs(ctx context.Context, ids []string) ([]m_product.Product, error)
+	UploadGfs(ctx context.Context, body []byte, md5 string, name string) (string, error)
+	PingGridFS(context.Context) error
 }
 
 var (
-	database string
+	database = "mongodb"
 	//DefaultDb is the database set for the microservice
 	DefaultDb Database
+	//Duration observes the latency of the operations on DefaultDb, see instrumenting.NewDBDuration
+	Duration metrics.Histogram = discard.NewHistogram()
 	//DBTypes is a map of DB interfaces that can be used for this service
 	DBTypes = map[string]Database{}
 	//ErrNoDatabaseFound error returnes when database interface does not exists in DBTypes
@@ -27,8 +37,9 @@ var (
 	ErrNoDatabaseSelected = errors.New("No DB selected")
 )
 
-func init() {
-	database = *flag.String("database", "mongodb", "Database to use")
+//RegisterFlags defines the flag selecting the database on fs
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&database, "database", database, "Database to use")
 }
 
 //Init inits the selected DB in DefaultDb
@@ -40,7 +51,30 @@ func Init() error {
 	if err != nil {
 		return err
 	}
-	return DefaultDb.Init()
+	return DefaultDb.Init(context.Background())
+}
+
+//Ping checks that DefaultDb is reachable, for the readiness check
+func Ping(ctx context.Context) error {
+	if DefaultDb == nil {
+		return ErrNoDatabaseSelected
+	}
+	return DefaultDb.Ping(ctx)
+}
+
+//PingGridFS checks that the GridFS of DefaultDb is usable, for the readiness check
+func PingGridFS(ctx context.Context) error {
+	if DefaultDb == nil {
+		return ErrNoDatabaseSelected
+	}
+	return DefaultDb.PingGridFS(ctx)
+}
+
+//Close closes DefaultDb, once the requests using it are served
+func Close() {
+	if DefaultDb != nil {
+		DefaultDb.Close()
+	}
 }
 
 //Set the DefaultDb
@@ -58,11 +92,19 @@ func Register(name string, db Database) {
 }
 
 //CreateProduct invokes DefaultDb method
-func CreateProduct(p *m_product.Product) (string, error) {
-	return DefaultDb.CreateProduct(p)
+func CreateProduct(ctx context.Context, p *m_product.Product) (_ string, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "CreateProduct")(&err)
+	return DefaultDb.CreateProduct(ctx, p)
+}
+
+//GetProductsByIDs invokes DefaultDb method
+func GetProductsByIDs(ctx context.Context, ids []string) (_ []m_product.Product, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "GetProductsByIDs")(&err)
+	return DefaultDb.GetProductsByIDs(ctx, ids)
 }
 
 // UploadGfs invokes DefaultDb method
-func UploadGfs(body []byte, md5 string, name string) (string, error) {
-	return DefaultDb.UploadGfs(body, md5, name)
+func UploadGfs(ctx context.Context, body []byte, md5 string, name string) (_ string, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "UploadGfs")(&err)
+	return DefaultDb.UploadGfs(ctx, body, md5, name)
 }
@@ -1,11 +1,12 @@
 package mongodb
 
 import (
+	"context"
 	"flag"
 	"net/url"
 	"strconv"
-	"time"
 
+	"github.com/laidingqing/dabanshan-go/svcs/mongo"
 	m_product "github.com/laidingqing/dabanshan-go/svcs/product/model"
 	"github.com/laidingqing/dabanshan-go/utils"
 	"gopkg.in/mgo.v2"
@@ -15,21 +16,32 @@ import (
 var (
 	name        string
 	password    string
-	host        string
+	host        = "127.0.0.1:27017"
 	db          = "test"
 	collections = "products"
+	opts        = mongo.DefaultOptions
 )
 
-func init() {
-	name = *flag.String("mongouser", "", "Mongo user")
-	password = *flag.String("mongopassword", "", "Mongo password")
-	host = *flag.String("mongohost", "127.0.0.1:27017", "mongo host")
+// RegisterFlags defines the flags of the MongoDB connection on fs.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&name, "mongouser", name, "Mongo user")
+	fs.StringVar(&password, "mongopassword", password, "Mongo password")
+	fs.StringVar(&host, "mongohost", host, "mongo host")
 }
 
 // Mongo ...
 type Mongo struct {
 	//Session is a MongoDB Session
 	Session *mgo.Session
+	// Database is the name of the database, "test" if empty.
+	Database string
+}
+
+func (m *Mongo) database() string {
+	if m.Database != "" {
+		return m.Database
+	}
+	return db
 }
 
 // MongoProduct is a wrapper for the users
@@ -47,10 +59,11 @@ func NewProduct() MongoProduct {
 }
 
 // Init MongoDB
-func (m *Mongo) Init() error {
+func (m *Mongo) Init(ctx context.Context) error {
 	u := getURL()
 	var err error
-	m.Session, err = mgo.DialWithTimeout(u.String(), time.Duration(5)*time.Second)
+	opts = mongo.Flags()
+	m.Session, err = mongo.Dial(ctx, u.String(), opts)
 	if err != nil {
 		return err
 	}
@@ -58,15 +71,15 @@ func (m *Mongo) Init() error {
 }
 
 // CreateProduct ...
-func (m *Mongo) CreateProduct(p *m_product.Product) (string, error) {
-	s := m.Session.Copy()
-	defer s.Close()
+func (m *Mongo) CreateProduct(ctx context.Context, p *m_product.Product) (string, error) {
 	id := bson.NewObjectId()
 	mp := NewProduct()
 	mp.Product = *p
 	mp.ID = id
-	c := s.DB(db).C(collections)
-	_, err := c.UpsertId(mp.ID, mp)
+	err := mongo.Retry(ctx, m.Session, opts, func(s *mgo.Session) error {
+		_, err := s.DB(m.database()).C(collections).UpsertId(mp.ID, mp)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
@@ -75,40 +88,105 @@ func (m *Mongo) CreateProduct(p *m_product.Product) (string, error) {
 	return mp.ID.Hex(), nil
 }
 
+// GetProductsByIDs returns the products with the given ids. Malformed ids
+// match no product.
+func (m *Mongo) GetProductsByIDs(ctx context.Context, ids []string) ([]m_product.Product, error) {
+	var oids []bson.ObjectId
+	for _, id := range ids {
+		if bson.IsObjectIdHex(id) {
+			oids = append(oids, bson.ObjectIdHex(id))
+		}
+	}
+	if len(oids) == 0 {
+		return []m_product.Product{}, nil
+	}
+	var mps []MongoProduct
+	err := mongo.Retry(ctx, m.Session, opts, func(s *mgo.Session) error {
+		return s.DB(m.database()).C(collections).Find(bson.M{"_id": bson.M{"$in": oids}}).All(&mps)
+	})
+	if err != nil {
+		return nil, err
+	}
+	products := make([]m_product.Product, 0, len(mps))
+	for _, mp := range mps {
+		mp.Product.ID = mp.ID.Hex()
+		products = append(products, mp.Product)
+	}
+	return products, nil
+}
+
 // UploadGfs ...
-func (m *Mongo) UploadGfs(body []byte, md5 string, name string) (string, error) {
+func (m *Mongo) UploadGfs(ctx context.Context, body []byte, md5 string, name string) (string, error) {
 	gf, _ := utils.NewGlowFlake(1, 1)
 	id, _ := gf.NextId()
 	fsid := strconv.FormatInt(id, 10)
-	s := m.Session.Copy()
-	defer s.Close()
-	fs, err := s.DB(db).GridFS("fs").Create(fsid)
+	err := mongo.Do(ctx, m.Session, opts, func(s *mgo.Session) error {
+		fs, err := s.DB(m.database()).GridFS("fs").Create(fsid)
+		if err != nil {
+			return err
+		}
+		fs.SetName(fsid)
+		if _, err := fs.Write(body); err != nil {
+			fs.Abort()
+			fs.Close()
+			return err
+		}
+		return fs.Close()
+	})
 	if err != nil {
 		return "", err
 	}
-	defer fs.Close()
-	fs.SetName(fsid)
-	if _, err := fs.Write(body); err != nil {
-		return "", err
-	}
 	return fsid, nil
 }
 
-// EnsureIndexes ensures userid is unique
+// Ping checks that the session reaches the server.
+func (m *Mongo) Ping(ctx context.Context) error {
+	return mongo.Do(ctx, m.Session, opts, func(s *mgo.Session) error {
+		return s.Ping()
+	})
+}
+
+// PingGridFS checks that the GridFS files collection can be read.
+func (m *Mongo) PingGridFS(ctx context.Context) error {
+	return mongo.Do(ctx, m.Session, opts, func(s *mgo.Session) error {
+		_, err := s.DB(m.database()).GridFS("fs").Files.Find(nil).Limit(1).Count()
+		return err
+	})
+}
+
+// Close closes the session and its connections.
+func (m *Mongo) Close() {
+	if m.Session != nil {
+		m.Session.Close()
+	}
+}
+
+// EnsureIndexes indexes the products of a user. It drops the unique index
+// on userid of older versions, a field products do not have, which let a
+// single product be stored.
 func (m *Mongo) EnsureIndexes() error {
 	s := m.Session.Copy()
 	defer s.Close()
+	c := s.DB(m.database()).C(collections)
+	if err := c.DropIndex("userid"); err != nil && !isIndexNotFound(err) {
+		return err
+	}
 	i := mgo.Index{
-		Key:        []string{"userid"},
-		Unique:     true,
-		DropDups:   true,
+		Key:        []string{"userID"},
 		Background: true,
-		Sparse:     false,
 	}
-	c := s.DB(db).C(collections)
 	return c.EnsureIndex(i)
 }
 
+// isIndexNotFound reports whether err is the server failing to drop an
+// index, or the collection, that does not exist.
+func isIndexNotFound(err error) bool {
+	if qe, ok := err.(*mgo.QueryError); ok {
+		return qe.Code == 27 || qe.Code == 26
+	}
+	return false
+}
+
 func getURL() url.URL {
 	ur := url.URL{
 		Scheme: "mongodb",
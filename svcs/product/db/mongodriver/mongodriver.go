@@ -0,0 +1,145 @@
+// Package mongodriver stores products in MongoDB with the official driver,
+// registered as the "mongodriver" database. It reads the documents and GridFS
+// files of the mgo backend, svcs/product/db/mongodb, so either can run on
+// the same data.
+package mongodriver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"strconv"
+
+	s_mongo "github.com/laidingqing/dabanshan-go/svcs/mongo"
+	"github.com/laidingqing/dabanshan-go/svcs/mongo/driver"
+	m_product "github.com/laidingqing/dabanshan-go/svcs/product/model"
+	"github.com/laidingqing/dabanshan-go/utils"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const collection = "products"
+
+// RegisterFlags defines the flags of the MongoDB connection on fs.
+func RegisterFlags(fs *flag.FlagSet) {
+	driver.RegisterFlags(fs)
+}
+
+// Mongo meets the Database interface requirements
+type Mongo struct {
+	conn *driver.Conn
+}
+
+// mongoProduct is the document of a product.
+type mongoProduct struct {
+	m_product.Product `bson:",inline"`
+	ID                bson.ObjectID `bson:"_id"`
+}
+
+// Init connects.
+func (m *Mongo) Init(ctx context.Context) error {
+	conn, err := driver.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	m.conn = conn
+	return m.EnsureIndexes(ctx)
+}
+
+// EnsureIndexes indexes the products of a user, dropping the unique index on
+// userid of older versions of the mgo backend.
+func (m *Mongo) EnsureIndexes(ctx context.Context) error {
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	indexes := m.conn.DB.Collection(collection).Indexes()
+	err := indexes.DropOne(ctx, "userid_1")
+	var se mongo.ServerError
+	if err != nil && !(errors.As(err, &se) && (se.HasErrorCode(27) || se.HasErrorCode(26))) {
+		return err
+	}
+	_, err = indexes.CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "userID", Value: 1}}})
+	return err
+}
+
+// Ping checks that the primary answers.
+func (m *Mongo) Ping(ctx context.Context) error {
+	if m.conn == nil {
+		return s_mongo.ErrNotConnected
+	}
+	return m.conn.Ping(ctx)
+}
+
+// PingGridFS checks that the GridFS files collection can be read.
+func (m *Mongo) PingGridFS(ctx context.Context) error {
+	if m.conn == nil {
+		return s_mongo.ErrNotConnected
+	}
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	_, err := m.conn.DB.Collection("fs.files").CountDocuments(ctx, bson.D{}, options.Count().SetLimit(1))
+	return err
+}
+
+// Close disconnects.
+func (m *Mongo) Close() {
+	if m.conn != nil {
+		m.conn.Close()
+	}
+}
+
+// CreateProduct inserts p, setting its id.
+func (m *Mongo) CreateProduct(ctx context.Context, p *m_product.Product) (string, error) {
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	mp := mongoProduct{Product: *p, ID: bson.NewObjectID()}
+	if _, err := m.conn.DB.Collection(collection).InsertOne(ctx, mp); err != nil {
+		return "", err
+	}
+	p.ID = mp.ID.Hex()
+	return p.ID, nil
+}
+
+// GetProductsByIDs returns the products with the given ids. Malformed ids
+// match no product.
+func (m *Mongo) GetProductsByIDs(ctx context.Context, ids []string) ([]m_product.Product, error) {
+	var oids []bson.ObjectID
+	for _, id := range ids {
+		if oid, ok := driver.ObjectID(id); ok {
+			oids = append(oids, oid)
+		}
+	}
+	if len(oids) == 0 {
+		return []m_product.Product{}, nil
+	}
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	cur, err := m.conn.DB.Collection(collection).Find(ctx, bson.M{"_id": bson.M{"$in": oids}})
+	if err != nil {
+		return nil, err
+	}
+	var mps []mongoProduct
+	if err := cur.All(ctx, &mps); err != nil {
+		return nil, err
+	}
+	products := make([]m_product.Product, 0, len(mps))
+	for _, mp := range mps {
+		mp.Product.ID = mp.ID.Hex()
+		products = append(products, mp.Product)
+	}
+	return products, nil
+}
+
+// UploadGfs stores body in GridFS, named by a new id it returns.
+func (m *Mongo) UploadGfs(ctx context.Context, body []byte, md5 string, name string) (string, error) {
+	gf, _ := utils.NewGlowFlake(1, 1)
+	id, _ := gf.NextId()
+	fsid := strconv.FormatInt(id, 10)
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	if _, err := m.conn.DB.GridFSBucket().UploadFromStream(ctx, fsid, bytes.NewReader(body)); err != nil {
+		return "", err
+	}
+	return fsid, nil
+}
@@ -0,0 +1,17 @@
+package mongodriver
+
+import (
+	"context"
+	"testing"
+
+	s_conformance "github.com/laidingqing/dabanshan-go/svcs/conformance"
+	"github.com/laidingqing/dabanshan-go/svcs/product/db/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	m := &Mongo{conn: s_conformance.Driver(t, s_conformance.Name("products"))}
+	if err := m.EnsureIndexes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	conformance.Run(t, m)
+}
@@ -9,8 +9,8 @@ import (
 	"github.com/go-kit/kit/circuitbreaker"
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/metrics"
 	"github.com/go-kit/kit/tracing/opentracing"
+	"github.com/laidingqing/dabanshan-go/svcs/instrumenting"
 	"github.com/laidingqing/dabanshan-go/svcs/product/model"
 	"github.com/laidingqing/dabanshan-go/svcs/product/service"
 )
@@ -19,18 +19,20 @@ import (
 // be used as a helper struct, to collect all of the endpoints into a single
 // parameter.
 type Set struct {
-	CreateProductEndpoint endpoint.Endpoint
-	GetProductsEndpoint   endpoint.Endpoint
-	UploadEndpoint        endpoint.Endpoint
+	CreateProductEndpoint    endpoint.Endpoint
+	GetProductsEndpoint      endpoint.Endpoint
+	GetProductsByIDsEndpoint endpoint.Endpoint
+	UploadEndpoint           endpoint.Endpoint
 }
 
 // New returns a Set that wraps the provided server, and wires in all of the
 // expected endpoint middlewares via the various parameters.
-func New(svc service.Service, logger log.Logger, duration metrics.Histogram, trace stdopentracing.Tracer) Set {
+func New(svc service.Service, logger log.Logger, metrics instrumenting.EndpointMetrics, trace stdopentracing.Tracer) Set {
 	var (
-		createProductEndpoint endpoint.Endpoint
-		getProductsEndpoint   endpoint.Endpoint
-		uploadEndpoint        endpoint.Endpoint
+		createProductEndpoint    endpoint.Endpoint
+		getProductsEndpoint      endpoint.Endpoint
+		getProductsByIDsEndpoint endpoint.Endpoint
+		uploadEndpoint           endpoint.Endpoint
 	)
 	{
 		createProductEndpoint = MakeCreateProductEndpoint(svc)
@@ -38,7 +40,7 @@ func New(svc service.Service, logger log.Logger, duration metrics.Histogram, tra
 		createProductEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(createProductEndpoint)
 		createProductEndpoint = opentracing.TraceServer(trace, "GetProducts")(createProductEndpoint)
 		createProductEndpoint = LoggingMiddleware(log.With(logger, "method", "GetProducts"))(createProductEndpoint)
-		createProductEndpoint = InstrumentingMiddleware(duration.With("method", "GetProducts"))(createProductEndpoint)
+		createProductEndpoint = metrics.Middleware("CreateProduct")(createProductEndpoint)
 	}
 	{
 		getProductsEndpoint = MakeGetProductsEndpoint(svc)
@@ -46,7 +48,14 @@ func New(svc service.Service, logger log.Logger, duration metrics.Histogram, tra
 		getProductsEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(getProductsEndpoint)
 		getProductsEndpoint = opentracing.TraceServer(trace, "GetProducts")(getProductsEndpoint)
 		getProductsEndpoint = LoggingMiddleware(log.With(logger, "method", "GetProducts"))(getProductsEndpoint)
-		getProductsEndpoint = InstrumentingMiddleware(duration.With("method", "GetProducts"))(getProductsEndpoint)
+		getProductsEndpoint = metrics.Middleware("GetProducts")(getProductsEndpoint)
+	}
+	{
+		getProductsByIDsEndpoint = MakeGetProductsByIDsEndpoint(svc)
+		getProductsByIDsEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(getProductsByIDsEndpoint)
+		getProductsByIDsEndpoint = opentracing.TraceServer(trace, "GetProductsByIDs")(getProductsByIDsEndpoint)
+		getProductsByIDsEndpoint = LoggingMiddleware(log.With(logger, "method", "GetProductsByIDs"))(getProductsByIDsEndpoint)
+		getProductsByIDsEndpoint = metrics.Middleware("GetProductsByIDs")(getProductsByIDsEndpoint)
 	}
 	{
 		uploadEndpoint = MakeUploadEndpoint(svc)
@@ -54,12 +63,13 @@ func New(svc service.Service, logger log.Logger, duration metrics.Histogram, tra
 		uploadEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(uploadEndpoint)
 		uploadEndpoint = opentracing.TraceServer(trace, "Upload")(uploadEndpoint)
 		uploadEndpoint = LoggingMiddleware(log.With(logger, "method", "Upload"))(uploadEndpoint)
-		uploadEndpoint = InstrumentingMiddleware(duration.With("method", "Upload"))(uploadEndpoint)
+		uploadEndpoint = metrics.Middleware("Upload")(uploadEndpoint)
 	}
 	return Set{
-		GetProductsEndpoint:   getProductsEndpoint,
-		CreateProductEndpoint: createProductEndpoint,
-		UploadEndpoint:        uploadEndpoint,
+		GetProductsEndpoint:      getProductsEndpoint,
+		GetProductsByIDsEndpoint: getProductsByIDsEndpoint,
+		CreateProductEndpoint:    createProductEndpoint,
+		UploadEndpoint:           uploadEndpoint,
 	}
 }
 
@@ -85,6 +95,16 @@ func (s Set) CreateProduct(ctx context.Context, req model.CreateProductRequest)
 	return response, response.Err
 }
 
+// GetProductsByIDs implements the service interface, so Set may be used as a service.
+func (s Set) GetProductsByIDs(ctx context.Context, req model.GetProductsByIDsRequest) (model.GetProductsByIDsResponse, error) {
+	resp, err := s.GetProductsByIDsEndpoint(ctx, req)
+	if err != nil {
+		return model.GetProductsByIDsResponse{}, err
+	}
+	response := resp.(model.GetProductsByIDsResponse)
+	return response, response.Err
+}
+
 // Upload implements the service interface, so Set may be used as a service.
 func (s Set) Upload(ctx context.Context, req model.UploadProductRequest) (model.UploadProductResponse, error) {
 	resp, err := s.UploadEndpoint(ctx, req)
@@ -113,6 +133,15 @@ func MakeCreateProductEndpoint(s service.Service) endpoint.Endpoint {
 	}
 }
 
+// MakeGetProductsByIDsEndpoint ...
+func MakeGetProductsByIDsEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(model.GetProductsByIDsRequest)
+		v, err := s.GetProductsByIDs(ctx, req)
+		return v, err
+	}
+}
+
 // MakeUploadEndpoint ...
 func MakeUploadEndpoint(s service.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
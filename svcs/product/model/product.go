@@ -41,6 +41,21 @@ type CreateProductResponse struct {
 	Err error  `json:"-"`
 }
 
+// GetProductsByIDsRequest looks up products by ID.
+type GetProductsByIDsRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// GetProductsByIDsResponse holds the products found, IDs matching no
+// product are left out.
+type GetProductsByIDsResponse struct {
+	Products []Product `json:"products"`
+	Err      error     `json:"-"`
+}
+
+// Failed implements Failer.
+func (r GetProductsByIDsResponse) Failed() error { return r.Err }
+
 // UploadProductRequest struct
 type UploadProductRequest struct {
 	Body []byte
@@ -5,6 +5,7 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
 	"github.com/laidingqing/dabanshan-go/svcs/product/model"
 )
 
@@ -24,45 +25,55 @@ type loggingMiddleware struct {
 
 func (mw loggingMiddleware) GetProducts(ctx context.Context, a, b int64) (v int64, err error) {
 	defer func() {
-		mw.logger.Log("method", "GetProducts", "err", err)
+		logging.With(ctx, mw.logger).Log("method", "GetProducts", "err", err)
 	}()
 	return mw.next.GetProducts(ctx, a, b)
 }
 
 func (mw loggingMiddleware) CreateProduct(ctx context.Context, req model.CreateProductRequest) (res model.CreateProductResponse, err error) {
 	defer func() {
-		mw.logger.Log("method", "CreateProduct", "err", err)
+		logging.With(ctx, mw.logger).Log("method", "CreateProduct", "err", err)
 	}()
 	return mw.next.CreateProduct(ctx, req)
 }
 
+func (mw loggingMiddleware) GetProductsByIDs(ctx context.Context, req model.GetProductsByIDsRequest) (res model.GetProductsByIDsResponse, err error) {
+	defer func() {
+		logging.With(ctx, mw.logger).Log("method", "GetProductsByIDs", "ids", len(req.IDs), "found", len(res.Products), "err", err)
+	}()
+	return mw.next.GetProductsByIDs(ctx, req)
+}
+
 func (mw loggingMiddleware) Upload(ctx context.Context, req model.UploadProductRequest) (res model.UploadProductResponse, err error) {
 	defer func() {
-		mw.logger.Log("method", "Upload", "err", err)
+		logging.With(ctx, mw.logger).Log("method", "Upload", "err", err)
 	}()
 	return mw.next.Upload(ctx, req)
 }
 
-// InstrumentingMiddleware ..
-func InstrumentingMiddleware(ints, chars metrics.Counter) Middleware {
+// Metrics are the business metrics of the product service.
+type Metrics struct {
+	// UploadBytes counts the bytes of the images uploaded.
+	UploadBytes metrics.Counter
+}
+
+// InstrumentingMiddleware counts the bytes uploaded with m.
+func InstrumentingMiddleware(m Metrics) Middleware {
 	return func(next Service) Service {
 		return instrumentingMiddleware{
-			ints:  ints,
-			chars: chars,
-			next:  next,
+			metrics: m,
+			next:    next,
 		}
 	}
 }
 
 type instrumentingMiddleware struct {
-	ints  metrics.Counter
-	chars metrics.Counter
-	next  Service
+	metrics Metrics
+	next    Service
 }
 
 func (mw instrumentingMiddleware) GetProducts(ctx context.Context, a, b int64) (int64, error) {
 	v, err := mw.next.GetProducts(ctx, a, b)
-	// mw.ints.Add(float64(v))
 	return v, err
 }
 
@@ -71,7 +82,15 @@ func (mw instrumentingMiddleware) CreateProduct(ctx context.Context, req model.C
 	return v, err
 }
 
+func (mw instrumentingMiddleware) GetProductsByIDs(ctx context.Context, req model.GetProductsByIDsRequest) (model.GetProductsByIDsResponse, error) {
+	v, err := mw.next.GetProductsByIDs(ctx, req)
+	return v, err
+}
+
 func (mw instrumentingMiddleware) Upload(ctx context.Context, req model.UploadProductRequest) (model.UploadProductResponse, error) {
 	v, err := mw.next.Upload(ctx, req)
+	if err == nil {
+		mw.metrics.UploadBytes.Add(float64(len(req.Body)))
+	}
 	return v, err
 }
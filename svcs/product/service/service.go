@@ -2,12 +2,11 @@ package service
 
 import (
 	"context"
-	"errors"
 	"sync"
 
 	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/metrics"
 	"github.com/laidingqing/dabanshan-go/pb"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
 	"github.com/laidingqing/dabanshan-go/svcs/product/db"
 	"github.com/laidingqing/dabanshan-go/svcs/product/model"
 )
@@ -26,27 +25,28 @@ func init() {
 type Service interface {
 	CreateProduct(ctx context.Context, req model.CreateProductRequest) (model.CreateProductResponse, error)
 	GetProducts(ctx context.Context, a, b int64) (int64, error)
+	GetProductsByIDs(ctx context.Context, req model.GetProductsByIDsRequest) (model.GetProductsByIDsResponse, error)
 	Upload(ctx context.Context, req model.UploadProductRequest) (model.UploadProductResponse, error)
 }
 
 // New returns a basic Service with all of the expected middlewares wired in.
-func New(logger log.Logger, ints, chars metrics.Counter) Service {
+func New(logger log.Logger, metrics Metrics) Service {
 	var svc Service
 	{
 		svc = NewBasicService()
 		svc = LoggingMiddleware(logger)(svc)
-		svc = InstrumentingMiddleware(ints, chars)(svc)
+		svc = InstrumentingMiddleware(metrics)(svc)
 	}
 	return svc
 }
 
 var (
 	// ErrTwoZeroes ..
-	ErrTwoZeroes = errors.New("can't sum two zeroes")
+	ErrTwoZeroes = errs.New(errs.InvalidArgument, "can't sum two zeroes")
 	// ErrIntOverflow ...
-	ErrIntOverflow = errors.New("integer overflow")
+	ErrIntOverflow = errs.New(errs.InvalidArgument, "integer overflow")
 	// ErrMaxSizeExceeded ...
-	ErrMaxSizeExceeded = errors.New("result exceeds maximum size")
+	ErrMaxSizeExceeded = errs.New(errs.InvalidArgument, "result exceeds maximum size")
 )
 
 const (
@@ -74,16 +74,25 @@ func (s basicService) GetProducts(_ context.Context, a, b int64) (int64, error)
 
 // create product
 func (s basicService) CreateProduct(ctx context.Context, req model.CreateProductRequest) (model.CreateProductResponse, error) {
-	id, err := db.CreateProduct(&req.Product)
+	id, err := db.CreateProduct(ctx, &req.Product)
 	if err != nil {
 		return model.CreateProductResponse{ID: "", Err: err}, err
 	}
 	return model.CreateProductResponse{ID: id, Err: nil}, err
 }
 
+// GetProductsByIDs looks up products in one batch.
+func (s basicService) GetProductsByIDs(ctx context.Context, req model.GetProductsByIDsRequest) (model.GetProductsByIDsResponse, error) {
+	products, err := db.GetProductsByIDs(ctx, req.IDs)
+	if err != nil {
+		return model.GetProductsByIDsResponse{Err: err}, err
+	}
+	return model.GetProductsByIDsResponse{Products: products}, nil
+}
+
 // Upload implement upload file to fs.
 func (s basicService) Upload(ctx context.Context, req model.UploadProductRequest) (model.UploadProductResponse, error) {
-	id, err := db.UploadGfs(req.Body, req.Md5, req.Name)
+	id, err := db.UploadGfs(ctx, req.Body, req.Md5, req.Name)
 	if err != nil {
 		return model.UploadProductResponse{Err: err}, err
 	}
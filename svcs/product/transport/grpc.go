@@ -12,6 +12,8 @@ import (
 	"github.com/go-kit/kit/tracing/opentracing"
 	grpctransport "github.com/go-kit/kit/transport/grpc"
 	"github.com/laidingqing/dabanshan-go/pb"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
 	p_endpoint "github.com/laidingqing/dabanshan-go/svcs/product/endpoint"
 	"github.com/laidingqing/dabanshan-go/svcs/product/service"
 	stdopentracing "github.com/opentracing/opentracing-go"
@@ -22,6 +24,7 @@ import (
 type grpcServer struct {
 	createProduct grpctransport.Handler
 	getproducts   grpctransport.Handler
+	getbyids      grpctransport.Handler
 	upload        grpctransport.Handler
 }
 
@@ -29,6 +32,7 @@ type grpcServer struct {
 func NewGRPCServer(endpoints p_endpoint.Set, tracer stdopentracing.Tracer, logger log.Logger) pb.ProductRpcServiceServer {
 	options := []grpctransport.ServerOption{
 		grpctransport.ServerErrorLogger(logger),
+		grpctransport.ServerBefore(logging.GRPCToContext),
 	}
 	return &grpcServer{
 		createProduct: grpctransport.NewServer(
@@ -43,6 +47,12 @@ func NewGRPCServer(endpoints p_endpoint.Set, tracer stdopentracing.Tracer, logge
 			encodeGRPCGetProductsResponse,
 			append(options, grpctransport.ServerBefore(opentracing.GRPCToContext(tracer, "GetProducts", logger)))...,
 		),
+		getbyids: grpctransport.NewServer(
+			endpoints.GetProductsByIDsEndpoint,
+			decodeGRPCGetProductsByIDsRequest,
+			encodeGRPCGetProductsByIDsResponse,
+			append(options, grpctransport.ServerBefore(opentracing.GRPCToContext(tracer, "GetProductsByIDs", logger)))...,
+		),
 		upload: grpctransport.NewServer(
 			endpoints.UploadEndpoint,
 			decodeGRPCUploadRequest,
@@ -62,6 +72,16 @@ func (s *grpcServer) GetProducts(ctx oldcontext.Context, req *pb.GetProductsRequ
 	return res, nil
 }
 
+// get products by ids
+func (s *grpcServer) GetProductsByIDs(ctx oldcontext.Context, req *pb.GetProductsByIDsRequest) (*pb.GetProductsByIDsResponse, error) {
+	_, rep, err := s.getbyids.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	res := rep.(*pb.GetProductsByIDsResponse)
+	return res, nil
+}
+
 // create product
 func (s *grpcServer) CreateProduct(ctx oldcontext.Context, req *pb.CreateProductRequest) (*pb.CreateProductResponse, error) {
 	fmt.Println("create name fmt")
@@ -87,6 +107,7 @@ func (s *grpcServer) Upload(ctx oldcontext.Context, req *pb.ProductUploadRequest
 func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger log.Logger) service.Service {
 	//	limiter := ratelimit.NewTokenBucketLimiter(jujuratelimit.NewBucketWithRate(100, 100))
 	var getProductsEndpoint endpoint.Endpoint
+	var getProductsByIDsEndpoint endpoint.Endpoint
 	var createProductEndpoint endpoint.Endpoint
 	var uploadEndpoint endpoint.Endpoint
 	{
@@ -97,8 +118,9 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 			encodeGRPCCreateProductRequest,
 			decodeGRPCCreateProductResponse,
 			pb.CreateProductResponse{},
-			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger)),
+			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger), logging.ContextToGRPC),
 		).Endpoint()
+		createProductEndpoint = errs.ClientMiddleware(createProductEndpoint)
 		createProductEndpoint = opentracing.TraceClient(tracer, "CreateProduct")(createProductEndpoint)
 		//	createProductEndpoint = limiter(createProductEndpoint)
 		createProductEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
@@ -114,8 +136,9 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 			encodeGRPCGetProductsRequest,
 			decodeGRPCGetProductsResponse,
 			pb.GetProductsResponse{},
-			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger)),
+			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger), logging.ContextToGRPC),
 		).Endpoint()
+		getProductsEndpoint = errs.ClientMiddleware(getProductsEndpoint)
 		getProductsEndpoint = opentracing.TraceClient(tracer, "GetProducts")(getProductsEndpoint)
 		//	getProductsEndpoint = limiter(getProductsEndpoint)
 		getProductsEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
@@ -123,6 +146,23 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 			Timeout: 30 * time.Second,
 		}))(getProductsEndpoint)
 	}
+	{
+		getProductsByIDsEndpoint = grpctransport.NewClient(
+			conn,
+			"pb.ProductRpcService",
+			"GetProductsByIDs",
+			encodeGRPCGetProductsByIDsRequest,
+			decodeGRPCGetProductsByIDsResponse,
+			pb.GetProductsByIDsResponse{},
+			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger), logging.ContextToGRPC),
+		).Endpoint()
+		getProductsByIDsEndpoint = errs.ClientMiddleware(getProductsByIDsEndpoint)
+		getProductsByIDsEndpoint = opentracing.TraceClient(tracer, "GetProductsByIDs")(getProductsByIDsEndpoint)
+		getProductsByIDsEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:    "GetProductsByIDs",
+			Timeout: 30 * time.Second,
+		}))(getProductsByIDsEndpoint)
+	}
 	{
 		uploadEndpoint = grpctransport.NewClient(
 			conn,
@@ -131,8 +171,9 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 			encodeGRPCUploadRequest,
 			decodeGRPCUploadResponse,
 			pb.ProductUploadResponse{},
-			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger)),
+			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger), logging.ContextToGRPC),
 		).Endpoint()
+		uploadEndpoint = errs.ClientMiddleware(uploadEndpoint)
 		uploadEndpoint = opentracing.TraceClient(tracer, "Upload")(uploadEndpoint)
 		//	uploadEndpoint = limiter(uploadEndpoint)
 		uploadEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
@@ -141,8 +182,9 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 		}))(uploadEndpoint)
 	}
 	return p_endpoint.Set{
-		CreateProductEndpoint: createProductEndpoint,
-		GetProductsEndpoint:   getProductsEndpoint,
-		UploadEndpoint:        uploadEndpoint,
+		CreateProductEndpoint:    createProductEndpoint,
+		GetProductsEndpoint:      getProductsEndpoint,
+		GetProductsByIDsEndpoint: getProductsByIDsEndpoint,
+		UploadEndpoint:           uploadEndpoint,
 	}
 }
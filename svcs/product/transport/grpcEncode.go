@@ -2,12 +2,10 @@ package transport
 
 import (
 	"context"
-	"errors"
-	"fmt"
 
 	"github.com/laidingqing/dabanshan-go/pb"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
 	"github.com/laidingqing/dabanshan-go/svcs/product/model"
-	"github.com/laidingqing/dabanshan-go/utils"
 )
 
 // server
@@ -20,7 +18,21 @@ func decodeGRPCGetProductsRequest(_ context.Context, grpcReq interface{}) (inter
 
 func encodeGRPCGetProductsResponse(_ context.Context, response interface{}) (interface{}, error) {
 	resp := response.(model.GetProductsResponse)
-	return &pb.GetProductsResponse{V: int64(resp.V), Err: err2str(resp.Err)}, nil
+	return &pb.GetProductsResponse{V: int64(resp.V), Err: errs.Encode(resp.Err)}, nil
+}
+
+// get products by ids encode/decode
+func decodeGRPCGetProductsByIDsRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.GetProductsByIDsRequest)
+	return model.GetProductsByIDsRequest{IDs: req.Ids}, nil
+}
+
+func encodeGRPCGetProductsByIDsResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(model.GetProductsByIDsResponse)
+	return &pb.GetProductsByIDsResponse{
+		Products: modelProducts2Pb(resp.Products),
+		Err:      errs.Encode(resp.Err),
+	}, nil
 }
 
 // Upload ...
@@ -41,15 +53,13 @@ func encodeGRPCUploadResponse(_ context.Context, response interface{}) (interfac
 // create products encode/decode
 func decodeGRPCCreateProductRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
 	req := grpcReq.(*pb.CreateProductRequest)
-	logger := utils.NewLogger()
-	logger.Log("create name", req.Name)
-	fmt.Println("create name fmt", req.Name)
 	return model.CreateProductRequest{
 		Product: model.Product{
 			Name:        req.Name,
 			Description: req.Description,
 			Price:       req.Price,
 			UserID:      req.UserID,
+			TenantID:    req.Tenantid,
 			CatalogID:   req.CatalogID,
 			Status:      req.Status,
 			Thumbnails:  req.Thumbnails,
@@ -60,7 +70,7 @@ func encodeGRPCCreateProductResponse(_ context.Context, response interface{}) (i
 	resp := response.(model.CreateProductResponse)
 	return &pb.CreateProductResponse{
 		Id:  resp.ID,
-		Err: err2str(resp.Err),
+		Err: errs.Encode(resp.Err),
 	}, nil
 }
 
@@ -74,6 +84,7 @@ func encodeGRPCCreateProductRequest(_ context.Context, request interface{}) (int
 		Description: req.Product.Description,
 		Price:       req.Product.Price,
 		UserID:      req.Product.UserID,
+		Tenantid:    req.Product.TenantID,
 		CatalogID:   req.Product.CatalogID,
 		Status:      req.Product.Status,
 		Thumbnails:  req.Product.Thumbnails,
@@ -84,7 +95,7 @@ func decodeGRPCCreateProductResponse(_ context.Context, grpcReply interface{}) (
 	reply := grpcReply.(*pb.CreateProductResponse)
 	return model.CreateProductResponse{
 		ID:  reply.Id,
-		Err: str2err(reply.Err)}, nil
+		Err: errs.Decode(reply.Err)}, nil
 }
 
 // get products encode/decode
@@ -95,7 +106,21 @@ func encodeGRPCGetProductsRequest(_ context.Context, request interface{}) (inter
 
 func decodeGRPCGetProductsResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
 	reply := grpcReply.(*pb.GetProductsResponse)
-	return model.GetProductsResponse{V: int64(reply.V), Err: str2err(reply.Err)}, nil
+	return model.GetProductsResponse{V: int64(reply.V), Err: errs.Decode(reply.Err)}, nil
+}
+
+// get products by ids encode/decode
+func encodeGRPCGetProductsByIDsRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(model.GetProductsByIDsRequest)
+	return &pb.GetProductsByIDsRequest{Ids: req.IDs}, nil
+}
+
+func decodeGRPCGetProductsByIDsResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*pb.GetProductsByIDsResponse)
+	return model.GetProductsByIDsResponse{
+		Products: pbProducts2Model(reply.Products),
+		Err:      errs.Decode(reply.Err),
+	}, nil
 }
 
 // upload
@@ -113,16 +138,38 @@ func decodeGRPCUploadResponse(_ context.Context, grpcReply interface{}) (interfa
 	return model.UploadProductResponse{ID: reply.Name}, nil
 }
 
-func str2err(s string) error {
-	if s == "" {
-		return nil
+func modelProducts2Pb(models []model.Product) []*pb.ProductRecord {
+	var records []*pb.ProductRecord
+	for _, m := range models {
+		records = append(records, &pb.ProductRecord{
+			Id:          m.ID,
+			Creator:     m.UserID,
+			Name:        m.Name,
+			Description: m.Description,
+			Pricetext:   m.Price,
+			Status:      pb.ProductStatus(m.Status),
+			Tenantid:    m.TenantID,
+			Catalogid:   m.CatalogID,
+			Thumbnails:  m.Thumbnails,
+		})
 	}
-	return errors.New(s)
+	return records
 }
 
-func err2str(err error) string {
-	if err == nil {
-		return ""
+func pbProducts2Model(records []*pb.ProductRecord) []model.Product {
+	var models []model.Product
+	for _, r := range records {
+		models = append(models, model.Product{
+			ID:          r.Id,
+			UserID:      r.Creator,
+			Name:        r.Name,
+			Description: r.Description,
+			Price:       r.Pricetext,
+			Status:      int32(r.Status),
+			TenantID:    r.Tenantid,
+			CatalogID:   r.Catalogid,
+			Thumbnails:  r.Thumbnails,
+		})
 	}
-	return err.Error()
+	return models
 }
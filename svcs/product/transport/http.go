@@ -11,6 +11,9 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/tracing/opentracing"
 	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+	"github.com/laidingqing/dabanshan-go/svcs/httprule"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
 	p_endpoint "github.com/laidingqing/dabanshan-go/svcs/product/endpoint"
 	// "github.com/laidingqing/dabanshan-go/svcs/product/service"
 )
@@ -21,29 +24,17 @@ var (
 )
 
 // NewHTTPHandler returns an HTTP handler that makes a set of endpoints
-// available on predefined paths.
+// available on the paths of the google.api.http options of
+// pb/product.proto, and uploads.
 func NewHTTPHandler(endpoints p_endpoint.Set, tracer stdopentracing.Tracer, logger log.Logger) http.Handler {
 	options := []httptransport.ServerOption{
-		httptransport.ServerErrorEncoder(errorEncoder),
+		httptransport.ServerErrorEncoder(errs.EncodeHTTP),
 		httptransport.ServerErrorLogger(logger),
+		httptransport.ServerBefore(logging.HTTPToContext),
 	}
 	// m := http.NewServeMux()
 	r := mux.NewRouter()
 
-	createProductHandle := httptransport.NewServer(
-		endpoints.CreateProductEndpoint,
-		decodeHTTPCreateProductRequest,
-		encodeHTTPGenericResponse,
-		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "CreateProduct", logger)))...,
-	)
-
-	listProductHandle := httptransport.NewServer(
-		endpoints.GetProductsEndpoint,
-		decodeHTTPGetProductRequest,
-		encodeHTTPGenericResponse,
-		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GetProducts", logger)))...,
-	)
-
 	uploadHandle := httptransport.NewServer(
 		endpoints.UploadEndpoint,
 		decodeHTTPUploadRequest,
@@ -51,15 +42,24 @@ func NewHTTPHandler(endpoints p_endpoint.Set, tracer stdopentracing.Tracer, logg
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "Upload", logger)))...,
 	)
 
-	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		logger.Log("params", r.FormValue("user"))
-		w.WriteHeader(http.StatusOK)
-	})
-	r.Handle("/api/v1/products/", listProductHandle).Methods("GET")          //获取所有商品，包含按条件分页:catalogID=?
-	r.Handle("/api/v1/products/{id}", nil).Methods("GET")                    //根据ID获取指定商品
-	r.Handle("/api/v1/products/{id}", nil).Methods("DELETE")                 //下架指定商品
-	r.Handle("/api/v1/products/{id}", nil).Methods("PUT")                    //修改指定商品
-	r.Handle("/api/v1/products/create", createProductHandle).Methods("POST") //新增商品
-	r.Handle("/api/v1/products/upload", uploadHandle).Methods("POST")        //上传图像
+	//r.Handle("/api/v1/products/{id}", nil).Methods("GET")                  //根据ID获取指定商品
+	//r.Handle("/api/v1/products/{id}", nil).Methods("DELETE")               //下架指定商品
+	//r.Handle("/api/v1/products/{id}", nil).Methods("PUT")                  //修改指定商品
+	r.Handle("/api/v1/products/upload", uploadHandle).Methods("POST") //上传图像
+	err := httprule.Register(r, "product.proto", "pb.ProductRpcService", map[string]httprule.Binding{
+		// 获取所有商品，包含按条件分页:catalogID=?
+		"GetProducts": {
+			Endpoint: endpoints.GetProductsEndpoint,
+			Decode:   decodeGRPCGetProductsRequest,
+		},
+		// 新增商品
+		"CreateProduct": {
+			Endpoint: endpoints.CreateProductEndpoint,
+			Decode:   decodeGRPCCreateProductRequest,
+		},
+	}, httprule.Options{ErrorEncoder: errs.EncodeHTTP, Tracer: tracer, Logger: logger})
+	if err != nil {
+		panic(err)
+	}
 	return r
 }
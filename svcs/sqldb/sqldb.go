@@ -0,0 +1,257 @@
+// Package sqldb opens the SQL databases of the backends of the services,
+// PostgreSQL for production and SQLite for local runs, migrates their schema
+// and bounds their operations by -sql.timeout.
+//
+// The backends write one schema for both: PostgreSQL SQL with $n
+// placeholders, which SQLite takes as well. Ids are 24 hex characters, like
+// the ObjectIds of the Mongo backends, so the services see the same ids
+// whatever the database.
+package sqldb
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	// database/sql drivers of the dialects
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Dialect is the SQL database a backend runs on.
+type Dialect string
+
+const (
+	// Postgres is PostgreSQL, connected to with -postgres.dsn.
+	Postgres Dialect = "postgres"
+	// SQLite is a SQLite file, -sqlite.path, for local runs.
+	SQLite Dialect = "sqlite"
+)
+
+// Options are the settings of the connection pool and the timeouts of the
+// operations.
+type Options struct {
+	// Timeout bounds connecting and each operation, whatever the deadline
+	// of its request.
+	Timeout time.Duration
+	// MaxOpenConns is the most connections open to the database.
+	MaxOpenConns int
+}
+
+// DefaultOptions are the defaults of the flags of RegisterFlags.
+var DefaultOptions = Options{
+	Timeout:      5 * time.Second,
+	MaxOpenConns: 20,
+}
+
+var (
+	// flags are the Options set by the flags of RegisterFlags.
+	flags       = DefaultOptions
+	postgresDSN = "postgres://127.0.0.1:5432/dabanshan?sslmode=disable"
+	sqlitePath  = "dabanshan.db"
+)
+
+// RegisterFlags defines the flags of the connections on fs.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&postgresDSN, "postgres.dsn", postgresDSN, "PostgreSQL connection string, with the credentials and TLS options")
+	fs.StringVar(&sqlitePath, "sqlite.path", sqlitePath, "SQLite database file")
+	fs.DurationVar(&flags.Timeout, "sql.timeout", flags.Timeout, "Time allowed to connect and to each SQL operation, within the deadline of its request")
+	fs.IntVar(&flags.MaxOpenConns, "sql.max-open-conns", flags.MaxOpenConns, "Most connections open to the SQL database")
+}
+
+// Validate reports the first invalid setting of the flags of RegisterFlags.
+func Validate() error {
+	switch {
+	case flags.Timeout <= 0:
+		return fmt.Errorf("-sql.timeout %v is not positive", flags.Timeout)
+	case flags.MaxOpenConns <= 0:
+		return fmt.Errorf("-sql.max-open-conns %d is not positive", flags.MaxOpenConns)
+	}
+	return nil
+}
+
+// ErrNotConnected is returned by the backends before they connect.
+var ErrNotConnected = errors.New("sqldb: not connected")
+
+// DB is an open database.
+type DB struct {
+	*sql.DB
+	Dialect Dialect
+	opts    Options
+}
+
+// Open opens the database of d named by the flags, -postgres.dsn or
+// -sqlite.path, waiting for it to answer within -sql.timeout.
+func Open(ctx context.Context, d Dialect) (*DB, error) {
+	switch d {
+	case Postgres:
+		return OpenDSN(ctx, d, postgresDSN)
+	case SQLite:
+		return OpenDSN(ctx, d, SQLiteDSN(sqlitePath))
+	}
+	return nil, fmt.Errorf("sqldb: unknown dialect %q", d)
+}
+
+// SQLiteDSN is the data source name of the SQLite file at path, with foreign
+// keys on, concurrent readers and writers waiting for each other rather than
+// failing, and transactions taking the write lock as they begin.
+func SQLiteDSN(path string) string {
+	return "file:" + path + "?" + url.Values{
+		"_pragma": {"foreign_keys(1)", "busy_timeout(5000)", "journal_mode(WAL)"},
+		"_txlock": {"immediate"},
+	}.Encode()
+}
+
+// OpenDSN opens the database of d at dsn, a data source name of its driver.
+func OpenDSN(ctx context.Context, d Dialect, dsn string) (*DB, error) {
+	driver := map[Dialect]string{Postgres: "pgx", SQLite: "sqlite"}[d]
+	if driver == "" {
+		return nil, fmt.Errorf("sqldb: unknown dialect %q", d)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(flags.MaxOpenConns)
+	db.SetMaxIdleConns(flags.MaxOpenConns)
+	ctx, cancel := context.WithTimeout(ctx, flags.Timeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DB{DB: db, Dialect: d, opts: flags}, nil
+}
+
+// Context returns ctx bounded by -sql.timeout, for one operation.
+func (db *DB) Context(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, db.opts.Timeout)
+}
+
+// Ping checks that the database answers.
+func (db *DB) Ping(ctx context.Context) error {
+	ctx, cancel := db.Context(ctx)
+	defer cancel()
+	return db.PingContext(ctx)
+}
+
+// Tx runs fn in a transaction, committed if fn succeeds and rolled back
+// otherwise.
+func (db *DB) Tx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Time is the argument of a query for t. SQLite stores times as text, which
+// it compares as such: they are written in UTC, to the microsecond like
+// PostgreSQL, in a format of fixed width.
+func (db *DB) Time(t time.Time) interface{} {
+	if db.Dialect == SQLite {
+		return t.UTC().Format("2006-01-02 15:04:05.000000")
+	}
+	return t
+}
+
+// Migrate brings the tables of a service up to date, running the migrations
+// it has not run yet in a single transaction. migrations are SQL scripts in
+// the order they were written, their statements ending with a semicolon at
+// the end of a line: a migration is never changed once released, new ones
+// are appended.
+func (db *DB) Migrate(ctx context.Context, service string, migrations []string) error {
+	ctx, cancel := db.Context(ctx)
+	defer cancel()
+	_, err := db.ExecContext(ctx, db.ddl(`CREATE TABLE IF NOT EXISTS schema_migrations (
+	service    TEXT NOT NULL,
+	version    INTEGER NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (service, version)
+)`))
+	if err != nil {
+		return err
+	}
+	return db.Tx(ctx, func(tx *sql.Tx) error {
+		if db.Dialect == Postgres {
+			// instances starting together migrate one after the other
+			if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('schema_migrations'))`); err != nil {
+				return err
+			}
+		}
+		var version int
+		err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations WHERE service = $1`, service).Scan(&version)
+		if err != nil {
+			return err
+		}
+		for v := version + 1; v <= len(migrations); v++ {
+			for _, stmt := range strings.Split(db.ddl(migrations[v-1]), ";\n") {
+				if _, err := tx.ExecContext(ctx, stmt); err != nil {
+					return fmt.Errorf("sqldb: migration %d of %s: %v", v, service, err)
+				}
+			}
+			_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (service, version, applied_at) VALUES ($1, $2, $3)`, service, v, db.Time(time.Now()))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ddl translates the types of PostgreSQL a SQLite driver would not read back
+// as times.
+func (db *DB) ddl(script string) string {
+	if db.Dialect == SQLite {
+		return strings.Replace(script, "TIMESTAMPTZ", "TIMESTAMP", -1)
+	}
+	return script
+}
+
+// IsUniqueViolation reports whether err is a statement failing a unique
+// constraint, in either dialect.
+func IsUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "23505"
+	}
+	var liteErr *sqlite.Error
+	if errors.As(err, &liteErr) {
+		return liteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+	}
+	return false
+}
+
+// NewID returns a new random id, 24 hex characters.
+func NewID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ID returns id as stored, lower case, reporting whether it is in the format
+// of NewID.
+func ID(id string) (string, bool) {
+	if len(id) != 24 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", false
+	}
+	return strings.ToLower(id), true
+}
@@ -0,0 +1,34 @@
+package tracing
+
+import (
+	"context"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// DBSpan starts the span of the operation op on the database db, a child of
+// the span of ctx if there is one, and returns the function finishing it
+// with the error of the operation:
+//
+//	func GetOrder(ctx context.Context, id string) (order m_order.Invoice, err error) {
+//		defer tracing.DBSpan(ctx, database, "GetOrder")(&err)
+//		...
+func DBSpan(ctx context.Context, db, op string) func(*error) {
+	name := db + "." + op
+	var span stdopentracing.Span
+	if parent := stdopentracing.SpanFromContext(ctx); parent != nil {
+		span = parent.Tracer().StartSpan(name, stdopentracing.ChildOf(parent.Context()))
+	} else {
+		span = stdopentracing.GlobalTracer().StartSpan(name)
+	}
+	ext.SpanKindRPCClient.Set(span)
+	ext.DBType.Set(span, db)
+	return func(err *error) {
+		if err != nil && *err != nil {
+			ext.Error.Set(span, true)
+			span.LogKV("event", "error", "message", (*err).Error())
+		}
+		span.Finish()
+	}
+}
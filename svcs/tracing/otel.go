@@ -0,0 +1,88 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel"
+	otbridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// shutdownTimeout bounds the flush of the spans left when a tracer is
+// closed.
+const shutdownTimeout = 5 * time.Second
+
+// newOTLPTracer returns an OpenTelemetry tracer exporting to an OTLP
+// collector over gRPC, bridged to OpenTracing.
+func newOTLPTracer(service, hostPort, endpoint string, insecure bool) (stdopentracing.Tracer, io.Closer, error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	// The client connects lazily, a collector not up yet is not an error.
+	exporter, err := otlptracegrpc.New(context.Background(), opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newBridgeTracer(service, hostPort, exporter, nil)
+}
+
+// newFileTracer returns an OpenTelemetry tracer writing spans to file as
+// JSON lines, or to stdout for "-", for debugging without a collector.
+func newFileTracer(service, hostPort, file string) (stdopentracing.Tracer, io.Closer, error) {
+	var w io.WriteCloser = os.Stdout
+	if file != "-" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		w = f
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		return nil, nil, err
+	}
+	if w == os.Stdout {
+		w = nil
+	}
+	return newBridgeTracer(service, hostPort, exporter, w)
+}
+
+// newBridgeTracer returns an OpenTracing tracer recording spans with an
+// OpenTelemetry provider batching them to exporter, propagating W3C trace
+// context. Closing it flushes the provider, then closes w if not nil.
+func newBridgeTracer(service, hostPort string, exporter sdktrace.SpanExporter, w io.Closer) (stdopentracing.Tracer, io.Closer, error) {
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(service),
+		semconv.ServiceInstanceID(hostPort),
+	)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	propagator := propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	tracer, wrapper := otbridge.NewTracerPair(provider.Tracer("github.com/laidingqing/dabanshan-go"))
+	tracer.SetTextMapPropagator(propagator)
+	otel.SetTracerProvider(wrapper)
+	otel.SetTextMapPropagator(propagator)
+	return tracer, closerFunc(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := provider.Shutdown(ctx)
+		if w != nil {
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}), nil
+}
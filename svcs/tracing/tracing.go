@@ -0,0 +1,121 @@
+// Package tracing sets up the OpenTracing tracer of a binary, selected by
+// command line flags, so that the gateway and the services report the
+// spans of a request to the same backend and link them across the gRPC
+// hops, down to the calls the services make to their database.
+package tracing
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/go-kit/kit/log"
+	lightstep "github.com/lightstep/lightstep-tracer-go"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	zipkin "github.com/openzipkin/zipkin-go-opentracing"
+	"sourcegraph.com/sourcegraph/appdash"
+	appdashot "sourcegraph.com/sourcegraph/appdash/opentracing"
+)
+
+// Flags are the command line flags selecting and configuring the tracer.
+type Flags struct {
+	kind           *string
+	zipkinURL      *string
+	otlpEndpoint   *string
+	otlpInsecure   *bool
+	lightstepToken *string
+	appdashAddr    *string
+	file           *string
+}
+
+// RegisterFlags defines the tracing flags on fs.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	return &Flags{
+		kind:           fs.String("tracer", "zipkin", "Tracer: zipkin, otlp, lightstep, appdash, file or none"),
+		zipkinURL:      fs.String("zipkin-url", "http://localhost:9411/api/v1/spans", "Zipkin collector URL, with -tracer=zipkin"),
+		otlpEndpoint:   fs.String("otlp.endpoint", "localhost:4317", "OTLP gRPC collector host:port, with -tracer=otlp"),
+		otlpInsecure:   fs.Bool("otlp.insecure", true, "Send to the OTLP collector without TLS"),
+		lightstepToken: fs.String("lightstep-token", "", "LightStep access token, with -tracer=lightstep"),
+		appdashAddr:    fs.String("appdash-addr", "localhost:7701", "Appdash server host:port, with -tracer=appdash"),
+		file:           fs.String("trace.file", "-", "File spans are written to as JSON lines, - for stdout, with -tracer=file"),
+	}
+}
+
+// New returns the tracer selected by the flags, recording the spans of
+// service, listening on addr, and a Closer flushing the spans not yet sent.
+// The tracer is also made the global tracer, for spans started without a
+// parent.
+func (f *Flags) New(service, addr string, logger log.Logger) (stdopentracing.Tracer, io.Closer, error) {
+	tracer, closer, err := f.new(service, HostPort(addr), logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	stdopentracing.SetGlobalTracer(tracer)
+	return tracer, closer, nil
+}
+
+func (f *Flags) new(service, hostPort string, logger log.Logger) (stdopentracing.Tracer, io.Closer, error) {
+	switch *f.kind {
+	case "zipkin":
+		logger.Log("tracer", "Zipkin", "URL", *f.zipkinURL)
+		collector, err := zipkin.NewHTTPCollector(*f.zipkinURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		tracer, err := zipkin.NewTracer(zipkin.NewRecorder(collector, false, hostPort, service))
+		if err != nil {
+			collector.Close()
+			return nil, nil, err
+		}
+		return tracer, collector, nil
+	case "otlp":
+		logger.Log("tracer", "OTLP", "endpoint", *f.otlpEndpoint)
+		return newOTLPTracer(service, hostPort, *f.otlpEndpoint, *f.otlpInsecure)
+	case "file":
+		logger.Log("tracer", "file", "file", *f.file)
+		return newFileTracer(service, hostPort, *f.file)
+	case "lightstep":
+		logger.Log("tracer", "LightStep") // probably don't want to print out the token :)
+		tracer := lightstep.NewTracer(lightstep.Options{
+			AccessToken: *f.lightstepToken,
+		})
+		return tracer, closerFunc(func() error {
+			lightstep.FlushLightStepTracer(tracer)
+			return nil
+		}), nil
+	case "appdash":
+		logger.Log("tracer", "Appdash", "addr", *f.appdashAddr)
+		return appdashot.NewTracer(appdash.NewRemoteCollector(*f.appdashAddr)), closerFunc(nil), nil
+	case "none", "":
+		logger.Log("tracer", "none")
+		return stdopentracing.NoopTracer{}, closerFunc(nil), nil
+	}
+	return nil, nil, fmt.Errorf("tracing: unknown tracer %q", *f.kind)
+}
+
+// HostPort returns the address spans are reported from for a listen
+// address, with the host name of the machine when addr has no host, as in
+// ":8072".
+func HostPort(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		if host, err = os.Hostname(); err != nil {
+			host = "localhost"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	if f == nil {
+		return nil
+	}
+	return f()
+}
@@ -0,0 +1,104 @@
+// Package conformance holds the behaviour every backend of svcs/user/db
+// shares, as tests each backend runs against a live database, connected by
+// svcs/conformance, in its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, &Mongo{conn: s_conformance.Driver(t, name)})
+//	}
+package conformance
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/laidingqing/dabanshan-go/svcs/user/db"
+	m_user "github.com/laidingqing/dabanshan-go/svcs/user/model"
+)
+
+// MissingID is an id in the format of every backend that no user has.
+const MissingID = "000000000000000000000001"
+
+// Run runs the tests against d, connected. The users it creates have unique
+// names, so d may hold other users.
+func Run(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	newUser := func(name string) m_user.User {
+		u := m_user.New()
+		u.Username = name + "-" + suffix
+		u.FirstName = "first"
+		u.LastName = "last"
+		u.Email = name + "@example.com"
+		u.Password = "hash"
+		return u
+	}
+
+	t.Run("Ping", func(t *testing.T) {
+		if err := d.Ping(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("CreateUser", func(t *testing.T) {
+		u := newUser("create")
+		id, err := d.CreateUser(ctx, &u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == "" {
+			t.Fatal("no id")
+		}
+		got, err := d.GetUser(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.UserID = id
+		if got != u {
+			t.Errorf("GetUser: got %+v, want %+v", got, u)
+		}
+		got, err = d.GetUserByName(ctx, u.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != u {
+			t.Errorf("GetUserByName: got %+v, want %+v", got, u)
+		}
+	})
+
+	t.Run("UniqueUsername", func(t *testing.T) {
+		u := newUser("unique")
+		if _, err := d.CreateUser(ctx, &u); err != nil {
+			t.Fatal(err)
+		}
+		again := newUser("unique")
+		if _, err := d.CreateUser(ctx, &again); err != db.ErrDuplicateUsername {
+			t.Errorf("creating a second user named %s: got %v, want %v", u.Username, err, db.ErrDuplicateUsername)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		if _, err := d.GetUser(ctx, MissingID); err != db.ErrNotFound {
+			t.Errorf("GetUser: got %v, want %v", err, db.ErrNotFound)
+		}
+		if _, err := d.GetUser(ctx, "not an id"); err != db.ErrInvalidID {
+			t.Errorf("GetUser: got %v, want %v", err, db.ErrInvalidID)
+		}
+		if _, err := d.GetUserByName(ctx, "nobody-"+suffix); err != db.ErrNotFound {
+			t.Errorf("GetUserByName: got %v, want %v", err, db.ErrNotFound)
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		u := newUser("canceled")
+		if _, err := d.CreateUser(ctx, &u); err == nil {
+			t.Error("CreateUser: no error with a canceled context")
+		}
+		if _, err := d.GetUserByName(context.Background(), u.Username); err != db.ErrNotFound {
+			t.Errorf("GetUserByName: got %v, want %v", err, db.ErrNotFound)
+		}
+	})
+}
@@ -1,36 +1,50 @@
 package db
 
 import (
+	"context"
 	"errors"
-	// "flag"
+	"flag"
 	"fmt"
 
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/laidingqing/dabanshan-go/svcs/instrumenting"
 	m_user "github.com/laidingqing/dabanshan-go/svcs/user/model"
 )
 
 // Database represents a simple interface so we can switch to a new system easily
 type Database interface {
-	Init() error
-	GetUserByName(string) (m_user.User, error)
-	GetUser(string) (m_user.User, error)
-	CreateUser(*m_user.User) (string, error)
+	Init(context.Context) error
+	Ping(context.Context) error
+	Close()
+	GetUserByName(context.Context, string) (m_user.User, error)
+	GetUser(context.Context, string) (m_user.User, error)
+	CreateUser(context.Context, *m_user.User) (string, error)
 }
 
 var (
-	database string
+	database = "mongodb"
 	//DefaultDb is the database set for the microservice
 	DefaultDb Database
+	//Duration observes the latency of the operations on DefaultDb, see instrumenting.NewDBDuration
+	Duration metrics.Histogram = discard.NewHistogram()
 	//DBTypes is a map of DB interfaces that can be used for this service
 	DBTypes = map[string]Database{}
 	//ErrNoDatabaseFound error returnes when database interface does not exists in DBTypes
 	ErrNoDatabaseFound = "No database with name %v registered"
 	//ErrNoDatabaseSelected is returned when no database was designated in the flag or env
 	ErrNoDatabaseSelected = errors.New("No DB selected")
+	//ErrInvalidID is returned when an id is not in the format the database expects
+	ErrInvalidID = errors.New("Invalid Id")
+	//ErrNotFound is returned when no user matches the given id or name
+	ErrNotFound = errors.New("Record not found")
+	//ErrDuplicateUsername is returned by CreateUser when the username is taken
+	ErrDuplicateUsername = errors.New("Username taken")
 )
 
-func init() {
-	// database = *flag.String("database", "mongodb", "Database to use")
-	database = "mongodb"
+//RegisterFlags defines the flag selecting the database on fs
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&database, "database", database, "Database to use")
 }
 
 //Init inits the selected DB in DefaultDb
@@ -42,7 +56,22 @@ func Init() error {
 	if err != nil {
 		return err
 	}
-	return DefaultDb.Init()
+	return DefaultDb.Init(context.Background())
+}
+
+//Ping checks that DefaultDb is reachable, for the readiness check
+func Ping(ctx context.Context) error {
+	if DefaultDb == nil {
+		return ErrNoDatabaseSelected
+	}
+	return DefaultDb.Ping(ctx)
+}
+
+//Close closes DefaultDb, once the requests using it are served
+func Close() {
+	if DefaultDb != nil {
+		DefaultDb.Close()
+	}
 }
 
 //Set the DefaultDb
@@ -60,23 +89,19 @@ func Register(name string, db Database) {
 }
 
 //GetUserByName invokes DefaultDb method
-func GetUserByName(n string) (m_user.User, error) {
-	u, err := DefaultDb.GetUserByName(n)
-	if err == nil {
-
-	}
-	return u, err
+func GetUserByName(ctx context.Context, n string) (_ m_user.User, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "GetUserByName")(&err)
+	return DefaultDb.GetUserByName(ctx, n)
 }
 
 //GetUser invokes DefaultDb method
-func GetUser(n string) (m_user.User, error) {
-	u, err := DefaultDb.GetUser(n)
-	if err == nil {
-	}
-	return u, err
+func GetUser(ctx context.Context, n string) (_ m_user.User, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "GetUser")(&err)
+	return DefaultDb.GetUser(ctx, n)
 }
 
 //CreateUser invokes DefaultDb method
-func CreateUser(u *m_user.User) (string, error) {
-	return DefaultDb.CreateUser(u)
+func CreateUser(ctx context.Context, u *m_user.User) (_ string, err error) {
+	defer instrumenting.DBOperation(ctx, Duration, database, "CreateUser")(&err)
+	return DefaultDb.CreateUser(ctx, u)
 }
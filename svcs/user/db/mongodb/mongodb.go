@@ -1,11 +1,13 @@
 package mongodb
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"net/url"
-	"time"
 
+	"github.com/laidingqing/dabanshan-go/svcs/mongo"
+	u_db "github.com/laidingqing/dabanshan-go/svcs/user/db"
 	m_user "github.com/laidingqing/dabanshan-go/svcs/user/model"
 
 	"gopkg.in/mgo.v2"
@@ -15,16 +17,18 @@ import (
 var (
 	name            string
 	password        string
-	host            string
+	host            = "127.0.0.1:27017"
 	db              = "test"
 	collections     = "users"
+	opts            = mongo.DefaultOptions
 	ErrInvalidHexID = errors.New("Invalid Id Hex")
 )
 
-func init() {
-	name = *flag.String("mongouser", "", "Mongo user")
-	password = *flag.String("mongopassword", "", "Mongo password")
-	host = *flag.String("mongohost", "127.0.0.1:27017", "mongo host")
+// RegisterFlags defines the flags of the MongoDB connection on fs.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&name, "mongouser", name, "Mongo user")
+	fs.StringVar(&password, "mongopassword", password, "Mongo password")
+	fs.StringVar(&host, "mongohost", host, "mongo host")
 }
 
 // Mongo meets the Database interface requirements
@@ -48,16 +52,31 @@ func New() MongoUser {
 }
 
 // Init MongoDB
-func (m *Mongo) Init() error {
+func (m *Mongo) Init(ctx context.Context) error {
 	u := getURL()
 	var err error
-	m.Session, err = mgo.DialWithTimeout(u.String(), time.Duration(5)*time.Second)
+	opts = mongo.Flags()
+	m.Session, err = mongo.Dial(ctx, u.String(), opts)
 	if err != nil {
 		return err
 	}
 	return m.EnsureIndexes()
 }
 
+// Ping checks that the session reaches the server.
+func (m *Mongo) Ping(ctx context.Context) error {
+	return mongo.Do(ctx, m.Session, opts, func(s *mgo.Session) error {
+		return s.Ping()
+	})
+}
+
+// Close closes the session and its connections.
+func (m *Mongo) Close() {
+	if m.Session != nil {
+		m.Session.Close()
+	}
+}
+
 // EnsureIndexes ensures userid is unique
 func (m *Mongo) EnsureIndexes() error {
 	s := m.Session.Copy()
@@ -87,26 +106,31 @@ func getURL() url.URL {
 }
 
 // GetUserByName Get user by their name
-func (m *Mongo) GetUserByName(name string) (m_user.User, error) {
-	s := m.Session.Copy()
-	defer s.Close()
-	c := s.DB(db).C(collections)
+func (m *Mongo) GetUserByName(ctx context.Context, name string) (m_user.User, error) {
 	mu := New()
-	err := c.Find(bson.M{"username": name}).One(&mu)
+	err := mongo.Retry(ctx, m.Session, opts, func(s *mgo.Session) error {
+		return s.DB(db).C(collections).Find(bson.M{"username": name}).One(&mu)
+	})
+	if err == mgo.ErrNotFound {
+		err = u_db.ErrNotFound
+	}
 	mu.UserID = mu.ID.Hex()
 	return mu.User, err
 }
 
 // CreateUser Insert user to MongoDB
-func (m *Mongo) CreateUser(u *m_user.User) (string, error) {
-	s := m.Session.Copy()
-	defer s.Close()
+func (m *Mongo) CreateUser(ctx context.Context, u *m_user.User) (string, error) {
 	id := bson.NewObjectId()
 	mu := New()
 	mu.User = *u
 	mu.ID = id
-	c := s.DB(db).C(collections)
-	_, err := c.UpsertId(mu.ID, mu)
+	err := mongo.Retry(ctx, m.Session, opts, func(s *mgo.Session) error {
+		_, err := s.DB(db).C(collections).UpsertId(mu.ID, mu)
+		return err
+	})
+	if mgo.IsDup(err) {
+		return "", u_db.ErrDuplicateUsername
+	}
 	if err != nil {
 		return "", err
 	}
@@ -114,15 +138,17 @@ func (m *Mongo) CreateUser(u *m_user.User) (string, error) {
 }
 
 // GetUser Get user by their object id
-func (m *Mongo) GetUser(id string) (m_user.User, error) {
-	s := m.Session.Copy()
-	defer s.Close()
+func (m *Mongo) GetUser(ctx context.Context, id string) (m_user.User, error) {
 	if !bson.IsObjectIdHex(id) {
-		return m_user.New(), errors.New("Invalid Id Hex")
+		return m_user.New(), u_db.ErrInvalidID
 	}
-	c := s.DB(db).C("users")
 	mu := New()
-	err := c.FindId(bson.ObjectIdHex(id)).One(&mu)
+	err := mongo.Retry(ctx, m.Session, opts, func(s *mgo.Session) error {
+		return s.DB(db).C("users").FindId(bson.ObjectIdHex(id)).One(&mu)
+	})
+	if err == mgo.ErrNotFound {
+		err = u_db.ErrNotFound
+	}
 	mu.UserID = mu.ID.Hex()
 	return mu.User, err
 }
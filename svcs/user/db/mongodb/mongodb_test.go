@@ -1,9 +1,11 @@
 package mongodb
 
 import (
+	"context"
 	"os"
 	"testing"
 
+	"github.com/laidingqing/dabanshan-go/svcs/user/db/conformance"
 	users "github.com/laidingqing/dabanshan-go/svcs/user/model"
 	"gopkg.in/mgo.v2/dbtest"
 )
@@ -37,7 +39,7 @@ func exitTest(i int) {
 }
 
 func TestInit(t *testing.T) {
-	err := TestMongo.Init()
+	err := TestMongo.Init(context.Background())
 	if err.Error() != "no reachable servers" {
 		t.Error("expecting no reachable servers error")
 	}
@@ -46,8 +48,14 @@ func TestInit(t *testing.T) {
 func TestGetUser(t *testing.T) {
 	TestMongo.Session = TestServer.Session()
 	defer TestMongo.Session.Close()
-	_, err := TestMongo.GetUser(TestUser.UserID)
+	_, err := TestMongo.GetUser(context.Background(), TestUser.UserID)
 	if err != nil {
 		t.Error(err)
 	}
 }
+
+func TestConformance(t *testing.T) {
+	TestMongo.Session = TestServer.Session()
+	defer TestMongo.Session.Close()
+	conformance.Run(t, &TestMongo)
+}
@@ -0,0 +1,117 @@
+// Package mongodriver stores users in MongoDB with the official driver,
+// registered as the "mongodriver" database. It reads the documents of the
+// mgo backend, svcs/user/db/mongodb, so either can run on the same data.
+package mongodriver
+
+import (
+	"context"
+	"errors"
+	"flag"
+
+	s_mongo "github.com/laidingqing/dabanshan-go/svcs/mongo"
+	"github.com/laidingqing/dabanshan-go/svcs/mongo/driver"
+	u_db "github.com/laidingqing/dabanshan-go/svcs/user/db"
+	m_user "github.com/laidingqing/dabanshan-go/svcs/user/model"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const collection = "users"
+
+// RegisterFlags defines the flags of the MongoDB connection on fs.
+func RegisterFlags(fs *flag.FlagSet) {
+	driver.RegisterFlags(fs)
+}
+
+// Mongo meets the Database interface requirements
+type Mongo struct {
+	conn *driver.Conn
+}
+
+// mongoUser is the document of a user.
+type mongoUser struct {
+	m_user.User `bson:",inline"`
+	ID          bson.ObjectID `bson:"_id"`
+}
+
+// Init connects and ensures the indexes.
+func (m *Mongo) Init(ctx context.Context) error {
+	conn, err := driver.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	m.conn = conn
+	return m.EnsureIndexes(ctx)
+}
+
+// EnsureIndexes ensures usernames are unique.
+func (m *Mongo) EnsureIndexes(ctx context.Context) error {
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	_, err := m.conn.DB.Collection(collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// Ping checks that the primary answers.
+func (m *Mongo) Ping(ctx context.Context) error {
+	if m.conn == nil {
+		return s_mongo.ErrNotConnected
+	}
+	return m.conn.Ping(ctx)
+}
+
+// Close disconnects.
+func (m *Mongo) Close() {
+	if m.conn != nil {
+		m.conn.Close()
+	}
+}
+
+// GetUserByName Get user by their name
+func (m *Mongo) GetUserByName(ctx context.Context, name string) (m_user.User, error) {
+	return m.findOne(ctx, bson.M{"username": name})
+}
+
+// GetUser Get user by their object id
+func (m *Mongo) GetUser(ctx context.Context, id string) (m_user.User, error) {
+	oid, ok := driver.ObjectID(id)
+	if !ok {
+		return m_user.New(), u_db.ErrInvalidID
+	}
+	return m.findOne(ctx, bson.M{"_id": oid})
+}
+
+func (m *Mongo) findOne(ctx context.Context, filter bson.M) (m_user.User, error) {
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	var mu mongoUser
+	err := m.conn.DB.Collection(collection).FindOne(ctx, filter).Decode(&mu)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return m_user.New(), u_db.ErrNotFound
+	}
+	if err != nil {
+		return m_user.New(), err
+	}
+	mu.UserID = mu.ID.Hex()
+	return mu.User, nil
+}
+
+// CreateUser inserts the user, failing with u_db.ErrDuplicateUsername if the
+// username is taken.
+func (m *Mongo) CreateUser(ctx context.Context, u *m_user.User) (string, error) {
+	ctx, cancel := m.conn.Context(ctx)
+	defer cancel()
+	mu := mongoUser{User: *u, ID: bson.NewObjectID()}
+	_, err := m.conn.DB.Collection(collection).InsertOne(ctx, mu)
+	if mongo.IsDuplicateKeyError(err) {
+		return "", u_db.ErrDuplicateUsername
+	}
+	if err != nil {
+		return "", err
+	}
+	return mu.ID.Hex(), nil
+}
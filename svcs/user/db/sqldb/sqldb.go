@@ -0,0 +1,117 @@
+// Package sqldb stores users in a SQL database, registered as the "postgres"
+// and "sqlite" databases. Usernames are unique, by a constraint of the users
+// table.
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+
+	s_sqldb "github.com/laidingqing/dabanshan-go/svcs/sqldb"
+	u_db "github.com/laidingqing/dabanshan-go/svcs/user/db"
+	m_user "github.com/laidingqing/dabanshan-go/svcs/user/model"
+)
+
+// migrations are the schema of the users, see s_sqldb.DB.Migrate.
+var migrations = []string{
+	`CREATE TABLE users (
+	id         CHAR(24) PRIMARY KEY,
+	username   TEXT NOT NULL UNIQUE,
+	first_name TEXT NOT NULL,
+	last_name  TEXT NOT NULL,
+	email      TEXT NOT NULL,
+	password   TEXT NOT NULL,
+	salt       TEXT NOT NULL,
+	authority  INTEGER NOT NULL
+)`,
+}
+
+const columns = `id, username, first_name, last_name, email, password, salt, authority`
+
+// RegisterFlags defines the flags of the SQL connection on fs.
+func RegisterFlags(fs *flag.FlagSet) {
+	s_sqldb.RegisterFlags(fs)
+}
+
+// SQL meets the Database interface requirements
+type SQL struct {
+	Dialect s_sqldb.Dialect
+	db      *s_sqldb.DB
+}
+
+// Init connects and migrates the schema.
+func (s *SQL) Init(ctx context.Context) error {
+	db, err := s_sqldb.Open(ctx, s.Dialect)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	return s.Migrate(ctx)
+}
+
+// Migrate brings the users table up to date.
+func (s *SQL) Migrate(ctx context.Context) error {
+	return s.db.Migrate(ctx, "users", migrations)
+}
+
+// Ping checks that the database answers.
+func (s *SQL) Ping(ctx context.Context) error {
+	if s.db == nil {
+		return s_sqldb.ErrNotConnected
+	}
+	return s.db.Ping(ctx)
+}
+
+// Close closes the connections.
+func (s *SQL) Close() {
+	if s.db != nil {
+		s.db.Close()
+	}
+}
+
+// GetUserByName Get user by their name
+func (s *SQL) GetUserByName(ctx context.Context, name string) (m_user.User, error) {
+	return s.getUser(ctx, `SELECT `+columns+` FROM users WHERE username = $1`, name)
+}
+
+// GetUser Get user by their id
+func (s *SQL) GetUser(ctx context.Context, id string) (m_user.User, error) {
+	id, ok := s_sqldb.ID(id)
+	if !ok {
+		return m_user.New(), u_db.ErrInvalidID
+	}
+	return s.getUser(ctx, `SELECT `+columns+` FROM users WHERE id = $1`, id)
+}
+
+func (s *SQL) getUser(ctx context.Context, query string, arg string) (m_user.User, error) {
+	ctx, cancel := s.db.Context(ctx)
+	defer cancel()
+	var u m_user.User
+	err := s.db.QueryRowContext(ctx, query, arg).Scan(
+		&u.UserID, &u.Username, &u.FirstName, &u.LastName, &u.Email, &u.Password, &u.Salt, &u.Authority)
+	if err == sql.ErrNoRows {
+		return m_user.New(), u_db.ErrNotFound
+	}
+	if err != nil {
+		return m_user.New(), err
+	}
+	return u, nil
+}
+
+// CreateUser inserts the user, failing with u_db.ErrDuplicateUsername if the
+// username is taken.
+func (s *SQL) CreateUser(ctx context.Context, u *m_user.User) (string, error) {
+	ctx, cancel := s.db.Context(ctx)
+	defer cancel()
+	id := s_sqldb.NewID()
+	_, err := s.db.ExecContext(ctx, `INSERT INTO users (`+columns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		id, u.Username, u.FirstName, u.LastName, u.Email, u.Password, u.Salt, int(u.Authority))
+	if s_sqldb.IsUniqueViolation(err) {
+		return "", u_db.ErrDuplicateUsername
+	}
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
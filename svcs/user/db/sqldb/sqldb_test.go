@@ -0,0 +1,31 @@
+package sqldb
+
+import (
+	"context"
+	"testing"
+
+	s_conformance "github.com/laidingqing/dabanshan-go/svcs/conformance"
+	s_sqldb "github.com/laidingqing/dabanshan-go/svcs/sqldb"
+	"github.com/laidingqing/dabanshan-go/svcs/user/db/conformance"
+)
+
+func TestSQLite(t *testing.T) {
+	ctx := context.Background()
+	s := &SQL{Dialect: s_sqldb.SQLite, db: s_conformance.SQLite(t, "users")}
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// migrating again is a no-op
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	conformance.Run(t, s)
+}
+
+func TestPostgres(t *testing.T) {
+	s := &SQL{Dialect: s_sqldb.Postgres, db: s_conformance.Postgres(t, s_conformance.Name("users"))}
+	if err := s.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	conformance.Run(t, s)
+}
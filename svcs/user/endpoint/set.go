@@ -2,14 +2,16 @@ package endpoint
 
 import (
 	"context"
+	"io"
 
 	"github.com/go-kit/kit/circuitbreaker"
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/metrics"
 	"github.com/go-kit/kit/ratelimit"
 	"github.com/go-kit/kit/tracing/opentracing"
 	rl "github.com/juju/ratelimit"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+	"github.com/laidingqing/dabanshan-go/svcs/instrumenting"
 	m_user "github.com/laidingqing/dabanshan-go/svcs/user/model"
 	"github.com/laidingqing/dabanshan-go/svcs/user/service"
 	stdopentracing "github.com/opentracing/opentracing-go"
@@ -27,7 +29,7 @@ type Set struct {
 
 // New returns a Set that wraps the provided server, and wires in all of the
 // expected endpoint middlewares via the various parameters.
-func New(svc service.Service, logger log.Logger, duration metrics.Histogram, trace stdopentracing.Tracer) Set {
+func New(svc service.Service, logger log.Logger, metrics instrumenting.EndpointMetrics, trace stdopentracing.Tracer) Set {
 	var (
 		getUserEndpoint  endpoint.Endpoint
 		registerEndpoint endpoint.Endpoint
@@ -39,7 +41,7 @@ func New(svc service.Service, logger log.Logger, duration metrics.Histogram, tra
 		getUserEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(getUserEndpoint)
 		getUserEndpoint = opentracing.TraceServer(trace, "GetUser")(getUserEndpoint)
 		getUserEndpoint = LoggingMiddleware(log.With(logger, "method", "GetUser"))(getUserEndpoint)
-		getUserEndpoint = InstrumentingMiddleware(duration.With("method", "GetUser"))(getUserEndpoint)
+		getUserEndpoint = metrics.Middleware("GetUser")(getUserEndpoint)
 	}
 	{
 		registerEndpoint = MakeRegisterEndpoint(svc)
@@ -47,7 +49,7 @@ func New(svc service.Service, logger log.Logger, duration metrics.Histogram, tra
 		registerEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(registerEndpoint)
 		registerEndpoint = opentracing.TraceServer(trace, "Register")(registerEndpoint)
 		registerEndpoint = LoggingMiddleware(log.With(logger, "method", "Register"))(registerEndpoint)
-		registerEndpoint = InstrumentingMiddleware(duration.With("method", "Register"))(registerEndpoint)
+		registerEndpoint = metrics.Middleware("Register")(registerEndpoint)
 	}
 	{
 		loginEndpoint = MakeLoginEndpoint(svc)
@@ -55,7 +57,7 @@ func New(svc service.Service, logger log.Logger, duration metrics.Histogram, tra
 		loginEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(loginEndpoint)
 		loginEndpoint = opentracing.TraceServer(trace, "Login")(loginEndpoint)
 		loginEndpoint = LoggingMiddleware(log.With(logger, "method", "Login"))(loginEndpoint)
-		loginEndpoint = InstrumentingMiddleware(duration.With("method", "Login"))(loginEndpoint)
+		loginEndpoint = metrics.Middleware("Login")(loginEndpoint)
 	}
 
 	return Set{
@@ -95,6 +97,15 @@ func (s Set) Login(ctx context.Context, login m_user.LoginRequest) (m_user.Login
 	return response, err
 }
 
+// ErrUploadNotServed is returned by Upload: the user service serves no
+// uploads over its endpoints.
+var ErrUploadNotServed = errs.New(errs.InvalidArgument, "uploads are not served by the user service")
+
+// Upload implements the service interface.
+func (s Set) Upload(ctx context.Context, manifestName string, manifest io.Reader, fileName string, file io.Reader) (string, error) {
+	return "", ErrUploadNotServed
+}
+
 // MakeGetUserEndpoint constructs a GetUser endpoint wrapping the service.
 func MakeGetUserEndpoint(s service.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
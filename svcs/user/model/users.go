@@ -93,10 +93,12 @@ type RegisterUserResponse struct {
 	Err error  `json:"-"`
 }
 
-// LoginRequest ..
+// LoginRequest .. CartToken identifies a guest cart to merge into the user's
+// cart once logged in.
 type LoginRequest struct {
-	Username string
-	Password string
+	Username  string
+	Password  string
+	CartToken string `json:"-"`
 }
 
 // LoginResponse ..
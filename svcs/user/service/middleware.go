@@ -2,9 +2,12 @@ package service
 
 import (
 	"context"
+	"io"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
 	"github.com/laidingqing/dabanshan-go/svcs/user/model"
 )
 
@@ -13,8 +16,7 @@ type Middleware func(Service) Service
 // LoggingMiddleware ..
 func LoggingMiddleware(logger log.Logger) Middleware {
 	return func(next Service) Service {
-		//return loggingMiddleware{logger, next}
-		return loggingMiddleware(logger, next)
+		return loggingMiddleware{logger, next}
 	}
 }
 
@@ -25,40 +27,54 @@ type loggingMiddleware struct {
 
 func (mw loggingMiddleware) GetUser(ctx context.Context, a string) (v model.GetUserResponse, err error) {
 	defer func() {
-		mw.logger.Log("method", "GetUser", "err", err)
+		logging.With(ctx, mw.logger).Log("method", "GetUser", "err", err)
 	}()
 	return mw.next.GetUser(ctx, a)
 }
 
 func (mw loggingMiddleware) Register(ctx context.Context, us model.RegisterRequest) (r model.RegisterUserResponse, err error) {
 	defer func() {
-		mw.logger.Log("method", "Register", "err", err)
+		logging.With(ctx, mw.logger).Log("method", "Register", "err", err)
 	}()
 	return mw.next.Register(ctx, us)
 }
 
 func (mw loggingMiddleware) Login(ctx context.Context, login model.LoginRequest) (r model.LoginResponse, err error) {
 	defer func() {
-		mw.logger.Log("method", "Login", "err", err)
+		logging.With(ctx, mw.logger).Log("method", "Login", "err", err)
 	}()
 	return mw.next.Login(ctx, login)
 }
 
-// InstrumentingMiddleware ..
-func InstrumentingMiddleware(ints, chars metrics.Counter) Middleware {
+func (mw loggingMiddleware) Upload(ctx context.Context, manifestName string, manifest io.Reader, fileName string, file io.Reader) (id string, err error) {
+	defer func() {
+		logging.With(ctx, mw.logger).Log("method", "Upload", "err", err)
+	}()
+	return mw.next.Upload(ctx, manifestName, manifest, fileName, file)
+}
+
+// Metrics are the business metrics of the user service.
+type Metrics struct {
+	// Registrations counts the users registered.
+	Registrations metrics.Counter
+	// LoginsFailed counts the failed logins, by errs code: unauthenticated
+	// for a wrong password.
+	LoginsFailed metrics.Counter
+}
+
+// InstrumentingMiddleware counts registrations and failed logins with m.
+func InstrumentingMiddleware(m Metrics) Middleware {
 	return func(next Service) Service {
 		return instrumentingMiddleware{
-			ints:  ints,
-			chars: chars,
-			next:  next,
+			metrics: m,
+			next:    next,
 		}
 	}
 }
 
 type instrumentingMiddleware struct {
-	ints  metrics.Counter
-	chars metrics.Counter
-	next  Service
+	metrics Metrics
+	next    Service
 }
 
 func (mw instrumentingMiddleware) GetUser(ctx context.Context, a string) (model.GetUserResponse, error) {
@@ -68,10 +84,21 @@ func (mw instrumentingMiddleware) GetUser(ctx context.Context, a string) (model.
 
 func (mw instrumentingMiddleware) Register(ctx context.Context, us model.RegisterRequest) (r model.RegisterUserResponse, err error) {
 	v, err := mw.next.Register(ctx, us)
+	// a taken username is reported in v.Err
+	if err == nil && v.Err == nil {
+		mw.metrics.Registrations.Add(1)
+	}
 	return v, err
 }
 
 func (mw instrumentingMiddleware) Login(ctx context.Context, login model.LoginRequest) (r model.LoginResponse, err error) {
 	v, err := mw.next.Login(ctx, login)
+	if err != nil {
+		mw.metrics.LoginsFailed.With("code", string(errs.CodeOf(err))).Add(1)
+	}
 	return v, err
 }
+
+func (mw instrumentingMiddleware) Upload(ctx context.Context, manifestName string, manifest io.Reader, fileName string, file io.Reader) (string, error) {
+	return mw.next.Upload(ctx, manifestName, manifest, fileName, file)
+}
@@ -2,21 +2,20 @@ package service
 
 import (
 	"context"
-	"errors"
 	"io"
 
 	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/metrics"
 	auth "github.com/laidingqing/dabanshan-go/svcs/authorize"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
 	"github.com/laidingqing/dabanshan-go/svcs/user/db"
 	"github.com/laidingqing/dabanshan-go/svcs/user/model"
 )
 
 var (
 	// ErrUserNotFound 用户未发现
-	ErrUserNotFound = errors.New("not found user")
+	ErrUserNotFound = errs.New(errs.NotFound, "not found user")
 	// ErrUserAlreadyExisting 用户名已存在
-	ErrUserAlreadyExisting = errors.New("username already existing")
+	ErrUserAlreadyExisting = errs.New(errs.Conflict, "username already existing")
 )
 
 // Service describes a service that adds things together.
@@ -28,18 +27,19 @@ type Service interface {
 }
 
 // New returns a basic Service with all of the expected middlewares wired in.
-func New(logger log.Logger, ints, chars metrics.Counter) Service {
+func New(logger log.Logger, metrics Metrics) Service {
 	var svc Service
 	{
 		svc = NewBasicService()
 		svc = LoggingMiddleware(logger)(svc)
-		svc = InstrumentingMiddleware(ints, chars)(svc)
+		svc = InstrumentingMiddleware(metrics)(svc)
 	}
 	return svc
 }
 
 var (
-	ErrUnauthorized = errors.New("Unauthorized")
+	// ErrUnauthorized is auth.ErrUnauthorized, for wrong credentials.
+	ErrUnauthorized = auth.ErrUnauthorized
 )
 
 const ()
@@ -52,8 +52,8 @@ func NewBasicService() Service {
 type basicService struct{}
 
 // GetUser get user by id
-func (s basicService) GetUser(_ context.Context, id string) (model.GetUserResponse, error) {
-	us, err := db.GetUser(id)
+func (s basicService) GetUser(ctx context.Context, id string) (model.GetUserResponse, error) {
+	us, err := db.GetUser(ctx, id)
 	if err != nil {
 		return model.GetUserResponse{V: model.New(), Err: nil}, ErrUserNotFound
 	}
@@ -65,7 +65,7 @@ func (s basicService) GetUser(_ context.Context, id string) (model.GetUserRespon
 
 // Register user
 func (s basicService) Register(ctx context.Context, req model.RegisterRequest) (model.RegisterUserResponse, error) {
-	us, err := db.GetUserByName(req.Username)
+	us, err := db.GetUserByName(ctx, req.Username)
 	if us.Username != "" && err == nil {
 		return model.RegisterUserResponse{
 			Err: ErrUserAlreadyExisting,
@@ -78,12 +78,18 @@ func (s basicService) Register(ctx context.Context, req model.RegisterRequest) (
 	u.Email = req.Email
 	u.FirstName = req.FirstName
 	u.LastName = req.LastName
-	id, err := db.CreateUser(&u)
+	id, err := db.CreateUser(ctx, &u)
+	if err == db.ErrDuplicateUsername {
+		// taken by a registration since GetUserByName
+		return model.RegisterUserResponse{
+			Err: ErrUserAlreadyExisting,
+		}, nil
+	}
 	return model.RegisterUserResponse{ID: id}, err
 }
 
 func (s basicService) Login(ctx context.Context, login model.LoginRequest) (model.LoginResponse, error) {
-	u, err := db.GetUserByName(login.Username)
+	u, err := db.GetUserByName(ctx, login.Username)
 	if err != nil {
 		return model.LoginResponse{
 			Err: err,
@@ -94,7 +100,7 @@ func (s basicService) Login(ctx context.Context, login model.LoginRequest) (mode
 			Err: ErrUnauthorized,
 		}, ErrUnauthorized
 	}
-	t, err := auth.CreateJWT()
+	t, err := auth.CreateJWT(u.UserID)
 	if err != nil {
 		return model.LoginResponse{
 			Err: err,
@@ -2,7 +2,6 @@ package transport
 
 import (
 	"context"
-	"errors"
 	"time"
 
 	"github.com/go-kit/kit/circuitbreaker"
@@ -13,6 +12,8 @@ import (
 	grpctransport "github.com/go-kit/kit/transport/grpc"
 	jujuratelimit "github.com/juju/ratelimit"
 	"github.com/laidingqing/dabanshan-go/pb"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+	"github.com/laidingqing/dabanshan-go/svcs/logging"
 	u_endpoint "github.com/laidingqing/dabanshan-go/svcs/user/endpoint"
 	m_user "github.com/laidingqing/dabanshan-go/svcs/user/model"
 	"github.com/laidingqing/dabanshan-go/svcs/user/service"
@@ -32,6 +33,7 @@ type grpcServer struct {
 func NewGRPCServer(endpoints u_endpoint.Set, tracer stdopentracing.Tracer, logger log.Logger) pb.UserRpcServiceServer {
 	options := []grpctransport.ServerOption{
 		grpctransport.ServerErrorLogger(logger),
+		grpctransport.ServerBefore(logging.GRPCToContext),
 	}
 	return &grpcServer{
 		getuser: grpctransport.NewServer(
@@ -80,7 +82,7 @@ func encodeGRPCGetUserResponse(_ context.Context, response interface{}) (interfa
 		Password:  "",
 		Salt:      "",
 		Userid:    resp.V.UserID,
-	}, Err: err2str(resp.Err)}, nil
+	}, Err: errs.Encode(resp.Err)}, nil
 }
 
 // Register RPC
@@ -108,7 +110,7 @@ func encodeGRPCRegisterResponse(_ context.Context, response interface{}) (interf
 	resp := response.(m_user.RegisterUserResponse)
 	return &pb.RegisterResponse{
 		Id:  resp.ID,
-		Err: err2str(resp.Err),
+		Err: errs.Encode(resp.Err),
 	}, nil
 }
 
@@ -124,17 +126,23 @@ func (s *grpcServer) Login(ctx oldcontext.Context, req *pb.LoginRequest) (*pb.Lo
 func decodeGRPCLoginRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
 	req := grpcReq.(*pb.LoginRequest)
 	return m_user.LoginRequest{
-		Username: req.Username,
-		Password: req.Password,
+		Username:  req.Username,
+		Password:  req.Password,
+		CartToken: req.Carttoken,
 	}, nil
 }
 
 func encodeGRPCLoginResponse(_ context.Context, response interface{}) (interface{}, error) {
 	resp := response.(m_user.LoginResponse)
+	var user *pb.UserRecord
+	if resp.User != nil {
+		user = modelUser2PbUser(*resp.User)
+		user.Password = ""
+	}
 	return &pb.LoginResponse{
-		User:  modelUser2PbUser(*resp.User),
+		User:  user,
 		Token: resp.Token,
-		Err:   err2str(resp.Err),
+		Err:   errs.Encode(resp.Err),
 	}, nil
 }
 
@@ -152,8 +160,9 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 			encodeGRPCGetUserRequest,
 			decodeGRPCGetUserResponse,
 			pb.GetUserResponse{},
-			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger)),
+			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger), logging.ContextToGRPC),
 		).Endpoint()
+		getUserEndpoint = errs.ClientMiddleware(getUserEndpoint)
 		getUserEndpoint = opentracing.TraceClient(tracer, "GetUser")(getUserEndpoint)
 		getUserEndpoint = limiter(getUserEndpoint)
 		getUserEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
@@ -168,8 +177,9 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 			encodeGRPCRegisterRequest,
 			decodeGRPCRegisterResponse,
 			pb.RegisterResponse{},
-			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger)),
+			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger), logging.ContextToGRPC),
 		).Endpoint()
+		registerEndpoint = errs.ClientMiddleware(registerEndpoint)
 		registerEndpoint = opentracing.TraceClient(tracer, "Register")(registerEndpoint)
 		registerEndpoint = limiter(registerEndpoint)
 		registerEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
@@ -184,8 +194,9 @@ func NewGRPCClient(conn *grpc.ClientConn, tracer stdopentracing.Tracer, logger l
 			encodeGRPCLoginRequest,
 			decodeGRPCLoginResponse,
 			pb.LoginResponse{},
-			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger)),
+			grpctransport.ClientBefore(opentracing.ContextToGRPC(tracer, logger), logging.ContextToGRPC),
 		).Endpoint()
+		loginEndPoint = errs.ClientMiddleware(loginEndPoint)
 		loginEndPoint = opentracing.TraceClient(tracer, "Login")(loginEndPoint)
 		loginEndPoint = limiter(loginEndPoint)
 		loginEndPoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
@@ -219,8 +230,9 @@ func encodeGRPCRegisterRequest(_ context.Context, request interface{}) (interfac
 func encodeGRPCLoginRequest(_ context.Context, request interface{}) (interface{}, error) {
 	req := request.(m_user.LoginRequest)
 	return &pb.LoginRequest{
-		Username: req.Username,
-		Password: req.Password,
+		Username:  req.Username,
+		Password:  req.Password,
+		Carttoken: req.CartToken,
 	}, nil
 }
 
@@ -234,39 +246,30 @@ func decodeGRPCGetUserResponse(_ context.Context, grpcReply interface{}) (interf
 		Password:  reply.V.Password,
 		Salt:      "",
 		UserID:    reply.V.Userid,
-	}, Err: str2err(reply.Err)}, nil
+	}, Err: errs.Decode(reply.Err)}, nil
 }
 
 func decodeGRPCRegisterResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
 	reply := grpcReply.(*pb.RegisterResponse)
 	return m_user.RegisterUserResponse{
 		ID:  reply.Id,
-		Err: str2err(reply.Err),
+		Err: errs.Decode(reply.Err),
 	}, nil
 }
 
 func decodeGRPCLoginResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
 	reply, _ := grpcReply.(*pb.LoginResponse)
+	var user *m_user.User
+	if reply.User != nil {
+		user = pbUser2ModelUser(*reply.User)
+	}
 	return m_user.LoginResponse{
-		User:  pbUser2ModelUser(*reply.User),
+		User:  user,
 		Token: reply.Token,
+		Err:   errs.Decode(reply.Err),
 	}, nil
 }
 
-func str2err(s string) error {
-	if s == "" {
-		return nil
-	}
-	return errors.New(s)
-}
-
-func err2str(err error) string {
-	if err == nil {
-		return ""
-	}
-	return err.Error()
-}
-
 func pbUser2ModelUser(record pb.UserRecord) *m_user.User {
 	return &m_user.User{
 		Username:  record.Username,
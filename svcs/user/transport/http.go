@@ -12,11 +12,12 @@ import (
 	stdopentracing "github.com/opentracing/opentracing-go"
 
 	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/tracing/opentracing"
-	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/golang/protobuf/proto"
+	"github.com/laidingqing/dabanshan-go/pb"
+	"github.com/laidingqing/dabanshan-go/svcs/authorize"
+	"github.com/laidingqing/dabanshan-go/svcs/errs"
+	"github.com/laidingqing/dabanshan-go/svcs/httprule"
 	p_endpoint "github.com/laidingqing/dabanshan-go/svcs/user/endpoint"
-	m_user "github.com/laidingqing/dabanshan-go/svcs/user/model"
-	"github.com/laidingqing/dabanshan-go/svcs/user/service"
 )
 
 var (
@@ -25,78 +26,38 @@ var (
 )
 
 // NewHTTPHandler returns an HTTP handler that makes a set of endpoints
-// available on predefined paths.
+// available on the paths of the google.api.http options of pb/user.proto.
 func NewHTTPHandler(endpoints p_endpoint.Set, tracer stdopentracing.Tracer, logger log.Logger) http.Handler {
-	options := []httptransport.ServerOption{
-		httptransport.ServerErrorEncoder(errorEncoder),
-		httptransport.ServerErrorLogger(logger),
-	}
 	// m := http.NewServeMux()
 	r := mux.NewRouter()
 	//authenticationMiddleware := authorize.ValidateTokenMiddleware()
 
-	getUserHandle := httptransport.NewServer(
-		endpoints.GetUserEndpoint,
-		decodeHTTPGetUserRequest,
-		encodeHTTPGenericResponse,
-		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "GetUser", logger)))...,
-	)
-
-	registerHandle := httptransport.NewServer(
-		endpoints.RegisterEndpoint,
-		decodeHTTPRegisterRequest,
-		encodeHTTPGenericResponse,
-		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "Register", logger)))...,
-	)
-
-	loginHandle := httptransport.NewServer(
-		endpoints.LoginEndpoint,
-		decodeHTTPLoginRequest,
-		encodeHTTPGenericResponse,
-		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "Login", logger)))...,
-	)
-
-	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
-	r.Handle("/api/v1/users/{id}", getUserHandle).Methods("GET")
-	r.Handle("/api/v1/users/", registerHandle).Methods("POST")
-	r.Handle("/api/v1/users/login", loginHandle).Methods("POST")
-	return r
-}
-
-func decodeHTTPRegisterRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	defer r.Body.Close()
-	a := m_user.RegisterRequest{}
-	err := json.NewDecoder(r.Body).Decode(&a)
-	if err != nil {
-		return nil, err
-	}
-	return a, nil
-}
-
-func decodeHTTPGetUserRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	vars := mux.Vars(r)
-	id, ok := vars["id"]
-	if !ok {
-		return nil, errors.New("bad route")
-	}
-	return m_user.GetUserRequest{A: id}, nil
-}
-
-func decodeHTTPLoginRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	defer r.Body.Close()
-	a := m_user.LoginRequest{}
-	err := json.NewDecoder(r.Body).Decode(&a)
+	err := httprule.Register(r, "user.proto", "pb.UserRpcService", map[string]httprule.Binding{
+		"GetUser": {
+			Endpoint: endpoints.GetUserEndpoint,
+			Decode:   decodeGRPCGetUserRequest,
+		},
+		"Register": {
+			Endpoint: endpoints.RegisterEndpoint,
+			Decode:   decodeGRPCRegisterRequest,
+		},
+		"Login": {
+			Endpoint: endpoints.LoginEndpoint,
+			Decode:   decodeGRPCLoginRequest,
+			Before:   beforeHTTPLogin,
+		},
+	}, httprule.Options{ErrorEncoder: errs.EncodeHTTP, Tracer: tracer, Logger: logger})
 	if err != nil {
-		return nil, err
+		panic(err)
 	}
-	return a, nil
+	return r
 }
 
-func errorEncoder(_ context.Context, err error, w http.ResponseWriter) {
-	w.WriteHeader(err2code(err))
-	json.NewEncoder(w).Encode(errorWrapper{Error: err.Error()})
+// beforeHTTPLogin passes on the guest cart of X-Cart-Token, merged into the
+// user's cart by the gateway.
+func beforeHTTPLogin(r *http.Request, msg proto.Message) error {
+	msg.(*pb.LoginRequest).Carttoken = authorize.CartToken(r)
+	return nil
 }
 
 // encodeHTTPGenericRequest is a transport/http.EncodeRequestFunc that
@@ -109,26 +70,3 @@ func encodeHTTPGenericRequest(_ context.Context, r *http.Request, request interf
 	r.Body = ioutil.NopCloser(&buf)
 	return nil
 }
-
-// encodeHTTPGenericResponse is a transport/http.EncodeResponseFunc that encodes
-// the response as JSON to the response writer. Primarily useful in a server.
-func encodeHTTPGenericResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
-	if f, ok := response.(m_user.Failer); ok && f.Failed() != nil {
-		errorEncoder(ctx, f.Failed(), w)
-		return nil
-	}
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	return json.NewEncoder(w).Encode(response)
-}
-
-type errorWrapper struct {
-	Error string `json:"error"`
-}
-
-func err2code(err error) int {
-	switch err {
-	case service.ErrUserNotFound, service.ErrUserAlreadyExisting:
-		return http.StatusBadRequest
-	}
-	return http.StatusInternalServerError
-}